@@ -0,0 +1,8 @@
+package main
+
+import "github.com/martynasd123/golang-scraper/server"
+
+// Runs the API server only. Tasks are processed by the standalone workers (see cmd/worker) sharing the message bus
+func main() {
+	server.Run(false)
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/martynasd123/golang-scraper/config"
+)
+
+// Runs a standalone worker, which processes the tasks queued by the API server (see cmd/api) to the shared message bus
+func main() {
+	messageBus, err := config.ConfigureMessageBus(true)
+	if err != nil {
+		log.Fatalln("Failed to configure message bus:", err)
+	}
+	worker, err := config.ConfigureWorker(messageBus)
+	if err != nil {
+		log.Fatalln("Failed to start worker:", err)
+	}
+	log.Printf("Worker %s processes up to %d tasks concurrently", worker.Id(), worker.GetConcurrency())
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	<-signals
+
+	// Tasks being processed are claimed by other workers once their leases expire
+	if err = worker.SetConcurrency(0); err != nil {
+		log.Println("Failed to stop worker:", err)
+	}
+	if err = worker.Deregister(); err != nil {
+		log.Println("Failed to deregister worker:", err)
+	}
+}
@@ -0,0 +1,339 @@
+// Package config reads the configuration shared by the API server and the workers from environment variables
+package config
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/martynasd123/golang-scraper/models/principal"
+	"github.com/martynasd123/golang-scraper/models/role"
+	. "github.com/martynasd123/golang-scraper/services/auth"
+	. "github.com/martynasd123/golang-scraper/services/scrape"
+	"github.com/martynasd123/golang-scraper/services/scrape/bus"
+	"github.com/martynasd123/golang-scraper/services/webhook"
+	"github.com/martynasd123/golang-scraper/storage"
+	_ "github.com/mattn/go-sqlite3"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ConfigureSigningKeys loads the keys, which access tokens are signed with, from environment variables:
+//
+//	SCRAPER_JWT_SIGNING_KEY_ID: ID of the signing key, sent in the kid header of tokens
+//	SCRAPER_JWT_SIGNING_KEY_FILE: PEM file with an RSA (RS256) or Ed25519 (EdDSA) private key
+//	SCRAPER_JWT_SECRET: secret of an HS256 key, used if SCRAPER_JWT_SIGNING_KEY_FILE is not set
+//	SCRAPER_JWT_VERIFICATION_KEYS: comma separated id=path pairs of PEM public keys, which tokens are still accepted
+//	from, e.g. keys rotated out recently
+//
+// If no signing key is configured, a random one is generated, so tokens become invalid on restart.
+func ConfigureSigningKeys() (*KeySet, error) {
+	id := os.Getenv("SCRAPER_JWT_SIGNING_KEY_ID")
+	var signing *SigningKey
+	var err error
+	if path := os.Getenv("SCRAPER_JWT_SIGNING_KEY_FILE"); path != "" {
+		pem, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if signing, err = CreateSigningKeyFromPem(id, pem); err != nil {
+			return nil, err
+		}
+	} else if secret := os.Getenv("SCRAPER_JWT_SECRET"); secret != "" {
+		if signing, err = CreateHmacSigningKey(id, []byte(secret)); err != nil {
+			return nil, err
+		}
+	} else {
+		log.Println("No JWT signing key configured - generating a temporary one")
+		return GenerateKeySet()
+	}
+
+	var verification []*SigningKey
+	if value := os.Getenv("SCRAPER_JWT_VERIFICATION_KEYS"); value != "" {
+		for _, entry := range strings.Split(value, ",") {
+			keyId, path, found := strings.Cut(strings.TrimSpace(entry), "=")
+			if !found {
+				return nil, fmt.Errorf("invalid verification key %q, expected id=path", entry)
+			}
+			pem, err := os.ReadFile(path)
+			if err != nil {
+				return nil, err
+			}
+			key, err := CreateVerificationKeyFromPem(keyId, pem)
+			if err != nil {
+				return nil, err
+			}
+			verification = append(verification, key)
+		}
+	}
+	return CreateKeySet(signing, verification...)
+}
+
+// ConfigureRevocationList creates the list of revoked access tokens. If SCRAPER_REVOCATION_FILE is set, the list is
+// stored in that file, so that tokens stay revoked after restart
+func ConfigureRevocationList() (storage.RevocationDao, error) {
+	if path := os.Getenv("SCRAPER_REVOCATION_FILE"); path != "" {
+		return storage.CreateRevocationFileDao(path)
+	}
+	return storage.CreateRevocationInMemoryDao(), nil
+}
+
+// ConfigureAuditLog creates the audit log. If SCRAPER_AUDIT_FILE is set, events are appended to that file as JSON lines,
+// so that they survive restarts
+func ConfigureAuditLog() (storage.AuditDao, error) {
+	if path := os.Getenv("SCRAPER_AUDIT_FILE"); path != "" {
+		return storage.CreateAuditFileDao(path)
+	}
+	return storage.CreateAuditInMemoryDao(), nil
+}
+
+// ConfigureMessageBus creates the message bus, which distributes tasks among workers. If SCRAPER_BUS_DATABASE is set,
+// jobs are kept in that SQLite database, so that workers of all processes sharing it can claim them. Otherwise tasks
+// are only processed by this process, so the bus must be configured if it is shared with standalone workers
+func ConfigureMessageBus(shared bool) (bus.MessageBus, error) {
+	path := os.Getenv("SCRAPER_BUS_DATABASE")
+	if path == "" && shared {
+		return nil, errors.New("SCRAPER_BUS_DATABASE is required, so that the API server and the workers share it")
+	}
+	if path == "" {
+		return bus.CreateInMemoryBus(), nil
+	}
+	db, err := sql.Open("sqlite3", "file:"+path+"?_busy_timeout=5000&_txlock=immediate&_journal_mode=WAL")
+	if err != nil {
+		return nil, err
+	}
+	return bus.CreateSqlBus(db, bus.SqlBusOptions{})
+}
+
+// ConfigureCookies reads the attributes of the cookies set by the server from environment variables:
+//
+//	SCRAPER_COOKIE_SECURE: if true, cookies are only sent over HTTPS
+//	SCRAPER_COOKIE_SAMESITE: lax (default), strict or none. none requires SCRAPER_COOKIE_SECURE
+func ConfigureCookies() (CookieConfig, error) {
+	cookies := DefaultCookieConfig
+	var err error
+	if value := os.Getenv("SCRAPER_COOKIE_SECURE"); value != "" {
+		if cookies.Secure, err = strconv.ParseBool(value); err != nil {
+			return cookies, err
+		}
+	}
+	switch strings.ToLower(os.Getenv("SCRAPER_COOKIE_SAMESITE")) {
+	case "", "lax":
+		cookies.SameSite = http.SameSiteLaxMode
+	case "strict":
+		cookies.SameSite = http.SameSiteStrictMode
+	case "none":
+		if !cookies.Secure {
+			return cookies, errors.New("SCRAPER_COOKIE_SAMESITE=none requires SCRAPER_COOKIE_SECURE=true")
+		}
+		cookies.SameSite = http.SameSiteNoneMode
+	default:
+		return cookies, fmt.Errorf("invalid SCRAPER_COOKIE_SAMESITE %q, expected lax, strict or none", os.Getenv("SCRAPER_COOKIE_SAMESITE"))
+	}
+	return cookies, nil
+}
+
+// ConfigureAllowedOrigins reads the origins (e.g. https://scraper.example.com), which state-changing requests are
+// accepted from besides the host of the server itself, from the comma separated SCRAPER_ALLOWED_ORIGINS
+func ConfigureAllowedOrigins() []string {
+	var origins []string
+	for _, origin := range strings.Split(os.Getenv("SCRAPER_ALLOWED_ORIGINS"), ",") {
+		if origin = strings.TrimSuffix(strings.TrimSpace(origin), "/"); origin != "" {
+			origins = append(origins, origin)
+		}
+	}
+	return origins
+}
+
+// ConfigureBootstrapAdmin creates the initial administrator from environment variables:
+//
+//	SCRAPER_ADMIN_USERNAME: username of the administrator
+//	SCRAPER_ADMIN_PASSWORD: password of the administrator, must satisfy the password policy
+func ConfigureBootstrapAdmin(authService *AuthService) error {
+	username := os.Getenv("SCRAPER_ADMIN_USERNAME")
+	password := os.Getenv("SCRAPER_ADMIN_PASSWORD")
+	if username == "" || password == "" {
+		log.Println("SCRAPER_ADMIN_USERNAME or SCRAPER_ADMIN_PASSWORD is not set - no users can log in")
+		return nil
+	}
+	err := authService.CreateUser(principal.System, username, password, role.Admin)
+	if errors.Is(err, ErrUserAlreadyExists) {
+		return nil
+	}
+	return err
+}
+
+// ConfigureOidc enables single sign-on through an OpenID Connect provider, if it is configured through environment
+// variables:
+//
+//	SCRAPER_OIDC_ISSUER: issuer URL of the provider
+//	SCRAPER_OIDC_CLIENT_ID, SCRAPER_OIDC_CLIENT_SECRET: credentials of the scraper at the provider
+//	SCRAPER_OIDC_REDIRECT_URL: public URL of /api/auth/oidc/callback
+//	SCRAPER_OIDC_USERNAME_CLAIM: claim of the ID token used as the username (default preferred_username)
+//	SCRAPER_OIDC_AUTO_PROVISION: if true, users are created on their first login
+//	SCRAPER_OIDC_LINK_VERIFIED_EMAIL: if true, existing users are linked on login if the verified email is the username
+//	SCRAPER_OIDC_DEFAULT_ROLE: role of the created users (default viewer)
+func ConfigureOidc(authService *AuthService) error {
+	config := OidcConfig{
+		Issuer:        os.Getenv("SCRAPER_OIDC_ISSUER"),
+		ClientId:      os.Getenv("SCRAPER_OIDC_CLIENT_ID"),
+		ClientSecret:  os.Getenv("SCRAPER_OIDC_CLIENT_SECRET"),
+		RedirectUrl:   os.Getenv("SCRAPER_OIDC_REDIRECT_URL"),
+		UsernameClaim: os.Getenv("SCRAPER_OIDC_USERNAME_CLAIM"),
+		DefaultRole:   role.Viewer,
+	}
+	if config.Issuer == "" {
+		return nil
+	}
+	if config.ClientId == "" || config.RedirectUrl == "" {
+		return errors.New("SCRAPER_OIDC_CLIENT_ID and SCRAPER_OIDC_REDIRECT_URL are required")
+	}
+	var err error
+	if value := os.Getenv("SCRAPER_OIDC_AUTO_PROVISION"); value != "" {
+		if config.AutoProvision, err = strconv.ParseBool(value); err != nil {
+			return err
+		}
+	}
+	if value := os.Getenv("SCRAPER_OIDC_LINK_VERIFIED_EMAIL"); value != "" {
+		if config.LinkVerifiedEmail, err = strconv.ParseBool(value); err != nil {
+			return err
+		}
+	}
+	if value := os.Getenv("SCRAPER_OIDC_DEFAULT_ROLE"); value != "" {
+		if config.DefaultRole, err = role.Parse(value); err != nil {
+			return err
+		}
+	}
+	provider, err := CreateOidcProvider(config, &http.Client{Timeout: 10 * time.Second})
+	if err != nil {
+		return err
+	}
+	authService.SetOidcProvider(provider)
+	return nil
+}
+
+// ConfigureRetention starts the task retention job, if a retention policy is configured through environment variables:
+//
+//	SCRAPER_RETENTION_MAX_AGE: tasks older than this duration (e.g. 720h) are removed
+//	SCRAPER_RETENTION_MAX_TASKS_PER_USER: only this many most recent tasks of each user are kept
+//	SCRAPER_RETENTION_INTERVAL: how often the policy is applied (default 1h)
+//	SCRAPER_ARCHIVE_FILE: if set, removed tasks are appended to this file instead of being discarded
+func ConfigureRetention(scrapeService *ScrapeService) error {
+	var policy RetentionPolicy
+	var err error
+	if value := os.Getenv("SCRAPER_RETENTION_MAX_AGE"); value != "" {
+		if policy.MaxAge, err = time.ParseDuration(value); err != nil {
+			return err
+		}
+		if policy.MaxAge <= 0 {
+			return errors.New("SCRAPER_RETENTION_MAX_AGE must be positive")
+		}
+	}
+	if value := os.Getenv("SCRAPER_RETENTION_MAX_TASKS_PER_USER"); value != "" {
+		if policy.MaxTasksPerUser, err = strconv.Atoi(value); err != nil {
+			return err
+		}
+		if policy.MaxTasksPerUser <= 0 {
+			return errors.New("SCRAPER_RETENTION_MAX_TASKS_PER_USER must be positive")
+		}
+	}
+	if policy.MaxAge == 0 && policy.MaxTasksPerUser == 0 {
+		return nil
+	}
+
+	interval := time.Hour
+	if value := os.Getenv("SCRAPER_RETENTION_INTERVAL"); value != "" {
+		if interval, err = time.ParseDuration(value); err != nil {
+			return err
+		}
+		if interval <= 0 {
+			return errors.New("SCRAPER_RETENTION_INTERVAL must be positive")
+		}
+	}
+	if path := os.Getenv("SCRAPER_ARCHIVE_FILE"); path != "" {
+		scrapeService.SetTaskArchive(storage.CreateTaskFileArchive(path))
+	}
+	_, err = scrapeService.StartRetentionJob(policy, interval)
+	return err
+}
+
+// ConfigureUpdateInterval limits how often progress updates of tasks are sent to listeners, if SCRAPER_UPDATE_INTERVAL
+// (e.g. 250ms) is set. By default every update is sent
+func ConfigureUpdateInterval(scrapeService *ScrapeService) error {
+	value := os.Getenv("SCRAPER_UPDATE_INTERVAL")
+	if value == "" {
+		return nil
+	}
+	interval, err := time.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+	scrapeService.SetUpdateInterval(interval)
+	return nil
+}
+
+// ConfigureWorker creates the worker, which processes tasks in this process, and registers it at the message bus.
+// The worker is configured through environment variables:
+//
+//	SCRAPER_WORKER_ID: ID of the worker, unique among the processes sharing the bus (default <hostname>-<random>)
+//	SCRAPER_WORKER_CONCURRENCY: number of tasks processed concurrently (default 3)
+//	SCRAPER_WORKER_REPORT_INTERVAL: how often the worker reports its status (default 10s)
+func ConfigureWorker(messageBus bus.MessageBus) (*Worker, error) {
+	id := os.Getenv("SCRAPER_WORKER_ID")
+	if id == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return nil, err
+		}
+		id = hostname + "-" + uuid.New().String()[:8]
+	}
+	concurrency := DefaultWorkerCount
+	var err error
+	if value := os.Getenv("SCRAPER_WORKER_CONCURRENCY"); value != "" {
+		if concurrency, err = strconv.Atoi(value); err != nil {
+			return nil, err
+		}
+		if concurrency < 1 {
+			return nil, ErrInvalidWorkerCount
+		}
+	}
+	interval := DefaultReportInterval
+	if value := os.Getenv("SCRAPER_WORKER_REPORT_INTERVAL"); value != "" {
+		if interval, err = time.ParseDuration(value); err != nil {
+			return nil, err
+		}
+		if interval <= 0 {
+			return nil, errors.New("SCRAPER_WORKER_REPORT_INTERVAL must be positive")
+		}
+	}
+
+	worker := CreateWorker(id, messageBus)
+	if err = worker.SetConcurrency(concurrency); err != nil {
+		return nil, err
+	}
+	if err = worker.Register(interval); err != nil {
+		worker.SetConcurrency(0)
+		return nil, err
+	}
+	return worker, nil
+}
+
+// ConfigureWebhooks allows webhooks to point to loopback, link-local and private addresses, if
+// SCRAPER_WEBHOOK_ALLOW_PRIVATE_ADDRESSES is true. By default they are rejected, so that users can not make the server
+// send requests to its own network
+func ConfigureWebhooks(webhookService *webhook.WebhookService) error {
+	value := os.Getenv("SCRAPER_WEBHOOK_ALLOW_PRIVATE_ADDRESSES")
+	if value == "" {
+		return nil
+	}
+	allow, err := strconv.ParseBool(value)
+	if err != nil {
+		return err
+	}
+	webhookService.SetAllowPrivateAddresses(allow)
+	return nil
+}
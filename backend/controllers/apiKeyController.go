@@ -0,0 +1,85 @@
+package authController
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	request "github.com/martynasd123/golang-scraper/models/request"
+	response "github.com/martynasd123/golang-scraper/models/response"
+	"github.com/martynasd123/golang-scraper/models/role"
+	authService "github.com/martynasd123/golang-scraper/services/auth"
+)
+
+type ApiKeyController struct {
+	authService *authService.AuthService
+}
+
+func CreateApiKeyController(service *authService.AuthService) *ApiKeyController {
+	return &ApiKeyController{authService: service}
+}
+
+func (controller *ApiKeyController) GetApiKeys(ctx *gin.Context) {
+	keys := controller.authService.GetApiKeys(authService.GetPrincipal(ctx).Username)
+	res := make([]*response.ApiKeyResponse, len(keys))
+	for i, key := range keys {
+		res[i] = response.CreateApiKeyResponse(key)
+	}
+	ctx.JSON(http.StatusOK, res)
+}
+
+func (controller *ApiKeyController) CreateApiKey(ctx *gin.Context) {
+	var body request.CreateApiKeyRequest
+	if err := ctx.ShouldBindJSON(&body); err != nil {
+		ctx.String(http.StatusBadRequest, "Could not parse request")
+		return
+	}
+	scopes := make([]role.Permission, len(body.Scopes))
+	for i, scope := range body.Scopes {
+		scopes[i] = role.Permission(scope)
+	}
+	key, apiKey, err := controller.authService.CreateApiKey(
+		authService.GetPrincipal(ctx),
+		body.Name,
+		scopes,
+		body.ExpiresAt,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, authService.ErrApiKeyNameMissing):
+			ctx.String(http.StatusBadRequest, "name is required")
+		case errors.Is(err, authService.ErrApiKeyNameTaken):
+			ctx.String(http.StatusConflict, "API key with this name already exists")
+		case errors.Is(err, authService.ErrInvalidScopes):
+			ctx.String(http.StatusBadRequest, "scopes must be permissions granted by your role")
+		case errors.Is(err, authService.ErrInvalidExpiry):
+			ctx.String(http.StatusBadRequest, "expiry must be in the future")
+		default:
+			log.Printf("error occurred when creating API key: %v", err)
+			ctx.String(http.StatusInternalServerError, "something went wrong")
+		}
+		return
+	}
+	ctx.JSON(http.StatusCreated, response.CreateCreatedApiKeyResponse(key, apiKey))
+}
+
+func (controller *ApiKeyController) RevokeApiKey(ctx *gin.Context) {
+	id, err := strconv.Atoi(ctx.Param("id"))
+	if err != nil {
+		ctx.String(http.StatusBadRequest, "invalid API key id")
+		return
+	}
+	err = controller.authService.RevokeApiKey(authService.GetPrincipal(ctx), id)
+	if err != nil {
+		if errors.Is(err, authService.ErrApiKeyNotExist) {
+			ctx.String(http.StatusNotFound, "API key not found")
+			return
+		}
+		log.Printf("error occurred when revoking API key: %v", err)
+		ctx.String(http.StatusInternalServerError, "something went wrong")
+		return
+	}
+	ctx.Status(http.StatusNoContent)
+}
@@ -0,0 +1,107 @@
+package authController
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	response "github.com/martynasd123/golang-scraper/models/response"
+	authService "github.com/martynasd123/golang-scraper/services/auth"
+	"github.com/martynasd123/golang-scraper/storage"
+)
+
+const (
+	defaultAuditPageSize = 100
+	maxAuditPageSize     = 1000
+)
+
+type AuditController struct {
+	authService *authService.AuthService
+}
+
+func CreateAuditController(service *authService.AuthService) *AuditController {
+	return &AuditController{authService: service}
+}
+
+// GetEvents returns a page of the audit log, newest first. Supported query parameters:
+//
+//	actor, action, target, outcome: exact values to filter by
+//	from, to: RFC 3339 timestamps limiting when the events were recorded
+//	limit: page size (default 100, at most 1000)
+//	cursor: nextCursor of the previous page
+func (controller *AuditController) GetEvents(ctx *gin.Context) {
+	filter, err := parseAuditFilter(ctx)
+	if err != nil {
+		ctx.String(http.StatusBadRequest, err.Error())
+		return
+	}
+	query := storage.AuditQuery{Filter: *filter, Limit: defaultAuditPageSize, Cursor: ctx.Query("cursor")}
+	if value, ok := ctx.GetQuery("limit"); ok {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit < 1 || limit > maxAuditPageSize {
+			ctx.String(http.StatusBadRequest, "invalid limit")
+			return
+		}
+		query.Limit = limit
+	}
+	page, err := controller.authService.QueryAuditEvents(query)
+	if err != nil {
+		if errors.Is(err, storage.ErrInvalidCursor) {
+			ctx.String(http.StatusBadRequest, "invalid cursor")
+			return
+		}
+		log.Printf("error occurred when querying audit log: %v", err)
+		ctx.String(http.StatusInternalServerError, "something went wrong")
+		return
+	}
+	ctx.JSON(http.StatusOK, response.CreateAuditEventListResponse(page))
+}
+
+// ExportEvents returns all events matching the filter as JSON lines, oldest first. Supports the same filters as
+// GetEvents
+func (controller *AuditController) ExportEvents(ctx *gin.Context) {
+	filter, err := parseAuditFilter(ctx)
+	if err != nil {
+		ctx.String(http.StatusBadRequest, err.Error())
+		return
+	}
+	events := controller.authService.GetAuditEvents(*filter)
+	ctx.Header("Content-Disposition", `attachment; filename="audit.jsonl"`)
+	ctx.Header("Content-Type", "application/x-ndjson")
+	ctx.Status(http.StatusOK)
+	encoder := json.NewEncoder(ctx.Writer)
+	for _, event := range events {
+		if err = encoder.Encode(response.CreateAuditEventResponse(event)); err != nil {
+			log.Printf("error occurred when exporting audit log: %v", err)
+			return
+		}
+	}
+}
+
+func parseAuditFilter(ctx *gin.Context) (*storage.AuditFilter, error) {
+	filter := &storage.AuditFilter{
+		Actor:   ctx.Query("actor"),
+		Action:  ctx.Query("action"),
+		Target:  ctx.Query("target"),
+		Outcome: ctx.Query("outcome"),
+	}
+	if value, ok := ctx.GetQuery("from"); ok {
+		from, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return nil, errors.New("invalid from")
+		}
+		filter.From = &from
+	}
+	if value, ok := ctx.GetQuery("to"); ok {
+		to, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return nil, errors.New("invalid to")
+		}
+		filter.To = &to
+	}
+	return filter, nil
+}
@@ -4,21 +4,26 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"math"
 	"net/http"
+	"net/url"
+	"strconv"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	. "github.com/martynasd123/golang-scraper/models/request"
+	response "github.com/martynasd123/golang-scraper/models/response"
 	authService "github.com/martynasd123/golang-scraper/services/auth"
 	. "github.com/martynasd123/golang-scraper/services/auth/constants"
 )
 
 type AuthController struct {
 	authService *authService.AuthService
+	cookies     authService.CookieConfig
 }
 
-func CreateAuthController(service *authService.AuthService) *AuthController {
-	return &AuthController{authService: service}
+func CreateAuthController(service *authService.AuthService, cookies authService.CookieConfig) *AuthController {
+	return &AuthController{authService: service, cookies: cookies}
 }
 
 func (controller *AuthController) Authenticate(ctx *gin.Context) {
@@ -35,41 +40,76 @@ func (controller *AuthController) Authenticate(ctx *gin.Context) {
 		ctx.Request.UserAgent(),
 	)
 	if err != nil {
-		if errors.Is(err, authService.ErrUserNotExist) || errors.Is(err, authService.ErrPasswordIncorrect) {
+		var throttled *authService.ThrottledError
+		var secondFactorRequired *authService.SecondFactorRequiredError
+		if errors.As(err, &secondFactorRequired) {
+			// Password is correct - the client has to send the code to /auth/2fa/verify along with the challenge
+			ctx.JSON(http.StatusAccepted, gin.H{"challenge": secondFactorRequired.Challenge})
+		} else if errors.As(err, &throttled) {
+			respondThrottled(ctx, throttled)
+		} else if errors.Is(err, authService.ErrUserNotExist) || errors.Is(err, authService.ErrPasswordIncorrect) {
 			ctx.String(http.StatusForbidden, "username or password is incorrect")
+		} else if errors.Is(err, authService.ErrUserDisabled) {
+			ctx.String(http.StatusForbidden, "account is disabled")
 		} else {
 			log.Println(err)
 			ctx.String(http.StatusInternalServerError, "something went wrong")
 		}
 		return
 	}
-	setRefreshTokenCookie(ctx, refreshToken, refreshTokenValidUntil)
-	setAccessTokenCookie(ctx, accessToken)
+	controller.startBrowserSession(ctx, accessToken, refreshToken, refreshTokenValidUntil)
 	ctx.String(http.StatusOK, "")
 }
 
-func setAccessTokenCookie(ctx *gin.Context, accessToken *string) {
+func respondThrottled(ctx *gin.Context, throttled *authService.ThrottledError) {
+	ctx.Header("Retry-After", strconv.Itoa(int(math.Ceil(throttled.RetryAfter.Seconds()))))
+	if errors.Is(throttled, authService.ErrAccountLocked) {
+		ctx.String(http.StatusTooManyRequests, "account is temporarily locked")
+	} else {
+		ctx.String(http.StatusTooManyRequests, "too many failed login attempts")
+	}
+}
+
+// Sets the cookies of a user, who has just logged in. The CSRF token is replaced as well, so that a token planted
+// before the login is not accepted
+func (controller *AuthController) startBrowserSession(
+	ctx *gin.Context,
+	accessToken, refreshToken *string,
+	refreshTokenValidUntil *time.Time,
+) {
+	controller.setRefreshTokenCookie(ctx, refreshToken, refreshTokenValidUntil)
+	controller.setAccessTokenCookie(ctx, accessToken)
+	authService.SetCsrfCookie(ctx, controller.cookies)
+}
+
+func (controller *AuthController) setAccessTokenCookie(ctx *gin.Context, accessToken *string) {
+	controller.cookies.Apply(ctx)
 	ctx.SetCookie(AccessTokenCookieName,
 		*accessToken,
 		0,
 		"/api/",
 		"",
-		false,
+		controller.cookies.Secure,
 		true,
 	)
 }
 
-func setRefreshTokenCookie(ctx *gin.Context, refreshToken *string, refreshTokenValidUntil *time.Time) {
+func (controller *AuthController) setRefreshTokenCookie(
+	ctx *gin.Context,
+	refreshToken *string,
+	refreshTokenValidUntil *time.Time,
+) {
 	maxAge := 0
 	if refreshTokenValidUntil != nil {
 		maxAge = int(refreshTokenValidUntil.Sub(time.Now()).Seconds())
 	}
+	controller.cookies.Apply(ctx)
 	ctx.SetCookie(RefreshTokenCookieName,
 		*refreshToken,
 		maxAge,
 		"/api/auth/refresh-token",
 		"",
-		false,
+		controller.cookies.Secure,
 		true,
 	)
 }
@@ -100,7 +140,10 @@ func (controller *AuthController) RefreshToken(ctx *gin.Context) {
 			errors.Is(err, authService.ErrRefreshTokenNotExist),
 			errors.Is(err, authService.ErrInvalidDeviceIdentifier),
 			errors.Is(err, authService.ErrRefreshTokenExpired),
-			errors.Is(err, authService.ErrUserNotExist):
+			errors.Is(err, authService.ErrUserNotExist),
+			errors.Is(err, authService.ErrUserDisabled),
+			errors.Is(err, authService.ErrSessionRevoked),
+			errors.Is(err, authService.ErrRefreshTokenReused):
 			ctx.String(http.StatusForbidden, "could not verify refresh token")
 		default:
 			log.Println(fmt.Errorf("unexpected error while refreshing token: %w", err))
@@ -108,29 +151,263 @@ func (controller *AuthController) RefreshToken(ctx *gin.Context) {
 		}
 		return
 	}
-	setAccessTokenCookie(ctx, accessToken)
-	setRefreshTokenCookie(ctx, newRefreshToken, refreshTokenValidUntil)
+	controller.setAccessTokenCookie(ctx, accessToken)
+	controller.setRefreshTokenCookie(ctx, newRefreshToken, refreshTokenValidUntil)
 }
 
 func (controller *AuthController) LogOut(ctx *gin.Context) {
-	var logOutRequest LogOutRequest
+	sessionId, _ := authService.GetSessionId(ctx)
+	err := controller.authService.LogOut(authService.GetPrincipal(ctx), sessionId)
+	if err != nil {
+		switch {
+		case errors.Is(err, authService.ErrSessionNotExist):
+			ctx.String(http.StatusForbidden, "bad credentials")
+		default:
+			log.Println(fmt.Errorf("unexpected error while logging out: %w", err))
+			ctx.String(http.StatusInternalServerError, "something went wrong")
+		}
+		return
+	}
+	controller.setAccessTokenCookie(ctx, new(string))
+	controller.setRefreshTokenCookie(ctx, new(string), nil)
+}
 
-	if err := ctx.ShouldBindJSON(&logOutRequest); err != nil {
+func (controller *AuthController) GetSessions(ctx *gin.Context) {
+	currentSessionId, _ := authService.GetSessionId(ctx)
+	sessions := controller.authService.GetSessions(ctx.GetString(UserNameContextKey))
+	res := make([]*response.SessionResponse, len(sessions))
+	for i, session := range sessions {
+		res[i] = response.CreateSessionResponse(session, *session.Id == currentSessionId)
+	}
+	ctx.JSON(http.StatusOK, res)
+}
+
+func (controller *AuthController) RevokeSession(ctx *gin.Context) {
+	sessionId, err := strconv.Atoi(ctx.Param("id"))
+	if err != nil {
+		ctx.String(http.StatusBadRequest, "invalid session id")
+		return
+	}
+	err = controller.authService.RevokeSession(authService.GetPrincipal(ctx), sessionId)
+	if err != nil {
+		if errors.Is(err, authService.ErrSessionNotExist) {
+			ctx.String(http.StatusNotFound, "session not found")
+			return
+		}
+		log.Println(fmt.Errorf("unexpected error while revoking session: %w", err))
+		ctx.String(http.StatusInternalServerError, "something went wrong")
+		return
+	}
+	ctx.Status(http.StatusNoContent)
+}
+
+func (controller *AuthController) ChangePassword(ctx *gin.Context) {
+	var changePasswordRequest ChangePasswordRequest
+
+	if err := ctx.ShouldBindJSON(&changePasswordRequest); err != nil {
 		ctx.String(http.StatusBadRequest, err.Error())
 		return
 	}
 
-	err := controller.authService.LogOut(logOutRequest.Username)
+	err := controller.authService.ChangePassword(
+		authService.GetPrincipal(ctx),
+		changePasswordRequest.OldPassword,
+		changePasswordRequest.NewPassword,
+	)
 	if err != nil {
 		switch {
+		case errors.Is(err, authService.ErrPasswordIncorrect):
+			ctx.String(http.StatusForbidden, "password is incorrect")
+		case errors.Is(err, authService.ErrPasswordPolicy):
+			ctx.String(http.StatusBadRequest, passwordPolicyMessage)
+		default:
+			log.Println(fmt.Errorf("unexpected error while changing password: %w", err))
+			ctx.String(http.StatusInternalServerError, "something went wrong")
+		}
+		return
+	}
+	// All sessions are revoked, so the user has to log in again
+	controller.setAccessTokenCookie(ctx, new(string))
+	controller.setRefreshTokenCookie(ctx, new(string), nil)
+	ctx.String(http.StatusOK, "")
+}
+
+// GetJwks returns the public keys, which other services can verify access tokens with
+func (controller *AuthController) GetJwks(ctx *gin.Context) {
+	ctx.JSON(http.StatusOK, gin.H{"keys": controller.authService.GetJwks()})
+}
+
+// VerifySecondFactor finishes logging in of a user with a second factor
+func (controller *AuthController) VerifySecondFactor(ctx *gin.Context) {
+	var body VerifySecondFactorRequest
+	if err := ctx.ShouldBindJSON(&body); err != nil {
+		ctx.String(http.StatusBadRequest, err.Error())
+		return
+	}
+	accessToken, refreshToken, refreshTokenValidUntil, err := controller.authService.VerifySecondFactor(
+		body.Challenge,
+		body.Code,
+		ctx.ClientIP(),
+		ctx.Request.UserAgent(),
+	)
+	if err != nil {
+		var throttled *authService.ThrottledError
+		switch {
+		case errors.As(err, &throttled):
+			respondThrottled(ctx, throttled)
+		case errors.Is(err, authService.ErrChallengeInvalid):
+			ctx.String(http.StatusForbidden, "login challenge is invalid or expired")
+		case errors.Is(err, authService.ErrSecondFactorIncorrect):
+			ctx.String(http.StatusForbidden, "code is incorrect")
+		case errors.Is(err, authService.ErrUserNotExist), errors.Is(err, authService.ErrUserDisabled):
+			ctx.String(http.StatusForbidden, "account is disabled")
+		default:
+			log.Println(fmt.Errorf("unexpected error while verifying second factor: %w", err))
+			ctx.String(http.StatusInternalServerError, "something went wrong")
+		}
+		return
+	}
+	controller.startBrowserSession(ctx, accessToken, refreshToken, refreshTokenValidUntil)
+	ctx.String(http.StatusOK, "")
+}
+
+// EnrollSecondFactor starts enabling the second factor. The returned secret has to be added to an authenticator app
+func (controller *AuthController) EnrollSecondFactor(ctx *gin.Context) {
+	enrollment, err := controller.authService.EnrollSecondFactor(ctx.GetString(UserNameContextKey))
+	if err != nil {
+		if errors.Is(err, authService.ErrSecondFactorEnabled) {
+			ctx.String(http.StatusConflict, "second factor is already enabled")
+			return
+		}
+		log.Println(fmt.Errorf("unexpected error while enrolling second factor: %w", err))
+		ctx.String(http.StatusInternalServerError, "something went wrong")
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{"secret": enrollment.Secret, "uri": enrollment.Uri})
+}
+
+// ConfirmSecondFactor enables the second factor and returns the recovery codes. They are only shown once
+func (controller *AuthController) ConfirmSecondFactor(ctx *gin.Context) {
+	var body ConfirmSecondFactorRequest
+	if err := ctx.ShouldBindJSON(&body); err != nil {
+		ctx.String(http.StatusBadRequest, err.Error())
+		return
+	}
+	recoveryCodes, err := controller.authService.ConfirmSecondFactor(authService.GetPrincipal(ctx), body.Code)
+	if err != nil {
+		switch {
+		case errors.Is(err, authService.ErrSecondFactorEnabled):
+			ctx.String(http.StatusConflict, "second factor is already enabled")
+		case errors.Is(err, authService.ErrSecondFactorNotEnrolled):
+			ctx.String(http.StatusBadRequest, "second factor enrollment was not started")
+		case errors.Is(err, authService.ErrSecondFactorIncorrect):
+			ctx.String(http.StatusBadRequest, "code is incorrect")
+		default:
+			log.Println(fmt.Errorf("unexpected error while confirming second factor: %w", err))
+			ctx.String(http.StatusInternalServerError, "something went wrong")
+		}
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{"recoveryCodes": recoveryCodes})
+}
+
+// OidcLogin redirects the user to the single sign-on provider. The state is also stored in a cookie, so that the
+// callback only accepts logins started in the same browser
+func (controller *AuthController) OidcLogin(ctx *gin.Context) {
+	authorizationUrl, state, err := controller.authService.StartOidcLogin()
+	if err != nil {
+		if errors.Is(err, authService.ErrOidcNotConfigured) {
+			ctx.String(http.StatusNotFound, "single sign-on is not configured")
+			return
+		}
+		log.Println(fmt.Errorf("unexpected error while starting single sign-on: %w", err))
+		ctx.String(http.StatusInternalServerError, "something went wrong")
+		return
+	}
+	controller.setOidcStateCookie(ctx, state)
+	ctx.Redirect(http.StatusFound, authorizationUrl)
+}
+
+// OidcLink starts a single sign-on login, which links the identity to the account of the logged-in user. The
+// authorization URL is returned instead of redirecting, since the request is sent by the frontend
+func (controller *AuthController) OidcLink(ctx *gin.Context) {
+	authorizationUrl, state, err := controller.authService.StartOidcLink(authService.GetPrincipal(ctx))
+	if err != nil {
+		var secondFactorRequired *authService.SecondFactorRequiredError
+		switch {
+		case errors.As(err, &secondFactorRequired):
+			// The client has to send the code to /auth/2fa/verify along with the challenge. It is passed in the
+			// fragment, so that it is not sent to the server or leaked through the Referer header
+			ctx.Redirect(http.StatusFound, "/login#challenge="+url.QueryEscape(secondFactorRequired.Challenge))
+		case errors.Is(err, authService.ErrOidcNotConfigured):
+			ctx.String(http.StatusNotFound, "single sign-on is not configured")
 		case errors.Is(err, authService.ErrUserNotExist):
-			ctx.String(http.StatusForbidden, "bad credentials")
+			ctx.String(http.StatusNotFound, "user does not exist")
 		default:
-			log.Println(fmt.Errorf("unexpected error while logging out: %w", err))
+			log.Println(fmt.Errorf("unexpected error while starting single sign-on link: %w", err))
+			ctx.String(http.StatusInternalServerError, "something went wrong")
+		}
+		return
+	}
+	controller.setOidcStateCookie(ctx, state)
+	ctx.JSON(http.StatusOK, gin.H{"authorizationUrl": authorizationUrl})
+}
+
+func (controller *AuthController) setOidcStateCookie(ctx *gin.Context, state string) {
+	// The provider redirects back from another site, so the cookie would not be sent with SameSite=Strict
+	ctx.SetSameSite(http.SameSiteLaxMode)
+	ctx.SetCookie(OidcStateCookieName, state, 0, "/api/auth/oidc", "", controller.cookies.Secure, true)
+}
+
+// OidcCallback finishes the single sign-on login, once the provider redirects the user back
+func (controller *AuthController) OidcCallback(ctx *gin.Context) {
+	state, err := ctx.Cookie(OidcStateCookieName)
+	ctx.SetSameSite(http.SameSiteLaxMode)
+	ctx.SetCookie(OidcStateCookieName, "", -1, "/api/auth/oidc", "", controller.cookies.Secure, true)
+	if err != nil || state != ctx.Query("state") {
+		ctx.String(http.StatusBadRequest, "single sign-on login is invalid or expired")
+		return
+	}
+	if ctx.Query("error") != "" {
+		ctx.String(http.StatusForbidden, "single sign-on login failed: "+ctx.Query("error"))
+		return
+	}
+	accessToken, refreshToken, refreshTokenValidUntil, err := controller.authService.FinishOidcLogin(
+		state,
+		ctx.Query("code"),
+		ctx.ClientIP(),
+		ctx.Request.UserAgent(),
+	)
+	if err != nil {
+		var secondFactorRequired *authService.SecondFactorRequiredError
+		switch {
+		case errors.As(err, &secondFactorRequired):
+			// The client has to send the code to /auth/2fa/verify along with the challenge. It is passed in the
+			// fragment, so that it is not sent to the server or leaked through the Referer header
+			ctx.Redirect(http.StatusFound, "/login#challenge="+url.QueryEscape(secondFactorRequired.Challenge))
+		case errors.Is(err, authService.ErrOidcNotConfigured):
+			ctx.String(http.StatusNotFound, "single sign-on is not configured")
+		case errors.Is(err, authService.ErrOidcStateInvalid):
+			ctx.String(http.StatusBadRequest, "single sign-on login is invalid or expired")
+		case errors.Is(err, authService.ErrOidcUserNotExist):
+			ctx.String(http.StatusForbidden, "account does not exist")
+		case errors.Is(err, authService.ErrOidcAccountNotLinked):
+			ctx.String(http.StatusForbidden, "account is not linked to single sign-on. Log in with a password and link it first")
+		case errors.Is(err, authService.ErrOidcIdentityLinked):
+			ctx.String(http.StatusConflict, "single sign-on identity is linked to a different account")
+		case errors.Is(err, authService.ErrUserDisabled):
+			ctx.String(http.StatusForbidden, "account is disabled")
+		case errors.Is(err, authService.ErrOidcSubjectMismatch),
+			errors.Is(err, authService.ErrOidcTokenInvalid),
+			errors.Is(err, authService.ErrOidcExchangeFailed):
+			log.Println(fmt.Errorf("single sign-on login rejected: %w", err))
+			ctx.String(http.StatusForbidden, "single sign-on login failed")
+		default:
+			log.Println(fmt.Errorf("unexpected error while finishing single sign-on: %w", err))
 			ctx.String(http.StatusInternalServerError, "something went wrong")
 		}
 		return
 	}
-	setAccessTokenCookie(ctx, new(string))
-	setRefreshTokenCookie(ctx, new(string), nil)
+	controller.startBrowserSession(ctx, accessToken, refreshToken, refreshTokenValidUntil)
+	ctx.Redirect(http.StatusFound, "/")
 }
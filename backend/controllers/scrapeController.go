@@ -7,12 +7,16 @@ import (
 	"net/http"
 	"net/url"
 	"strconv"
-	"strings"
+	"time"
 
+	"github.com/gin-contrib/sse"
 	"github.com/gin-gonic/gin"
 	request "github.com/martynasd123/golang-scraper/models/request"
 	response "github.com/martynasd123/golang-scraper/models/response"
+	authService "github.com/martynasd123/golang-scraper/services/auth"
 	scrapeService "github.com/martynasd123/golang-scraper/services/scrape"
+	"github.com/martynasd123/golang-scraper/storage"
+	"github.com/martynasd123/golang-scraper/utils/patch"
 )
 
 type ScrapeController struct {
@@ -47,8 +51,20 @@ func (controller *ScrapeController) AddTask(ctx *gin.Context) {
 		parsedUrl.Fragment = ""
 	}
 
-	id, err := controller.service.AddTask(parsedUrl)
+	options := scrapeService.TaskOptions{
+		Priority: scrapeService.DefaultPriority,
+		Owner:    authService.GetPrincipal(ctx).Username,
+	}
+	if body.Priority != nil {
+		options.Priority = *body.Priority
+	}
+
+	id, err := controller.service.AddTask(authService.GetPrincipal(ctx), parsedUrl, options)
 	if err != nil {
+		if errors.Is(err, scrapeService.ErrInvalidPriority) {
+			ctx.String(http.StatusBadRequest, "Invalid priority")
+			return
+		}
 		log.Printf("error occurred when adding task: %v", err)
 		ctx.String(http.StatusInternalServerError, "something went wrong")
 		return
@@ -57,13 +73,173 @@ func (controller *ScrapeController) AddTask(ctx *gin.Context) {
 	ctx.JSON(http.StatusOK, response.CreateAddTaskResponse(id))
 }
 
+const (
+	defaultTaskPageSize = 50
+	maxTaskPageSize     = 200
+)
+
+// GetAllTasks returns a page of tasks. Supported query parameters:
+//
+//	status: task status, can be repeated
+//	host: host of the task link
+//	createdFrom, createdTo: creation time range (RFC 3339)
+//	title: substring of the page title
+//	hasBrokenLinks: true or false
+//	sort: ctime (default), crawledLinks or inaccessibleLinks
+//	order: desc (default) or asc
+//	limit: page size
+//	cursor: cursor returned with the previous page
 func (controller *ScrapeController) GetAllTasks(ctx *gin.Context) {
-	tasks := controller.service.GetAllTasks()
-	taskListItems := []*response.TaskListItem{}
-	for _, task := range tasks {
-		taskListItems = append(taskListItems, response.CreateTaskListItemResponse(task))
+	query, err := parseTaskQuery(ctx)
+	if err != nil {
+		ctx.String(http.StatusBadRequest, err.Error())
+		return
+	}
+	page, err := controller.service.QueryTasks(authService.GetPrincipal(ctx), *query)
+	if err != nil {
+		if errors.Is(err, storage.ErrInvalidCursor) {
+			ctx.String(http.StatusBadRequest, "invalid cursor")
+			return
+		}
+		log.Printf("error occurred when querying tasks: %v", err)
+		ctx.String(http.StatusInternalServerError, "something went wrong")
+		return
+	}
+	ctx.JSON(http.StatusOK, response.CreateTaskListResponse(page))
+}
+
+func parseTaskQuery(ctx *gin.Context) (*storage.TaskQuery, error) {
+	query := &storage.TaskQuery{
+		Filter: storage.TaskFilter{
+			Statuses:      ctx.QueryArray("status"),
+			Host:          ctx.Query("host"),
+			TitleContains: ctx.Query("title"),
+		},
+		SortBy: ctx.DefaultQuery("sort", storage.SortByCreationTime),
+		Limit:  defaultTaskPageSize,
+		Cursor: ctx.Query("cursor"),
+	}
+
+	if value, ok := ctx.GetQuery("createdFrom"); ok {
+		createdFrom, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return nil, errors.New("invalid createdFrom")
+		}
+		query.Filter.CreatedAfter = &createdFrom
+	}
+	if value, ok := ctx.GetQuery("createdTo"); ok {
+		createdTo, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return nil, errors.New("invalid createdTo")
+		}
+		query.Filter.CreatedBefore = &createdTo
+	}
+	if value, ok := ctx.GetQuery("hasBrokenLinks"); ok {
+		hasBrokenLinks, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, errors.New("invalid hasBrokenLinks")
+		}
+		query.Filter.HasBrokenLinks = &hasBrokenLinks
+	}
+
+	switch query.SortBy {
+	case storage.SortByCreationTime, storage.SortByCrawledLinks, storage.SortByInaccessibleLinks:
+	default:
+		return nil, errors.New("invalid sort")
+	}
+	switch ctx.DefaultQuery("order", "desc") {
+	case "asc":
+		query.Ascending = true
+	case "desc":
+		query.Ascending = false
+	default:
+		return nil, errors.New("invalid order")
+	}
+	if value, ok := ctx.GetQuery("limit"); ok {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit < 1 || limit > maxTaskPageSize {
+			return nil, errors.New("invalid limit")
+		}
+		query.Limit = limit
+	}
+	return query, nil
+}
+
+func (controller *ScrapeController) GetTask(ctx *gin.Context) {
+	taskId, err := strconv.Atoi(ctx.Param("id"))
+	if err != nil {
+		ctx.String(http.StatusBadRequest, "invalid task id")
+		return
+	}
+	task, err := controller.service.GetTask(authService.GetPrincipal(ctx), taskId)
+	if err != nil {
+		ctx.String(http.StatusNotFound, "task not found")
+		return
+	}
+	ctx.JSON(http.StatusOK, controller.createTaskStatusResponse(task))
+}
+
+func (controller *ScrapeController) GetUpdateMetrics(ctx *gin.Context) {
+	metrics := controller.service.GetUpdateMetrics()
+	ctx.JSON(http.StatusOK, response.CreateUpdateMetricsResponse(
+		metrics.DroppedEvents(),
+		metrics.DisconnectedSubscribers(),
+	))
+}
+
+// GetWorkers lists the workers of all processes along with the tasks each one is processing
+func (controller *ScrapeController) GetWorkers(ctx *gin.Context) {
+	workers, err := controller.service.GetWorkers()
+	if err != nil {
+		log.Printf("error occurred when listing workers: %v", err)
+		ctx.String(http.StatusInternalServerError, "something went wrong")
+		return
+	}
+	now := time.Now()
+	workerResponses := make([]*response.WorkerResponse, 0, len(workers))
+	for i := range workers {
+		workerResponses = append(workerResponses, response.CreateWorkerResponse(&workers[i], now))
+	}
+	ctx.JSON(http.StatusOK, workerResponses)
+}
+
+func (controller *ScrapeController) GetConcurrencySettings(ctx *gin.Context) {
+	ctx.JSON(http.StatusOK, response.CreateConcurrencySettingsResponse(
+		controller.service.GetWorkerCount(),
+		controller.service.GetQueuedTaskCount(),
+	))
+}
+
+func (controller *ScrapeController) UpdateConcurrencySettings(ctx *gin.Context) {
+	var body request.UpdateConcurrencyRequest
+	if err := ctx.ShouldBindJSON(&body); err != nil {
+		ctx.String(http.StatusBadRequest, "Could not parse request")
+		return
+	}
+	err := controller.service.SetWorkerCount(authService.GetPrincipal(ctx), body.Workers)
+	if err != nil {
+		if errors.Is(err, scrapeService.ErrInvalidWorkerCount) {
+			ctx.String(http.StatusBadRequest, "invalid worker count")
+			return
+		}
+		if errors.Is(err, scrapeService.ErrNoLocalWorker) {
+			ctx.String(http.StatusConflict, "tasks are only processed by standalone workers")
+			return
+		}
+		log.Printf("error occurred when updating worker count: %v", err)
+		ctx.String(http.StatusInternalServerError, "something went wrong")
+		return
+	}
+	controller.GetConcurrencySettings(ctx)
+}
+
+// Creates task status response, which includes the position of the task in the queue, if it is still pending
+func (controller *ScrapeController) createTaskStatusResponse(task *storage.Task) *response.TaskStatusResponse {
+	statusResponse := response.CreateTaskStatusResponse(task)
+	if position, queued := controller.service.GetQueuePosition(*task.Id); queued {
+		statusResponse.QueuePosition = &position
 	}
-	ctx.JSON(http.StatusOK, taskListItems)
+	return statusResponse
 }
 
 func (controller *ScrapeController) InterruptTask(ctx *gin.Context) {
@@ -72,36 +248,252 @@ func (controller *ScrapeController) InterruptTask(ctx *gin.Context) {
 		ctx.String(400, "invalid task id")
 		return
 	}
-	err = controller.service.InterruptTask(taskId)
+	err = controller.service.InterruptTask(authService.GetPrincipal(ctx), taskId)
+	if err != nil {
+		respondWithTaskControlError(ctx, err)
+		return
+	}
+}
+
+func (controller *ScrapeController) PauseTask(ctx *gin.Context) {
+	taskId, err := strconv.Atoi(ctx.Param("id"))
+	if err != nil {
+		ctx.String(400, "invalid task id")
+		return
+	}
+	err = controller.service.PauseTask(authService.GetPrincipal(ctx), taskId)
+	if err != nil {
+		respondWithTaskControlError(ctx, err)
+		return
+	}
+}
+
+func (controller *ScrapeController) ResumeTask(ctx *gin.Context) {
+	taskId, err := strconv.Atoi(ctx.Param("id"))
+	if err != nil {
+		ctx.String(400, "invalid task id")
+		return
+	}
+	err = controller.service.ResumeTask(authService.GetPrincipal(ctx), taskId)
+	if err != nil {
+		respondWithTaskControlError(ctx, err)
+		return
+	}
+}
+
+func (controller *ScrapeController) RetryTask(ctx *gin.Context) {
+	taskId, err := strconv.Atoi(ctx.Param("id"))
+	if err != nil {
+		ctx.String(400, "invalid task id")
+		return
+	}
+	newId, err := controller.service.RetryTask(authService.GetPrincipal(ctx), taskId)
+	if err != nil {
+		respondWithTaskControlError(ctx, err)
+		return
+	}
+	ctx.JSON(http.StatusOK, response.CreateAddTaskResponse(newId))
+}
+
+func (controller *ScrapeController) RecheckBrokenLinks(ctx *gin.Context) {
+	taskId, err := strconv.Atoi(ctx.Param("id"))
+	if err != nil {
+		ctx.String(400, "invalid task id")
+		return
+	}
+	err = controller.service.RecheckBrokenLinks(authService.GetPrincipal(ctx), taskId)
+	if err != nil {
+		respondWithTaskControlError(ctx, err)
+		return
+	}
+}
+
+func (controller *ScrapeController) GetLinkResults(ctx *gin.Context) {
+	taskId, err := strconv.Atoi(ctx.Param("id"))
+	if err != nil {
+		ctx.String(400, "invalid task id")
+		return
+	}
+	results, err := controller.service.GetLinkResults(authService.GetPrincipal(ctx), taskId)
+	if err != nil {
+		ctx.String(http.StatusNotFound, "task not found")
+		return
+	}
+	resultResponses := []*response.LinkResultResponse{}
+	for _, result := range results {
+		resultResponses = append(resultResponses, response.CreateLinkResultResponse(result))
+	}
+	ctx.JSON(http.StatusOK, resultResponses)
+}
+
+func (controller *ScrapeController) DeleteTask(ctx *gin.Context) {
+	taskId, err := strconv.Atoi(ctx.Param("id"))
+	if err != nil {
+		ctx.String(400, "invalid task id")
+		return
+	}
+	force := ctx.Query("force") == "true"
+	err = controller.service.DeleteTask(authService.GetPrincipal(ctx), taskId, force)
+	if err != nil {
+		respondWithTaskControlError(ctx, err)
+		return
+	}
+}
+
+func (controller *ScrapeController) BulkDeleteTasks(ctx *gin.Context) {
+	var body request.BulkDeleteTasksRequest
+	if err := ctx.ShouldBindJSON(&body); err != nil {
+		ctx.String(http.StatusBadRequest, "Could not parse request")
+		return
+	}
+	// An empty filter matches every task
+	if len(body.Statuses) == 0 && body.Host == "" && body.CreatedBefore == nil {
+		ctx.String(http.StatusBadRequest, "at least one of statuses, host or createdBefore is required")
+		return
+	}
+	filter := storage.TaskFilter{
+		Statuses:      body.Statuses,
+		Host:          body.Host,
+		CreatedBefore: body.CreatedBefore,
+	}
+	deleted, err := controller.service.DeleteTasks(authService.GetPrincipal(ctx), filter, body.Force)
 	if err != nil {
-		switch {
-		case errors.Is(err, scrapeService.ErrTaskInFinalState):
-			ctx.String(http.StatusBadRequest, "task already in final state")
-		case errors.Is(err, scrapeService.ErrInterruptAlreadySent):
-			ctx.String(http.StatusBadRequest, "interrupt already sent")
-		default:
-			ctx.String(http.StatusInternalServerError, "something went wrong")
+		log.Printf("error occurred when deleting tasks: %v", err)
+		ctx.String(http.StatusInternalServerError, "something went wrong")
+		return
+	}
+	ctx.JSON(http.StatusOK, response.CreateDeleteTasksResponse(deleted))
+}
+
+func respondWithTaskControlError(ctx *gin.Context, err error) {
+	ctx.String(taskControlError(err))
+}
+
+// taskControlError maps an error of controlling a task to the HTTP status and message returned to the client
+func taskControlError(err error) (int, string) {
+	switch {
+	case errors.Is(err, scrapeService.ErrTaskNotFound):
+		return http.StatusNotFound, "task not found"
+	case errors.Is(err, scrapeService.ErrTaskInFinalState):
+		return http.StatusBadRequest, "task already in final state"
+	case errors.Is(err, scrapeService.ErrInterruptAlreadySent):
+		return http.StatusBadRequest, "interrupt already sent"
+	case errors.Is(err, scrapeService.ErrPauseAlreadySent):
+		return http.StatusBadRequest, "pause already sent"
+	case errors.Is(err, scrapeService.ErrTaskAlreadyPaused):
+		return http.StatusBadRequest, "task already paused"
+	case errors.Is(err, scrapeService.ErrTaskNotPaused):
+		return http.StatusBadRequest, "task is not paused"
+	case errors.Is(err, scrapeService.ErrTaskNotFinished):
+		return http.StatusBadRequest, "task is not in final state"
+	case errors.Is(err, scrapeService.ErrNoBrokenLinks):
+		return http.StatusBadRequest, "task has no broken links"
+	case errors.Is(err, scrapeService.ErrTaskRunning):
+		return http.StatusConflict, "task is running"
+	default:
+		log.Printf("unexpected error occurred while controlling task: %v", err)
+		return http.StatusInternalServerError, "something went wrong"
+	}
+}
+
+// Activity streams the creation and status changes of all tasks visible to the user as server-sent events. Query
+// parameters status (can be repeated) and host limit the tasks to the matching ones
+func (controller *ScrapeController) Activity(ctx *gin.Context) {
+	filter := storage.TaskFilter{
+		Statuses: ctx.QueryArray("status"),
+		Host:     ctx.Query("host"),
+	}
+	done := ctx.Writer.CloseNotify()
+	data, notifyDone := controller.service.ListenForActivity(authService.GetPrincipal(ctx), filter)
+
+	// Headers are sent right away, so that the client knows the stream is open before the first change
+	ctx.Writer.Header().Set("Content-Type", "text/event-stream")
+	ctx.Writer.Header().Set("Cache-Control", "no-cache")
+	ctx.Status(http.StatusOK)
+	ctx.Writer.Flush()
+
+	ctx.Stream(func(w io.Writer) bool {
+		select {
+		case <-done:
+			// Client closed connection
+			close(notifyDone)
+			return false
+		case update, ok := <-data:
+			if !ok {
+				// Client did not keep up with the updates, it will reconnect
+				close(notifyDone)
+				return false
+			}
+			ctx.Render(-1, sse.Event{
+				Id:    strconv.FormatUint(update.Id, 10),
+				Event: "message",
+				Data:  controller.createTaskStatusResponse(&update.State),
+			})
+			return true
 		}
+	})
+}
+
+// Reconnection delay (in milliseconds) sent along with the final state, in case the client ignores the end event
+const finalStateRetry = 60 * 60 * 1000
+
+// Tells the client that the task is no longer running, so it should close the event source instead of reconnecting
+var endEvent = sse.Event{Event: "end", Data: ""}
+
+// Sends the state of the task, which is no longer running, followed by the end event. The state carries the ID of the
+// final event of the task, so a client, which already received it, gets 204 No Content on reconnection - this stops
+// the event source from reconnecting even if the end event was missed
+func (controller *ScrapeController) sendFinalState(ctx *gin.Context, taskId int, lastEventId uint64) {
+	finalEventId, found := controller.service.GetFinalEventId(taskId)
+	if found && lastEventId >= finalEventId {
+		ctx.Status(http.StatusNoContent)
 		return
 	}
+	task, err := controller.service.GetTask(authService.GetPrincipal(ctx), taskId)
+	if err != nil {
+		ctx.String(http.StatusNotFound, "task not found")
+		return
+	}
+	message := sse.Event{Event: "message", Data: controller.createTaskStatusResponse(task), Retry: finalStateRetry}
+	if found {
+		message.Id = strconv.FormatUint(finalEventId, 10)
+	}
+	ctx.Render(-1, message)
+	ctx.Render(-1, endEvent)
 }
 
+// Listen streams state updates of the task as server-sent events. Each event has an ID, so that a reconnecting
+// client, which sends the Last-Event-ID header, receives the updates it missed. If the delta query parameter is true,
+// only the first event carries the whole state - the following ones are "patch" events with a JSON merge patch
+// (RFC 7386) of the previous state. Once the task stops running, an "end" event is sent
 func (controller *ScrapeController) Listen(ctx *gin.Context) {
 	taskId, err := strconv.Atoi(ctx.Param("id"))
 	if err != nil {
 		ctx.String(400, "invalid task id")
 		return
 	}
+	delta, err := strconv.ParseBool(ctx.DefaultQuery("delta", "false"))
+	if err != nil {
+		ctx.String(http.StatusBadRequest, "invalid delta")
+		return
+	}
+	var lastEventId uint64
+	if value := ctx.GetHeader("Last-Event-ID"); value != "" {
+		lastEventId, err = strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			ctx.String(http.StatusBadRequest, "invalid last event id")
+			return
+		}
+	}
 	done := ctx.Writer.CloseNotify()
 
-	err, data, notifyDone := controller.service.RegisterListener(taskId)
+	err, data, notifyDone := controller.service.RegisterListener(authService.GetPrincipal(ctx), taskId, lastEventId)
 
 	if err != nil {
-		if err.Error() == "task already finished" {
-			task, _ := controller.service.GetTaskById(taskId)
-			ctx.SSEvent("message", response.CreateTaskStatusResponse(task))
-		} else if strings.HasPrefix(err.Error(), "no task found with id") {
-			ctx.String(400, "invalid task id")
+		if errors.Is(err, scrapeService.ErrTaskNotRunning) {
+			controller.sendFinalState(ctx, taskId, lastEventId)
+		} else if errors.Is(err, scrapeService.ErrTaskNotFound) {
+			ctx.String(http.StatusNotFound, "task not found")
 		} else {
 			log.Printf("unexpected error occurred while attempting to register listener for task: %s", err)
 			ctx.String(500, "unexpected error occurred")
@@ -109,6 +501,9 @@ func (controller *ScrapeController) Listen(ctx *gin.Context) {
 		return
 	}
 
+	// State last sent to the client, which patches are relative to
+	var previous *response.TaskStatusResponse
+
 	// Stream response
 	ctx.Stream(func(w io.Writer) bool {
 		for {
@@ -117,12 +512,25 @@ func (controller *ScrapeController) Listen(ctx *gin.Context) {
 				// Client closed connection
 				notifyDone <- struct{}{}
 				return false // False to indicate no more data should be sent
-			case task, ok := <-data:
+			case update, ok := <-data:
 				if !ok {
-					// No more data
+					// Task stopped running, no more data
+					ctx.Render(-1, endEvent)
 					return false
 				}
-				ctx.SSEvent("message", response.CreateTaskStatusResponse(&task))
+				state := controller.createTaskStatusResponse(&update.State)
+				message := sse.Event{Id: strconv.FormatUint(update.Id, 10), Event: "message", Data: state}
+				if delta && previous != nil {
+					// Whole state is sent if the patch can not be created
+					if statePatch, err := patch.CreateMergePatch(previous, state); err != nil {
+						log.Printf("could not create patch of task state: %v", err)
+					} else {
+						message.Event = "patch"
+						message.Data = statePatch
+					}
+				}
+				previous = state
+				ctx.Render(-1, message)
 				return true
 			}
 		}
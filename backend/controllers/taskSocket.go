@@ -0,0 +1,267 @@
+package authController
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"github.com/martynasd123/golang-scraper/models/principal"
+	request "github.com/martynasd123/golang-scraper/models/request"
+	response "github.com/martynasd123/golang-scraper/models/response"
+	"github.com/martynasd123/golang-scraper/models/role"
+	authService "github.com/martynasd123/golang-scraper/services/auth"
+	scrapeService "github.com/martynasd123/golang-scraper/services/scrape"
+	"github.com/martynasd123/golang-scraper/storage"
+	"github.com/martynasd123/golang-scraper/utils/event"
+	"golang.org/x/net/websocket"
+)
+
+// Socket serves task updates over a WebSocket, for clients which can not use server-sent events. A single socket can
+// subscribe to any number of tasks. Client sends request.TaskSocketMessage messages:
+//
+//	subscribe: start receiving updates of the task, replaying the ones after lastEventId if set
+//	unsubscribe: stop receiving updates of the task
+//	interrupt: interrupt the task, requires permission to manage tasks
+//
+// and receives response.TaskSocketMessage messages - updates of the subscribed tasks, and an acknowledgement or an
+// error for each message sent
+func (controller *ScrapeController) Socket(ctx *gin.Context) {
+	actor := authService.GetPrincipal(ctx)
+	canManage := authService.HasPermission(ctx, role.PermissionManageTasks)
+	server := websocket.Server{
+		// Origin is already checked by the CheckOrigin middleware. Clients other than browsers may not send it at all
+		Handshake: func(*websocket.Config, *http.Request) error {
+			return nil
+		},
+		Handler: func(conn *websocket.Conn) {
+			socket := &taskSocket{
+				controller:    controller,
+				conn:          conn,
+				actor:         actor,
+				canManage:     canManage,
+				outgoing:      make(chan *response.TaskSocketMessage),
+				closed:        make(chan struct{}),
+				writerDone:    make(chan struct{}),
+				subscriptions: make(map[int]chan struct{}),
+			}
+			socket.serve()
+		},
+	}
+	server.ServeHTTP(ctx.Writer, ctx.Request)
+}
+
+type taskSocket struct {
+	controller *ScrapeController
+	conn       *websocket.Conn
+	actor      principal.Principal
+	canManage  bool
+	// Connection does not support concurrent writes, so all messages are written by a single goroutine
+	outgoing chan *response.TaskSocketMessage
+	// Closed when the connection is closed
+	closed chan struct{}
+	// Closed when the writing goroutine stops, e.g. because writing failed
+	writerDone chan struct{}
+
+	mu sync.Mutex
+	// Channels, which stop forwarding the updates of the subscribed tasks when closed
+	subscriptions map[int]chan struct{}
+}
+
+func (socket *taskSocket) serve() {
+	go socket.write()
+	defer func() {
+		close(socket.closed)
+		socket.unsubscribeAll()
+		socket.conn.Close()
+	}()
+	for {
+		var data []byte
+		if err := websocket.Message.Receive(socket.conn, &data); err != nil {
+			// Client closed the connection
+			return
+		}
+		var message request.TaskSocketMessage
+		if err := json.Unmarshal(data, &message); err != nil {
+			socket.send(&response.TaskSocketMessage{Type: response.TaskSocketError, Error: "invalid message"})
+			continue
+		}
+		if err := socket.handle(&message); err != nil {
+			socket.send(&response.TaskSocketMessage{
+				Type:      response.TaskSocketError,
+				RequestId: message.RequestId,
+				TaskId:    message.TaskId,
+				Error:     err.Error(),
+			})
+		}
+	}
+}
+
+func (socket *taskSocket) write() {
+	defer close(socket.writerDone)
+	for {
+		select {
+		case <-socket.closed:
+			return
+		case message := <-socket.outgoing:
+			if err := websocket.JSON.Send(socket.conn, message); err != nil {
+				// Reading fails as well once the connection is closed, which stops the socket
+				socket.conn.Close()
+				return
+			}
+		}
+	}
+}
+
+func (socket *taskSocket) acknowledge(message *request.TaskSocketMessage) {
+	socket.send(&response.TaskSocketMessage{
+		Type:      response.TaskSocketAck,
+		RequestId: message.RequestId,
+		TaskId:    message.TaskId,
+	})
+}
+
+// send queues the message for writing. Message is dropped if the connection is already closed, or writing has failed.
+// Must not be called while holding mu, since the writer may be waiting for the client
+func (socket *taskSocket) send(message *response.TaskSocketMessage) {
+	select {
+	case socket.outgoing <- message:
+	case <-socket.closed:
+	case <-socket.writerDone:
+	}
+}
+
+// handle performs the action requested by the message and acknowledges it. Returns the error to be sent to the client
+func (socket *taskSocket) handle(message *request.TaskSocketMessage) error {
+	switch message.Type {
+	case request.TaskSocketSubscribe:
+		return socket.subscribe(message)
+	case request.TaskSocketUnsubscribe:
+		if err := socket.unsubscribe(message.TaskId); err != nil {
+			return err
+		}
+		socket.acknowledge(message)
+		return nil
+	case request.TaskSocketInterrupt:
+		if !socket.canManage {
+			return errors.New("forbidden")
+		}
+		if err := socket.controller.service.InterruptTask(socket.actor, message.TaskId); err != nil {
+			_, errorMessage := taskControlError(err)
+			return errors.New(errorMessage)
+		}
+		socket.acknowledge(message)
+		return nil
+	default:
+		return errors.New("unknown message type")
+	}
+}
+
+// subscribe starts forwarding the updates of the task. Acknowledgement is sent before the first update
+func (socket *taskSocket) subscribe(message *request.TaskSocketMessage) error {
+	taskId := message.TaskId
+	// Subscription is recorded before the listener is registered, so that the task can not be subscribed to twice. It
+	// may be stopped by the client in the meantime - forward notices that right away
+	stop := make(chan struct{})
+	socket.mu.Lock()
+	if _, exists := socket.subscriptions[taskId]; exists {
+		socket.mu.Unlock()
+		return errors.New("already subscribed")
+	}
+	socket.subscriptions[taskId] = stop
+	socket.mu.Unlock()
+
+	err, data, done := socket.controller.service.RegisterListener(socket.actor, taskId, message.LastEventId)
+	if err != nil {
+		socket.removeSubscription(taskId, stop)
+		if errors.Is(err, scrapeService.ErrTaskNotRunning) {
+			// Same as the listen endpoint, only the final state is sent
+			task, err := socket.controller.service.GetTask(socket.actor, taskId)
+			if err != nil {
+				return errors.New("task not found")
+			}
+			finalEventId, _ := socket.controller.service.GetFinalEventId(taskId)
+			socket.acknowledge(message)
+			socket.sendUpdate(taskId, event.Event[storage.Task]{Id: finalEventId, State: *task})
+			socket.send(&response.TaskSocketMessage{Type: response.TaskSocketEnd, TaskId: taskId})
+			return nil
+		}
+		if errors.Is(err, scrapeService.ErrTaskNotFound) {
+			return errors.New("task not found")
+		}
+		log.Printf("unexpected error occurred while attempting to register listener for task: %s", err)
+		return errors.New("something went wrong")
+	}
+
+	socket.acknowledge(message)
+	go socket.forward(taskId, data, done, stop)
+	return nil
+}
+
+// Removes the subscription, unless it was already replaced or stopped
+func (socket *taskSocket) removeSubscription(taskId int, stop <-chan struct{}) {
+	socket.mu.Lock()
+	defer socket.mu.Unlock()
+	if socket.subscriptions[taskId] == stop {
+		delete(socket.subscriptions, taskId)
+	}
+}
+
+// forward sends the updates of the task to the client until the task ends or the subscription is stopped
+func (socket *taskSocket) forward(
+	taskId int,
+	data <-chan event.Event[storage.Task],
+	done chan<- struct{},
+	stop <-chan struct{},
+) {
+	defer close(done)
+	for {
+		select {
+		case <-stop:
+			done <- struct{}{}
+			// Broadcaster closes the channel once it has unregistered the listener
+			for range data {
+			}
+			return
+		case update, ok := <-data:
+			if !ok {
+				socket.removeSubscription(taskId, stop)
+				socket.send(&response.TaskSocketMessage{Type: response.TaskSocketEnd, TaskId: taskId})
+				return
+			}
+			socket.sendUpdate(taskId, update)
+		}
+	}
+}
+
+func (socket *taskSocket) sendUpdate(taskId int, update event.Event[storage.Task]) {
+	socket.send(&response.TaskSocketMessage{
+		Type:    response.TaskSocketUpdate,
+		TaskId:  taskId,
+		EventId: update.Id,
+		Data:    socket.controller.createTaskStatusResponse(&update.State),
+	})
+}
+
+func (socket *taskSocket) unsubscribe(taskId int) error {
+	socket.mu.Lock()
+	defer socket.mu.Unlock()
+	stop, exists := socket.subscriptions[taskId]
+	if !exists {
+		return errors.New("not subscribed")
+	}
+	delete(socket.subscriptions, taskId)
+	close(stop)
+	return nil
+}
+
+func (socket *taskSocket) unsubscribeAll() {
+	socket.mu.Lock()
+	defer socket.mu.Unlock()
+	for taskId, stop := range socket.subscriptions {
+		delete(socket.subscriptions, taskId)
+		close(stop)
+	}
+}
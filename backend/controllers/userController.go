@@ -0,0 +1,168 @@
+package authController
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	request "github.com/martynasd123/golang-scraper/models/request"
+	response "github.com/martynasd123/golang-scraper/models/response"
+	"github.com/martynasd123/golang-scraper/models/role"
+	authService "github.com/martynasd123/golang-scraper/services/auth"
+)
+
+var passwordPolicyMessage = fmt.Sprintf(
+	"password must be %d to %d characters long and contain at least one letter and one digit",
+	authService.MinPasswordLength,
+	authService.MaxPasswordLength,
+)
+
+type UserController struct {
+	authService *authService.AuthService
+}
+
+func CreateUserController(service *authService.AuthService) *UserController {
+	return &UserController{authService: service}
+}
+
+func (controller *UserController) GetAllUsers(ctx *gin.Context) {
+	users := controller.authService.GetAllUsers()
+	res := make([]*response.UserResponse, len(users))
+	for i, user := range users {
+		res[i] = response.CreateUserResponse(user)
+	}
+	ctx.JSON(http.StatusOK, res)
+}
+
+func (controller *UserController) CreateUser(ctx *gin.Context) {
+	var body request.CreateUserRequest
+	if err := ctx.ShouldBindJSON(&body); err != nil {
+		ctx.String(http.StatusBadRequest, "Could not parse request")
+		return
+	}
+	if body.Username == "" || body.Password == "" {
+		ctx.String(http.StatusBadRequest, "username and password are required")
+		return
+	}
+	userRole, err := role.Parse(body.Role)
+	if err != nil {
+		ctx.String(http.StatusBadRequest, "invalid role")
+		return
+	}
+	err = controller.authService.CreateUser(authService.GetPrincipal(ctx), body.Username, body.Password, userRole)
+	if err != nil {
+		if errors.Is(err, authService.ErrUserAlreadyExists) {
+			ctx.String(http.StatusConflict, "user already exists")
+			return
+		}
+		if errors.Is(err, authService.ErrPasswordPolicy) {
+			ctx.String(http.StatusBadRequest, passwordPolicyMessage)
+			return
+		}
+		log.Printf("error occurred when creating user: %v", err)
+		ctx.String(http.StatusInternalServerError, "something went wrong")
+		return
+	}
+	ctx.Status(http.StatusCreated)
+}
+
+func (controller *UserController) UpdateUserRole(ctx *gin.Context) {
+	var body request.UpdateUserRoleRequest
+	if err := ctx.ShouldBindJSON(&body); err != nil {
+		ctx.String(http.StatusBadRequest, "Could not parse request")
+		return
+	}
+	userRole, err := role.Parse(body.Role)
+	if err != nil {
+		ctx.String(http.StatusBadRequest, "invalid role")
+		return
+	}
+	err = controller.authService.SetUserRole(authService.GetPrincipal(ctx), ctx.Param("username"), userRole)
+	if err != nil {
+		if errors.Is(err, authService.ErrUserNotExist) {
+			ctx.String(http.StatusNotFound, "user not found")
+			return
+		}
+		log.Printf("error occurred when updating user role: %v", err)
+		ctx.String(http.StatusInternalServerError, "something went wrong")
+		return
+	}
+	ctx.Status(http.StatusOK)
+}
+
+func (controller *UserController) DisableUser(ctx *gin.Context) {
+	controller.setUserDisabled(ctx, true)
+}
+
+func (controller *UserController) EnableUser(ctx *gin.Context) {
+	controller.setUserDisabled(ctx, false)
+}
+
+func (controller *UserController) setUserDisabled(ctx *gin.Context, disabled bool) {
+	username := ctx.Param("username")
+	if username == authService.GetPrincipal(ctx).Username {
+		ctx.String(http.StatusBadRequest, "can not disable own account")
+		return
+	}
+	err := controller.authService.SetUserDisabled(authService.GetPrincipal(ctx), username, disabled)
+	if err != nil {
+		if errors.Is(err, authService.ErrUserNotExist) {
+			ctx.String(http.StatusNotFound, "user not found")
+			return
+		}
+		log.Printf("error occurred when disabling user: %v", err)
+		ctx.String(http.StatusInternalServerError, "something went wrong")
+		return
+	}
+	ctx.Status(http.StatusOK)
+}
+
+func (controller *UserController) DeleteUser(ctx *gin.Context) {
+	username := ctx.Param("username")
+	if username == authService.GetPrincipal(ctx).Username {
+		ctx.String(http.StatusBadRequest, "can not delete own account")
+		return
+	}
+	err := controller.authService.DeleteUser(authService.GetPrincipal(ctx), username)
+	if err != nil {
+		if errors.Is(err, authService.ErrUserNotExist) {
+			ctx.String(http.StatusNotFound, "user not found")
+			return
+		}
+		log.Printf("error occurred when deleting user: %v", err)
+		ctx.String(http.StatusInternalServerError, "something went wrong")
+		return
+	}
+	ctx.Status(http.StatusNoContent)
+}
+
+func (controller *UserController) UnlockUser(ctx *gin.Context) {
+	err := controller.authService.UnlockUser(authService.GetPrincipal(ctx), ctx.Param("username"))
+	if err != nil {
+		if errors.Is(err, authService.ErrUserNotExist) {
+			ctx.String(http.StatusNotFound, "user not found")
+			return
+		}
+		log.Printf("error occurred when unlocking user: %v", err)
+		ctx.String(http.StatusInternalServerError, "something went wrong")
+		return
+	}
+	ctx.Status(http.StatusOK)
+}
+
+// ResetSecondFactor removes the second factor of a user, who lost access to it
+func (controller *UserController) ResetSecondFactor(ctx *gin.Context) {
+	err := controller.authService.ResetSecondFactor(authService.GetPrincipal(ctx), ctx.Param("username"))
+	if err != nil {
+		if errors.Is(err, authService.ErrUserNotExist) {
+			ctx.String(http.StatusNotFound, "user not found")
+			return
+		}
+		log.Printf("error occurred when resetting second factor: %v", err)
+		ctx.String(http.StatusInternalServerError, "something went wrong")
+		return
+	}
+	ctx.Status(http.StatusOK)
+}
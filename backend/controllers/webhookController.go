@@ -0,0 +1,108 @@
+package authController
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	request "github.com/martynasd123/golang-scraper/models/request"
+	response "github.com/martynasd123/golang-scraper/models/response"
+	authService "github.com/martynasd123/golang-scraper/services/auth"
+	webhookService "github.com/martynasd123/golang-scraper/services/webhook"
+)
+
+type WebhookController struct {
+	service *webhookService.WebhookService
+}
+
+func CreateWebhookController(service *webhookService.WebhookService) *WebhookController {
+	return &WebhookController{service: service}
+}
+
+func (controller *WebhookController) GetWebhooks(ctx *gin.Context) {
+	webhooks := controller.service.GetWebhooks(authService.GetPrincipal(ctx))
+	res := make([]*response.WebhookResponse, len(webhooks))
+	for i, webhook := range webhooks {
+		res[i] = response.CreateWebhookResponse(webhook)
+	}
+	ctx.JSON(http.StatusOK, res)
+}
+
+func (controller *WebhookController) CreateWebhook(ctx *gin.Context) {
+	var body request.CreateWebhookRequest
+	if err := ctx.ShouldBindJSON(&body); err != nil {
+		ctx.String(http.StatusBadRequest, "Could not parse request")
+		return
+	}
+	webhook, err := controller.service.CreateWebhook(authService.GetPrincipal(ctx), webhookService.WebhookOptions{
+		Url:                  body.Url,
+		Events:               body.Events,
+		BrokenLinksThreshold: body.BrokenLinksThreshold,
+		TaskId:               body.TaskId,
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, webhookService.ErrInvalidWebhookUrl):
+			ctx.String(http.StatusBadRequest, "url must be an absolute http or https URL")
+		case errors.Is(err, webhookService.ErrHostNotResolved):
+			ctx.String(http.StatusBadRequest, "host of the url could not be resolved")
+		case errors.Is(err, webhookService.ErrForbiddenAddress):
+			ctx.String(http.StatusBadRequest, "url must not point to a loopback, link-local, private or unspecified address")
+		case errors.Is(err, webhookService.ErrInvalidWebhookEvents):
+			ctx.String(http.StatusBadRequest, "events must be some of finished, error, interrupted and broken_links")
+		case errors.Is(err, webhookService.ErrInvalidThreshold):
+			ctx.String(http.StatusBadRequest, "broken links threshold must not be negative")
+		case errors.Is(err, webhookService.ErrWebhookTaskNotFound):
+			ctx.String(http.StatusNotFound, "task not found")
+		default:
+			log.Printf("error occurred when creating webhook: %v", err)
+			ctx.String(http.StatusInternalServerError, "something went wrong")
+		}
+		return
+	}
+	ctx.JSON(http.StatusCreated, response.CreateCreatedWebhookResponse(webhook))
+}
+
+func (controller *WebhookController) DeleteWebhook(ctx *gin.Context) {
+	id, err := strconv.Atoi(ctx.Param("id"))
+	if err != nil {
+		ctx.String(http.StatusBadRequest, "invalid webhook id")
+		return
+	}
+	err = controller.service.DeleteWebhook(authService.GetPrincipal(ctx), id)
+	if err != nil {
+		if errors.Is(err, webhookService.ErrWebhookNotFound) {
+			ctx.String(http.StatusNotFound, "webhook not found")
+			return
+		}
+		log.Printf("error occurred when deleting webhook: %v", err)
+		ctx.String(http.StatusInternalServerError, "something went wrong")
+		return
+	}
+	ctx.Status(http.StatusNoContent)
+}
+
+func (controller *WebhookController) GetDeliveries(ctx *gin.Context) {
+	id, err := strconv.Atoi(ctx.Param("id"))
+	if err != nil {
+		ctx.String(http.StatusBadRequest, "invalid webhook id")
+		return
+	}
+	deliveries, err := controller.service.GetDeliveries(authService.GetPrincipal(ctx), id)
+	if err != nil {
+		if errors.Is(err, webhookService.ErrWebhookNotFound) {
+			ctx.String(http.StatusNotFound, "webhook not found")
+			return
+		}
+		log.Printf("error occurred when retrieving webhook deliveries: %v", err)
+		ctx.String(http.StatusInternalServerError, "something went wrong")
+		return
+	}
+	res := make([]*response.WebhookDeliveryResponse, len(deliveries))
+	for i, delivery := range deliveries {
+		res[i] = response.CreateWebhookDeliveryResponse(delivery)
+	}
+	ctx.JSON(http.StatusOK, res)
+}
@@ -0,0 +1,19 @@
+package principal
+
+// Principal identifies the user, on whose behalf an action is performed
+type Principal struct {
+	Username string
+	// Principal can see and control tasks of all users
+	AllTasks bool
+	// Address and user agent of the client, which sent the request. Recorded in the audit log
+	IP        string
+	UserAgent string
+}
+
+// System is the principal of actions, which are not performed on behalf of a user (e.g. scheduled jobs)
+var System = Principal{Username: "system", AllTasks: true}
+
+// CanAccess checks whether a resource owned by the given user is visible to the principal
+func (principal Principal) CanAccess(owner string) bool {
+	return principal.AllTasks || principal.Username == owner
+}
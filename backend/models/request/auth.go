@@ -1,5 +1,7 @@
 package scrape
 
+import "time"
+
 type AuthRequest struct {
 	Username string `json:"username"`
 	Password string `json:"password"`
@@ -9,6 +11,34 @@ type RefreshTokenRequest struct {
 	Username string `json:"username"`
 }
 
-type LogOutRequest struct {
+type CreateUserRequest struct {
 	Username string `json:"username"`
+	Password string `json:"password"`
+	Role     string `json:"role"`
+}
+
+type UpdateUserRoleRequest struct {
+	Role string `json:"role"`
+}
+
+type ChangePasswordRequest struct {
+	OldPassword string `json:"oldPassword"`
+	NewPassword string `json:"newPassword"`
+}
+
+type CreateApiKeyRequest struct {
+	Name   string   `json:"name"`
+	Scopes []string `json:"scopes"`
+	// Key never expires if not set
+	ExpiresAt *time.Time `json:"expiresAt"`
+}
+
+type VerifySecondFactorRequest struct {
+	Challenge string `json:"challenge"`
+	// TOTP code or one of the recovery codes
+	Code string `json:"code"`
+}
+
+type ConfirmSecondFactorRequest struct {
+	Code string `json:"code"`
 }
@@ -1,5 +1,36 @@
 package scrape
 
+import "time"
+
 type AddTaskRequest struct {
-	Link string `json:"link"`
-}
\ No newline at end of file
+	Link     string `json:"link"`
+	Priority *int   `json:"priority"`
+}
+
+type UpdateConcurrencyRequest struct {
+	Workers int `json:"workers"`
+}
+
+type BulkDeleteTasksRequest struct {
+	Statuses      []string   `json:"statuses"`
+	Host          string     `json:"host"`
+	CreatedBefore *time.Time `json:"createdBefore"`
+	// Running tasks are interrupted and deleted as well
+	Force bool `json:"force"`
+}
+
+// Types of messages sent by the client through the task socket
+const (
+	TaskSocketSubscribe   = "subscribe"
+	TaskSocketUnsubscribe = "unsubscribe"
+	TaskSocketInterrupt   = "interrupt"
+)
+
+type TaskSocketMessage struct {
+	Type string `json:"type"`
+	// Echoed in the acknowledgement or error, so that the client can match them to the message. Optional
+	RequestId string `json:"requestId"`
+	TaskId    int    `json:"taskId"`
+	// ID of the last update received before reconnecting. Only used when subscribing
+	LastEventId uint64 `json:"lastEventId"`
+}
@@ -0,0 +1,11 @@
+package scrape
+
+type CreateWebhookRequest struct {
+	Url string `json:"url"`
+	// finished, error, interrupted or broken_links
+	Events []string `json:"events"`
+	// Minimal number of inaccessible links, which triggers the broken_links event. 1 if not set
+	BrokenLinksThreshold int `json:"brokenLinksThreshold"`
+	// If set, the webhook is only notified about this task, instead of the other webhooks of the task owner
+	TaskId *int `json:"taskId"`
+}
@@ -0,0 +1,45 @@
+package scrape
+
+import (
+	"time"
+
+	. "github.com/martynasd123/golang-scraper/storage"
+)
+
+type ApiKeyResponse struct {
+	Id         int        `json:"id"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"`
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	ExpiresAt  *time.Time `json:"expiresAt"`
+	LastUsedAt *time.Time `json:"lastUsedAt"`
+	RevokedAt  *time.Time `json:"revokedAt"`
+}
+
+func CreateApiKeyResponse(key *ApiKey) *ApiKeyResponse {
+	scopes := make([]string, len(key.Scopes))
+	for i, scope := range key.Scopes {
+		scopes[i] = string(scope)
+	}
+	return &ApiKeyResponse{
+		Id:         *key.Id,
+		Name:       key.Name,
+		Prefix:     key.Prefix,
+		Scopes:     scopes,
+		CreatedAt:  key.CreatedAt,
+		ExpiresAt:  key.ExpiresAt,
+		LastUsedAt: key.LastUsedAt,
+		RevokedAt:  key.RevokedAt,
+	}
+}
+
+// CreatedApiKeyResponse is returned once, when the key is created. The key can not be retrieved later
+type CreatedApiKeyResponse struct {
+	ApiKeyResponse
+	Key string `json:"key"`
+}
+
+func CreateCreatedApiKeyResponse(key string, apiKey *ApiKey) *CreatedApiKeyResponse {
+	return &CreatedApiKeyResponse{ApiKeyResponse: *CreateApiKeyResponse(apiKey), Key: key}
+}
@@ -0,0 +1,48 @@
+package scrape
+
+import (
+	"time"
+
+	. "github.com/martynasd123/golang-scraper/storage"
+)
+
+type AuditEventResponse struct {
+	Id        int       `json:"id"`
+	Actor     string    `json:"actor"`
+	Action    string    `json:"action"`
+	Target    string    `json:"target"`
+	IP        string    `json:"ip"`
+	UserAgent string    `json:"userAgent"`
+	Outcome   string    `json:"outcome"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+type AuditEventListResponse struct {
+	Items []*AuditEventResponse `json:"items"`
+	// Cursor, which is to be passed to retrieve the next page. Nil if there are no more events
+	NextCursor *string `json:"nextCursor"`
+}
+
+func CreateAuditEventResponse(event *AuditEvent) *AuditEventResponse {
+	return &AuditEventResponse{
+		Id:        *event.Id,
+		Actor:     event.Actor,
+		Action:    event.Action,
+		Target:    event.Target,
+		IP:        event.IP,
+		UserAgent: event.UserAgent,
+		Outcome:   event.Outcome,
+		Timestamp: event.Timestamp,
+	}
+}
+
+func CreateAuditEventListResponse(page *AuditPage) *AuditEventListResponse {
+	response := &AuditEventListResponse{Items: make([]*AuditEventResponse, len(page.Events))}
+	for i, event := range page.Events {
+		response.Items[i] = CreateAuditEventResponse(event)
+	}
+	if page.NextCursor != "" {
+		response.NextCursor = &page.NextCursor
+	}
+	return response
+}
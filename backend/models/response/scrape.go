@@ -1,6 +1,9 @@
 package scrape
 
 import (
+	"time"
+
+	"github.com/martynasd123/golang-scraper/services/scrape/bus"
 	. "github.com/martynasd123/golang-scraper/storage"
 )
 
@@ -25,6 +28,11 @@ type TaskStatusResponse struct {
 	CrawledLinks      int     `json:"crawledLinks"`
 	LoginFormPresent  *bool   `json:"loginFormPresent"`
 	Error             *string `json:"error"`
+	Priority          int     `json:"priority"`
+	QueuePosition     *int    `json:"queuePosition"`
+	RetryOf           *int    `json:"retryOf"`
+	// Set while the broken links of the finished task are being re-checked
+	Rechecking bool `json:"rechecking"`
 }
 
 func CreateTaskStatusResponse(task *Task) *TaskStatusResponse {
@@ -41,6 +49,9 @@ func CreateTaskStatusResponse(task *Task) *TaskStatusResponse {
 	response.LoginFormPresent = task.LoginFormPresent
 	response.CrawledLinks = task.CrawledLinks
 	response.Error = task.Error
+	response.Priority = task.Priority
+	response.RetryOf = task.RetryOf
+	response.Rechecking = task.Rechecking
 	return response
 }
 
@@ -54,6 +65,23 @@ type TaskListItem struct {
 	Error             *string `json:"error"`
 }
 
+type TaskListResponse struct {
+	Items []*TaskListItem `json:"items"`
+	// Cursor, which is to be passed to retrieve the next page. Nil if there are no more tasks
+	NextCursor *string `json:"nextCursor"`
+}
+
+func CreateTaskListResponse(page *TaskPage) *TaskListResponse {
+	response := &TaskListResponse{Items: []*TaskListItem{}}
+	for _, task := range page.Tasks {
+		response.Items = append(response.Items, CreateTaskListItemResponse(task))
+	}
+	if page.NextCursor != "" {
+		response.NextCursor = &page.NextCursor
+	}
+	return response
+}
+
 func CreateTaskListItemResponse(task *Task) *TaskListItem {
 	response := &TaskListItem{}
 	response.Id = task.Id
@@ -65,3 +93,93 @@ func CreateTaskListItemResponse(task *Task) *TaskListItem {
 	response.Status = task.Status
 	return response
 }
+
+type ConcurrencySettingsResponse struct {
+	Workers     int `json:"workers"`
+	QueuedTasks int `json:"queuedTasks"`
+}
+
+func CreateConcurrencySettingsResponse(workers int, queuedTasks int) *ConcurrencySettingsResponse {
+	return &ConcurrencySettingsResponse{Workers: workers, QueuedTasks: queuedTasks}
+}
+
+type WorkerResponse struct {
+	Id       string `json:"id"`
+	Hostname string `json:"hostname"`
+	// Number of tasks the worker processes concurrently
+	Capacity int `json:"capacity"`
+	// IDs of the tasks the worker is processing
+	Tasks      []int     `json:"tasks"`
+	Healthy    bool      `json:"healthy"`
+	StartedAt  time.Time `json:"startedAt"`
+	ReportedAt time.Time `json:"reportedAt"`
+}
+
+func CreateWorkerResponse(status *bus.WorkerStatus, now time.Time) *WorkerResponse {
+	return &WorkerResponse{
+		Id:         status.Id,
+		Hostname:   status.Hostname,
+		Capacity:   status.Capacity,
+		Tasks:      status.Tasks,
+		Healthy:    status.IsHealthy(now),
+		StartedAt:  status.StartedAt,
+		ReportedAt: status.ReportedAt,
+	}
+}
+
+type UpdateMetricsResponse struct {
+	// Task updates dropped, because listeners did not keep up with them
+	DroppedUpdates uint64 `json:"droppedUpdates"`
+	// Listeners disconnected, because they did not keep up with the updates
+	DisconnectedListeners uint64 `json:"disconnectedListeners"`
+}
+
+func CreateUpdateMetricsResponse(droppedUpdates uint64, disconnectedListeners uint64) *UpdateMetricsResponse {
+	return &UpdateMetricsResponse{DroppedUpdates: droppedUpdates, DisconnectedListeners: disconnectedListeners}
+}
+
+type LinkResultResponse struct {
+	Link           string    `json:"link"`
+	Status         int       `json:"status"`
+	TransportError bool      `json:"transportError"`
+	Accessible     bool      `json:"accessible"`
+	CrawledAt      time.Time `json:"crawledAt"`
+}
+
+func CreateLinkResultResponse(result *LinkResult) *LinkResultResponse {
+	return &LinkResultResponse{
+		Link:           result.Link.String(),
+		Status:         result.Status,
+		TransportError: result.TransportError,
+		Accessible:     result.IsAccessible(),
+		CrawledAt:      result.CrawledAt,
+	}
+}
+
+type DeleteTasksResponse struct {
+	Deleted int `json:"deleted"`
+}
+
+func CreateDeleteTasksResponse(deleted int) *DeleteTasksResponse {
+	return &DeleteTasksResponse{Deleted: deleted}
+}
+
+// Types of messages sent by the server through the task socket
+const (
+	// State of a subscribed task, same as sent by the listen endpoint
+	TaskSocketUpdate = "update"
+	// No more updates of the task will follow
+	TaskSocketEnd = "end"
+	// Client message was handled successfully
+	TaskSocketAck   = "ack"
+	TaskSocketError = "error"
+)
+
+type TaskSocketMessage struct {
+	Type      string              `json:"type"`
+	RequestId string              `json:"requestId,omitempty"`
+	TaskId    int                 `json:"taskId"`
+	EventId   uint64              `json:"eventId,omitempty"`
+	Data      *TaskStatusResponse `json:"data,omitempty"`
+	Error     string              `json:"error,omitempty"`
+}
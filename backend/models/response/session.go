@@ -0,0 +1,28 @@
+package scrape
+
+import (
+	"time"
+
+	. "github.com/martynasd123/golang-scraper/storage"
+)
+
+type SessionResponse struct {
+	Id         int       `json:"id"`
+	UserAgent  string    `json:"userAgent"`
+	IP         string    `json:"ip"`
+	CreatedAt  time.Time `json:"createdAt"`
+	LastSeenAt time.Time `json:"lastSeenAt"`
+	// Whether the request was made in this session
+	Current bool `json:"current"`
+}
+
+func CreateSessionResponse(session *Session, current bool) *SessionResponse {
+	return &SessionResponse{
+		Id:         *session.Id,
+		UserAgent:  session.UserAgent,
+		IP:         session.IP,
+		CreatedAt:  session.CreatedAt,
+		LastSeenAt: session.LastSeenAt,
+		Current:    current,
+	}
+}
@@ -0,0 +1,21 @@
+package scrape
+
+import . "github.com/martynasd123/golang-scraper/storage"
+
+type UserResponse struct {
+	Username string `json:"username"`
+	Role     string `json:"role"`
+	Disabled bool   `json:"disabled"`
+	// Whether the user has to enter a TOTP code after the password
+	TwoFactorEnabled bool `json:"twoFactorEnabled"`
+}
+
+func CreateUserResponse(user *User) *UserResponse {
+	return &UserResponse{
+		Username: user.Username,
+		Role:     string(user.Role),
+		Disabled: user.Disabled,
+
+		TwoFactorEnabled: user.HasSecondFactor(),
+	}
+}
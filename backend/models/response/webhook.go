@@ -0,0 +1,73 @@
+package scrape
+
+import (
+	"slices"
+	"time"
+
+	. "github.com/martynasd123/golang-scraper/storage"
+)
+
+type WebhookResponse struct {
+	Id                   int       `json:"id"`
+	Url                  string    `json:"url"`
+	Events               []string  `json:"events"`
+	BrokenLinksThreshold int       `json:"brokenLinksThreshold"`
+	TaskId               *int      `json:"taskId"`
+	CreatedAt            time.Time `json:"createdAt"`
+}
+
+func CreateWebhookResponse(webhook *Webhook) *WebhookResponse {
+	return &WebhookResponse{
+		Id:                   *webhook.Id,
+		Url:                  webhook.Url,
+		Events:               slices.Clone(webhook.Events),
+		BrokenLinksThreshold: webhook.BrokenLinksThreshold,
+		TaskId:               webhook.TaskId,
+		CreatedAt:            webhook.CreatedAt,
+	}
+}
+
+// CreatedWebhookResponse is returned once, when the webhook is created. The secret can not be retrieved later
+type CreatedWebhookResponse struct {
+	WebhookResponse
+	Secret string `json:"secret"`
+}
+
+func CreateCreatedWebhookResponse(webhook *Webhook) *CreatedWebhookResponse {
+	return &CreatedWebhookResponse{WebhookResponse: *CreateWebhookResponse(webhook), Secret: webhook.Secret}
+}
+
+type WebhookDeliveryResponse struct {
+	Id         int       `json:"id"`
+	EventId    string    `json:"eventId"`
+	Event      string    `json:"event"`
+	TaskId     int       `json:"taskId"`
+	Attempt    int       `json:"attempt"`
+	Success    bool      `json:"success"`
+	StatusCode int       `json:"statusCode"`
+	Error      *string   `json:"error"`
+	Timestamp  time.Time `json:"timestamp"`
+}
+
+func CreateWebhookDeliveryResponse(delivery *WebhookDelivery) *WebhookDeliveryResponse {
+	return &WebhookDeliveryResponse{
+		Id:         *delivery.Id,
+		EventId:    delivery.EventId,
+		Event:      delivery.Event,
+		TaskId:     delivery.TaskId,
+		Attempt:    delivery.Attempt,
+		Success:    delivery.Succeeded(),
+		StatusCode: delivery.StatusCode,
+		Error:      delivery.Error,
+		Timestamp:  delivery.Timestamp,
+	}
+}
+
+// WebhookPayload is the body of the requests sent to webhooks
+type WebhookPayload struct {
+	// Same for all attempts to deliver the event, so that the receiver can ignore duplicates
+	Id        string              `json:"id"`
+	Event     string              `json:"event"`
+	Timestamp time.Time           `json:"timestamp"`
+	Task      *TaskStatusResponse `json:"task"`
+}
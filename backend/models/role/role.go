@@ -0,0 +1,61 @@
+package role
+
+import "errors"
+
+var ErrUnknownRole = errors.New("unknown role")
+
+// Role of a user, which determines what the user is permitted to do
+type Role string
+
+const (
+	// Admin can do everything, including managing users and settings
+	Admin Role = "admin"
+	// Operator can view and control own tasks
+	Operator Role = "operator"
+	// Viewer can only list and listen to own tasks
+	Viewer Role = "viewer"
+)
+
+// Permission to perform a group of actions
+type Permission string
+
+const (
+	PermissionViewTasks      Permission = "tasks:view"
+	PermissionManageTasks    Permission = "tasks:manage"
+	PermissionAccessAllTasks Permission = "tasks:all"
+	PermissionManageSettings Permission = "settings:manage"
+	PermissionManageUsers    Permission = "users:manage"
+	PermissionViewAuditLog   Permission = "audit:view"
+)
+
+var permissions = map[Role][]Permission{
+	Admin: {
+		PermissionViewTasks,
+		PermissionManageTasks,
+		PermissionAccessAllTasks,
+		PermissionManageSettings,
+		PermissionManageUsers,
+		PermissionViewAuditLog,
+	},
+	Operator: {PermissionViewTasks, PermissionManageTasks},
+	Viewer:   {PermissionViewTasks},
+}
+
+// Parse converts the name of a role to Role
+func Parse(name string) (Role, error) {
+	role := Role(name)
+	if _, ok := permissions[role]; !ok {
+		return "", ErrUnknownRole
+	}
+	return role, nil
+}
+
+// Has checks whether the role grants the permission. Unknown roles have no permissions
+func (role Role) Has(permission Permission) bool {
+	for _, granted := range permissions[role] {
+		if granted == permission {
+			return true
+		}
+	}
+	return false
+}
@@ -8,6 +8,7 @@ const (
 	UpdateTypeError
 	UpdateTypeFinished
 	UpdateTypeInterrupted
+	UpdateTypePaused
 )
 
 const (
@@ -25,6 +26,10 @@ const (
 	StatusInterrupting = "INTERRUPTING"
 	// Error occurred
 	StatusError = "ERROR"
+	// Pause signal received - waiting for spiders to finish links that were already dispatched
+	StatusPausing = "PAUSING"
+	// Task was paused and can be resumed later
+	StatusPaused = "PAUSED"
 )
 
 // ProcessingUpdate is the interface for all seeker updates
@@ -58,6 +63,16 @@ func (e InterruptedUpdate) Type() int {
 	return UpdateTypeInterrupted
 }
 
+// PausedUpdate is an update indicating that the seeker stopped dispatching links and all dispatched links were crawled
+type PausedUpdate struct {
+	// Links that were not crawled yet. Nil if seeker was paused before the initial page was processed
+	RemainingLinks []url.URL
+}
+
+func (PausedUpdate) Type() int {
+	return UpdateTypePaused
+}
+
 // PageBaseInfoUpdate is and update sent before the spiders are in action, after the initial GET request.
 type PageBaseInfoUpdate struct {
 	BaseInfo *PageBaseInfo
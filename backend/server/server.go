@@ -0,0 +1,275 @@
+// Package server wires the services of the API server together and defines its routes
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/martynasd123/golang-scraper/config"
+	. "github.com/martynasd123/golang-scraper/controllers"
+	"github.com/martynasd123/golang-scraper/models/role"
+	. "github.com/martynasd123/golang-scraper/services/auth"
+	. "github.com/martynasd123/golang-scraper/services/scrape"
+	"github.com/martynasd123/golang-scraper/services/scrape/bus"
+	. "github.com/martynasd123/golang-scraper/services/webhook"
+	"github.com/martynasd123/golang-scraper/storage"
+	"log"
+)
+
+// Time allowed for the requests being handled to finish once the server is signalled to stop
+const shutdownTimeout = 10 * time.Second
+
+type ApplicationContext struct {
+	AuthService    *AuthService
+	ScrapeService  *ScrapeService
+	WebhookService *WebhookService
+
+	AuthController    *AuthController
+	ScrapeController  *ScrapeController
+	UserController    *UserController
+	ApiKeyController  *ApiKeyController
+	AuditController   *AuditController
+	WebhookController *WebhookController
+
+	AuthDao       storage.AuthDao
+	SessionDao    storage.SessionDao
+	RevocationDao storage.RevocationDao
+	AuditDao      storage.AuditDao
+	TaskDao       storage.TaskDao
+	WebhookDao    storage.WebhookDao
+
+	RequireAuthMiddleware gin.HandlerFunc
+	CsrfMiddleware        gin.HandlerFunc
+	CheckOriginMiddleware gin.HandlerFunc
+}
+
+func WireContext(
+	keys *KeySet,
+	revocationDao storage.RevocationDao,
+	auditDao storage.AuditDao,
+	messageBus bus.MessageBus,
+	localWorker *Worker,
+	cookies CookieConfig,
+) *ApplicationContext {
+	ctx := new(ApplicationContext)
+
+	ctx.AuthDao = storage.CreateAuthInMemoryDao()
+	ctx.SessionDao = storage.CreateSessionInMemoryDao()
+	ctx.RevocationDao = revocationDao
+	ctx.AuditDao = auditDao
+	ctx.TaskDao = storage.CreateTaskInMemoryDao()
+	ctx.WebhookDao = storage.CreateWebhookInMemoryDao()
+
+	ctx.AuthService = CreateAuthService(ctx.AuthDao, ctx.SessionDao, ctx.RevocationDao, ctx.AuditDao, keys)
+	ctx.ScrapeService = CreateTaskServiceWithBus(ctx.TaskDao, messageBus, localWorker)
+	ctx.ScrapeService.SetAuditLog(ctx.AuditDao)
+	ctx.WebhookService = CreateWebhookService(ctx.WebhookDao, ctx.ScrapeService)
+	ctx.WebhookService.SetAuditLog(ctx.AuditDao)
+	ctx.ScrapeService.SetCompletionListener(ctx.WebhookService.NotifyTaskCompleted)
+
+	ctx.AuthController = CreateAuthController(ctx.AuthService, cookies)
+	ctx.ScrapeController = CreateScrapeController(ctx.ScrapeService)
+	ctx.UserController = CreateUserController(ctx.AuthService)
+	ctx.ApiKeyController = CreateApiKeyController(ctx.AuthService)
+	ctx.AuditController = CreateAuditController(ctx.AuthService)
+	ctx.WebhookController = CreateWebhookController(ctx.WebhookService)
+
+	ctx.RequireAuthMiddleware = RequireAuth(ctx.AuthService)
+	ctx.CsrfMiddleware = CsrfProtection(cookies)
+	ctx.CheckOriginMiddleware = CheckOrigin(nil)
+	return ctx
+}
+
+func DefineAuthRoutes(router *gin.RouterGroup, context *ApplicationContext) {
+	router.POST("/", context.AuthController.Authenticate)
+	router.POST("/refresh-token", context.AuthController.RefreshToken)
+	router.GET("/jwks.json", context.AuthController.GetJwks)
+	router.POST("/2fa/verify", context.AuthController.VerifySecondFactor)
+	router.GET("/oidc/login", context.AuthController.OidcLogin)
+	router.GET("/oidc/callback", context.AuthController.OidcCallback)
+	router.POST("/oidc/link", context.RequireAuthMiddleware, RequireSession(), context.AuthController.OidcLink)
+	router.POST("/2fa/enroll", context.RequireAuthMiddleware, RequireSession(), context.AuthController.EnrollSecondFactor)
+	router.POST("/2fa/confirm", context.RequireAuthMiddleware, RequireSession(), context.AuthController.ConfirmSecondFactor)
+	router.POST("/log-out", context.RequireAuthMiddleware, RequireSession(), context.AuthController.LogOut)
+	router.GET("/sessions", context.RequireAuthMiddleware, RequireSession(), context.AuthController.GetSessions)
+	router.DELETE("/sessions/:id", context.RequireAuthMiddleware, RequireSession(), context.AuthController.RevokeSession)
+	router.POST("/change-password", context.RequireAuthMiddleware, RequireSession(), context.AuthController.ChangePassword)
+	router.GET("/api-keys", context.RequireAuthMiddleware, RequireSession(), context.ApiKeyController.GetApiKeys)
+	router.POST("/api-keys", context.RequireAuthMiddleware, RequireSession(), context.ApiKeyController.CreateApiKey)
+	router.DELETE("/api-keys/:id", context.RequireAuthMiddleware, RequireSession(), context.ApiKeyController.RevokeApiKey)
+}
+
+func DefineScrapeRoutes(router *gin.RouterGroup, context *ApplicationContext) {
+	view := RequirePermission(role.PermissionViewTasks)
+	manage := RequirePermission(role.PermissionManageTasks)
+	manageSettings := RequirePermission(role.PermissionManageSettings)
+
+	router.POST("/add-task", manage, context.ScrapeController.AddTask)
+	router.POST("/task/:id/interrupt", manage, context.ScrapeController.InterruptTask)
+	router.POST("/task/:id/pause", manage, context.ScrapeController.PauseTask)
+	router.POST("/task/:id/resume", manage, context.ScrapeController.ResumeTask)
+	router.POST("/task/:id/retry", manage, context.ScrapeController.RetryTask)
+	router.POST("/task/:id/recheck-broken", manage, context.ScrapeController.RecheckBrokenLinks)
+	router.GET("/task/:id/links", view, context.ScrapeController.GetLinkResults)
+	router.DELETE("/task/:id", manage, context.ScrapeController.DeleteTask)
+	router.POST("/tasks/bulk-delete", manage, context.ScrapeController.BulkDeleteTasks)
+	router.GET("/task/:id/listen", view, context.ScrapeController.Listen)
+	router.GET("/socket", view, context.ScrapeController.Socket)
+	router.GET("/activity", view, context.ScrapeController.Activity)
+	router.GET("/task/:id", view, context.ScrapeController.GetTask)
+	router.GET("/tasks", view, context.ScrapeController.GetAllTasks)
+	router.GET("/settings/concurrency", view, context.ScrapeController.GetConcurrencySettings)
+	router.PUT("/settings/concurrency", manageSettings, context.ScrapeController.UpdateConcurrencySettings)
+	router.GET("/metrics/updates", manageSettings, context.ScrapeController.GetUpdateMetrics)
+	router.GET("/workers", manageSettings, context.ScrapeController.GetWorkers)
+}
+
+func DefineUserRoutes(router *gin.RouterGroup, context *ApplicationContext) {
+	router.GET("/", context.UserController.GetAllUsers)
+	router.POST("/", context.UserController.CreateUser)
+	router.PUT("/:username/role", context.UserController.UpdateUserRole)
+	router.POST("/:username/disable", context.UserController.DisableUser)
+	router.POST("/:username/enable", context.UserController.EnableUser)
+	router.POST("/:username/unlock", context.UserController.UnlockUser)
+	router.POST("/:username/reset-2fa", context.UserController.ResetSecondFactor)
+	router.DELETE("/:username", context.UserController.DeleteUser)
+}
+
+func DefineAuditRoutes(router *gin.RouterGroup, context *ApplicationContext) {
+	router.GET("/", context.AuditController.GetEvents)
+	router.GET("/export", context.AuditController.ExportEvents)
+}
+
+func DefineWebhookRoutes(router *gin.RouterGroup, context *ApplicationContext) {
+	view := RequirePermission(role.PermissionViewTasks)
+	manage := RequirePermission(role.PermissionManageTasks)
+
+	router.GET("/", view, context.WebhookController.GetWebhooks)
+	router.POST("/", manage, context.WebhookController.CreateWebhook)
+	router.DELETE("/:id", manage, context.WebhookController.DeleteWebhook)
+	router.GET("/:id/deliveries", view, context.WebhookController.GetDeliveries)
+}
+
+func DefineRoutes(router *gin.RouterGroup, context *ApplicationContext) {
+	router.Use(context.CheckOriginMiddleware, context.CsrfMiddleware)
+
+	DefineAuthRoutes(router.Group("/auth"), context)
+
+	scrapeGroup := router.Group("/scrape")
+	scrapeGroup.Use(context.RequireAuthMiddleware)
+	DefineScrapeRoutes(scrapeGroup, context)
+
+	userGroup := router.Group("/users")
+	userGroup.Use(context.RequireAuthMiddleware, RequirePermission(role.PermissionManageUsers))
+	DefineUserRoutes(userGroup, context)
+
+	webhookGroup := router.Group("/webhooks")
+	webhookGroup.Use(context.RequireAuthMiddleware)
+	DefineWebhookRoutes(webhookGroup, context)
+
+	auditGroup := router.Group("/audit")
+	auditGroup.Use(context.RequireAuthMiddleware, RequirePermission(role.PermissionViewAuditLog))
+	DefineAuditRoutes(auditGroup, context)
+}
+
+// Run configures the API server from environment variables and serves it. If local is set, tasks are processed by a
+// worker of this process as well, otherwise only by standalone workers sharing the message bus
+func Run(local bool) {
+	keys, err := config.ConfigureSigningKeys()
+	if err != nil {
+		log.Fatalln("Failed to configure JWT signing keys:", err)
+	}
+	revocationDao, err := config.ConfigureRevocationList()
+	if err != nil {
+		log.Fatalln("Failed to load access token revocation list:", err)
+	}
+	cookies, err := config.ConfigureCookies()
+	if err != nil {
+		log.Fatalln("Failed to configure cookies:", err)
+	}
+	auditDao, err := config.ConfigureAuditLog()
+	if err != nil {
+		log.Fatalln("Failed to load audit log:", err)
+	}
+	messageBus, err := config.ConfigureMessageBus(!local)
+	if err != nil {
+		log.Fatalln("Failed to configure message bus:", err)
+	}
+	// Tasks are stored in memory, so jobs left in a shared bus by a previous run would collide with new tasks
+	if err = messageBus.Purge(); err != nil {
+		log.Fatalln("Failed to purge message bus:", err)
+	}
+	var localWorker *Worker
+	if local {
+		localWorker, err = config.ConfigureWorker(messageBus)
+		if err != nil {
+			log.Fatalln("Failed to start worker:", err)
+		}
+	}
+	context := WireContext(keys, revocationDao, auditDao, messageBus, localWorker, cookies)
+	context.ScrapeService.StartWorkerPruningJob(WorkerRetention)
+	context.CheckOriginMiddleware = CheckOrigin(config.ConfigureAllowedOrigins())
+
+	err = config.ConfigureBootstrapAdmin(context.AuthService)
+	if err != nil {
+		log.Fatalln("Failed to create bootstrap admin:", err)
+	}
+
+	err = config.ConfigureOidc(context.AuthService)
+	if err != nil {
+		log.Fatalln("Failed to configure single sign-on:", err)
+	}
+
+	err = config.ConfigureRetention(context.ScrapeService)
+	if err != nil {
+		log.Fatalln("Failed to configure task retention:", err)
+	}
+
+	err = config.ConfigureUpdateInterval(context.ScrapeService)
+	if err != nil {
+		log.Fatalln("Failed to configure update interval:", err)
+	}
+
+	err = config.ConfigureWebhooks(context.WebhookService)
+	if err != nil {
+		log.Fatalln("Failed to configure webhooks:", err)
+	}
+
+	app := gin.Default()
+
+	DefineRoutes(app.Group("/api"), context)
+
+	serve(app, context)
+}
+
+// Serves the requests until the process is signalled to stop. Requests being handled are finished, and deliveries of
+// webhooks are stopped, before returning
+func serve(app *gin.Engine, applicationContext *ApplicationContext) {
+	address := ":8080"
+	if port := os.Getenv("PORT"); port != "" {
+		address = ":" + port
+	}
+	httpServer := &http.Server{Addr: address, Handler: app}
+	go func() {
+		if err := httpServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatalln("Failed to serve:", err)
+		}
+	}()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	<-signals
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := httpServer.Shutdown(ctx); err != nil {
+		log.Println("Failed to shut down the server:", err)
+	}
+	applicationContext.WebhookService.Stop()
+}
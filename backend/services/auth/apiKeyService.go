@@ -0,0 +1,139 @@
+package authService
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"github.com/martynasd123/golang-scraper/models/principal"
+	"github.com/martynasd123/golang-scraper/models/role"
+	auth "github.com/martynasd123/golang-scraper/storage"
+	"slices"
+	"strconv"
+	"time"
+)
+
+const (
+	apiKeyPrefix = "sk_"
+	// Number of characters of the key, which are stored in plain text
+	apiKeyDisplayLength = 10
+)
+
+var (
+	ErrApiKeyInvalid     = errors.New("API key is invalid")
+	ErrApiKeyNotExist    = errors.New("API key does not exist")
+	ErrApiKeyNameTaken   = errors.New("API key with this name already exists")
+	ErrApiKeyNameMissing = errors.New("API key name is required")
+	ErrInvalidScopes     = errors.New("API key scopes are invalid")
+	ErrInvalidExpiry     = errors.New("API key expiry must be in the future")
+	ErrCouldNotCreateKey = errors.New("could not generate API key")
+)
+
+// ApiKeyClaims is the information about the user, which is carried by an API key
+type ApiKeyClaims struct {
+	Username string
+	Role     role.Role
+	Scopes   []role.Permission
+}
+
+// CreateApiKey creates a new API key of the user. Scopes must be granted by the user's role. Returns the key, which
+// is not stored and can not be retrieved later, along with its metadata
+func (authService *AuthService) CreateApiKey(
+	actor principal.Principal,
+	name string,
+	scopes []role.Permission,
+	expiresAt *time.Time,
+) (_ string, _ *auth.ApiKey, err error) {
+	username := actor.Username
+	defer func() { authService.audit(actor, AuditActionApiKeyCreated, name, err) }()
+	user, err := authService.authStorage.GetUser(username)
+	if err != nil {
+		return "", nil, errors.Join(ErrUserNotExist, err)
+	}
+	if name == "" {
+		return "", nil, ErrApiKeyNameMissing
+	}
+	if len(scopes) == 0 {
+		return "", nil, ErrInvalidScopes
+	}
+	for _, scope := range scopes {
+		if !user.Role.Has(scope) {
+			return "", nil, ErrInvalidScopes
+		}
+	}
+	now := time.Now()
+	if expiresAt != nil && !expiresAt.After(now) {
+		return "", nil, ErrInvalidExpiry
+	}
+	for _, existing := range authService.authStorage.GetApiKeys(username) {
+		if existing.Name == name && existing.IsActive(now) {
+			return "", nil, ErrApiKeyNameTaken
+		}
+	}
+
+	secret := make([]byte, 32)
+	if _, err = rand.Read(secret); err != nil {
+		return "", nil, errors.Join(ErrCouldNotCreateKey, err)
+	}
+	key := apiKeyPrefix + base64.RawURLEncoding.EncodeToString(secret)
+
+	apiKey := &auth.ApiKey{
+		Username:  username,
+		Name:      name,
+		Hash:      hashToken(key),
+		Prefix:    key[:apiKeyDisplayLength],
+		Scopes:    slices.Clone(scopes),
+		CreatedAt: now,
+		ExpiresAt: expiresAt,
+	}
+	if _, err = authService.authStorage.StoreApiKey(apiKey); err != nil {
+		return "", nil, errors.Join(ErrUserPersistenceError, err)
+	}
+	return key, apiKey, nil
+}
+
+func (authService *AuthService) GetApiKeys(username string) []*auth.ApiKey {
+	return authService.authStorage.GetApiKeys(username)
+}
+
+// RevokeApiKey revokes the API key of the user. Revoked keys are kept, so that they are still listed
+func (authService *AuthService) RevokeApiKey(actor principal.Principal, id int) (err error) {
+	defer func() { authService.audit(actor, AuditActionApiKeyRevoked, strconv.Itoa(id), err) }()
+	for _, key := range authService.authStorage.GetApiKeys(actor.Username) {
+		if *key.Id != id {
+			continue
+		}
+		if key.RevokedAt == nil {
+			now := time.Now()
+			key.RevokedAt = &now
+			if _, err := authService.authStorage.StoreApiKey(key); err != nil {
+				return errors.Join(ErrUserPersistenceError, err)
+			}
+		}
+		return nil
+	}
+	return ErrApiKeyNotExist
+}
+
+// ValidateApiKey checks that the API key is active and belongs to an enabled user, and records its usage
+func (authService *AuthService) ValidateApiKey(key string) (*ApiKeyClaims, error) {
+	apiKey, err := authService.authStorage.GetApiKeyByHash(hashToken(key))
+	if err != nil {
+		return nil, errors.Join(ErrApiKeyInvalid, err)
+	}
+	now := time.Now()
+	if !apiKey.IsActive(now) {
+		return nil, ErrApiKeyInvalid
+	}
+	user, err := authService.authStorage.GetUser(apiKey.Username)
+	if err != nil {
+		return nil, errors.Join(ErrApiKeyInvalid, err)
+	}
+	if user.Disabled {
+		return nil, errors.Join(ErrApiKeyInvalid, ErrUserDisabled)
+	}
+
+	if err = authService.authStorage.SetApiKeyLastUsed(*apiKey.Id, now); err != nil {
+		return nil, errors.Join(ErrUserPersistenceError, err)
+	}
+	return &ApiKeyClaims{Username: user.Username, Role: user.Role, Scopes: apiKey.Scopes}, nil
+}
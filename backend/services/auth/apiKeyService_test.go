@@ -0,0 +1,97 @@
+package authService_test
+
+import (
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+
+	"github.com/martynasd123/golang-scraper/models/principal"
+	"github.com/martynasd123/golang-scraper/models/role"
+	"github.com/martynasd123/golang-scraper/services/auth"
+	"github.com/martynasd123/golang-scraper/storage"
+)
+
+func TestAuthService_CreateAndValidateApiKey(t *testing.T) {
+	inMemoryStorage := storage.CreateAuthInMemoryDao()
+	auth := createAuthService(t, inMemoryStorage)
+
+	err := auth.CreateUser(principal.System, "testuser", "password1", role.Operator)
+	require.NoError(t, err)
+
+	key, apiKey, err := auth.CreateApiKey(principal.Principal{Username: "testuser"}, "ci", []role.Permission{role.PermissionManageTasks}, nil)
+	require.NoError(t, err)
+	require.NotEqual(t, key, apiKey.Hash)
+	require.Nil(t, apiKey.LastUsedAt)
+
+	claims, err := auth.ValidateApiKey(key)
+	require.NoError(t, err)
+	require.Equal(t, "testuser", claims.Username)
+	require.Equal(t, role.Operator, claims.Role)
+	require.Equal(t, []role.Permission{role.PermissionManageTasks}, claims.Scopes)
+
+	keys := auth.GetApiKeys("testuser")
+	require.Len(t, keys, 1)
+	require.NotNil(t, keys[0].LastUsedAt)
+
+	_, err = auth.ValidateApiKey("sk_unknown")
+	require.ErrorIs(t, err, authService.ErrApiKeyInvalid)
+
+	_, _, err = auth.CreateApiKey(principal.Principal{Username: "testuser"}, "ci", []role.Permission{role.PermissionViewTasks}, nil)
+	require.ErrorIs(t, err, authService.ErrApiKeyNameTaken)
+	// Operators can not manage users, so neither can their keys
+	_, _, err = auth.CreateApiKey(principal.Principal{Username: "testuser"}, "other", []role.Permission{role.PermissionManageUsers}, nil)
+	require.ErrorIs(t, err, authService.ErrInvalidScopes)
+	past := time.Now().Add(-time.Hour)
+	_, _, err = auth.CreateApiKey(principal.Principal{Username: "testuser"}, "other", []role.Permission{role.PermissionViewTasks}, &past)
+	require.ErrorIs(t, err, authService.ErrInvalidExpiry)
+}
+
+func TestAuthService_RevokeApiKey(t *testing.T) {
+	inMemoryStorage := storage.CreateAuthInMemoryDao()
+	auth := createAuthService(t, inMemoryStorage)
+
+	require.NoError(t, auth.CreateUser(principal.System, "testuser", "password1", role.Operator))
+	require.NoError(t, auth.CreateUser(principal.System, "otheruser", "password1", role.Operator))
+
+	key, apiKey, err := auth.CreateApiKey(principal.Principal{Username: "testuser"}, "ci", []role.Permission{role.PermissionViewTasks}, nil)
+	require.NoError(t, err)
+
+	require.ErrorIs(t, auth.RevokeApiKey(principal.Principal{Username: "otheruser"}, *apiKey.Id), authService.ErrApiKeyNotExist)
+	require.NoError(t, auth.RevokeApiKey(principal.Principal{Username: "testuser"}, *apiKey.Id))
+
+	_, err = auth.ValidateApiKey(key)
+	require.ErrorIs(t, err, authService.ErrApiKeyInvalid)
+
+	// Name of a revoked key can be reused
+	_, _, err = auth.CreateApiKey(principal.Principal{Username: "testuser"}, "ci", []role.Permission{role.PermissionViewTasks}, nil)
+	require.NoError(t, err)
+}
+
+func TestAuthService_ApiKeyOfDisabledUser(t *testing.T) {
+	inMemoryStorage := storage.CreateAuthInMemoryDao()
+	auth := createAuthService(t, inMemoryStorage)
+
+	require.NoError(t, auth.CreateUser(principal.System, "testuser", "password1", role.Operator))
+	key, _, err := auth.CreateApiKey(principal.Principal{Username: "testuser"}, "ci", []role.Permission{role.PermissionViewTasks}, nil)
+	require.NoError(t, err)
+
+	require.NoError(t, auth.SetUserDisabled(principal.System, "testuser", true))
+	_, err = auth.ValidateApiKey(key)
+	require.ErrorIs(t, err, authService.ErrApiKeyInvalid)
+}
+
+func TestAuthService_ApiKeyOfDeletedUser(t *testing.T) {
+	inMemoryStorage := storage.CreateAuthInMemoryDao()
+	auth := createAuthService(t, inMemoryStorage)
+
+	require.NoError(t, auth.CreateUser(principal.System, "testuser", "password1", role.Operator))
+	key, _, err := auth.CreateApiKey(principal.Principal{Username: "testuser"}, "ci", []role.Permission{role.PermissionViewTasks}, nil)
+	require.NoError(t, err)
+
+	require.NoError(t, auth.DeleteUser(principal.System, "testuser"))
+	// A new user with the same username does not get the keys
+	require.NoError(t, auth.CreateUser(principal.System, "testuser", "password1", role.Operator))
+	_, err = auth.ValidateApiKey(key)
+	require.ErrorIs(t, err, authService.ErrApiKeyInvalid)
+	require.Empty(t, auth.GetApiKeys("testuser"))
+}
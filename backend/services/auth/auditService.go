@@ -0,0 +1,15 @@
+package authService
+
+import (
+	auth "github.com/martynasd123/golang-scraper/storage"
+)
+
+// QueryAuditEvents returns a page of events from the audit log, newest first
+func (authService *AuthService) QueryAuditEvents(query auth.AuditQuery) (*auth.AuditPage, error) {
+	return authService.auditStorage.QueryEvents(query)
+}
+
+// GetAuditEvents returns all events matching the filter in the order they were recorded
+func (authService *AuthService) GetAuditEvents(filter auth.AuditFilter) []*auth.AuditEvent {
+	return authService.auditStorage.GetEvents(filter)
+}
@@ -2,23 +2,120 @@ package authService
 
 import (
 	"github.com/gin-gonic/gin"
+	"github.com/martynasd123/golang-scraper/models/principal"
+	"github.com/martynasd123/golang-scraper/models/role"
 	. "github.com/martynasd123/golang-scraper/services/auth/constants"
 	"net/http"
+	"slices"
+	"strings"
 )
 
+// RequireAuth authenticates the request with the access token cookie, or with an API key passed through either
+// the Authorization (as a bearer token) or the X-API-Key header
 func RequireAuth(service *AuthService) gin.HandlerFunc {
 	return func(ctx *gin.Context) {
+		if apiKey, ok := getApiKey(ctx); ok {
+			claims, err := service.ValidateApiKey(apiKey)
+			if err != nil {
+				ctx.AbortWithStatusJSON(http.StatusForbidden, "API key invalid")
+				return
+			}
+			ctx.Set(UserNameContextKey, claims.Username)
+			ctx.Set(RoleContextKey, claims.Role)
+			ctx.Set(ApiKeyScopesContextKey, claims.Scopes)
+			ctx.Next()
+			return
+		}
 		accessToken, err := ctx.Cookie(AccessTokenCookieName)
 		if err != nil {
 			ctx.AbortWithStatusJSON(http.StatusForbidden, "access token required")
 			return
 		}
-		username, err := service.ValidateAccessToken(accessToken)
+		claims, err := service.ValidateAccessToken(accessToken)
 		if err != nil {
 			ctx.AbortWithStatusJSON(http.StatusForbidden, "access token invalid")
 			return
 		}
-		ctx.Set(UserNameContextKey, username)
+		ctx.Set(UserNameContextKey, claims.Username)
+		ctx.Set(RoleContextKey, claims.Role)
+		ctx.Set(SessionIdContextKey, claims.SessionId)
 		ctx.Next()
 	}
 }
+
+func getApiKey(ctx *gin.Context) (string, bool) {
+	if key := ctx.GetHeader(ApiKeyHeaderName); key != "" {
+		return key, true
+	}
+	if key, found := strings.CutPrefix(ctx.GetHeader("Authorization"), "Bearer "); found && key != "" {
+		return key, true
+	}
+	return "", false
+}
+
+// RequireSession rejects requests authenticated with an API key. Must be used after RequireAuth
+func RequireSession() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		if _, ok := GetSessionId(ctx); !ok {
+			ctx.AbortWithStatusJSON(http.StatusForbidden, "not allowed with an API key")
+			return
+		}
+		ctx.Next()
+	}
+}
+
+// RequirePermission only lets through requests of users, whose role grants the permission. Must be used after
+// RequireAuth
+func RequirePermission(permission role.Permission) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		if !HasPermission(ctx, permission) {
+			ctx.AbortWithStatusJSON(http.StatusForbidden, "insufficient permissions")
+			return
+		}
+		ctx.Next()
+	}
+}
+
+// GetSessionId returns the ID of the session of the user authenticated by RequireAuth. Requests authenticated with an
+// API key have no session
+func GetSessionId(ctx *gin.Context) (int, bool) {
+	sessionId, ok := ctx.Get(SessionIdContextKey)
+	if !ok {
+		return 0, false
+	}
+	id, ok := sessionId.(int)
+	return id, ok
+}
+
+// GetRole returns the role of the user authenticated by RequireAuth
+func GetRole(ctx *gin.Context) role.Role {
+	userRole, _ := ctx.Get(RoleContextKey)
+	if userRole, ok := userRole.(role.Role); ok {
+		return userRole
+	}
+	return ""
+}
+
+// HasPermission checks whether the role of the authenticated user, and the API key scopes if the request was
+// authenticated with an API key, grant the permission
+func HasPermission(ctx *gin.Context, permission role.Permission) bool {
+	if !GetRole(ctx).Has(permission) {
+		return false
+	}
+	scopes, ok := ctx.Get(ApiKeyScopesContextKey)
+	if !ok {
+		return true
+	}
+	scopeList, _ := scopes.([]role.Permission)
+	return slices.Contains(scopeList, permission)
+}
+
+// GetPrincipal returns the principal of the request authenticated by RequireAuth
+func GetPrincipal(ctx *gin.Context) principal.Principal {
+	return principal.Principal{
+		Username:  ctx.GetString(UserNameContextKey),
+		AllTasks:  HasPermission(ctx, role.PermissionAccessAllTasks),
+		IP:        ctx.ClientIP(),
+		UserAgent: ctx.Request.UserAgent(),
+	}
+}
@@ -6,11 +6,38 @@ import (
 	"errors"
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/google/uuid"
+	"github.com/martynasd123/golang-scraper/models/principal"
+	"github.com/martynasd123/golang-scraper/models/role"
 	auth "github.com/martynasd123/golang-scraper/storage"
+	"github.com/martynasd123/golang-scraper/utils/clock"
 	"golang.org/x/crypto/bcrypt"
+	"log"
+	"strconv"
 	"time"
 )
 
+// Actions recorded in the audit log
+const (
+	AuditActionLogin               = "login"
+	AuditActionLogout              = "logout"
+	AuditActionRefreshTokenReused  = "session.token_reused"
+	AuditActionSessionRevoked      = "session.revoked"
+	AuditActionPasswordChanged     = "password.changed"
+	AuditActionAccountLocked       = "account.locked"
+	AuditActionAccountUnlocked     = "account.unlocked"
+	AuditActionSecondFactorEnabled = "2fa.enabled"
+	AuditActionSecondFactorReset   = "2fa.reset"
+	AuditActionUserCreated         = "user.created"
+	AuditActionUserProvisioned     = "user.provisioned"
+	AuditActionUserOidcLinked      = "user.oidc_linked"
+	AuditActionUserRoleChanged     = "user.role_changed"
+	AuditActionUserDisabled        = "user.disabled"
+	AuditActionUserEnabled         = "user.enabled"
+	AuditActionUserDeleted         = "user.deleted"
+	AuditActionApiKeyCreated       = "api_key.created"
+	AuditActionApiKeyRevoked       = "api_key.revoked"
+)
+
 var (
 	ErrUserNotExist                = errors.New("user does not exist")
 	ErrRefreshTokenNotExist        = errors.New("refresh token does not exist")
@@ -22,59 +49,181 @@ var (
 	ErrUserPersistenceError        = errors.New("could not update user")
 	ErrPasswordIncorrect           = errors.New("password is incorrect")
 	ErrCouldNotHashPassword        = errors.New("password hashing failed")
+	ErrUserAlreadyExists           = errors.New("user already exists")
+	ErrUserDisabled                = errors.New("user is disabled")
+	ErrRefreshTokenReused          = errors.New("refresh token was already used")
+	ErrSessionRevoked              = errors.New("session is revoked")
+	ErrSessionNotExist             = errors.New("session does not exist")
+	ErrAccessTokenRevoked          = errors.New("access token is revoked")
 )
 
-var JwtSecretKey = "Some very secret key"
+// AccessTokenClaims is the information about the user carried by the access token
+type AccessTokenClaims struct {
+	Username string
+	Role     role.Role
+	// ID of the session, in which the token was issued
+	SessionId int
+}
+
+// Access tokens are short-lived, so that the revocation list stays small. Clients use the refresh token to get a new
+// one once it expires
+const AccessTokenLifetime = 15 * time.Minute
 
 type AuthService struct {
-	authStorage auth.AuthDao
+	authStorage       auth.AuthDao
+	sessionStorage    auth.SessionDao
+	revocationStorage auth.RevocationDao
+	auditStorage      auth.AuditDao
+	keys              *KeySet
+	throttle          *LoginThrottle
+	challenges        challengeStore
+	// Nil if single sign-on is not configured
+	oidc *OidcProvider
 }
 
-func CreateAuthService(storage auth.AuthDao) *AuthService {
+func CreateAuthService(
+	storage auth.AuthDao,
+	sessionStorage auth.SessionDao,
+	revocationStorage auth.RevocationDao,
+	auditStorage auth.AuditDao,
+	keys *KeySet,
+) *AuthService {
 	return &AuthService{
-		authStorage: storage,
+		authStorage:       storage,
+		sessionStorage:    sessionStorage,
+		revocationStorage: revocationStorage,
+		auditStorage:      auditStorage,
+		keys:              keys,
+		throttle:          CreateLoginThrottle(DefaultThrottlePolicy, clock.Real),
+		challenges:        challengeStore{challenges: make(map[string]*loginChallenge)},
 	}
 }
 
+// SetLoginThrottle replaces the throttle, which failed login attempts are tracked with
+func (authService *AuthService) SetLoginThrottle(throttle *LoginThrottle) {
+	authService.throttle = throttle
+}
+
+// GetJwks returns the public keys, which access tokens can be verified with
+func (authService *AuthService) GetJwks() []Jwk {
+	return authService.keys.Jwks()
+}
+
 func (authService *AuthService) Login(username, password, ip, userAgent string) (
 	accessToken, refreshToken *string,
 	refreshTokenValidUntil *time.Time,
 	err error,
 ) {
+	defer func() {
+		var secondFactorRequired *SecondFactorRequiredError
+		if !errors.As(err, &secondFactorRequired) {
+			actor := principal.Principal{Username: username, IP: ip, UserAgent: userAgent}
+			authService.audit(actor, AuditActionLogin, username, err)
+		}
+	}()
+
+	// Attempts are throttled before the password is checked, so that bcrypt can not be brute-forced. The attempt is
+	// reserved, so its outcome has to be recorded on every path below
+	if err = authService.throttle.Check(username, ip); err != nil {
+		return nil, nil, nil, err
+	}
+
 	user, err := authService.authStorage.GetUser(username)
 	if err != nil {
+		// Attempts for unknown users are counted as well, so that they can not be told apart from existing ones
+		authService.recordLoginFailure(username, ip, userAgent)
 		return nil, nil, nil, errors.Join(ErrUserNotExist, err)
 	}
 
 	if len(user.Password) > 72 {
 		// Make sure password length does not exceed the maximum Bcrypt length
+		authService.recordLoginFailure(username, ip, userAgent)
 		return nil, nil, nil, ErrPasswordIncorrect
 	}
 
 	err = bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password))
 	if err != nil {
+		authService.recordLoginFailure(username, ip, userAgent)
 		return nil, nil, nil, errors.Join(ErrPasswordIncorrect, err)
 	}
 
-	refreshToken, refreshTokenValidUntil = generateRefreshToken()
+	if user.Disabled {
+		authService.throttle.Release(username, ip)
+		return nil, nil, nil, ErrUserDisabled
+	}
 
-	user.DeviceIdentifier = generateDeviceIdentifier(ip, userAgent)
+	if user.HasSecondFactor() {
+		// Failed attempts are only forgotten once the second factor is verified as well
+		authService.throttle.Release(username, ip)
+		challenge, err := authService.createChallenge(username, ip, userAgent)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		return nil, nil, nil, &SecondFactorRequiredError{Challenge: challenge}
+	}
+	authService.throttle.RecordSuccess(username, ip)
+	return authService.startSession(user, ip, userAgent)
+}
 
-	user.RefreshToken = refreshToken
-	user.RefreshTokenValidUntil = refreshTokenValidUntil
-	err = authService.authStorage.UpdateUser(user)
+// Creates a session of the user, who has just authenticated, and issues its tokens
+func (authService *AuthService) startSession(user *auth.User, ip, userAgent string) (
+	accessToken, refreshToken *string,
+	refreshTokenValidUntil *time.Time,
+	err error,
+) {
+	refreshToken, refreshTokenValidUntil = generateRefreshToken()
 
+	now := time.Now()
+	session := &auth.Session{
+		Username:         user.Username,
+		DeviceIdentifier: *generateDeviceIdentifier(ip, userAgent),
+		UserAgent:        userAgent,
+		IP:               ip,
+		RefreshTokenHash: hashToken(*refreshToken),
+		ValidUntil:       *refreshTokenValidUntil,
+		CreatedAt:        now,
+		LastSeenAt:       now,
+	}
+	_, err = authService.sessionStorage.StoreSession(session)
 	if err != nil {
 		return nil, nil, nil, errors.Join(ErrUserPersistenceError, err)
 	}
 
-	accessToken, err = generateAccessToken(username)
+	accessToken, err = authService.generateAccessToken(user, session)
 	if err != nil {
 		return nil, nil, nil, errors.Join(ErrCouldNotGenerateAccessToken, err)
 	}
+	_, err = authService.sessionStorage.StoreSession(session)
+	if err != nil {
+		return nil, nil, nil, errors.Join(ErrUserPersistenceError, err)
+	}
 	return accessToken, refreshToken, refreshTokenValidUntil, nil
 }
 
+// Records the failed attempt and audits the lockout, if the account got locked because of it
+func (authService *AuthService) recordLoginFailure(username, ip, userAgent string) {
+	if authService.throttle.RecordFailure(username, ip) {
+		authService.audit(principal.Principal{IP: ip, UserAgent: userAgent}, AuditActionAccountLocked, username, nil)
+	}
+}
+
+// UnlockUser lets the user log in right away, even if the account was locked because of failed login attempts
+func (authService *AuthService) UnlockUser(actor principal.Principal, username string) (err error) {
+	defer func() { authService.audit(actor, AuditActionAccountUnlocked, username, err) }()
+	if _, err = authService.authStorage.GetUser(username); err != nil {
+		return errors.Join(ErrUserNotExist, err)
+	}
+	authService.throttle.Unlock(username)
+	return nil
+}
+
+// Records the action in the audit log. Failures to record it are only logged, since the action was already performed
+func (authService *AuthService) audit(actor principal.Principal, action string, target string, err error) {
+	if recordErr := authService.auditStorage.RecordEvent(auth.CreateAuditEvent(actor, action, target, err)); recordErr != nil {
+		log.Printf("could not record %s of %s in the audit log: %v", action, target, recordErr)
+	}
+}
+
 func generateDeviceIdentifier(ip string, agent string) *string {
 	h := sha256.New()
 	h.Write([]byte(ip + agent))
@@ -89,14 +238,28 @@ func generateRefreshToken() (*string, *time.Time) {
 	return &refreshToken, &validUntil
 }
 
-func (authService *AuthService) CreateFakeUser(username string, password string) error {
-	hashedPass, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+// CreateUser creates a user with the given role. The password must satisfy the password policy
+func (authService *AuthService) CreateUser(
+	actor principal.Principal,
+	username string,
+	password string,
+	userRole role.Role,
+) (err error) {
+	defer func() { authService.audit(actor, AuditActionUserCreated, username, err) }()
+	if err = ValidatePassword(password); err != nil {
+		return err
+	}
+	if _, err = authService.authStorage.GetUser(username); err == nil {
+		return ErrUserAlreadyExists
+	}
+	hashedPass, err := hashPassword(password)
 	if err != nil {
-		return errors.Join(err, ErrCouldNotHashPassword)
+		return err
 	}
 	user := &auth.User{
 		Username: username,
-		Password: string(hashedPass),
+		Password: hashedPass,
+		Role:     userRole,
 	}
 
 	// Store the user in the storage
@@ -108,102 +271,266 @@ func (authService *AuthService) CreateFakeUser(username string, password string)
 	return nil
 }
 
+// SetUserRole changes the role of the user. The change takes effect once the user's access token is refreshed
+func (authService *AuthService) SetUserRole(actor principal.Principal, username string, userRole role.Role) (err error) {
+	defer func() { authService.audit(actor, AuditActionUserRoleChanged, username, err) }()
+	user, err := authService.authStorage.GetUser(username)
+	if err != nil {
+		return errors.Join(ErrUserNotExist, err)
+	}
+	user.Role = userRole
+	err = authService.authStorage.UpdateUser(user)
+	if err != nil {
+		return errors.Join(err, ErrUserPersistenceError)
+	}
+	return nil
+}
+
+// SetUserDisabled disables or enables the user. Disabled users are logged out and can not log in again
+func (authService *AuthService) SetUserDisabled(actor principal.Principal, username string, disabled bool) (err error) {
+	defer func() {
+		action := AuditActionUserEnabled
+		if disabled {
+			action = AuditActionUserDisabled
+		}
+		authService.audit(actor, action, username, err)
+	}()
+	user, err := authService.authStorage.GetUser(username)
+	if err != nil {
+		return errors.Join(ErrUserNotExist, err)
+	}
+	user.Disabled = disabled
+	err = authService.authStorage.UpdateUser(user)
+	if err != nil {
+		return errors.Join(err, ErrUserPersistenceError)
+	}
+	if disabled {
+		return authService.revokeAllSessions(username)
+	}
+	return nil
+}
+
+func (authService *AuthService) DeleteUser(actor principal.Principal, username string) (err error) {
+	defer func() { authService.audit(actor, AuditActionUserDeleted, username, err) }()
+	err = authService.authStorage.DeleteUser(username)
+	if err != nil {
+		return errors.Join(ErrUserNotExist, err)
+	}
+	return authService.revokeAllSessions(username)
+}
+
+// ChangePassword sets a new password of the user, after verifying the old one. All sessions of the user are revoked,
+// so the user has to log in again with the new password
+func (authService *AuthService) ChangePassword(actor principal.Principal, oldPassword string, newPassword string) (err error) {
+	username := actor.Username
+	defer func() { authService.audit(actor, AuditActionPasswordChanged, username, err) }()
+	user, err := authService.authStorage.GetUser(username)
+	if err != nil {
+		return errors.Join(ErrUserNotExist, err)
+	}
+	err = bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(oldPassword))
+	if err != nil {
+		return errors.Join(ErrPasswordIncorrect, err)
+	}
+	if err = ValidatePassword(newPassword); err != nil {
+		return err
+	}
+	user.Password, err = hashPassword(newPassword)
+	if err != nil {
+		return err
+	}
+	err = authService.authStorage.UpdateUser(user)
+	if err != nil {
+		return errors.Join(err, ErrUserPersistenceError)
+	}
+	return authService.revokeAllSessions(username)
+}
+
+func hashPassword(password string) (string, error) {
+	hashedPass, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", errors.Join(err, ErrCouldNotHashPassword)
+	}
+	return string(hashedPass), nil
+}
+
+func (authService *AuthService) GetAllUsers() []*auth.User {
+	return authService.authStorage.GetAllUsers()
+}
+
+// RefreshToken issues a new access token and replaces the refresh token of the session. If a refresh token, which
+// was already replaced, is used again, it might have been stolen - the session is revoked in that case
 func (authService *AuthService) RefreshToken(
 	token string,
 	username string,
 	ip string,
 	agent string,
 ) (accessToken, refreshToken *string, refreshTokenExp *time.Time, err error) {
-	user, err := authService.authStorage.GetUser(username)
+	tokenHash := hashToken(token)
+	session, err := authService.sessionStorage.GetSessionByTokenHash(tokenHash)
 	if err != nil {
-		return nil, nil, nil, errors.Join(ErrUserNotExist, err)
+		return nil, nil, nil, errors.Join(ErrRefreshTokenNotExist, err)
 	}
 
-	if user.RefreshToken == nil || user.RefreshTokenValidUntil == nil {
-		return nil, nil, nil, ErrRefreshTokenNotExist
+	if session.Username != username {
+		return nil, nil, nil, ErrRefreshTokenMismatch
 	}
 
-	if *user.RefreshToken != token {
-		return nil, nil, nil, ErrRefreshTokenMismatch
+	if session.RevokedAt != nil {
+		return nil, nil, nil, ErrSessionRevoked
 	}
 
-	if (*user.RefreshTokenValidUntil).Compare(time.Now()) < 0 {
+	now := time.Now()
+	if session.RefreshTokenHash != tokenHash {
+		return nil, nil, nil, authService.handleRefreshTokenReuse(session, username, ip, agent)
+	}
+
+	if session.ValidUntil.Before(now) {
 		return nil, nil, nil, ErrRefreshTokenExpired
 	}
 
-	if *generateDeviceIdentifier(ip, agent) != *user.DeviceIdentifier {
-		return nil, nil, nil, errors.Join(ErrInvalidDeviceIdentifier, err)
+	if *generateDeviceIdentifier(ip, agent) != session.DeviceIdentifier {
+		return nil, nil, nil, ErrInvalidDeviceIdentifier
+	}
+
+	user, err := authService.authStorage.GetUser(username)
+	if err != nil {
+		return nil, nil, nil, errors.Join(ErrUserNotExist, err)
+	}
+
+	if user.Disabled {
+		return nil, nil, nil, ErrUserDisabled
 	}
 
-	accessToken, err = generateAccessToken(username)
+	accessToken, err = authService.generateAccessToken(user, session)
 	if err != nil {
 		return nil, nil, nil, errors.Join(ErrCouldNotGenerateAccessToken, err)
 	}
 
 	refreshToken, refreshTokenExp = generateRefreshToken()
 
-	user.RefreshToken = refreshToken
-	user.RefreshTokenValidUntil = refreshTokenExp
-
-	err = authService.authStorage.UpdateUser(user)
+	session.PreviousTokenHashes = append(session.PreviousTokenHashes, tokenHash)
+	session.RefreshTokenHash = hashToken(*refreshToken)
+	session.ValidUntil = *refreshTokenExp
+	session.LastSeenAt = now
+	session.IP = ip
+
+	// The session was revoked or the token was used by a concurrent request in the meantime, which counts as reuse
+	err = authService.sessionStorage.RotateRefreshToken(session, tokenHash)
+	if errors.Is(err, auth.ErrSessionChanged) {
+		if session, err = authService.sessionStorage.GetSession(*session.Id); err != nil {
+			return nil, nil, nil, errors.Join(ErrUserPersistenceError, err)
+		}
+		if session.RevokedAt != nil {
+			return nil, nil, nil, ErrSessionRevoked
+		}
+		return nil, nil, nil, authService.handleRefreshTokenReuse(session, username, ip, agent)
+	}
 	if err != nil {
 		return nil, nil, nil, errors.Join(ErrUserPersistenceError, err)
 	}
 	return
 }
 
-func (authService *AuthService) LogOut(username string) error {
-	user, err := authService.authStorage.GetUser(username)
-	if err != nil {
-		return errors.Join(ErrUserNotExist, err)
+// Revokes the session, whose refresh token was used again after it was replaced
+func (authService *AuthService) handleRefreshTokenReuse(session *auth.Session, username, ip, agent string) error {
+	actor := principal.Principal{Username: username, IP: ip, UserAgent: agent}
+	authService.audit(actor, AuditActionRefreshTokenReused, strconv.Itoa(*session.Id), ErrRefreshTokenReused)
+	if err := authService.revokeSession(session); err != nil {
+		return errors.Join(ErrRefreshTokenReused, err)
 	}
+	return ErrRefreshTokenReused
+}
 
-	user.RefreshTokenValidUntil = nil
-	user.RefreshToken = nil
-	user.DeviceIdentifier = nil
-	err = authService.authStorage.UpdateUser(user)
-
-	if err != nil {
-		return errors.Join(err, ErrUserPersistenceError)
-	}
-	return nil
+// LogOut revokes the session of the user. Other sessions of the user stay active
+func (authService *AuthService) LogOut(actor principal.Principal, sessionId int) (err error) {
+	defer func() { authService.audit(actor, AuditActionLogout, strconv.Itoa(sessionId), err) }()
+	return authService.revokeOwnSession(actor.Username, sessionId)
 }
 
-func (authService *AuthService) ValidateAccessToken(token string) (username string, err error) {
+func (authService *AuthService) ValidateAccessToken(token string) (*AccessTokenClaims, error) {
 	claims := jwt.MapClaims{}
-	_, err = jwt.ParseWithClaims(token, claims, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, ErrAccessTokenInvalid
-		}
-		return []byte(JwtSecretKey), nil
-	})
+	_, err := jwt.ParseWithClaims(token, claims, authService.keys.verificationKey)
 	if err != nil {
-		return "", errors.Join(ErrAccessTokenInvalid, err)
+		return nil, errors.Join(ErrAccessTokenInvalid, err)
 	}
 
 	if exp, ok := claims["exp"].(float64); ok {
 		if time.Unix(int64(exp), 0).Before(time.Now()) {
-			return "", ErrAccessTokenInvalid
+			return nil, ErrAccessTokenInvalid
 		}
 	} else {
-		return "", ErrAccessTokenInvalid
+		return nil, ErrAccessTokenInvalid
 	}
 
 	username, ok := claims["username"].(string)
 	if !ok {
-		return "", ErrAccessTokenInvalid
+		return nil, ErrAccessTokenInvalid
+	}
+	roleName, ok := claims["role"].(string)
+	if !ok {
+		return nil, ErrAccessTokenInvalid
+	}
+	userRole, err := role.Parse(roleName)
+	if err != nil {
+		return nil, errors.Join(ErrAccessTokenInvalid, err)
+	}
+
+	// Tokens are revoked on log out, password change and when the user is disabled or deleted
+	tokenId, ok := claims["jti"].(string)
+	if !ok {
+		return nil, ErrAccessTokenInvalid
+	}
+	if authService.revocationStorage.IsTokenRevoked(tokenId) {
+		return nil, errors.Join(ErrAccessTokenInvalid, ErrAccessTokenRevoked)
+	}
+
+	// Tokens of deleted and disabled users are rejected even if their token IDs were not revoked
+	user, err := authService.authStorage.GetUser(username)
+	if err != nil {
+		return nil, errors.Join(ErrAccessTokenInvalid, err)
+	}
+	if user.Disabled {
+		return nil, errors.Join(ErrAccessTokenInvalid, ErrUserDisabled)
+	}
+
+	// Tokens of revoked sessions are rejected as well
+	sessionId, ok := claims["sid"].(float64)
+	if !ok {
+		return nil, ErrAccessTokenInvalid
+	}
+	session, err := authService.sessionStorage.GetSession(int(sessionId))
+	if err != nil {
+		return nil, errors.Join(ErrAccessTokenInvalid, err)
 	}
-	return username, nil
+	if session.Username != username || session.RevokedAt != nil {
+		return nil, errors.Join(ErrAccessTokenInvalid, ErrSessionRevoked)
+	}
+	return &AccessTokenClaims{Username: username, Role: userRole, SessionId: int(sessionId)}, nil
 }
 
-func generateAccessToken(username string) (*string, error) {
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-		"username": username,
-		"exp":      time.Now().Add(time.Hour * 72).Unix(),
+// Issues an access token in the session. The token is recorded in the session, which has to be stored afterwards
+func (authService *AuthService) generateAccessToken(user *auth.User, session *auth.Session) (*string, error) {
+	now := time.Now()
+	tokenId := uuid.New().String()
+	expiresAt := now.Add(AccessTokenLifetime)
+	accessToken, err := authService.keys.sign(jwt.MapClaims{
+		"jti":      tokenId,
+		"username": user.Username,
+		"role":     string(user.Role),
+		"sid":      *session.Id,
+		"exp":      expiresAt.Unix(),
 	})
-	accessToken, err := token.SignedString([]byte(JwtSecretKey))
 	if err != nil {
 		return nil, err
 	}
+
+	issued := make([]auth.IssuedToken, 0, len(session.AccessTokens)+1)
+	for _, token := range session.AccessTokens {
+		if token.ExpiresAt.After(now) {
+			issued = append(issued, token)
+		}
+	}
+	session.AccessTokens = append(issued, auth.IssuedToken{Id: tokenId, ExpiresAt: expiresAt})
 	return &accessToken, nil
 }
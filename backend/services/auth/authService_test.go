@@ -2,23 +2,27 @@ package authService_test
 
 import (
 	"github.com/stretchr/testify/require"
+	"sync"
+	"sync/atomic"
 	"testing"
 
+	"github.com/martynasd123/golang-scraper/models/principal"
+	"github.com/martynasd123/golang-scraper/models/role"
 	"github.com/martynasd123/golang-scraper/services/auth"
 	"github.com/martynasd123/golang-scraper/storage"
 )
 
 func TestAuthService_RefreshToken(t *testing.T) {
 	inMemoryStorage := storage.CreateAuthInMemoryDao()
-	auth := authService.CreateAuthService(inMemoryStorage)
+	auth := createAuthService(t, inMemoryStorage)
 
-	err := auth.CreateFakeUser("testuser", "password")
+	err := auth.CreateUser(principal.System, "testuser", "password1", role.Operator)
 	require.NoError(t, err)
 
 	ip := "192.168.1.1"
 	userAgent := "Mozilla/5.0"
 
-	_, refreshToken, _, err := auth.Login("testuser", "password", ip, userAgent)
+	_, refreshToken, _, err := auth.Login("testuser", "password1", ip, userAgent)
 	require.NoError(t, err)
 
 	_, newRefreshToken, _, err := auth.RefreshToken(*refreshToken, "testuser", ip, userAgent)
@@ -32,44 +36,215 @@ func TestAuthService_RefreshToken(t *testing.T) {
 
 func TestAuthService_LogOut(t *testing.T) {
 	inMemoryStorage := storage.CreateAuthInMemoryDao()
-	auth := authService.CreateAuthService(inMemoryStorage)
+	auth := createAuthService(t, inMemoryStorage)
 
-	err := auth.CreateFakeUser("testuser", "password")
+	err := auth.CreateUser(principal.System, "testuser", "password1", role.Operator)
 	require.NoError(t, err)
 
-	_, _, _, err = auth.Login("testuser", "password", "127.0.0.1", "Mozilla/5.0")
+	laptopToken, laptopRefreshToken, _, err := auth.Login("testuser", "password1", "127.0.0.1", "Mozilla/5.0")
 	require.NoError(t, err)
+	phoneToken, _, _, err := auth.Login("testuser", "password1", "127.0.0.2", "Mobile Safari")
+	require.NoError(t, err)
+	require.Len(t, auth.GetSessions("testuser"), 2)
 
-	err = auth.LogOut("testuser")
+	claims, err := auth.ValidateAccessToken(*laptopToken)
+	require.NoError(t, err)
+	err = auth.LogOut(principal.Principal{Username: "testuser"}, claims.SessionId)
 	require.NoError(t, err)
 
-	user, err := inMemoryStorage.GetUser("testuser")
+	// Only the laptop session is logged out
+	_, err = auth.ValidateAccessToken(*laptopToken)
+	require.ErrorIs(t, err, authService.ErrAccessTokenInvalid)
+	_, _, _, err = auth.RefreshToken(*laptopRefreshToken, "testuser", "127.0.0.1", "Mozilla/5.0")
+	require.ErrorIs(t, err, authService.ErrSessionRevoked)
+	_, err = auth.ValidateAccessToken(*phoneToken)
 	require.NoError(t, err)
-	require.Nil(t, user.RefreshTokenValidUntil)
-	require.Nil(t, user.DeviceIdentifier)
-	require.Nil(t, user.RefreshToken)
 
-	err = auth.LogOut("nonexistentuser")
-	require.Error(t, err)
+	sessions := auth.GetSessions("testuser")
+	require.Len(t, sessions, 1)
+	require.Equal(t, "Mobile Safari", sessions[0].UserAgent)
+
+	err = auth.LogOut(principal.Principal{Username: "nonexistentuser"}, *sessions[0].Id)
+	require.ErrorIs(t, err, authService.ErrSessionNotExist)
+}
+
+func TestAuthService_RefreshTokenReuse(t *testing.T) {
+	inMemoryStorage := storage.CreateAuthInMemoryDao()
+	auth := createAuthService(t, inMemoryStorage)
+
+	err := auth.CreateUser(principal.System, "testuser", "password1", role.Operator)
+	require.NoError(t, err)
+
+	ip := "192.168.1.1"
+	userAgent := "Mozilla/5.0"
+
+	_, refreshToken, _, err := auth.Login("testuser", "password1", ip, userAgent)
+	require.NoError(t, err)
+	accessToken, newRefreshToken, _, err := auth.RefreshToken(*refreshToken, "testuser", ip, userAgent)
+	require.NoError(t, err)
+
+	// The replaced token is used again - the whole session is revoked
+	_, _, _, err = auth.RefreshToken(*refreshToken, "testuser", ip, userAgent)
+	require.ErrorIs(t, err, authService.ErrRefreshTokenReused)
+	_, _, _, err = auth.RefreshToken(*newRefreshToken, "testuser", ip, userAgent)
+	require.ErrorIs(t, err, authService.ErrSessionRevoked)
+	_, err = auth.ValidateAccessToken(*accessToken)
+	require.ErrorIs(t, err, authService.ErrAccessTokenInvalid)
+	require.Empty(t, auth.GetSessions("testuser"))
+}
+
+func TestAuthService_ConcurrentRefreshToken(t *testing.T) {
+	auth := createAuthService(t, storage.CreateAuthInMemoryDao())
+	require.NoError(t, auth.CreateUser(principal.System, "testuser", "password1", role.Operator))
+	_, refreshToken, _, err := auth.Login("testuser", "password1", "127.0.0.1", "Mozilla/5.0")
+	require.NoError(t, err)
+
+	// The same token is used by parallel requests - at most one of them gets a new token
+	var wg sync.WaitGroup
+	var succeeded atomic.Int32
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, _, _, err := auth.RefreshToken(*refreshToken, "testuser", "127.0.0.1", "Mozilla/5.0"); err == nil {
+				succeeded.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	require.LessOrEqual(t, succeeded.Load(), int32(1))
+	// The token was reused, so the session is revoked
+	require.Empty(t, auth.GetSessions("testuser"))
 }
 
 func TestAuthService_ValidateAccessToken(t *testing.T) {
 	inMemoryStorage := storage.CreateAuthInMemoryDao()
-	auth := authService.CreateAuthService(inMemoryStorage)
+	auth := createAuthService(t, inMemoryStorage)
 
-	err := auth.CreateFakeUser("testuser", "password")
+	err := auth.CreateUser(principal.System, "testuser", "password1", role.Operator)
 	require.NoError(t, err)
 
 	ip := "192.168.1.1"
 	userAgent := "Mozilla/5.0"
 
-	accessToken, _, _, err := auth.Login("testuser", "password", ip, userAgent)
+	accessToken, _, _, err := auth.Login("testuser", "password1", ip, userAgent)
 	require.NoError(t, err)
 
-	username, err := auth.ValidateAccessToken(*accessToken)
+	claims, err := auth.ValidateAccessToken(*accessToken)
 	require.NoError(t, err)
-	require.Equal(t, "testuser", username)
+	require.Equal(t, "testuser", claims.Username)
+	require.Equal(t, role.Operator, claims.Role)
 
 	_, err = auth.ValidateAccessToken("bad token")
 	require.Error(t, err)
 }
+
+func TestAuthService_ValidateAccessTokenWithoutRevocationList(t *testing.T) {
+	authStorage := storage.CreateAuthInMemoryDao()
+	sessionStorage := storage.CreateSessionInMemoryDao()
+	keys, err := authService.GenerateKeySet()
+	require.NoError(t, err)
+	auth := authService.CreateAuthService(authStorage, sessionStorage, storage.CreateRevocationInMemoryDao(), storage.CreateAuditInMemoryDao(), keys)
+	require.NoError(t, auth.CreateUser(principal.System, "testuser", "password1", role.Operator))
+	require.NoError(t, auth.CreateUser(principal.System, "otheruser", "password1", role.Operator))
+
+	loggedOutToken, _, _, err := auth.Login("testuser", "password1", "127.0.0.1", "Mozilla/5.0")
+	require.NoError(t, err)
+	claims, err := auth.ValidateAccessToken(*loggedOutToken)
+	require.NoError(t, err)
+	require.NoError(t, auth.LogOut(principal.Principal{Username: "testuser"}, claims.SessionId))
+	disabledToken, _, _, err := auth.Login("otheruser", "password1", "127.0.0.1", "Mozilla/5.0")
+	require.NoError(t, err)
+	require.NoError(t, auth.SetUserDisabled(principal.System, "otheruser", true))
+
+	// The revoked token IDs are lost (e.g. on restart without a revocation file), but the session and the user are
+	// still checked
+	auth = authService.CreateAuthService(authStorage, sessionStorage, storage.CreateRevocationInMemoryDao(), storage.CreateAuditInMemoryDao(), keys)
+	_, err = auth.ValidateAccessToken(*loggedOutToken)
+	require.ErrorIs(t, err, authService.ErrSessionRevoked)
+	_, err = auth.ValidateAccessToken(*disabledToken)
+	require.ErrorIs(t, err, authService.ErrUserDisabled)
+}
+
+func TestAuthService_SetUserRole(t *testing.T) {
+	inMemoryStorage := storage.CreateAuthInMemoryDao()
+	auth := createAuthService(t, inMemoryStorage)
+
+	err := auth.CreateUser(principal.System, "testuser", "password1", role.Viewer)
+	require.NoError(t, err)
+	require.ErrorIs(t, auth.CreateUser(principal.System, "testuser", "password1", role.Admin), authService.ErrUserAlreadyExists)
+
+	err = auth.SetUserRole(principal.System, "testuser", role.Admin)
+	require.NoError(t, err)
+
+	accessToken, _, _, err := auth.Login("testuser", "password1", "127.0.0.1", "Mozilla/5.0")
+	require.NoError(t, err)
+	claims, err := auth.ValidateAccessToken(*accessToken)
+	require.NoError(t, err)
+	require.Equal(t, role.Admin, claims.Role)
+
+	require.ErrorIs(t, auth.SetUserRole(principal.System, "nonexistentuser", role.Admin), authService.ErrUserNotExist)
+}
+
+func TestAuthService_ChangePassword(t *testing.T) {
+	inMemoryStorage := storage.CreateAuthInMemoryDao()
+	auth := createAuthService(t, inMemoryStorage)
+
+	err := auth.CreateUser(principal.System, "testuser", "password1", role.Operator)
+	require.NoError(t, err)
+
+	accessToken, _, _, err := auth.Login("testuser", "password1", "127.0.0.1", "Mozilla/5.0")
+	require.NoError(t, err)
+
+	require.ErrorIs(t, auth.ChangePassword(principal.Principal{Username: "testuser"}, "wrong", "password2"), authService.ErrPasswordIncorrect)
+	require.ErrorIs(t, auth.ChangePassword(principal.Principal{Username: "testuser"}, "password1", "short"), authService.ErrPasswordPolicy)
+	require.NoError(t, auth.ChangePassword(principal.Principal{Username: "testuser"}, "password1", "password2"))
+	// Tokens issued before the password change are revoked
+	_, err = auth.ValidateAccessToken(*accessToken)
+	require.ErrorIs(t, err, authService.ErrAccessTokenRevoked)
+
+	_, _, _, err = auth.Login("testuser", "password1", "127.0.0.1", "Mozilla/5.0")
+	require.ErrorIs(t, err, authService.ErrPasswordIncorrect)
+	_, _, _, err = auth.Login("testuser", "password2", "127.0.0.1", "Mozilla/5.0")
+	require.NoError(t, err)
+}
+
+func TestAuthService_DisableUser(t *testing.T) {
+	inMemoryStorage := storage.CreateAuthInMemoryDao()
+	auth := createAuthService(t, inMemoryStorage)
+
+	err := auth.CreateUser(principal.System, "testuser", "password1", role.Operator)
+	require.NoError(t, err)
+
+	accessToken, refreshToken, _, err := auth.Login("testuser", "password1", "127.0.0.1", "Mozilla/5.0")
+	require.NoError(t, err)
+
+	require.NoError(t, auth.SetUserDisabled(principal.System, "testuser", true))
+	_, err = auth.ValidateAccessToken(*accessToken)
+	require.ErrorIs(t, err, authService.ErrAccessTokenInvalid)
+	_, _, _, err = auth.RefreshToken(*refreshToken, "testuser", "127.0.0.1", "Mozilla/5.0")
+	require.ErrorIs(t, err, authService.ErrSessionRevoked)
+	_, _, _, err = auth.Login("testuser", "password1", "127.0.0.1", "Mozilla/5.0")
+	require.ErrorIs(t, err, authService.ErrUserDisabled)
+
+	require.NoError(t, auth.SetUserDisabled(principal.System, "testuser", false))
+	_, _, _, err = auth.Login("testuser", "password1", "127.0.0.1", "Mozilla/5.0")
+	require.NoError(t, err)
+
+	require.NoError(t, auth.DeleteUser(principal.System, "testuser"))
+	_, err = auth.ValidateAccessToken(*accessToken)
+	require.ErrorIs(t, err, authService.ErrAccessTokenInvalid)
+}
+
+func TestValidatePassword(t *testing.T) {
+	require.NoError(t, authService.ValidatePassword("password1"))
+	require.ErrorIs(t, authService.ValidatePassword("pass1"), authService.ErrPasswordPolicy)
+	require.ErrorIs(t, authService.ValidatePassword("password"), authService.ErrPasswordPolicy)
+	require.ErrorIs(t, authService.ValidatePassword("12345678"), authService.ErrPasswordPolicy)
+}
+
+func createAuthService(t *testing.T, authStorage storage.AuthDao) *authService.AuthService {
+	keys, err := authService.GenerateKeySet()
+	require.NoError(t, err)
+	return authService.CreateAuthService(authStorage, storage.CreateSessionInMemoryDao(), storage.CreateRevocationInMemoryDao(), storage.CreateAuditInMemoryDao(), keys)
+}
@@ -4,4 +4,12 @@ const (
 	RefreshTokenCookieName = "refresh_token"
 	AccessTokenCookieName  = "access_token"
 	UserNameContextKey     = "username"
+	RoleContextKey         = "role"
+	SessionIdContextKey    = "sessionId"
+	ApiKeyScopesContextKey = "apiKeyScopes"
+	ApiKeyHeaderName       = "X-API-Key"
+	OidcStateCookieName    = "oidc_state"
+	// Default names of axios, so that the frontend sends the token without extra configuration
+	CsrfCookieName = "XSRF-TOKEN"
+	CsrfHeaderName = "X-XSRF-TOKEN"
 )
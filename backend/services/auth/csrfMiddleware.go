@@ -0,0 +1,114 @@
+package authService
+
+import (
+	"crypto/subtle"
+	"github.com/gin-gonic/gin"
+	. "github.com/martynasd123/golang-scraper/services/auth/constants"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+)
+
+// CookieConfig holds the attributes of the cookies set by the server
+type CookieConfig struct {
+	// Cookies are only sent over HTTPS. Should be enabled whenever the server is behind TLS
+	Secure   bool
+	SameSite http.SameSite
+}
+
+var DefaultCookieConfig = CookieConfig{SameSite: http.SameSiteLaxMode}
+
+// Apply sets the SameSite attribute of the cookies, which are set on the context afterward
+func (cookies CookieConfig) Apply(ctx *gin.Context) {
+	ctx.SetSameSite(cookies.SameSite)
+}
+
+// CsrfProtection implements the double-submit cookie pattern. A random token is set in a cookie, which scripts of
+// the page can read, and state-changing requests authenticated with cookies must send the same token in a header.
+// Other sites can not read the cookie, so they can not forge such requests. Requests authenticated with an API key
+// are not affected, since browsers never send the key on their own
+func CsrfProtection(cookies CookieConfig) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		token, err := ctx.Cookie(CsrfCookieName)
+		if err != nil || token == "" {
+			token = SetCsrfCookie(ctx, cookies)
+		}
+		if isSafeMethod(ctx.Request.Method) || !hasAuthCookie(ctx) {
+			ctx.Next()
+			return
+		}
+		if _, ok := getApiKey(ctx); ok {
+			ctx.Next()
+			return
+		}
+		header := ctx.GetHeader(CsrfHeaderName)
+		if header == "" || subtle.ConstantTimeCompare([]byte(header), []byte(token)) != 1 {
+			ctx.AbortWithStatusJSON(http.StatusForbidden, "CSRF token missing or invalid")
+			return
+		}
+		ctx.Next()
+	}
+}
+
+// SetCsrfCookie sets a new CSRF token. Called on login, so that a token planted before the login can not be used
+func SetCsrfCookie(ctx *gin.Context, cookies CookieConfig) string {
+	token, err := generateRandomCode(32)
+	if err != nil {
+		log.Printf("could not generate CSRF token: %v", err)
+		return ""
+	}
+	cookies.Apply(ctx)
+	// Not HttpOnly, so that the page can copy the token to the header
+	ctx.SetCookie(CsrfCookieName, token, 0, "/", "", cookies.Secure, false)
+	return token
+}
+
+// CheckOrigin rejects state-changing requests and WebSocket handshakes sent from other sites. The Origin header (or
+// Referer, if Origin is not sent) must either match the host of the request or one of the allowed origins. Requests
+// without either header are let through, since they do not come from browsers
+func CheckOrigin(allowedOrigins []string) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		// WebSocket handshakes are GET requests, but browsers send cookies with them regardless of the origin
+		if isSafeMethod(ctx.Request.Method) && !isWebSocketUpgrade(ctx) {
+			ctx.Next()
+			return
+		}
+		origin := ctx.GetHeader("Origin")
+		if origin == "" {
+			origin = ctx.GetHeader("Referer")
+		}
+		if origin == "" {
+			ctx.Next()
+			return
+		}
+		parsed, err := url.Parse(origin)
+		if err != nil || parsed.Host == "" {
+			ctx.AbortWithStatusJSON(http.StatusForbidden, "origin not allowed")
+			return
+		}
+		if parsed.Host != ctx.Request.Host && !slices.Contains(allowedOrigins, parsed.Scheme+"://"+parsed.Host) {
+			ctx.AbortWithStatusJSON(http.StatusForbidden, "origin not allowed")
+			return
+		}
+		ctx.Next()
+	}
+}
+
+func isSafeMethod(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead || method == http.MethodOptions
+}
+
+func isWebSocketUpgrade(ctx *gin.Context) bool {
+	return strings.EqualFold(ctx.GetHeader("Upgrade"), "websocket")
+}
+
+func hasAuthCookie(ctx *gin.Context) bool {
+	for _, name := range []string{AccessTokenCookieName, RefreshTokenCookieName} {
+		if value, err := ctx.Cookie(name); err == nil && value != "" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,110 @@
+package authService_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/require"
+
+	"github.com/martynasd123/golang-scraper/services/auth"
+	. "github.com/martynasd123/golang-scraper/services/auth/constants"
+)
+
+func TestCsrfProtection(t *testing.T) {
+	router := createMiddlewareRouter(authService.CsrfProtection(authService.DefaultCookieConfig))
+
+	// Token is issued on the first request
+	res := serve(router, httptest.NewRequest(http.MethodGet, "/", nil))
+	require.Equal(t, http.StatusOK, res.Code)
+	var token string
+	for _, cookie := range res.Result().Cookies() {
+		if cookie.Name == CsrfCookieName {
+			token = cookie.Value
+			require.False(t, cookie.HttpOnly)
+			require.Equal(t, http.SameSiteLaxMode, cookie.SameSite)
+		}
+	}
+	require.NotEmpty(t, token)
+
+	// Requests without auth cookies can not be forged in a harmful way
+	res = serve(router, httptest.NewRequest(http.MethodPost, "/", nil))
+	require.Equal(t, http.StatusOK, res.Code)
+
+	req := httptest.NewRequest(http.MethodPost, "/", nil)
+	req.AddCookie(&http.Cookie{Name: AccessTokenCookieName, Value: "token"})
+	req.AddCookie(&http.Cookie{Name: CsrfCookieName, Value: token})
+	res = serve(router, req)
+	require.Equal(t, http.StatusForbidden, res.Code)
+
+	req.Header.Set(CsrfHeaderName, "other")
+	res = serve(router, req)
+	require.Equal(t, http.StatusForbidden, res.Code)
+
+	req.Header.Set(CsrfHeaderName, token)
+	res = serve(router, req)
+	require.Equal(t, http.StatusOK, res.Code)
+
+	// API keys are not sent by browsers automatically
+	req = httptest.NewRequest(http.MethodPost, "/", nil)
+	req.AddCookie(&http.Cookie{Name: AccessTokenCookieName, Value: "token"})
+	req.Header.Set(ApiKeyHeaderName, "sk_key")
+	res = serve(router, req)
+	require.Equal(t, http.StatusOK, res.Code)
+}
+
+func TestCheckOrigin(t *testing.T) {
+	router := createMiddlewareRouter(authService.CheckOrigin([]string{"https://scraper.example.com"}))
+
+	tests := []struct {
+		name    string
+		method  string
+		header  string
+		value   string
+		upgrade bool
+		allowed bool
+	}{
+		{"same host", http.MethodPost, "Origin", "http://example.com", false, true},
+		{"allowed origin", http.MethodPost, "Origin", "https://scraper.example.com", false, true},
+		{"other origin", http.MethodPost, "Origin", "https://evil.com", false, false},
+		{"opaque origin", http.MethodPost, "Origin", "null", false, false},
+		{"other referer", http.MethodDelete, "Referer", "https://evil.com/page", false, false},
+		{"no origin", http.MethodPost, "", "", false, true},
+		{"safe method", http.MethodGet, "Origin", "https://evil.com", false, true},
+		{"websocket", http.MethodGet, "Origin", "https://evil.com", true, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest(test.method, "/", nil)
+			if test.header != "" {
+				req.Header.Set(test.header, test.value)
+			}
+			if test.upgrade {
+				req.Header.Set("Upgrade", "websocket")
+			}
+			res := serve(router, req)
+			if test.allowed {
+				require.Equal(t, http.StatusOK, res.Code)
+			} else {
+				require.Equal(t, http.StatusForbidden, res.Code)
+			}
+		})
+	}
+}
+
+func createMiddlewareRouter(middleware gin.HandlerFunc) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(middleware)
+	router.Any("/", func(ctx *gin.Context) {
+		ctx.Status(http.StatusOK)
+	})
+	return router
+}
+
+func serve(router *gin.Engine, req *http.Request) *httptest.ResponseRecorder {
+	res := httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+	return res
+}
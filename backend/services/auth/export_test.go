@@ -0,0 +1,12 @@
+package authService
+
+import "time"
+
+// TotpCode returns the code, which an authenticator app shows at the given time
+func TotpCode(secret string, now time.Time) string {
+	code, err := totpCode(secret, totpStep(now))
+	if err != nil {
+		panic(err)
+	}
+	return code
+}
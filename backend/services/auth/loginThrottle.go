@@ -0,0 +1,222 @@
+package authService
+
+import (
+	"errors"
+	"fmt"
+	"github.com/martynasd123/golang-scraper/utils/clock"
+	"sync"
+	"time"
+)
+
+var (
+	ErrLoginThrottled = errors.New("too many failed login attempts")
+	ErrAccountLocked  = errors.New("account is temporarily locked")
+)
+
+// ThrottledError is returned when a login attempt is rejected without checking the password. It wraps either
+// ErrLoginThrottled or ErrAccountLocked
+type ThrottledError struct {
+	Err error
+	// Time until the next attempt is accepted
+	RetryAfter time.Duration
+}
+
+func (err *ThrottledError) Error() string {
+	return fmt.Sprintf("%s, retry after %s", err.Err, err.RetryAfter)
+}
+
+func (err *ThrottledError) Unwrap() error {
+	return err.Err
+}
+
+// ThrottlePolicy configures the delays between failed login attempts
+type ThrottlePolicy struct {
+	// Number of failed attempts, which are not delayed
+	FreeAttempts int
+	// Delay after the first delayed attempt. Doubles with every further failed attempt, up to MaxDelay
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+	// Number of failed attempts of a username, after which the account is locked
+	LockoutThreshold int
+	LockoutDuration  time.Duration
+	// Failed attempts are forgotten, if there were none for this long
+	FailureWindow time.Duration
+}
+
+var DefaultThrottlePolicy = ThrottlePolicy{
+	FreeAttempts:     3,
+	BaseDelay:        time.Second,
+	MaxDelay:         time.Minute,
+	LockoutThreshold: 10,
+	LockoutDuration:  15 * time.Minute,
+	FailureWindow:    time.Hour,
+}
+
+type failedAttempts struct {
+	count       int
+	lastFailure time.Time
+	// Attempts are rejected until this time
+	blockedUntil time.Time
+	locked       bool
+	// Attempts, which were allowed by Check, but whose outcome is not recorded yet
+	pending int
+}
+
+// LoginThrottle tracks failed login attempts per username and per client IP. Attempts are delayed exponentially once
+// there are too many failures, and usernames are locked for a while after LockoutThreshold failures.
+//
+// Every attempt allowed by Check is reserved until its outcome is recorded through RecordFailure, RecordSuccess or
+// Release. Reserved attempts count as failures, so that parallel attempts can not get past the delays: once the free
+// attempts are used up, only one attempt is allowed at a time
+type LoginThrottle struct {
+	mu     sync.Mutex
+	clock  clock.Clock
+	policy ThrottlePolicy
+	byUser map[string]*failedAttempts
+	byIP   map[string]*failedAttempts
+}
+
+func CreateLoginThrottle(policy ThrottlePolicy, clock clock.Clock) *LoginThrottle {
+	return &LoginThrottle{
+		clock:  clock,
+		policy: policy,
+		byUser: make(map[string]*failedAttempts),
+		byIP:   make(map[string]*failedAttempts),
+	}
+}
+
+// Check returns a ThrottledError if an attempt to log in as the user from the IP is not allowed yet. Otherwise, the
+// attempt is reserved until its outcome is recorded
+func (throttle *LoginThrottle) Check(username, ip string) error {
+	throttle.mu.Lock()
+	defer throttle.mu.Unlock()
+
+	now := throttle.clock.Now()
+	user := throttle.get(throttle.byUser, username, now)
+	if user != nil && user.locked && now.Before(user.blockedUntil) {
+		return &ThrottledError{Err: ErrAccountLocked, RetryAfter: user.blockedUntil.Sub(now)}
+	}
+	ipAttempts := throttle.get(throttle.byIP, ip, now)
+	var retryAfter time.Duration
+	for _, attempts := range []*failedAttempts{user, ipAttempts} {
+		if attempts == nil {
+			continue
+		}
+		if now.Before(attempts.blockedUntil) {
+			retryAfter = max(retryAfter, attempts.blockedUntil.Sub(now))
+		} else if attempts.pending > 0 && attempts.count+attempts.pending >= throttle.policy.FreeAttempts {
+			// The attempt would be delayed if the pending one fails, which is not known yet
+			retryAfter = max(retryAfter, throttle.policy.BaseDelay)
+		}
+	}
+	if retryAfter > 0 {
+		return &ThrottledError{Err: ErrLoginThrottled, RetryAfter: retryAfter}
+	}
+	throttle.reserve(throttle.byUser, username, user)
+	throttle.reserve(throttle.byIP, ip, ipAttempts)
+	return nil
+}
+
+// RecordFailure records a failed attempt. Returns true if the account got locked because of it
+func (throttle *LoginThrottle) RecordFailure(username, ip string) bool {
+	throttle.mu.Lock()
+	defer throttle.mu.Unlock()
+
+	now := throttle.clock.Now()
+	throttle.release(throttle.byIP, ip, now)
+	throttle.release(throttle.byUser, username, now)
+	throttle.recordFailure(throttle.byIP, ip, now)
+	user := throttle.recordFailure(throttle.byUser, username, now)
+	if !user.locked && user.count >= throttle.policy.LockoutThreshold {
+		user.locked = true
+		user.blockedUntil = now.Add(throttle.policy.LockoutDuration)
+		return true
+	}
+	return false
+}
+
+// RecordSuccess forgets failed attempts of the user and the IP
+func (throttle *LoginThrottle) RecordSuccess(username, ip string) {
+	throttle.mu.Lock()
+	defer throttle.mu.Unlock()
+	delete(throttle.byUser, username)
+	delete(throttle.byIP, ip)
+}
+
+// Release ends the attempt without counting it as a failure or a success, e.g. if the user is disabled or still has to
+// provide the second factor
+func (throttle *LoginThrottle) Release(username, ip string) {
+	throttle.mu.Lock()
+	defer throttle.mu.Unlock()
+
+	now := throttle.clock.Now()
+	throttle.release(throttle.byUser, username, now)
+	throttle.release(throttle.byIP, ip, now)
+}
+
+// Unlock forgets failed attempts of the user, so that the user can log in right away
+func (throttle *LoginThrottle) Unlock(username string) {
+	throttle.mu.Lock()
+	defer throttle.mu.Unlock()
+	delete(throttle.byUser, username)
+}
+
+// Returns failed attempts of the key, if they are still relevant
+func (throttle *LoginThrottle) get(attempts map[string]*failedAttempts, key string, now time.Time) *failedAttempts {
+	entry, ok := attempts[key]
+	if !ok {
+		return nil
+	}
+	expired := now.Sub(entry.lastFailure) > throttle.policy.FailureWindow && !now.Before(entry.blockedUntil)
+	if entry.locked && !now.Before(entry.blockedUntil) {
+		// Lockout is over - the user gets a fresh start
+		expired = true
+	}
+	if expired {
+		if entry.pending == 0 {
+			delete(attempts, key)
+			return nil
+		}
+		*entry = failedAttempts{pending: entry.pending}
+	}
+	return entry
+}
+
+func (throttle *LoginThrottle) reserve(attempts map[string]*failedAttempts, key string, entry *failedAttempts) {
+	if entry == nil {
+		entry = &failedAttempts{}
+		attempts[key] = entry
+	}
+	entry.pending++
+}
+
+// Ends a reserved attempt. Attempts may have been forgotten in the meantime, e.g. on success of a parallel attempt
+func (throttle *LoginThrottle) release(attempts map[string]*failedAttempts, key string, now time.Time) {
+	if entry := throttle.get(attempts, key, now); entry != nil && entry.pending > 0 {
+		entry.pending--
+		// Forgets the entry, if it only existed because of the reservation
+		throttle.get(attempts, key, now)
+	}
+}
+
+func (throttle *LoginThrottle) recordFailure(
+	attempts map[string]*failedAttempts,
+	key string,
+	now time.Time,
+) *failedAttempts {
+	entry := throttle.get(attempts, key, now)
+	if entry == nil {
+		entry = &failedAttempts{}
+		attempts[key] = entry
+	}
+	entry.count++
+	entry.lastFailure = now
+	if delayed := entry.count - throttle.policy.FreeAttempts; delayed > 0 {
+		delay := throttle.policy.BaseDelay
+		for i := 1; i < delayed && delay < throttle.policy.MaxDelay; i++ {
+			delay *= 2
+		}
+		entry.blockedUntil = now.Add(min(delay, throttle.policy.MaxDelay))
+	}
+	return entry
+}
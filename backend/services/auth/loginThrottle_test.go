@@ -0,0 +1,174 @@
+package authService_test
+
+import (
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/require"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/martynasd123/golang-scraper/models/principal"
+	"github.com/martynasd123/golang-scraper/models/role"
+	"github.com/martynasd123/golang-scraper/services/auth"
+	"github.com/martynasd123/golang-scraper/storage"
+	"github.com/martynasd123/golang-scraper/utils/clock"
+)
+
+var testPolicy = authService.ThrottlePolicy{
+	FreeAttempts:     2,
+	BaseDelay:        time.Second,
+	MaxDelay:         4 * time.Second,
+	LockoutThreshold: 6,
+	LockoutDuration:  time.Minute,
+	FailureWindow:    time.Hour,
+}
+
+func TestLoginThrottle_ExponentialDelay(t *testing.T) {
+	fakeClock := clock.CreateFakeClock(time.Now())
+	throttle := authService.CreateLoginThrottle(testPolicy, fakeClock)
+
+	for range 2 {
+		require.NoError(t, throttle.Check("testuser", "127.0.0.1"))
+		throttle.RecordFailure("testuser", "127.0.0.1")
+	}
+	require.NoError(t, throttle.Check("testuser", "127.0.0.1"))
+
+	// Delays double with every failure, up to the maximum
+	for _, expectedDelay := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second} {
+		throttle.RecordFailure("testuser", "127.0.0.1")
+		err := throttle.Check("testuser", "127.0.0.1")
+		require.ErrorIs(t, err, authService.ErrLoginThrottled)
+		var throttled *authService.ThrottledError
+		require.True(t, errors.As(err, &throttled))
+		require.Equal(t, expectedDelay, throttled.RetryAfter)
+
+		fakeClock.Advance(expectedDelay)
+		require.NoError(t, throttle.Check("testuser", "127.0.0.1"))
+	}
+
+	// The last attempt neither failed nor succeeded
+	throttle.Release("testuser", "127.0.0.1")
+
+	// The IP is throttled for other usernames as well
+	require.NoError(t, throttle.Check("otheruser", "127.0.0.1"))
+	throttle.RecordFailure("otheruser", "127.0.0.1")
+	require.ErrorIs(t, throttle.Check("otheruser", "127.0.0.1"), authService.ErrLoginThrottled)
+	require.NoError(t, throttle.Check("otheruser", "127.0.0.2"))
+
+	throttle.RecordSuccess("testuser", "127.0.0.1")
+	require.NoError(t, throttle.Check("testuser", "127.0.0.1"))
+}
+
+func TestLoginThrottle_ParallelAttempts(t *testing.T) {
+	fakeClock := clock.CreateFakeClock(time.Now())
+	throttle := authService.CreateLoginThrottle(testPolicy, fakeClock)
+
+	// Free attempts can run in parallel, but further ones have to wait for their outcome
+	for range testPolicy.FreeAttempts {
+		require.NoError(t, throttle.Check("testuser", "127.0.0.1"))
+	}
+	require.ErrorIs(t, throttle.Check("testuser", "127.0.0.1"), authService.ErrLoginThrottled)
+	require.ErrorIs(t, throttle.Check("testuser", "127.0.0.2"), authService.ErrLoginThrottled)
+	require.ErrorIs(t, throttle.Check("otheruser", "127.0.0.1"), authService.ErrLoginThrottled)
+
+	for range testPolicy.FreeAttempts {
+		throttle.RecordFailure("testuser", "127.0.0.1")
+	}
+	require.NoError(t, throttle.Check("testuser", "127.0.0.1"))
+	require.ErrorIs(t, throttle.Check("testuser", "127.0.0.1"), authService.ErrLoginThrottled)
+
+	// Released attempts are not counted
+	throttle.Release("testuser", "127.0.0.1")
+	require.NoError(t, throttle.Check("testuser", "127.0.0.1"))
+	throttle.RecordFailure("testuser", "127.0.0.1")
+	require.ErrorIs(t, throttle.Check("testuser", "127.0.0.1"), authService.ErrLoginThrottled)
+	fakeClock.Advance(testPolicy.BaseDelay)
+	require.NoError(t, throttle.Check("testuser", "127.0.0.1"))
+}
+
+func TestAuthService_ParallelLogins(t *testing.T) {
+	auth := createAuthService(t, storage.CreateAuthInMemoryDao())
+	auth.SetLoginThrottle(authService.CreateLoginThrottle(testPolicy, clock.CreateFakeClock(time.Now())))
+	require.NoError(t, auth.CreateUser(principal.System, "testuser", "password1", role.Operator))
+
+	// A burst of guesses only gets as many password checks as there are free attempts, plus the one pending
+	var wg sync.WaitGroup
+	var checked atomic.Int32
+	for range 20 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, _, _, err := auth.Login("testuser", "wrong", "127.0.0.1", "Mozilla/5.0")
+			if errors.Is(err, authService.ErrPasswordIncorrect) {
+				checked.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	require.LessOrEqual(t, checked.Load(), int32(testPolicy.FreeAttempts+1))
+}
+
+func TestLoginThrottle_Lockout(t *testing.T) {
+	fakeClock := clock.CreateFakeClock(time.Now())
+	throttle := authService.CreateLoginThrottle(testPolicy, fakeClock)
+
+	locked := false
+	for i := range testPolicy.LockoutThreshold {
+		// Attempts come from different IPs, so that only the username is throttled
+		ip := fmt.Sprintf("10.0.0.%d", i)
+		fakeClock.Advance(testPolicy.MaxDelay)
+		require.NoError(t, throttle.Check("testuser", ip))
+		locked = throttle.RecordFailure("testuser", ip)
+	}
+	require.True(t, locked)
+	require.ErrorIs(t, throttle.Check("testuser", "10.0.1.1"), authService.ErrAccountLocked)
+
+	fakeClock.Advance(testPolicy.LockoutDuration)
+	require.NoError(t, throttle.Check("testuser", "10.0.1.1"))
+}
+
+func TestAuthService_LoginLockoutAndUnlock(t *testing.T) {
+	keys, err := authService.GenerateKeySet()
+	require.NoError(t, err)
+	auditStorage := storage.CreateAuditInMemoryDao()
+	auth := authService.CreateAuthService(
+		storage.CreateAuthInMemoryDao(),
+		storage.CreateSessionInMemoryDao(),
+		storage.CreateRevocationInMemoryDao(),
+		auditStorage,
+		keys,
+	)
+	fakeClock := clock.CreateFakeClock(time.Now())
+	auth.SetLoginThrottle(authService.CreateLoginThrottle(testPolicy, fakeClock))
+	require.NoError(t, auth.CreateUser(principal.System, "testuser", "password1", role.Operator))
+
+	for range testPolicy.LockoutThreshold {
+		fakeClock.Advance(testPolicy.MaxDelay)
+		_, _, _, err = auth.Login("testuser", "wrong", "127.0.0.1", "Mozilla/5.0")
+		require.ErrorIs(t, err, authService.ErrPasswordIncorrect)
+	}
+	fakeClock.Advance(testPolicy.MaxDelay)
+	// Even the correct password is rejected while the account is locked
+	_, _, _, err = auth.Login("testuser", "password1", "127.0.0.1", "Mozilla/5.0")
+	require.ErrorIs(t, err, authService.ErrAccountLocked)
+
+	events := auditStorage.GetEvents(storage.AuditFilter{Action: authService.AuditActionAccountLocked})
+	require.Len(t, events, 1)
+	require.Equal(t, "testuser", events[0].Target)
+	failedLogins := auditStorage.GetEvents(storage.AuditFilter{
+		Action:  authService.AuditActionLogin,
+		Outcome: storage.AuditOutcomeFailure,
+	})
+	require.Len(t, failedLogins, testPolicy.LockoutThreshold+1)
+
+	require.NoError(t, auth.UnlockUser(principal.Principal{Username: "admin"}, "testuser"))
+	_, _, _, err = auth.Login("testuser", "password1", "127.0.0.2", "Mozilla/5.0")
+	require.NoError(t, err)
+	events = auditStorage.GetEvents(storage.AuditFilter{Action: authService.AuditActionAccountUnlocked})
+	require.Len(t, events, 1)
+	require.Equal(t, "admin", events[0].Actor)
+
+	require.ErrorIs(t, auth.UnlockUser(principal.Principal{Username: "admin"}, "nonexistentuser"), authService.ErrUserNotExist)
+}
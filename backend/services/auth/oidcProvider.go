@@ -0,0 +1,297 @@
+package authService
+
+import (
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/martynasd123/golang-scraper/models/role"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrOidcDiscoveryFailed = errors.New("could not load OpenID Connect provider configuration")
+	ErrOidcStateInvalid    = errors.New("single sign-on login is invalid or expired")
+	ErrOidcExchangeFailed  = errors.New("could not exchange authorization code")
+	ErrOidcTokenInvalid    = errors.New("ID token is invalid")
+)
+
+// Time the user has to log in at the provider
+const oidcLoginLifetime = 10 * time.Minute
+
+// OidcConfig configures the OpenID Connect provider, which users can log in with instead of a password
+type OidcConfig struct {
+	// Issuer URL of the provider. The provider configuration is loaded from /.well-known/openid-configuration
+	Issuer       string
+	ClientId     string
+	ClientSecret string
+	// URL of the callback endpoint, which the provider redirects the user back to
+	RedirectUrl string
+	// Claim of the ID token, which is used as the username (e.g. preferred_username or email)
+	UsernameClaim string
+	// Whether users, who log in for the first time, are created. Otherwise, an administrator has to create them
+	AutoProvision bool
+	// Whether an existing user, whose identity is not linked yet, is linked on login if the identity has a verified
+	// email equal to the username. Otherwise, users have to link their identity themselves while logged in
+	LinkVerifiedEmail bool
+	// Role of the created users
+	DefaultRole role.Role
+}
+
+// Parts of the provider configuration, which the authorization code flow uses
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JwksUri               string `json:"jwks_uri"`
+}
+
+// Login, which was started, but the user was not redirected back yet
+type oidcLogin struct {
+	codeVerifier string
+	nonce        string
+	expiresAt    time.Time
+	// Username of the logged-in user, who started the login to link the identity to their account
+	linkUsername string
+}
+
+// OidcIdentity is the user information taken from a verified ID token
+type OidcIdentity struct {
+	Subject  string
+	Username string
+	// Set only if the provider has verified the email
+	VerifiedEmail string
+	// Username of the logged-in user, who started the login to link the identity to their account. Empty for logins
+	LinkUsername string
+}
+
+// OidcProvider implements the authorization code flow with PKCE against an OpenID Connect provider
+type OidcProvider struct {
+	config    OidcConfig
+	client    *http.Client
+	discovery oidcDiscovery
+
+	mu sync.Mutex
+	// Signing keys of the provider by key ID. Reloaded when a token is signed with an unknown key
+	keys map[string]interface{}
+	// Started logins by state
+	logins map[string]*oidcLogin
+}
+
+// CreateOidcProvider loads the configuration of the provider. The client is used for all requests to the provider
+func CreateOidcProvider(config OidcConfig, client *http.Client) (*OidcProvider, error) {
+	if config.UsernameClaim == "" {
+		config.UsernameClaim = "preferred_username"
+	}
+	provider := &OidcProvider{
+		config: config,
+		client: client,
+		keys:   make(map[string]interface{}),
+		logins: make(map[string]*oidcLogin),
+	}
+	discoveryUrl := strings.TrimSuffix(config.Issuer, "/") + "/.well-known/openid-configuration"
+	if err := provider.getJson(discoveryUrl, &provider.discovery); err != nil {
+		return nil, errors.Join(ErrOidcDiscoveryFailed, err)
+	}
+	if provider.discovery.Issuer != config.Issuer {
+		return nil, fmt.Errorf("%w: issuer %q does not match %q", ErrOidcDiscoveryFailed, provider.discovery.Issuer, config.Issuer)
+	}
+	return provider, nil
+}
+
+// AuthorizationUrl starts a login and returns the URL of the provider, which the user has to be redirected to, along
+// with the state, which the provider sends back to the callback
+func (provider *OidcProvider) AuthorizationUrl(linkUsername string) (authorizationUrl, state string, err error) {
+	if state, err = generateRandomCode(32); err != nil {
+		return "", "", err
+	}
+	login := &oidcLogin{expiresAt: time.Now().Add(oidcLoginLifetime), linkUsername: linkUsername}
+	if login.codeVerifier, err = generateRandomCode(64); err != nil {
+		return "", "", err
+	}
+	if login.nonce, err = generateRandomCode(32); err != nil {
+		return "", "", err
+	}
+
+	provider.mu.Lock()
+	now := time.Now()
+	for pendingState, pending := range provider.logins {
+		if !now.Before(pending.expiresAt) {
+			delete(provider.logins, pendingState)
+		}
+	}
+	provider.logins[state] = login
+	provider.mu.Unlock()
+
+	challenge := sha256.Sum256([]byte(login.codeVerifier))
+	query := url.Values{}
+	query.Set("response_type", "code")
+	query.Set("client_id", provider.config.ClientId)
+	query.Set("redirect_uri", provider.config.RedirectUrl)
+	query.Set("scope", "openid profile email")
+	query.Set("state", state)
+	query.Set("nonce", login.nonce)
+	query.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	query.Set("code_challenge_method", "S256")
+
+	separator := "?"
+	if strings.Contains(provider.discovery.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+	return provider.discovery.AuthorizationEndpoint + separator + query.Encode(), state, nil
+}
+
+// Exchange finishes the login started with the state. The authorization code is exchanged for an ID token, which is
+// verified and returned as the identity of the user
+func (provider *OidcProvider) Exchange(state, code string) (*OidcIdentity, error) {
+	provider.mu.Lock()
+	login, ok := provider.logins[state]
+	delete(provider.logins, state)
+	provider.mu.Unlock()
+	if !ok || !time.Now().Before(login.expiresAt) {
+		return nil, ErrOidcStateInvalid
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", provider.config.RedirectUrl)
+	form.Set("client_id", provider.config.ClientId)
+	form.Set("code_verifier", login.codeVerifier)
+	req, err := http.NewRequest(http.MethodPost, provider.discovery.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, errors.Join(ErrOidcExchangeFailed, err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if provider.config.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(provider.config.ClientId), url.QueryEscape(provider.config.ClientSecret))
+	}
+	res, err := provider.client.Do(req)
+	if err != nil {
+		return nil, errors.Join(ErrOidcExchangeFailed, err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%w: token endpoint responded with %s", ErrOidcExchangeFailed, res.Status)
+	}
+	var tokens struct {
+		IdToken string `json:"id_token"`
+	}
+	if err = json.NewDecoder(res.Body).Decode(&tokens); err != nil {
+		return nil, errors.Join(ErrOidcExchangeFailed, err)
+	}
+	identity, err := provider.verifyIdToken(tokens.IdToken, login.nonce)
+	if err != nil {
+		return nil, err
+	}
+	identity.LinkUsername = login.linkUsername
+	return identity, nil
+}
+
+func (provider *OidcProvider) verifyIdToken(idToken, nonce string) (*OidcIdentity, error) {
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(idToken, claims, provider.verificationKey,
+		jwt.WithValidMethods([]string{jwt.SigningMethodRS256.Alg(), jwt.SigningMethodEdDSA.Alg()}),
+		jwt.WithIssuer(provider.discovery.Issuer),
+		jwt.WithAudience(provider.config.ClientId),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuedAt(),
+	)
+	if err != nil {
+		return nil, errors.Join(ErrOidcTokenInvalid, err)
+	}
+	if tokenNonce, _ := claims["nonce"].(string); tokenNonce != nonce {
+		return nil, fmt.Errorf("%w: nonce does not match", ErrOidcTokenInvalid)
+	}
+	subject, _ := claims["sub"].(string)
+	username, _ := claims[provider.config.UsernameClaim].(string)
+	if subject == "" || username == "" {
+		return nil, fmt.Errorf("%w: sub or %s claim is missing", ErrOidcTokenInvalid, provider.config.UsernameClaim)
+	}
+	identity := &OidcIdentity{Subject: subject, Username: username}
+	if verified, _ := claims["email_verified"].(bool); verified {
+		identity.VerifiedEmail, _ = claims["email"].(string)
+	}
+	return identity, nil
+}
+
+// Finds the key of the provider, which the token is signed with. Keys are reloaded if the key is not known, since
+// providers rotate their keys
+func (provider *OidcProvider) verificationKey(token *jwt.Token) (interface{}, error) {
+	id, _ := token.Header["kid"].(string)
+	provider.mu.Lock()
+	key, ok := provider.keys[id]
+	provider.mu.Unlock()
+	if ok {
+		return key, nil
+	}
+
+	var jwks struct {
+		Keys []Jwk `json:"keys"`
+	}
+	if err := provider.getJson(provider.discovery.JwksUri, &jwks); err != nil {
+		return nil, err
+	}
+	keys := make(map[string]interface{}, len(jwks.Keys))
+	for _, jwk := range jwks.Keys {
+		if publicKey, err := jwk.publicKey(); err == nil {
+			keys[jwk.Kid] = publicKey
+		}
+	}
+	provider.mu.Lock()
+	provider.keys = keys
+	provider.mu.Unlock()
+
+	if key, ok = keys[id]; !ok {
+		return nil, ErrUnknownKeyId
+	}
+	return key, nil
+}
+
+func (provider *OidcProvider) getJson(url string, value interface{}) error {
+	res, err := provider.client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s responded with %s", url, res.Status)
+	}
+	return json.NewDecoder(res.Body).Decode(value)
+}
+
+// Converts the JSON Web Key to an RSA or Ed25519 public key
+func (jwk *Jwk) publicKey() (interface{}, error) {
+	switch {
+	case jwk.Kty == "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(jwk.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(jwk.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case jwk.Kty == "OKP" && jwk.Crv == "Ed25519":
+		x, err := base64.RawURLEncoding.DecodeString(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return nil, ErrUnsupportedKey
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, ErrUnsupportedKey
+}
@@ -0,0 +1,166 @@
+package authService
+
+import (
+	"errors"
+	"github.com/martynasd123/golang-scraper/models/principal"
+	auth "github.com/martynasd123/golang-scraper/storage"
+	"strings"
+	"time"
+)
+
+var (
+	ErrOidcNotConfigured    = errors.New("single sign-on is not configured")
+	ErrOidcUserNotExist     = errors.New("user does not exist and is not provisioned automatically")
+	ErrOidcSubjectMismatch  = errors.New("user is linked to a different single sign-on identity")
+	ErrOidcAccountNotLinked = errors.New("user exists, but is not linked to the single sign-on identity")
+	ErrOidcIdentityLinked   = errors.New("single sign-on identity is linked to a different user")
+)
+
+// SetOidcProvider enables logging in through the OpenID Connect provider
+func (authService *AuthService) SetOidcProvider(provider *OidcProvider) {
+	authService.oidc = provider
+}
+
+// StartOidcLogin returns the URL, which the user has to be redirected to in order to log in at the provider, and the
+// state, which is expected on the callback
+func (authService *AuthService) StartOidcLogin() (authorizationUrl, state string, err error) {
+	if authService.oidc == nil {
+		return "", "", ErrOidcNotConfigured
+	}
+	return authService.oidc.AuthorizationUrl("")
+}
+
+// StartOidcLink works like StartOidcLogin, but the identity the user logs in with at the provider is linked to the
+// account of the logged-in user once the callback is reached
+func (authService *AuthService) StartOidcLink(actor principal.Principal) (authorizationUrl, state string, err error) {
+	if authService.oidc == nil {
+		return "", "", ErrOidcNotConfigured
+	}
+	if _, err = authService.authStorage.GetUser(actor.Username); err != nil {
+		return "", "", errors.Join(ErrUserNotExist, err)
+	}
+	return authService.oidc.AuthorizationUrl(actor.Username)
+}
+
+// FinishOidcLogin exchanges the authorization code, maps the identity to a local user and starts a session. If the
+// user has a second factor, SecondFactorRequiredError is returned instead, same as by Login, since the provider can
+// not be relied on to have checked one.
+//
+// Existing users are never taken over by matching the username alone: the identity has to be linked to them through
+// StartOidcLink first, or carry a verified email equal to the username if LinkVerifiedEmail is enabled
+func (authService *AuthService) FinishOidcLogin(state, code, ip, userAgent string) (
+	accessToken, refreshToken *string,
+	refreshTokenValidUntil *time.Time,
+	err error,
+) {
+	if authService.oidc == nil {
+		return nil, nil, nil, ErrOidcNotConfigured
+	}
+	identity, err := authService.oidc.Exchange(state, code)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	var user *auth.User
+	if identity.LinkUsername != "" {
+		if user, err = authService.linkOidcIdentity(identity, ip, userAgent); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+	actor := principal.Principal{Username: identity.Username, IP: ip, UserAgent: userAgent}
+	defer func() {
+		var secondFactorRequired *SecondFactorRequiredError
+		if !errors.As(err, &secondFactorRequired) {
+			authService.audit(actor, AuditActionLogin, actor.Username, err)
+		}
+	}()
+
+	if user == nil {
+		user = authService.findOidcUser(identity.Subject)
+	}
+	if user == nil {
+		if user, err = authService.authStorage.GetUser(identity.Username); err != nil {
+			if !authService.oidc.config.AutoProvision {
+				return nil, nil, nil, errors.Join(ErrOidcUserNotExist, err)
+			}
+			if user, err = authService.provisionUser(actor, identity); err != nil {
+				return nil, nil, nil, err
+			}
+		}
+	}
+	actor.Username = user.Username
+	if user.Disabled {
+		return nil, nil, nil, ErrUserDisabled
+	}
+	switch {
+	case user.OidcSubject == identity.Subject:
+	case user.OidcSubject != "":
+		return nil, nil, nil, ErrOidcSubjectMismatch
+	case authService.oidc.config.LinkVerifiedEmail && identity.VerifiedEmail != "" &&
+		strings.EqualFold(identity.VerifiedEmail, user.Username):
+		user.OidcSubject = identity.Subject
+		err = authService.authStorage.UpdateUser(user)
+		authService.audit(actor, AuditActionUserOidcLinked, user.Username, err)
+		if err != nil {
+			return nil, nil, nil, errors.Join(ErrUserPersistenceError, err)
+		}
+	default:
+		return nil, nil, nil, ErrOidcAccountNotLinked
+	}
+	if user.HasSecondFactor() {
+		challenge, err := authService.createChallenge(user.Username, ip, userAgent)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		return nil, nil, nil, &SecondFactorRequiredError{Challenge: challenge}
+	}
+	return authService.startSession(user, ip, userAgent)
+}
+
+// Links the identity to the user, who started the login through StartOidcLink
+func (authService *AuthService) linkOidcIdentity(identity *OidcIdentity, ip, userAgent string) (
+	user *auth.User,
+	err error,
+) {
+	actor := principal.Principal{Username: identity.LinkUsername, IP: ip, UserAgent: userAgent}
+	defer func() { authService.audit(actor, AuditActionUserOidcLinked, identity.LinkUsername, err) }()
+
+	if linked := authService.findOidcUser(identity.Subject); linked != nil && linked.Username != identity.LinkUsername {
+		return nil, ErrOidcIdentityLinked
+	}
+	if user, err = authService.authStorage.GetUser(identity.LinkUsername); err != nil {
+		return nil, errors.Join(ErrUserNotExist, err)
+	}
+	if user.OidcSubject != "" && user.OidcSubject != identity.Subject {
+		return nil, ErrOidcSubjectMismatch
+	}
+	user.OidcSubject = identity.Subject
+	if err = authService.authStorage.UpdateUser(user); err != nil {
+		return nil, errors.Join(ErrUserPersistenceError, err)
+	}
+	return user, nil
+}
+
+// Finds the user linked to the identity with the subject. Returns nil if there is none
+func (authService *AuthService) findOidcUser(subject string) *auth.User {
+	for _, user := range authService.authStorage.GetAllUsers() {
+		if user.OidcSubject == subject {
+			return user
+		}
+	}
+	return nil
+}
+
+// Creates a user without a password, who can only log in through the provider
+func (authService *AuthService) provisionUser(actor principal.Principal, identity *OidcIdentity) (*auth.User, error) {
+	user := &auth.User{
+		Username:    identity.Username,
+		Role:        authService.oidc.config.DefaultRole,
+		OidcSubject: identity.Subject,
+	}
+	err := authService.authStorage.CreateUser(user)
+	authService.audit(actor, AuditActionUserProvisioned, identity.Username, err)
+	if err != nil {
+		return nil, errors.Join(ErrUserPersistenceError, err)
+	}
+	return user, nil
+}
@@ -0,0 +1,339 @@
+package authService_test
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/require"
+
+	"github.com/martynasd123/golang-scraper/models/principal"
+	"github.com/martynasd123/golang-scraper/models/role"
+	"github.com/martynasd123/golang-scraper/services/auth"
+	"github.com/martynasd123/golang-scraper/storage"
+)
+
+const oidcClientId = "scraper"
+
+func TestAuthService_OidcLogin(t *testing.T) {
+	provider := createMockOidcProvider(t)
+	authStorage := storage.CreateAuthInMemoryDao()
+	auth := createOidcAuthService(t, authStorage, provider, true, false)
+
+	authorizationUrl, state, err := auth.StartOidcLogin()
+	require.NoError(t, err)
+	code := provider.authorize(t, authorizationUrl, "subject-1", "jane")
+
+	accessToken, refreshToken, _, err := auth.FinishOidcLogin(state, code, "127.0.0.1", "Mozilla/5.0")
+	require.NoError(t, err)
+	require.NotNil(t, refreshToken)
+	claims, err := auth.ValidateAccessToken(*accessToken)
+	require.NoError(t, err)
+	require.Equal(t, "jane", claims.Username)
+	require.Equal(t, role.Viewer, claims.Role)
+
+	user, err := authStorage.GetUser("jane")
+	require.NoError(t, err)
+	require.Equal(t, "subject-1", user.OidcSubject)
+
+	// State can only be used once
+	_, _, _, err = auth.FinishOidcLogin(state, code, "127.0.0.1", "Mozilla/5.0")
+	require.ErrorIs(t, err, authService.ErrOidcStateInvalid)
+}
+
+func TestAuthService_OidcLoginWithoutProvisioning(t *testing.T) {
+	provider := createMockOidcProvider(t)
+	auth := createOidcAuthService(t, storage.CreateAuthInMemoryDao(), provider, false, false)
+
+	authorizationUrl, state, err := auth.StartOidcLogin()
+	require.NoError(t, err)
+	code := provider.authorize(t, authorizationUrl, "subject-1", "jane")
+	_, _, _, err = auth.FinishOidcLogin(state, code, "127.0.0.1", "Mozilla/5.0")
+	require.ErrorIs(t, err, authService.ErrOidcUserNotExist)
+
+	// Existing users are not taken over by an identity with the same username, even if the email is verified
+	require.NoError(t, auth.CreateUser(principal.System, "jane", "password1", role.Operator))
+	authorizationUrl, state, err = auth.StartOidcLogin()
+	require.NoError(t, err)
+	code = provider.authorize(t, authorizationUrl, "subject-1", "jane")
+	provider.codes[code].email = "jane"
+	provider.codes[code].emailVerified = true
+	_, _, _, err = auth.FinishOidcLogin(state, code, "127.0.0.1", "Mozilla/5.0")
+	require.ErrorIs(t, err, authService.ErrOidcAccountNotLinked)
+}
+
+func TestAuthService_OidcLink(t *testing.T) {
+	provider := createMockOidcProvider(t)
+	authStorage := storage.CreateAuthInMemoryDao()
+	auth := createOidcAuthService(t, authStorage, provider, false, false)
+	require.NoError(t, auth.CreateUser(principal.System, "jane", "password1", role.Operator))
+	require.NoError(t, auth.CreateUser(principal.System, "john", "password1", role.Viewer))
+	jane := principal.Principal{Username: "jane"}
+
+	// The identity can have a different username at the provider
+	authorizationUrl, state, err := auth.StartOidcLink(jane)
+	require.NoError(t, err)
+	code := provider.authorize(t, authorizationUrl, "subject-1", "jane.doe")
+	_, _, _, err = auth.FinishOidcLogin(state, code, "127.0.0.1", "Mozilla/5.0")
+	require.NoError(t, err)
+	user, err := authStorage.GetUser("jane")
+	require.NoError(t, err)
+	require.Equal(t, "subject-1", user.OidcSubject)
+
+	// Linked users log in with the identity
+	authorizationUrl, state, err = auth.StartOidcLogin()
+	require.NoError(t, err)
+	code = provider.authorize(t, authorizationUrl, "subject-1", "jane.doe")
+	accessToken, _, _, err := auth.FinishOidcLogin(state, code, "127.0.0.1", "Mozilla/5.0")
+	require.NoError(t, err)
+	claims, err := auth.ValidateAccessToken(*accessToken)
+	require.NoError(t, err)
+	require.Equal(t, "jane", claims.Username)
+	require.Equal(t, role.Operator, claims.Role)
+
+	// The identity can not be linked to another user
+	authorizationUrl, state, err = auth.StartOidcLink(principal.Principal{Username: "john"})
+	require.NoError(t, err)
+	code = provider.authorize(t, authorizationUrl, "subject-1", "jane.doe")
+	_, _, _, err = auth.FinishOidcLogin(state, code, "127.0.0.1", "Mozilla/5.0")
+	require.ErrorIs(t, err, authService.ErrOidcIdentityLinked)
+
+	// A different identity with the same username is rejected
+	authorizationUrl, state, err = auth.StartOidcLogin()
+	require.NoError(t, err)
+	code = provider.authorize(t, authorizationUrl, "subject-2", "jane")
+	_, _, _, err = auth.FinishOidcLogin(state, code, "127.0.0.1", "Mozilla/5.0")
+	require.ErrorIs(t, err, authService.ErrOidcSubjectMismatch)
+}
+
+func TestAuthService_OidcLoginRequiresSecondFactor(t *testing.T) {
+	provider := createMockOidcProvider(t)
+	auth := createOidcAuthService(t, storage.CreateAuthInMemoryDao(), provider, true, false)
+	authorizationUrl, state, err := auth.StartOidcLogin()
+	require.NoError(t, err)
+	_, _, _, err = auth.FinishOidcLogin(state, provider.authorize(t, authorizationUrl, "subject-1", "jane"), "127.0.0.1", "Mozilla/5.0")
+	require.NoError(t, err)
+	secret := enableSecondFactor(t, auth, "jane")
+
+	authorizationUrl, state, err = auth.StartOidcLogin()
+	require.NoError(t, err)
+	code := provider.authorize(t, authorizationUrl, "subject-1", "jane")
+	accessToken, _, _, err := auth.FinishOidcLogin(state, code, "127.0.0.1", "Mozilla/5.0")
+	var secondFactorRequired *authService.SecondFactorRequiredError
+	require.ErrorAs(t, err, &secondFactorRequired)
+	require.Nil(t, accessToken)
+
+	// The code of the current period was used for confirmation, so the next one is used
+	code = authService.TotpCode(secret, time.Now().Add(30*time.Second))
+	accessToken, _, _, err = auth.VerifySecondFactor(secondFactorRequired.Challenge, code, "127.0.0.1", "Mozilla/5.0")
+	require.NoError(t, err)
+	claims, err := auth.ValidateAccessToken(*accessToken)
+	require.NoError(t, err)
+	require.Equal(t, "jane", claims.Username)
+}
+
+func TestAuthService_OidcLinkVerifiedEmail(t *testing.T) {
+	provider := createMockOidcProvider(t)
+	authStorage := storage.CreateAuthInMemoryDao()
+	auth := createOidcAuthService(t, authStorage, provider, false, true)
+	require.NoError(t, auth.CreateUser(principal.System, "jane@example.com", "password1", role.Operator))
+
+	// The email is not verified
+	authorizationUrl, state, err := auth.StartOidcLogin()
+	require.NoError(t, err)
+	code := provider.authorize(t, authorizationUrl, "subject-1", "jane@example.com")
+	provider.codes[code].email = "jane@example.com"
+	_, _, _, err = auth.FinishOidcLogin(state, code, "127.0.0.1", "Mozilla/5.0")
+	require.ErrorIs(t, err, authService.ErrOidcAccountNotLinked)
+
+	authorizationUrl, state, err = auth.StartOidcLogin()
+	require.NoError(t, err)
+	code = provider.authorize(t, authorizationUrl, "subject-1", "jane@example.com")
+	provider.codes[code].email = "Jane@Example.com"
+	provider.codes[code].emailVerified = true
+	_, _, _, err = auth.FinishOidcLogin(state, code, "127.0.0.1", "Mozilla/5.0")
+	require.NoError(t, err)
+	user, err := authStorage.GetUser("jane@example.com")
+	require.NoError(t, err)
+	require.Equal(t, "subject-1", user.OidcSubject)
+}
+
+func TestAuthService_OidcRejectsInvalidTokens(t *testing.T) {
+	provider := createMockOidcProvider(t)
+	auth := createOidcAuthService(t, storage.CreateAuthInMemoryDao(), provider, true, false)
+
+	// PKCE verifier does not match the challenge
+	authorizationUrl, state, err := auth.StartOidcLogin()
+	require.NoError(t, err)
+	code := provider.authorize(t, authorizationUrl, "subject-1", "jane")
+	provider.codes[code].challenge = "tampered"
+	_, _, _, err = auth.FinishOidcLogin(state, code, "127.0.0.1", "Mozilla/5.0")
+	require.ErrorIs(t, err, authService.ErrOidcExchangeFailed)
+
+	// ID token was issued for a different login
+	authorizationUrl, state, err = auth.StartOidcLogin()
+	require.NoError(t, err)
+	code = provider.authorize(t, authorizationUrl, "subject-1", "jane")
+	provider.codes[code].nonce = "other"
+	_, _, _, err = auth.FinishOidcLogin(state, code, "127.0.0.1", "Mozilla/5.0")
+	require.ErrorIs(t, err, authService.ErrOidcTokenInvalid)
+
+	// ID token is signed with a key, which the provider does not publish
+	authorizationUrl, state, err = auth.StartOidcLogin()
+	require.NoError(t, err)
+	code = provider.authorize(t, authorizationUrl, "subject-1", "jane")
+	provider.codes[code].key, err = rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	_, _, _, err = auth.FinishOidcLogin(state, code, "127.0.0.1", "Mozilla/5.0")
+	require.ErrorIs(t, err, authService.ErrOidcTokenInvalid)
+}
+
+func TestAuthService_OidcNotConfigured(t *testing.T) {
+	auth := createAuthService(t, storage.CreateAuthInMemoryDao())
+	_, _, err := auth.StartOidcLogin()
+	require.ErrorIs(t, err, authService.ErrOidcNotConfigured)
+}
+
+// Authorization code issued by the mock provider
+type mockAuthorization struct {
+	subject       string
+	username      string
+	email         string
+	emailVerified bool
+	nonce         string
+	challenge     string
+	key           *rsa.PrivateKey
+}
+
+// OpenID Connect provider, which skips the login page - codes are issued by calling authorize directly
+type mockOidcProvider struct {
+	server *httptest.Server
+	key    *rsa.PrivateKey
+
+	mu    sync.Mutex
+	codes map[string]*mockAuthorization
+}
+
+func createMockOidcProvider(t *testing.T) *mockOidcProvider {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	provider := &mockOidcProvider{key: key, codes: make(map[string]*mockAuthorization)}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		writeJson(w, map[string]string{
+			"issuer":                 provider.server.URL,
+			"authorization_endpoint": provider.server.URL + "/authorize",
+			"token_endpoint":         provider.server.URL + "/token",
+			"jwks_uri":               provider.server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		writeJson(w, map[string]interface{}{"keys": []authService.Jwk{{
+			Kty: "RSA",
+			Kid: "mock",
+			Alg: "RS256",
+			Use: "sig",
+			N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/token", provider.token)
+	provider.server = httptest.NewServer(mux)
+	t.Cleanup(provider.server.Close)
+	return provider
+}
+
+// Simulates the user logging in at the authorization URL. Returns the code, which the provider would redirect back with
+func (provider *mockOidcProvider) authorize(t *testing.T, authorizationUrl, subject, username string) string {
+	parsed, err := url.Parse(authorizationUrl)
+	require.NoError(t, err)
+	query := parsed.Query()
+	require.Equal(t, provider.server.URL+"/authorize", parsed.Scheme+"://"+parsed.Host+parsed.Path)
+	require.Equal(t, oidcClientId, query.Get("client_id"))
+	require.Equal(t, "S256", query.Get("code_challenge_method"))
+	require.NotEmpty(t, query.Get("state"))
+
+	provider.mu.Lock()
+	defer provider.mu.Unlock()
+	code := "code-" + query.Get("state")
+	provider.codes[code] = &mockAuthorization{
+		subject:   subject,
+		username:  username,
+		nonce:     query.Get("nonce"),
+		challenge: query.Get("code_challenge"),
+		key:       provider.key,
+	}
+	return code
+}
+
+func (provider *mockOidcProvider) token(w http.ResponseWriter, r *http.Request) {
+	provider.mu.Lock()
+	authorization, ok := provider.codes[r.PostFormValue("code")]
+	delete(provider.codes, r.PostFormValue("code"))
+	provider.mu.Unlock()
+	if !ok || r.PostFormValue("grant_type") != "authorization_code" || r.PostFormValue("client_id") != oidcClientId {
+		http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+		return
+	}
+	challenge := sha256.Sum256([]byte(r.PostFormValue("code_verifier")))
+	if base64.RawURLEncoding.EncodeToString(challenge[:]) != authorization.challenge {
+		http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+		return
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+		"iss":                provider.server.URL,
+		"aud":                oidcClientId,
+		"sub":                authorization.subject,
+		"preferred_username": authorization.username,
+		"email":              authorization.email,
+		"email_verified":     authorization.emailVerified,
+		"nonce":              authorization.nonce,
+		"iat":                time.Now().Unix(),
+		"exp":                time.Now().Add(time.Minute).Unix(),
+	})
+	token.Header["kid"] = "mock"
+	idToken, err := token.SignedString(authorization.key)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJson(w, map[string]string{"id_token": idToken, "token_type": "Bearer"})
+}
+
+func writeJson(w http.ResponseWriter, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(value)
+}
+
+func createOidcAuthService(
+	t *testing.T,
+	authStorage storage.AuthDao,
+	provider *mockOidcProvider,
+	autoProvision bool,
+	linkVerifiedEmail bool,
+) *authService.AuthService {
+	auth := createAuthService(t, authStorage)
+	oidc, err := authService.CreateOidcProvider(authService.OidcConfig{
+		Issuer:            provider.server.URL,
+		ClientId:          oidcClientId,
+		RedirectUrl:       "http://localhost:8080/api/auth/oidc/callback",
+		AutoProvision:     autoProvision,
+		LinkVerifiedEmail: linkVerifiedEmail,
+		DefaultRole:       role.Viewer,
+	}, provider.server.Client())
+	require.NoError(t, err)
+	auth.SetOidcProvider(oidc)
+	return auth
+}
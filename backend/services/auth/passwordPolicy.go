@@ -0,0 +1,31 @@
+package authService
+
+import (
+	"errors"
+	"unicode"
+)
+
+const (
+	MinPasswordLength = 8
+	// Bcrypt ignores everything past the first 72 bytes
+	MaxPasswordLength = 72
+)
+
+var ErrPasswordPolicy = errors.New("password does not satisfy the password policy")
+
+// ValidatePassword checks that the password is between MinPasswordLength and MaxPasswordLength bytes long and
+// contains at least one letter and one digit
+func ValidatePassword(password string) error {
+	if len(password) < MinPasswordLength || len(password) > MaxPasswordLength {
+		return ErrPasswordPolicy
+	}
+	hasLetter, hasDigit := false, false
+	for _, r := range password {
+		hasLetter = hasLetter || unicode.IsLetter(r)
+		hasDigit = hasDigit || unicode.IsDigit(r)
+	}
+	if !hasLetter || !hasDigit {
+		return ErrPasswordPolicy
+	}
+	return nil
+}
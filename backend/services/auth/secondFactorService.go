@@ -0,0 +1,242 @@
+package authService
+
+import (
+	"crypto/rand"
+	"errors"
+	"github.com/martynasd123/golang-scraper/models/principal"
+	auth "github.com/martynasd123/golang-scraper/storage"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Time the user has to enter the second factor after entering the password
+	challengeLifetime = 5 * time.Minute
+	// Number of wrong codes, after which the challenge is discarded and the user has to enter the password again
+	challengeMaxAttempts = 5
+	recoveryCodeCount    = 10
+)
+
+var (
+	ErrChallengeInvalid          = errors.New("login challenge is invalid or expired")
+	ErrSecondFactorIncorrect     = errors.New("second factor code is incorrect")
+	ErrSecondFactorEnabled       = errors.New("second factor is already enabled")
+	ErrSecondFactorNotEnrolled   = errors.New("second factor enrollment was not started")
+	ErrCouldNotGenerateChallenge = errors.New("could not generate login challenge")
+)
+
+// SecondFactorRequiredError is returned by Login and FinishOidcLogin, when the user authenticated, but has a second
+// factor. The challenge has to be passed to VerifySecondFactor along with the code to finish logging in
+type SecondFactorRequiredError struct {
+	Challenge string
+}
+
+func (err *SecondFactorRequiredError) Error() string {
+	return "second factor required"
+}
+
+// Login, which is waiting for the second factor
+type loginChallenge struct {
+	username  string
+	ip        string
+	userAgent string
+	expiresAt time.Time
+	attempts  int
+}
+
+// Pending logins by challenge hash
+type challengeStore struct {
+	mu         sync.Mutex
+	challenges map[string]*loginChallenge
+}
+
+// SecondFactorEnrollment is the information needed to add the account to an authenticator app
+type SecondFactorEnrollment struct {
+	Secret string
+	// otpauth:// URI, usually shown as a QR code
+	Uri string
+}
+
+func (authService *AuthService) createChallenge(username, ip, userAgent string) (string, error) {
+	challenge, err := generateRandomCode(32)
+	if err != nil {
+		return "", errors.Join(ErrCouldNotGenerateChallenge, err)
+	}
+	store := &authService.challenges
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	now := time.Now()
+	for hash, pending := range store.challenges {
+		if !now.Before(pending.expiresAt) {
+			delete(store.challenges, hash)
+		}
+	}
+	store.challenges[hashToken(challenge)] = &loginChallenge{
+		username:  username,
+		ip:        ip,
+		userAgent: userAgent,
+		expiresAt: now.Add(challengeLifetime),
+	}
+	return challenge, nil
+}
+
+// VerifySecondFactor finishes logging in with either a TOTP code or an unused recovery code. The request must come
+// from the same device, which the password was entered on
+func (authService *AuthService) VerifySecondFactor(challenge, code, ip, userAgent string) (
+	accessToken, refreshToken *string,
+	refreshTokenValidUntil *time.Time,
+	err error,
+) {
+	store := &authService.challenges
+	store.mu.Lock()
+	hash := hashToken(challenge)
+	pending, ok := store.challenges[hash]
+	if !ok || !time.Now().Before(pending.expiresAt) || pending.ip != ip || pending.userAgent != userAgent {
+		store.mu.Unlock()
+		return nil, nil, nil, ErrChallengeInvalid
+	}
+	pending.attempts++
+	if pending.attempts >= challengeMaxAttempts {
+		delete(store.challenges, hash)
+	}
+	store.mu.Unlock()
+
+	defer func() {
+		actor := principal.Principal{Username: pending.username, IP: ip, UserAgent: userAgent}
+		authService.audit(actor, AuditActionLogin, pending.username, err)
+	}()
+
+	if err = authService.throttle.Check(pending.username, ip); err != nil {
+		return nil, nil, nil, err
+	}
+	user, err := authService.authStorage.GetUser(pending.username)
+	if err != nil {
+		authService.throttle.Release(pending.username, ip)
+		return nil, nil, nil, errors.Join(ErrUserNotExist, err)
+	}
+	if user.Disabled {
+		authService.throttle.Release(pending.username, ip)
+		return nil, nil, nil, ErrUserDisabled
+	}
+	correct, err := authService.consumeSecondFactor(user, code)
+	if err != nil {
+		authService.throttle.Release(pending.username, ip)
+		return nil, nil, nil, errors.Join(ErrUserPersistenceError, err)
+	}
+	if !correct {
+		authService.recordLoginFailure(user.Username, ip, userAgent)
+		return nil, nil, nil, ErrSecondFactorIncorrect
+	}
+
+	store.mu.Lock()
+	delete(store.challenges, hash)
+	store.mu.Unlock()
+
+	authService.throttle.RecordSuccess(user.Username, ip)
+	return authService.startSession(user, ip, userAgent)
+}
+
+// Checks the TOTP or recovery code and marks it as used in the storage, so that parallel requests can not use the
+// same code twice
+func (authService *AuthService) consumeSecondFactor(user *auth.User, code string) (bool, error) {
+	code = strings.TrimSpace(code)
+	if step, ok := verifyTotpCode(user.TotpSecret, code, time.Now(), user.TotpLastUsedStep); ok {
+		err := authService.authStorage.ConsumeTotpStep(user.Username, step)
+		if errors.Is(err, auth.ErrCodeAlreadyUsed) {
+			return false, nil
+		}
+		return err == nil, err
+	}
+	err := authService.authStorage.ConsumeRecoveryCode(user.Username, hashToken(strings.ToLower(code)))
+	if errors.Is(err, auth.ErrCodeAlreadyUsed) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// EnrollSecondFactor generates a new TOTP secret for the user. The second factor is enabled once the secret is
+// confirmed with ConfirmSecondFactor
+func (authService *AuthService) EnrollSecondFactor(username string) (*SecondFactorEnrollment, error) {
+	user, err := authService.authStorage.GetUser(username)
+	if err != nil {
+		return nil, errors.Join(ErrUserNotExist, err)
+	}
+	if user.HasSecondFactor() {
+		return nil, ErrSecondFactorEnabled
+	}
+	secret, err := generateTotpSecret()
+	if err != nil {
+		return nil, errors.Join(ErrCouldNotGenerateChallenge, err)
+	}
+	user.PendingTotpSecret = secret
+	if err = authService.authStorage.UpdateUser(user); err != nil {
+		return nil, errors.Join(ErrUserPersistenceError, err)
+	}
+	return &SecondFactorEnrollment{Secret: secret, Uri: totpUri(username, secret)}, nil
+}
+
+// ConfirmSecondFactor enables the second factor, if the code matches the secret generated on enrollment. Returns
+// recovery codes, which are only stored hashed and can not be retrieved later
+func (authService *AuthService) ConfirmSecondFactor(actor principal.Principal, code string) (_ []string, err error) {
+	defer func() { authService.audit(actor, AuditActionSecondFactorEnabled, actor.Username, err) }()
+	user, err := authService.authStorage.GetUser(actor.Username)
+	if err != nil {
+		return nil, errors.Join(ErrUserNotExist, err)
+	}
+	if user.HasSecondFactor() {
+		return nil, ErrSecondFactorEnabled
+	}
+	if user.PendingTotpSecret == "" {
+		return nil, ErrSecondFactorNotEnrolled
+	}
+	step, ok := verifyTotpCode(user.PendingTotpSecret, strings.TrimSpace(code), time.Now(), 0)
+	if !ok {
+		return nil, ErrSecondFactorIncorrect
+	}
+
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		if codes[i], err = generateRandomCode(10); err != nil {
+			return nil, errors.Join(ErrCouldNotGenerateChallenge, err)
+		}
+		codes[i] = strings.ToLower(codes[i][:5] + "-" + codes[i][5:])
+		hashes[i] = hashToken(codes[i])
+	}
+	user.TotpSecret = user.PendingTotpSecret
+	user.PendingTotpSecret = ""
+	user.TotpLastUsedStep = step
+	user.RecoveryCodeHashes = hashes
+	if err = authService.authStorage.UpdateUser(user); err != nil {
+		return nil, errors.Join(ErrUserPersistenceError, err)
+	}
+	return codes, nil
+}
+
+// ResetSecondFactor removes the second factor of the user, e.g. when the user lost access to it and its recovery codes
+func (authService *AuthService) ResetSecondFactor(actor principal.Principal, username string) (err error) {
+	defer func() { authService.audit(actor, AuditActionSecondFactorReset, username, err) }()
+	user, err := authService.authStorage.GetUser(username)
+	if err != nil {
+		return errors.Join(ErrUserNotExist, err)
+	}
+	user.TotpSecret = ""
+	user.PendingTotpSecret = ""
+	user.TotpLastUsedStep = 0
+	user.RecoveryCodeHashes = nil
+	if err = authService.authStorage.UpdateUser(user); err != nil {
+		return errors.Join(ErrUserPersistenceError, err)
+	}
+	return nil
+}
+
+// Generates a random code of the given length, consisting of base32 characters
+func generateRandomCode(length int) (string, error) {
+	random := make([]byte, length)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+	return totpEncoding.EncodeToString(random)[:length], nil
+}
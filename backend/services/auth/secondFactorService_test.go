@@ -0,0 +1,173 @@
+package authService_test
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/martynasd123/golang-scraper/models/principal"
+	"github.com/martynasd123/golang-scraper/models/role"
+	"github.com/martynasd123/golang-scraper/services/auth"
+	"github.com/martynasd123/golang-scraper/storage"
+	"github.com/martynasd123/golang-scraper/utils/clock"
+)
+
+func TestAuthService_SecondFactorLogin(t *testing.T) {
+	auth := createAuthService(t, storage.CreateAuthInMemoryDao())
+	require.NoError(t, auth.CreateUser(principal.System, "testuser", "password1", role.Operator))
+	secret := enableSecondFactor(t, auth, "testuser")
+
+	ip := "127.0.0.1"
+	userAgent := "Mozilla/5.0"
+	challenge := loginWithSecondFactor(t, auth, ip, userAgent)
+
+	// Challenge is bound to the device, which entered the password
+	_, _, _, err := auth.VerifySecondFactor(challenge, "000000", "127.0.0.2", userAgent)
+	require.ErrorIs(t, err, authService.ErrChallengeInvalid)
+
+	_, _, _, err = auth.VerifySecondFactor(challenge, "000000", ip, userAgent)
+	require.ErrorIs(t, err, authService.ErrSecondFactorIncorrect)
+
+	// The code of the current period was used for confirmation, so the next one is used
+	code := authService.TotpCode(secret, time.Now().Add(30*time.Second))
+	accessToken, refreshToken, _, err := auth.VerifySecondFactor(challenge, code, ip, userAgent)
+	require.NoError(t, err)
+	require.NotNil(t, refreshToken)
+	claims, err := auth.ValidateAccessToken(*accessToken)
+	require.NoError(t, err)
+	require.Equal(t, "testuser", claims.Username)
+
+	// Challenge can only be used once
+	_, _, _, err = auth.VerifySecondFactor(challenge, code, ip, userAgent)
+	require.ErrorIs(t, err, authService.ErrChallengeInvalid)
+
+	// Code can not be replayed
+	challenge = loginWithSecondFactor(t, auth, ip, userAgent)
+	_, _, _, err = auth.VerifySecondFactor(challenge, code, ip, userAgent)
+	require.ErrorIs(t, err, authService.ErrSecondFactorIncorrect)
+}
+
+func TestAuthService_RecoveryCodes(t *testing.T) {
+	auth := createAuthService(t, storage.CreateAuthInMemoryDao())
+	require.NoError(t, auth.CreateUser(principal.System, "testuser", "password1", role.Operator))
+
+	enrollment, err := auth.EnrollSecondFactor("testuser")
+	require.NoError(t, err)
+	recoveryCodes, err := auth.ConfirmSecondFactor(principal.Principal{Username: "testuser"}, authService.TotpCode(enrollment.Secret, time.Now()))
+	require.NoError(t, err)
+	require.Len(t, recoveryCodes, 10)
+
+	challenge := loginWithSecondFactor(t, auth, "127.0.0.1", "Mozilla/5.0")
+	_, _, _, err = auth.VerifySecondFactor(challenge, recoveryCodes[0], "127.0.0.1", "Mozilla/5.0")
+	require.NoError(t, err)
+
+	// Recovery code can only be used once
+	challenge = loginWithSecondFactor(t, auth, "127.0.0.1", "Mozilla/5.0")
+	_, _, _, err = auth.VerifySecondFactor(challenge, recoveryCodes[0], "127.0.0.1", "Mozilla/5.0")
+	require.ErrorIs(t, err, authService.ErrSecondFactorIncorrect)
+	_, _, _, err = auth.VerifySecondFactor(challenge, recoveryCodes[1], "127.0.0.1", "Mozilla/5.0")
+	require.NoError(t, err)
+}
+
+func TestAuthService_ParallelSecondFactor(t *testing.T) {
+	auth := createAuthService(t, storage.CreateAuthInMemoryDao())
+	// Rejected codes are not throttled, so that every request reaches the check
+	auth.SetLoginThrottle(authService.CreateLoginThrottle(authService.ThrottlePolicy{FreeAttempts: 100}, clock.Real))
+	require.NoError(t, auth.CreateUser(principal.System, "testuser", "password1", role.Operator))
+	enrollment, err := auth.EnrollSecondFactor("testuser")
+	require.NoError(t, err)
+	recoveryCodes, err := auth.ConfirmSecondFactor(principal.Principal{Username: "testuser"}, authService.TotpCode(enrollment.Secret, time.Now()))
+	require.NoError(t, err)
+
+	// The same code is sent with several challenges at once - only one of them is accepted
+	for _, code := range []string{authService.TotpCode(enrollment.Secret, time.Now().Add(30*time.Second)), recoveryCodes[0]} {
+		challenges := make([]string, 5)
+		for i := range challenges {
+			challenges[i] = loginWithSecondFactor(t, auth, "127.0.0.1", "Mozilla/5.0")
+		}
+		var wg sync.WaitGroup
+		var accepted atomic.Int32
+		for _, challenge := range challenges {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if _, _, _, err := auth.VerifySecondFactor(challenge, code, "127.0.0.1", "Mozilla/5.0"); err == nil {
+					accepted.Add(1)
+				}
+			}()
+		}
+		wg.Wait()
+		require.Equal(t, int32(1), accepted.Load())
+	}
+}
+
+func TestAuthService_EnrollSecondFactor(t *testing.T) {
+	auth := createAuthService(t, storage.CreateAuthInMemoryDao())
+	require.NoError(t, auth.CreateUser(principal.System, "testuser", "password1", role.Operator))
+
+	_, err := auth.ConfirmSecondFactor(principal.Principal{Username: "testuser"}, "000000")
+	require.ErrorIs(t, err, authService.ErrSecondFactorNotEnrolled)
+
+	enrollment, err := auth.EnrollSecondFactor("testuser")
+	require.NoError(t, err)
+	require.Contains(t, enrollment.Uri, "otpauth://totp/")
+	require.Contains(t, enrollment.Uri, "secret="+enrollment.Secret)
+
+	// Second factor is not required until it is confirmed
+	_, _, _, err = auth.Login("testuser", "password1", "127.0.0.1", "Mozilla/5.0")
+	require.NoError(t, err)
+
+	_, err = auth.ConfirmSecondFactor(principal.Principal{Username: "testuser"}, "000000")
+	require.ErrorIs(t, err, authService.ErrSecondFactorIncorrect)
+	_, err = auth.ConfirmSecondFactor(principal.Principal{Username: "testuser"}, authService.TotpCode(enrollment.Secret, time.Now()))
+	require.NoError(t, err)
+
+	_, err = auth.EnrollSecondFactor("testuser")
+	require.ErrorIs(t, err, authService.ErrSecondFactorEnabled)
+}
+
+func TestAuthService_ResetSecondFactor(t *testing.T) {
+	auditStorage := storage.CreateAuditInMemoryDao()
+	keys, err := authService.GenerateKeySet()
+	require.NoError(t, err)
+	auth := authService.CreateAuthService(
+		storage.CreateAuthInMemoryDao(),
+		storage.CreateSessionInMemoryDao(),
+		storage.CreateRevocationInMemoryDao(),
+		auditStorage,
+		keys,
+	)
+	require.NoError(t, auth.CreateUser(principal.System, "testuser", "password1", role.Operator))
+	enableSecondFactor(t, auth, "testuser")
+
+	err = auth.ResetSecondFactor(principal.Principal{Username: "admin"}, "testuser")
+	require.NoError(t, err)
+
+	_, _, _, err = auth.Login("testuser", "password1", "127.0.0.1", "Mozilla/5.0")
+	require.NoError(t, err)
+
+	events := auditStorage.GetEvents(storage.AuditFilter{Action: authService.AuditActionSecondFactorReset})
+	require.Len(t, events, 1)
+	require.Equal(t, "admin", events[0].Actor)
+	require.Equal(t, "testuser", events[0].Target)
+}
+
+// Enables the second factor of the user and returns its secret
+func enableSecondFactor(t *testing.T, auth *authService.AuthService, username string) string {
+	enrollment, err := auth.EnrollSecondFactor(username)
+	require.NoError(t, err)
+	_, err = auth.ConfirmSecondFactor(principal.Principal{Username: username}, authService.TotpCode(enrollment.Secret, time.Now()))
+	require.NoError(t, err)
+	return enrollment.Secret
+}
+
+// Enters the password of testuser and returns the challenge for the second factor
+func loginWithSecondFactor(t *testing.T, auth *authService.AuthService, ip, userAgent string) string {
+	_, _, _, err := auth.Login("testuser", "password1", ip, userAgent)
+	var secondFactorRequired *authService.SecondFactorRequiredError
+	require.ErrorAs(t, err, &secondFactorRequired)
+	return secondFactorRequired.Challenge
+}
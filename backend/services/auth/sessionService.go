@@ -0,0 +1,78 @@
+package authService
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"github.com/martynasd123/golang-scraper/models/principal"
+	auth "github.com/martynasd123/golang-scraper/storage"
+	"strconv"
+	"time"
+)
+
+// GetSessions returns the active sessions of the user
+func (authService *AuthService) GetSessions(username string) []*auth.Session {
+	now := time.Now()
+	sessions := make([]*auth.Session, 0)
+	for _, session := range authService.sessionStorage.GetSessions(username) {
+		if session.IsActive(now) {
+			sessions = append(sessions, session)
+		}
+	}
+	return sessions
+}
+
+// RevokeSession revokes the session of the user, so that neither its refresh token nor its access tokens can be
+// used anymore
+func (authService *AuthService) RevokeSession(actor principal.Principal, id int) (err error) {
+	defer func() { authService.audit(actor, AuditActionSessionRevoked, strconv.Itoa(id), err) }()
+	return authService.revokeOwnSession(actor.Username, id)
+}
+
+func (authService *AuthService) revokeOwnSession(username string, id int) error {
+	session, err := authService.sessionStorage.GetSession(id)
+	if err != nil {
+		return errors.Join(ErrSessionNotExist, err)
+	}
+	if session.Username != username {
+		return ErrSessionNotExist
+	}
+	if session.RevokedAt != nil {
+		return nil
+	}
+	return authService.revokeSession(session)
+}
+
+// Revokes the session and adds its access tokens, which have not expired yet, to the revocation list
+func (authService *AuthService) revokeSession(session *auth.Session) error {
+	now := time.Now()
+	for _, token := range session.AccessTokens {
+		if !token.ExpiresAt.After(now) {
+			continue
+		}
+		if err := authService.revocationStorage.RevokeToken(token.Id, token.ExpiresAt); err != nil {
+			return errors.Join(ErrUserPersistenceError, err)
+		}
+	}
+	session.AccessTokens = nil
+	session.RevokedAt = &now
+	if _, err := authService.sessionStorage.StoreSession(session); err != nil {
+		return errors.Join(ErrUserPersistenceError, err)
+	}
+	return nil
+}
+
+func (authService *AuthService) revokeAllSessions(username string) error {
+	for _, session := range authService.sessionStorage.GetSessions(username) {
+		if err := authService.revokeOwnSession(username, *session.Id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Refresh tokens and API keys are random and long, so a fast hash is sufficient, unlike for passwords
+func hashToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
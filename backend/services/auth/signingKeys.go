@@ -0,0 +1,172 @@
+package authService
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"errors"
+	"github.com/golang-jwt/jwt/v5"
+	"math/big"
+	"sort"
+)
+
+var (
+	ErrUnsupportedKey = errors.New("key must be either an RSA or an Ed25519 key in PEM format")
+	ErrDuplicateKeyId = errors.New("key ID is used by more than one key")
+	ErrMissingKeyId   = errors.New("key ID is required")
+	ErrUnknownKeyId   = errors.New("no verification key with this ID")
+)
+
+// SigningKey is a key, which access tokens are signed or verified with. Keys are identified by the kid header of
+// the token
+type SigningKey struct {
+	Id     string
+	Method jwt.SigningMethod
+	// Key used for signing. Nil for keys, which are only used for verification
+	signKey interface{}
+	// Key used for verification
+	verifyKey interface{}
+}
+
+// CreateHmacSigningKey creates a HS256 key from a shared secret. The secret is used both for signing and verification,
+// so HMAC keys are never published
+func CreateHmacSigningKey(id string, secret []byte) (*SigningKey, error) {
+	if id == "" {
+		return nil, ErrMissingKeyId
+	}
+	return &SigningKey{Id: id, Method: jwt.SigningMethodHS256, signKey: secret, verifyKey: secret}, nil
+}
+
+// CreateSigningKeyFromPem creates a signing key from a PEM encoded RSA (RS256) or Ed25519 (EdDSA) private key
+func CreateSigningKeyFromPem(id string, pem []byte) (*SigningKey, error) {
+	if id == "" {
+		return nil, ErrMissingKeyId
+	}
+	if key, err := jwt.ParseRSAPrivateKeyFromPEM(pem); err == nil {
+		return &SigningKey{Id: id, Method: jwt.SigningMethodRS256, signKey: key, verifyKey: &key.PublicKey}, nil
+	}
+	if key, err := jwt.ParseEdPrivateKeyFromPEM(pem); err == nil {
+		if key, ok := key.(ed25519.PrivateKey); ok {
+			return &SigningKey{Id: id, Method: jwt.SigningMethodEdDSA, signKey: key, verifyKey: key.Public()}, nil
+		}
+	}
+	return nil, ErrUnsupportedKey
+}
+
+// CreateVerificationKeyFromPem creates a key, which is only used to verify tokens, from a PEM encoded RSA or Ed25519
+// public key. Used for keys, which were rotated out, until tokens signed with them expire
+func CreateVerificationKeyFromPem(id string, pem []byte) (*SigningKey, error) {
+	if id == "" {
+		return nil, ErrMissingKeyId
+	}
+	if key, err := jwt.ParseRSAPublicKeyFromPEM(pem); err == nil {
+		return &SigningKey{Id: id, Method: jwt.SigningMethodRS256, verifyKey: key}, nil
+	}
+	if key, err := jwt.ParseEdPublicKeyFromPEM(pem); err == nil {
+		if key, ok := key.(ed25519.PublicKey); ok {
+			return &SigningKey{Id: id, Method: jwt.SigningMethodEdDSA, verifyKey: key}, nil
+		}
+	}
+	return nil, ErrUnsupportedKey
+}
+
+// KeySet holds the key, which new tokens are signed with, and all keys, which tokens are still accepted from
+type KeySet struct {
+	signing      *SigningKey
+	verification map[string]*SigningKey
+}
+
+// CreateKeySet creates a key set, which signs tokens with the signing key and accepts tokens signed with it or any of
+// the verification keys
+func CreateKeySet(signing *SigningKey, verification ...*SigningKey) (*KeySet, error) {
+	keys := &KeySet{signing: signing, verification: map[string]*SigningKey{signing.Id: signing}}
+	for _, key := range verification {
+		if _, exists := keys.verification[key.Id]; exists {
+			return nil, ErrDuplicateKeyId
+		}
+		keys.verification[key.Id] = key
+	}
+	return keys, nil
+}
+
+// GenerateKeySet creates a key set with a random Ed25519 key. Tokens signed with it can not be verified after restart
+func GenerateKeySet() (*KeySet, error) {
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	id := make([]byte, 8)
+	if _, err = rand.Read(id); err != nil {
+		return nil, err
+	}
+	return CreateKeySet(&SigningKey{
+		Id:        base64.RawURLEncoding.EncodeToString(id),
+		Method:    jwt.SigningMethodEdDSA,
+		signKey:   privateKey,
+		verifyKey: privateKey.Public(),
+	})
+}
+
+func (keys *KeySet) sign(claims jwt.Claims) (string, error) {
+	token := jwt.NewWithClaims(keys.signing.Method, claims)
+	token.Header["kid"] = keys.signing.Id
+	return token.SignedString(keys.signing.signKey)
+}
+
+// Finds the key, which the token claims to be signed with. The algorithm of the token must match the key, so that
+// e.g. a public RSA key can not be used as an HMAC secret
+func (keys *KeySet) verificationKey(token *jwt.Token) (interface{}, error) {
+	id, ok := token.Header["kid"].(string)
+	if !ok {
+		return nil, ErrMissingKeyId
+	}
+	key, ok := keys.verification[id]
+	if !ok {
+		return nil, ErrUnknownKeyId
+	}
+	if token.Method.Alg() != key.Method.Alg() {
+		return nil, ErrAccessTokenInvalid
+	}
+	return key.verifyKey, nil
+}
+
+// Jwk is a public key in JSON Web Key format
+type Jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	// RSA modulus and exponent
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+	// Curve and public key of OKP keys
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+}
+
+// Jwks returns the public keys of the key set, which other services can verify access tokens with. HMAC keys are
+// secret and are not included
+func (keys *KeySet) Jwks() []Jwk {
+	jwks := make([]Jwk, 0, len(keys.verification))
+	for _, key := range keys.verification {
+		jwk := Jwk{Kid: key.Id, Alg: key.Method.Alg(), Use: "sig"}
+		switch publicKey := key.verifyKey.(type) {
+		case *rsa.PublicKey:
+			jwk.Kty = "RSA"
+			jwk.N = base64.RawURLEncoding.EncodeToString(publicKey.N.Bytes())
+			jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(publicKey.E)).Bytes())
+		case ed25519.PublicKey:
+			jwk.Kty = "OKP"
+			jwk.Crv = "Ed25519"
+			jwk.X = base64.RawURLEncoding.EncodeToString(publicKey)
+		default:
+			continue
+		}
+		jwks = append(jwks, jwk)
+	}
+	sort.Slice(jwks, func(i, j int) bool {
+		return jwks[i].Kid < jwks[j].Kid
+	})
+	return jwks
+}
@@ -0,0 +1,88 @@
+package authService_test
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"github.com/stretchr/testify/require"
+	"testing"
+
+	"github.com/martynasd123/golang-scraper/models/principal"
+	"github.com/martynasd123/golang-scraper/models/role"
+	"github.com/martynasd123/golang-scraper/services/auth"
+	"github.com/martynasd123/golang-scraper/storage"
+)
+
+func TestAuthService_KeyRotation(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	oldKey, err := authService.CreateSigningKeyFromPem("old", encodePrivateKey(t, rsaKey))
+	require.NoError(t, err)
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	newKey, err := authService.CreateSigningKeyFromPem("new", encodePrivateKey(t, edKey))
+	require.NoError(t, err)
+
+	authStorage := storage.CreateAuthInMemoryDao()
+	sessionStorage := storage.CreateSessionInMemoryDao()
+	revocationStorage := storage.CreateRevocationInMemoryDao()
+	oldKeys, err := authService.CreateKeySet(oldKey)
+	require.NoError(t, err)
+	auth := authService.CreateAuthService(authStorage, sessionStorage, revocationStorage, storage.CreateAuditInMemoryDao(), oldKeys)
+	require.NoError(t, auth.CreateUser(principal.System, "testuser", "password1", role.Operator))
+	oldToken, _, _, err := auth.Login("testuser", "password1", "127.0.0.1", "Mozilla/5.0")
+	require.NoError(t, err)
+
+	// The new key signs tokens, the old one is only used to verify them
+	oldPublicKey, err := authService.CreateVerificationKeyFromPem("old", encodePublicKey(t, &rsaKey.PublicKey))
+	require.NoError(t, err)
+	rotatedKeys, err := authService.CreateKeySet(newKey, oldPublicKey)
+	require.NoError(t, err)
+	rotated := authService.CreateAuthService(authStorage, sessionStorage, revocationStorage, storage.CreateAuditInMemoryDao(), rotatedKeys)
+
+	_, err = rotated.ValidateAccessToken(*oldToken)
+	require.NoError(t, err)
+	newToken, _, _, err := rotated.Login("testuser", "password1", "127.0.0.1", "Mozilla/5.0")
+	require.NoError(t, err)
+	_, err = rotated.ValidateAccessToken(*newToken)
+	require.NoError(t, err)
+	// Tokens signed with the new key are unknown to the old key set
+	_, err = auth.ValidateAccessToken(*newToken)
+	require.ErrorIs(t, err, authService.ErrAccessTokenInvalid)
+
+	jwks := rotated.GetJwks()
+	require.Len(t, jwks, 2)
+	require.Equal(t, "new", jwks[0].Kid)
+	require.Equal(t, "OKP", jwks[0].Kty)
+	require.Equal(t, "EdDSA", jwks[0].Alg)
+	require.Equal(t, "old", jwks[1].Kid)
+	require.Equal(t, "RSA", jwks[1].Kty)
+	require.Equal(t, "RS256", jwks[1].Alg)
+}
+
+func TestAuthService_HmacKeyNotPublished(t *testing.T) {
+	key, err := authService.CreateHmacSigningKey("secret", []byte("some secret"))
+	require.NoError(t, err)
+	keys, err := authService.CreateKeySet(key)
+	require.NoError(t, err)
+	require.Empty(t, keys.Jwks())
+
+	_, err = authService.CreateHmacSigningKey("", []byte("some secret"))
+	require.ErrorIs(t, err, authService.ErrMissingKeyId)
+	_, err = authService.CreateKeySet(key, key)
+	require.ErrorIs(t, err, authService.ErrDuplicateKeyId)
+}
+
+func encodePrivateKey(t *testing.T, key interface{}) []byte {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	require.NoError(t, err)
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+}
+
+func encodePublicKey(t *testing.T, key interface{}) []byte {
+	der, err := x509.MarshalPKIXPublicKey(key)
+	require.NoError(t, err)
+	return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+}
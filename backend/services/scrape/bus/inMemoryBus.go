@@ -0,0 +1,194 @@
+package bus
+
+import (
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/martynasd123/golang-scraper/services/scrape/queue"
+)
+
+// Heartbeats are only checked for revoked leases, so they do not need to be frequent
+const inMemoryHeartbeatInterval = 10 * time.Second
+
+// InMemoryBus distributes jobs among workers of the same process. Its leases never expire, since its workers can not
+// fail independently of it
+type InMemoryBus struct {
+	mu    sync.Mutex
+	queue *queue.TaskQueue
+	// Task ID to the job of that task, which is either waiting or claimed
+	jobs    map[int]*inMemoryJob
+	workers map[string]WorkerStatus
+	updates chan Update
+	// Closed when the subscriber of the updates stops receiving them
+	unsubscribed <-chan struct{}
+}
+
+type inMemoryJob struct {
+	job Job
+	// Nil while the job is waiting to be claimed
+	lease *Lease
+	// Signal sent before the job was claimed
+	signal Signal
+}
+
+func CreateInMemoryBus() *InMemoryBus {
+	return &InMemoryBus{
+		queue:        queue.CreateTaskQueue(),
+		jobs:         make(map[int]*inMemoryJob),
+		workers:      make(map[string]WorkerStatus),
+		updates:      make(chan Update),
+		unsubscribed: make(chan struct{}),
+	}
+}
+
+func (bus *InMemoryBus) Enqueue(job Job) error {
+	bus.mu.Lock()
+	defer bus.mu.Unlock()
+	taskId := *job.Task.Id
+	bus.jobs[taskId] = &inMemoryJob{job: job}
+	bus.queue.Push(taskId, job.Task.Priority, job.Task.Owner)
+	return nil
+}
+
+func (bus *InMemoryBus) Remove(taskId int) (bool, error) {
+	bus.mu.Lock()
+	defer bus.mu.Unlock()
+	if _, exists := bus.jobs[taskId]; !exists {
+		return false, nil
+	}
+	delete(bus.jobs, taskId)
+	bus.queue.Remove(taskId)
+	return true, nil
+}
+
+func (bus *InMemoryBus) Position(taskId int) (int, bool) {
+	return bus.queue.Position(taskId)
+}
+
+func (bus *InMemoryBus) Len() int {
+	return bus.queue.Len()
+}
+
+func (bus *InMemoryBus) Claim(workerId string, done <-chan struct{}) (*Lease, bool) {
+	for {
+		taskId, ok := bus.queue.Pop(done)
+		if !ok {
+			return nil, false
+		}
+		bus.mu.Lock()
+		queued, exists := bus.jobs[taskId]
+		if !exists || queued.lease != nil {
+			// Job was removed after it was popped
+			bus.mu.Unlock()
+			continue
+		}
+		queued.lease = createLease(uuid.New().String(), workerId, queued.job, inMemoryHeartbeatInterval)
+		if queued.signal != 0 {
+			queued.lease.deliver(queued.signal)
+		}
+		bus.mu.Unlock()
+		return queued.lease, true
+	}
+}
+
+func (bus *InMemoryBus) Heartbeat(lease *Lease) error {
+	bus.mu.Lock()
+	defer bus.mu.Unlock()
+	if !bus.holds(lease) {
+		return ErrLeaseLost
+	}
+	return nil
+}
+
+func (bus *InMemoryBus) Signal(taskId int, signal Signal) error {
+	bus.mu.Lock()
+	defer bus.mu.Unlock()
+	queued, exists := bus.jobs[taskId]
+	if !exists {
+		return nil
+	}
+	if queued.lease == nil {
+		queued.signal = signal
+		return nil
+	}
+	queued.lease.deliver(signal)
+	return nil
+}
+
+func (bus *InMemoryBus) Publish(lease *Lease, update Update) error {
+	bus.mu.Lock()
+	if !bus.holds(lease) {
+		bus.mu.Unlock()
+		return ErrLeaseLost
+	}
+	if update.Final {
+		delete(bus.jobs, *lease.Job.Task.Id)
+	}
+	unsubscribed := bus.unsubscribed
+	bus.mu.Unlock()
+
+	update.JobId = lease.Job.Id
+	update.WorkerId = lease.WorkerId
+	select {
+	case bus.updates <- update:
+	case <-unsubscribed:
+	}
+	return nil
+}
+
+func (bus *InMemoryBus) Updates(done <-chan struct{}) <-chan Update {
+	bus.mu.Lock()
+	defer bus.mu.Unlock()
+	bus.unsubscribed = done
+	return bus.updates
+}
+
+// Updates are delivered directly to the subscriber, so only the jobs are removed
+func (bus *InMemoryBus) Purge() error {
+	bus.mu.Lock()
+	defer bus.mu.Unlock()
+	for taskId := range bus.jobs {
+		bus.queue.Remove(taskId)
+	}
+	clear(bus.jobs)
+	return nil
+}
+
+func (bus *InMemoryBus) ReportStatus(status WorkerStatus) error {
+	bus.mu.Lock()
+	defer bus.mu.Unlock()
+	status.Tasks = slices.Clone(status.Tasks)
+	bus.workers[status.Id] = status
+	return nil
+}
+
+func (bus *InMemoryBus) Deregister(workerId string) (bool, error) {
+	bus.mu.Lock()
+	defer bus.mu.Unlock()
+	_, exists := bus.workers[workerId]
+	delete(bus.workers, workerId)
+	return exists, nil
+}
+
+func (bus *InMemoryBus) GetWorkers() ([]WorkerStatus, error) {
+	bus.mu.Lock()
+	defer bus.mu.Unlock()
+	workers := make([]WorkerStatus, 0, len(bus.workers))
+	for _, status := range bus.workers {
+		status.Tasks = slices.Clone(status.Tasks)
+		workers = append(workers, status)
+	}
+	slices.SortFunc(workers, func(a, b WorkerStatus) int {
+		return strings.Compare(a.Id, b.Id)
+	})
+	return workers, nil
+}
+
+// Must be called while holding mu
+func (bus *InMemoryBus) holds(lease *Lease) bool {
+	queued, exists := bus.jobs[*lease.Job.Task.Id]
+	return exists && queued.lease != nil && queued.lease.Id == lease.Id
+}
@@ -0,0 +1,149 @@
+package bus
+
+import (
+	"errors"
+	"time"
+
+	"github.com/martynasd123/golang-scraper/storage"
+)
+
+var ErrLeaseLost = errors.New("lease is no longer held")
+
+// Signal asks the worker processing a task to stop it
+type Signal int
+
+const (
+	SignalInterrupt Signal = iota + 1
+	SignalPause
+)
+
+// Job is a task queued for processing. It carries everything a worker needs, so that workers do not need access to the
+// task storage
+type Job struct {
+	// Unique for every time a task is queued
+	Id   string
+	Task storage.Task
+	// Results of the links of the task crawled before, if its broken links are being re-checked (see Task.Rechecking)
+	PreviousResults []*storage.LinkResult
+}
+
+// Lease gives a worker the exclusive right to process a job. A lease expires unless it is extended with heartbeats -
+// the job is claimed by another worker then
+type Lease struct {
+	Id       string
+	WorkerId string
+	Job      Job
+	// Heartbeat must be sent at least this often
+	HeartbeatInterval time.Duration
+	signals           chan Signal
+}
+
+func createLease(id string, workerId string, job Job, heartbeatInterval time.Duration) *Lease {
+	return &Lease{
+		Id:                id,
+		WorkerId:          workerId,
+		Job:               job,
+		HeartbeatInterval: heartbeatInterval,
+		signals:           make(chan Signal, 1),
+	}
+}
+
+// Signals delivers the signals sent to the task of the job while the lease is held
+func (lease *Lease) Signals() <-chan Signal {
+	return lease.signals
+}
+
+// Delivers the signal, unless one is already waiting to be received. Only the first signal sent to a task matters,
+// except for an interrupt, which replaces a waiting pause
+func (lease *Lease) deliver(signal Signal) {
+	if signal == SignalInterrupt {
+		select {
+		case waiting := <-lease.signals:
+			if waiting != SignalPause {
+				signal = waiting
+			}
+		default:
+		}
+	}
+	select {
+	case lease.signals <- signal:
+	default:
+	}
+}
+
+// Update is a change of a task reported by the worker processing it
+type Update struct {
+	JobId    string
+	WorkerId string
+	// State of the task after the change
+	Task storage.Task
+	// Result of the crawled link, which caused the update
+	LinkResult *storage.LinkResult
+	// Set for the last update of the job, once the task is in a final state or paused
+	Final bool
+}
+
+// A worker is considered unhealthy once it misses this many reports in a row
+const missedReports = 3
+
+// WorkerStatus is reported by a worker periodically, so that it can be listed along with the tasks it is processing
+type WorkerStatus struct {
+	Id       string
+	Hostname string
+	// Number of tasks the worker processes concurrently
+	Capacity int
+	// IDs of the tasks the worker is processing
+	Tasks     []int
+	StartedAt time.Time
+	// Time of the last report
+	ReportedAt time.Time
+	// How often the worker reports its status
+	ReportInterval time.Duration
+}
+
+// IsHealthy returns false if the worker has missed several reports, e.g. because it crashed or can not reach the bus
+func (status *WorkerStatus) IsHealthy(now time.Time) bool {
+	return now.Sub(status.ReportedAt) < missedReports*status.ReportInterval
+}
+
+// WorkerRegistry keeps the statuses reported by workers
+type WorkerRegistry interface {
+	// ReportStatus registers the worker or replaces its status
+	ReportStatus(status WorkerStatus) error
+	// Deregister removes the worker. Returns false if it was not registered
+	Deregister(workerId string) (bool, error)
+	// GetWorkers returns the statuses of the registered workers, ordered by ID
+	GetWorkers() ([]WorkerStatus, error)
+}
+
+// MessageBus distributes queued tasks among workers, which may run in other processes, and carries the updates of the
+// tasks back. Among the jobs waiting to be claimed, the ones with a higher priority are claimed first, and owners of
+// the jobs take turns. Workers report their status through it as well
+type MessageBus interface {
+	WorkerRegistry
+	// Enqueue queues the job. A job already queued for the same task is replaced - its lease is revoked if it is claimed
+	Enqueue(job Job) error
+	// Remove removes the job of the task, revoking its lease if it is claimed. Returns false if the task has no job
+	Remove(taskId int) (bool, error)
+	// Position returns the 1-based position of the job of the task among the jobs waiting to be claimed. Returns false
+	// if the job is not waiting
+	Position(taskId int) (int, bool)
+	// Len returns the number of jobs waiting to be claimed
+	Len() int
+	// Claim blocks until a job is available and leases it to the worker. Returns false if done is closed first
+	Claim(workerId string, done <-chan struct{}) (*Lease, bool)
+	// Heartbeat extends the lease. Returns ErrLeaseLost if it has expired or was revoked
+	Heartbeat(lease *Lease) error
+	// Signal sends the signal to the worker holding the lease of the job of the task, once it is claimed
+	Signal(taskId int, signal Signal) error
+	// Publish reports an update of the job of the lease. The final update removes the job. Returns ErrLeaseLost if the
+	// lease is no longer held - the worker must stop processing the job then
+	Publish(lease *Lease, update Update) error
+	// Updates delivers the updates published by all workers in the order they were published, until done is closed.
+	// Must have a single subscriber
+	Updates(done <-chan struct{}) <-chan Update
+	// Purge removes all jobs, revoking their leases, and the updates not delivered yet. Called by the subscriber on
+	// start if its tasks do not survive restarts, since jobs left by a previous run would refer to tasks, which no
+	// longer exist, or to other tasks reusing their IDs
+	Purge() error
+}
@@ -0,0 +1,354 @@
+package bus_test
+
+import (
+	"database/sql"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/martynasd123/golang-scraper/services/scrape/bus"
+	"github.com/martynasd123/golang-scraper/storage"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const fastPollInterval = 10 * time.Millisecond
+
+func openDatabase(t *testing.T) *sql.DB {
+	path := filepath.Join(t.TempDir(), "bus.db")
+	db, err := sql.Open("sqlite3", "file:"+path+"?_busy_timeout=5000&_txlock=immediate&_journal_mode=WAL")
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func createSqlBus(t *testing.T, db *sql.DB, options bus.SqlBusOptions) *bus.SqlBus {
+	messageBus, err := bus.CreateSqlBus(db, options)
+	require.NoError(t, err)
+	return messageBus
+}
+
+// Runs the test against every implementation of the message bus
+func forEachBus(t *testing.T, test func(t *testing.T, messageBus bus.MessageBus)) {
+	t.Run("InMemory", func(t *testing.T) {
+		test(t, bus.CreateInMemoryBus())
+	})
+	t.Run("Sql", func(t *testing.T) {
+		test(t, createSqlBus(t, openDatabase(t), bus.SqlBusOptions{PollInterval: fastPollInterval}))
+	})
+}
+
+func createJob(taskId int, priority int, owner string) bus.Job {
+	link, _ := url.Parse("https://example.com")
+	return bus.Job{
+		Id:   "job-" + strconv.Itoa(taskId),
+		Task: storage.Task{Id: &taskId, Link: *link, Priority: priority, Owner: owner},
+	}
+}
+
+// Claims a job without waiting for one. Returns nil if there are none
+func tryClaim(messageBus bus.MessageBus, workerId string) *bus.Lease {
+	done := make(chan struct{})
+	close(done)
+	lease, _ := messageBus.Claim(workerId, done)
+	return lease
+}
+
+func claimedTaskIds(messageBus bus.MessageBus) []int {
+	ids := make([]int, 0)
+	for lease := tryClaim(messageBus, "worker"); lease != nil; lease = tryClaim(messageBus, "worker") {
+		ids = append(ids, *lease.Job.Task.Id)
+	}
+	return ids
+}
+
+func receiveSignal(t *testing.T, lease *bus.Lease) bus.Signal {
+	select {
+	case signal := <-lease.Signals():
+		return signal
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for signal")
+		return 0
+	}
+}
+
+func receiveUpdate(t *testing.T, updates <-chan bus.Update) bus.Update {
+	select {
+	case update := <-updates:
+		return update
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for update")
+		return bus.Update{}
+	}
+}
+
+func TestMessageBus_ClaimsByPriorityAndOwnerTurns(t *testing.T) {
+	forEachBus(t, func(t *testing.T, messageBus bus.MessageBus) {
+		require.NoError(t, messageBus.Enqueue(createJob(1, 0, "alice")))
+		require.NoError(t, messageBus.Enqueue(createJob(2, 5, "alice")))
+		require.NoError(t, messageBus.Enqueue(createJob(3, 0, "alice")))
+		require.NoError(t, messageBus.Enqueue(createJob(4, 0, "bob")))
+
+		assert.Equal(t, 4, messageBus.Len())
+		position, queued := messageBus.Position(2)
+		assert.True(t, queued)
+		assert.Equal(t, 1, position)
+
+		assert.Equal(t, []int{2, 4, 1, 3}, claimedTaskIds(messageBus))
+		assert.Equal(t, 0, messageBus.Len())
+		_, queued = messageBus.Position(2)
+		assert.False(t, queued)
+	})
+}
+
+func TestMessageBus_ClaimWaitsForJob(t *testing.T) {
+	forEachBus(t, func(t *testing.T, messageBus bus.MessageBus) {
+		claimed := make(chan *bus.Lease)
+		go func() {
+			lease, _ := messageBus.Claim("worker", make(chan struct{}))
+			claimed <- lease
+		}()
+		require.NoError(t, messageBus.Enqueue(createJob(1, 0, "alice")))
+
+		select {
+		case lease := <-claimed:
+			assert.Equal(t, 1, *lease.Job.Task.Id)
+			assert.Equal(t, "worker", lease.WorkerId)
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout waiting for claim")
+		}
+
+		done := make(chan struct{})
+		close(done)
+		_, ok := messageBus.Claim("worker", done)
+		assert.False(t, ok)
+	})
+}
+
+func TestMessageBus_LeaseIsExclusive(t *testing.T) {
+	forEachBus(t, func(t *testing.T, messageBus bus.MessageBus) {
+		require.NoError(t, messageBus.Enqueue(createJob(1, 0, "alice")))
+		lease := tryClaim(messageBus, "first")
+		require.NotNil(t, lease)
+		assert.Nil(t, tryClaim(messageBus, "second"))
+		assert.NoError(t, messageBus.Heartbeat(lease))
+	})
+}
+
+func TestMessageBus_RemoveRevokesLease(t *testing.T) {
+	forEachBus(t, func(t *testing.T, messageBus bus.MessageBus) {
+		require.NoError(t, messageBus.Enqueue(createJob(1, 0, "alice")))
+		lease := tryClaim(messageBus, "worker")
+		require.NotNil(t, lease)
+
+		removed, err := messageBus.Remove(1)
+		require.NoError(t, err)
+		assert.True(t, removed)
+		assert.ErrorIs(t, messageBus.Heartbeat(lease), bus.ErrLeaseLost)
+		assert.ErrorIs(t, messageBus.Publish(lease, bus.Update{Task: lease.Job.Task}), bus.ErrLeaseLost)
+
+		removed, err = messageBus.Remove(1)
+		require.NoError(t, err)
+		assert.False(t, removed)
+	})
+}
+
+func TestMessageBus_EnqueueReplacesJob(t *testing.T) {
+	forEachBus(t, func(t *testing.T, messageBus bus.MessageBus) {
+		require.NoError(t, messageBus.Enqueue(createJob(1, 0, "alice")))
+		lease := tryClaim(messageBus, "worker")
+		require.NotNil(t, lease)
+
+		replacement := createJob(1, 0, "alice")
+		replacement.Id = "replacement"
+		require.NoError(t, messageBus.Enqueue(replacement))
+		assert.ErrorIs(t, messageBus.Heartbeat(lease), bus.ErrLeaseLost)
+
+		lease = tryClaim(messageBus, "worker")
+		require.NotNil(t, lease)
+		assert.Equal(t, "replacement", lease.Job.Id)
+	})
+}
+
+func TestMessageBus_DeliversSignals(t *testing.T) {
+	forEachBus(t, func(t *testing.T, messageBus bus.MessageBus) {
+		// Signal sent before the job is claimed
+		require.NoError(t, messageBus.Enqueue(createJob(1, 0, "alice")))
+		require.NoError(t, messageBus.Signal(1, bus.SignalPause))
+		lease := tryClaim(messageBus, "worker")
+		require.NotNil(t, lease)
+		require.NoError(t, messageBus.Heartbeat(lease))
+		assert.Equal(t, bus.SignalPause, receiveSignal(t, lease))
+
+		// Signal sent while the job is processed
+		require.NoError(t, messageBus.Enqueue(createJob(2, 0, "alice")))
+		lease = tryClaim(messageBus, "worker")
+		require.NotNil(t, lease)
+		require.NoError(t, messageBus.Signal(2, bus.SignalInterrupt))
+		require.NoError(t, messageBus.Heartbeat(lease))
+		assert.Equal(t, bus.SignalInterrupt, receiveSignal(t, lease))
+
+		// Signal of a task without a job is ignored
+		assert.NoError(t, messageBus.Signal(3, bus.SignalInterrupt))
+	})
+}
+
+func TestMessageBus_DeliversUpdatesInOrder(t *testing.T) {
+	forEachBus(t, func(t *testing.T, messageBus bus.MessageBus) {
+		done := make(chan struct{})
+		defer close(done)
+		updates := messageBus.Updates(done)
+
+		require.NoError(t, messageBus.Enqueue(createJob(1, 0, "alice")))
+		lease := tryClaim(messageBus, "worker")
+		require.NotNil(t, lease)
+
+		link, _ := url.Parse("https://example.com/about")
+		published := make(chan error, 3)
+		go func() {
+			task := lease.Job.Task
+			task.Status = "INITIATING"
+			published <- messageBus.Publish(lease, bus.Update{Task: task})
+			task.CrawledLinks = 1
+			published <- messageBus.Publish(lease, bus.Update{
+				Task:       task,
+				LinkResult: &storage.LinkResult{Link: *link, Status: 404},
+			})
+			task.Status = "FINISHED"
+			published <- messageBus.Publish(lease, bus.Update{Task: task, Final: true})
+		}()
+
+		update := receiveUpdate(t, updates)
+		assert.Equal(t, lease.Job.Id, update.JobId)
+		assert.Equal(t, "worker", update.WorkerId)
+		assert.Equal(t, "INITIATING", update.Task.Status)
+		assert.Nil(t, update.LinkResult)
+
+		update = receiveUpdate(t, updates)
+		assert.Equal(t, 1, update.Task.CrawledLinks)
+		require.NotNil(t, update.LinkResult)
+		assert.Equal(t, *link, update.LinkResult.Link)
+		assert.Equal(t, 404, update.LinkResult.Status)
+
+		update = receiveUpdate(t, updates)
+		assert.Equal(t, "FINISHED", update.Task.Status)
+		assert.True(t, update.Final)
+
+		for range 3 {
+			assert.NoError(t, <-published)
+		}
+		// Final update removes the job
+		assert.ErrorIs(t, messageBus.Heartbeat(lease), bus.ErrLeaseLost)
+		removed, err := messageBus.Remove(1)
+		require.NoError(t, err)
+		assert.False(t, removed)
+	})
+}
+
+func TestSqlBus_ExpiredLeaseIsClaimedAgain(t *testing.T) {
+	messageBus := createSqlBus(t, openDatabase(t), bus.SqlBusOptions{
+		LeaseDuration: 50 * time.Millisecond,
+		PollInterval:  fastPollInterval,
+	})
+	require.NoError(t, messageBus.Enqueue(createJob(1, 0, "alice")))
+	first := tryClaim(messageBus, "first")
+	require.NotNil(t, first)
+	assert.Nil(t, tryClaim(messageBus, "second"))
+
+	time.Sleep(100 * time.Millisecond)
+	second := tryClaim(messageBus, "second")
+	require.NotNil(t, second)
+	assert.Equal(t, first.Job.Id, second.Job.Id)
+	assert.ErrorIs(t, messageBus.Heartbeat(first), bus.ErrLeaseLost)
+	assert.ErrorIs(t, messageBus.Publish(first, bus.Update{Task: first.Job.Task}), bus.ErrLeaseLost)
+	assert.NoError(t, messageBus.Heartbeat(second))
+}
+
+func TestSqlBus_SharedBetweenInstances(t *testing.T) {
+	db := openDatabase(t)
+	options := bus.SqlBusOptions{PollInterval: fastPollInterval}
+	api := createSqlBus(t, db, options)
+	worker := createSqlBus(t, db, options)
+
+	require.NoError(t, api.Enqueue(createJob(1, 0, "alice")))
+	lease := tryClaim(worker, "worker")
+	require.NotNil(t, lease)
+	require.NoError(t, api.Signal(1, bus.SignalInterrupt))
+	require.NoError(t, worker.Heartbeat(lease))
+	assert.Equal(t, bus.SignalInterrupt, receiveSignal(t, lease))
+
+	// Updates are kept until there is a subscriber
+	require.NoError(t, worker.Publish(lease, bus.Update{Task: lease.Job.Task, Final: true}))
+	done := make(chan struct{})
+	defer close(done)
+	update := receiveUpdate(t, api.Updates(done))
+	assert.Equal(t, lease.Job.Id, update.JobId)
+	assert.True(t, update.Final)
+}
+
+func TestSqlBus_PurgeJobsOfPreviousRun(t *testing.T) {
+	db := openDatabase(t)
+	options := bus.SqlBusOptions{PollInterval: fastPollInterval}
+	previousApi := createSqlBus(t, db, options)
+	worker := createSqlBus(t, db, options)
+	require.NoError(t, previousApi.Enqueue(createJob(1, 0, "alice")))
+	require.NoError(t, previousApi.Enqueue(createJob(2, 0, "alice")))
+	lease := tryClaim(worker, "worker")
+	require.NotNil(t, lease)
+	require.NoError(t, worker.Publish(lease, bus.Update{Task: lease.Job.Task}))
+
+	// The API server is restarted, and its tasks are lost
+	api := createSqlBus(t, db, options)
+	require.NoError(t, api.Purge())
+	assert.Equal(t, 0, api.Len())
+	assert.ErrorIs(t, worker.Heartbeat(lease), bus.ErrLeaseLost)
+	assert.ErrorIs(t, worker.Publish(lease, bus.Update{Task: lease.Job.Task}), bus.ErrLeaseLost)
+
+	// A new task reusing the ID is claimed with its own job, and only its updates are delivered
+	job := createJob(1, 0, "bob")
+	job.Id = "job-1-next"
+	require.NoError(t, api.Enqueue(job))
+	lease = tryClaim(worker, "worker")
+	require.NotNil(t, lease)
+	assert.Equal(t, job.Id, lease.Job.Id)
+	require.NoError(t, worker.Publish(lease, bus.Update{Task: lease.Job.Task, Final: true}))
+	done := make(chan struct{})
+	defer close(done)
+	assert.Equal(t, job.Id, receiveUpdate(t, api.Updates(done)).JobId)
+}
+
+func TestMessageBus_WorkerRegistry(t *testing.T) {
+	forEachBus(t, func(t *testing.T, messageBus bus.MessageBus) {
+		now := time.Now()
+		second := bus.WorkerStatus{Id: "second", Capacity: 2, ReportedAt: now, ReportInterval: time.Second}
+		require.NoError(t, messageBus.ReportStatus(second))
+		first := bus.WorkerStatus{Id: "first", Capacity: 1, Tasks: []int{3}, ReportedAt: now, ReportInterval: time.Second}
+		require.NoError(t, messageBus.ReportStatus(first))
+
+		first.Tasks = []int{3, 4}
+		require.NoError(t, messageBus.ReportStatus(first))
+		workers, err := messageBus.GetWorkers()
+		require.NoError(t, err)
+		require.Len(t, workers, 2)
+		assert.Equal(t, "first", workers[0].Id)
+		assert.Equal(t, []int{3, 4}, workers[0].Tasks)
+		assert.Equal(t, "second", workers[1].Id)
+		assert.Equal(t, 2, workers[1].Capacity)
+		assert.True(t, workers[1].IsHealthy(now))
+		assert.False(t, workers[1].IsHealthy(now.Add(5*time.Second)))
+
+		removed, err := messageBus.Deregister("first")
+		require.NoError(t, err)
+		assert.True(t, removed)
+		removed, err = messageBus.Deregister("first")
+		require.NoError(t, err)
+		assert.False(t, removed)
+		workers, err = messageBus.GetWorkers()
+		require.NoError(t, err)
+		require.Len(t, workers, 1)
+		assert.Equal(t, "second", workers[0].Id)
+	})
+}
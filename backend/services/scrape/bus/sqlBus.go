@@ -0,0 +1,411 @@
+package bus
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	DefaultLeaseDuration = 30 * time.Second
+	DefaultPollInterval  = time.Second
+	// Maximum number of updates read from the table at once
+	updateBatchSize = 100
+)
+
+// Tables are created if they do not exist. Leases are claimed with conditional updates, so that two workers can not
+// claim the same job, even if they select it at the same time
+const sqlSchema = `
+CREATE TABLE IF NOT EXISTS scrape_jobs (
+	task_id INTEGER PRIMARY KEY,
+	job_id TEXT NOT NULL,
+	job TEXT NOT NULL,
+	priority INTEGER NOT NULL,
+	owner TEXT NOT NULL,
+	seq INTEGER NOT NULL,
+	lease_id TEXT,
+	worker_id TEXT,
+	lease_expires_at INTEGER,
+	signal INTEGER NOT NULL DEFAULT 0
+);
+CREATE TABLE IF NOT EXISTS scrape_job_owners (
+	owner TEXT PRIMARY KEY,
+	last_claim INTEGER NOT NULL
+);
+CREATE TABLE IF NOT EXISTS scrape_updates (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	task_id INTEGER NOT NULL,
+	payload TEXT NOT NULL
+);
+CREATE TABLE IF NOT EXISTS scrape_workers (
+	id TEXT PRIMARY KEY,
+	status TEXT NOT NULL
+);
+`
+
+// Jobs waiting to be claimed, in the order they are claimed: by priority, then by the owner served least recently, then
+// in the order they were queued
+const sqlWaitingJobs = `
+FROM scrape_jobs j LEFT JOIN scrape_job_owners o ON o.owner = j.owner
+WHERE j.lease_id IS NULL OR j.lease_expires_at < ?
+ORDER BY j.priority DESC, COALESCE(o.last_claim, 0) ASC, j.seq ASC`
+
+// SqlBusOptions configure a SqlBus. Fields with zero values are set to defaults
+type SqlBusOptions struct {
+	// How long a lease is held without heartbeats. DefaultLeaseDuration by default
+	LeaseDuration time.Duration
+	// How often the tables are polled for jobs and updates, and how often workers send heartbeats. Signals are only
+	// received with heartbeats. DefaultPollInterval by default
+	PollInterval time.Duration
+}
+
+// SqlBus keeps jobs and updates in SQL tables, so that they are shared by all processes using the same database, and
+// survive restarts. Written for SQLite - the database should be opened with immediate transaction locking and a busy
+// timeout, so that concurrent processes wait for each other instead of failing
+type SqlBus struct {
+	db      *sql.DB
+	options SqlBusOptions
+}
+
+func CreateSqlBus(db *sql.DB, options SqlBusOptions) (*SqlBus, error) {
+	if options.LeaseDuration == 0 {
+		options.LeaseDuration = DefaultLeaseDuration
+	}
+	if options.PollInterval == 0 {
+		options.PollInterval = DefaultPollInterval
+	}
+	if _, err := db.Exec(sqlSchema); err != nil {
+		return nil, err
+	}
+	return &SqlBus{db: db, options: options}, nil
+}
+
+func (bus *SqlBus) Enqueue(job Job) error {
+	encoded, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	_, err = bus.db.Exec(`
+		INSERT INTO scrape_jobs (task_id, job_id, job, priority, owner, seq)
+		VALUES (?, ?, ?, ?, ?, (SELECT COALESCE(MAX(seq), 0) + 1 FROM scrape_jobs))
+		ON CONFLICT (task_id) DO UPDATE SET
+			job_id = excluded.job_id, job = excluded.job, priority = excluded.priority, owner = excluded.owner,
+			seq = excluded.seq, lease_id = NULL, worker_id = NULL, lease_expires_at = NULL, signal = 0`,
+		*job.Task.Id, job.Id, string(encoded), job.Task.Priority, job.Task.Owner,
+	)
+	return err
+}
+
+func (bus *SqlBus) Remove(taskId int) (bool, error) {
+	result, err := bus.db.Exec(`DELETE FROM scrape_jobs WHERE task_id = ?`, taskId)
+	if err != nil {
+		return false, err
+	}
+	removed, err := result.RowsAffected()
+	return removed > 0, err
+}
+
+// Position follows the order of sqlWaitingJobs, which the next job is claimed in: by priority, then owners, whose jobs
+// were claimed least recently, first. Jobs of the same owner are counted one after another, so the position is only
+// an estimate - claiming a job moves its owner behind the others
+func (bus *SqlBus) Position(taskId int) (int, bool) {
+	rows, err := bus.db.Query(`SELECT j.task_id `+sqlWaitingJobs, time.Now().UnixNano())
+	if err != nil {
+		log.Printf("could not query waiting jobs: %v", err)
+		return 0, false
+	}
+	defer rows.Close()
+	for position := 1; rows.Next(); position++ {
+		var id int
+		if err = rows.Scan(&id); err != nil {
+			log.Printf("could not read waiting job: %v", err)
+			return 0, false
+		}
+		if id == taskId {
+			return position, true
+		}
+	}
+	return 0, false
+}
+
+func (bus *SqlBus) Len() int {
+	var count int
+	err := bus.db.QueryRow(
+		`SELECT COUNT(*) FROM scrape_jobs WHERE lease_id IS NULL OR lease_expires_at < ?`,
+		time.Now().UnixNano(),
+	).Scan(&count)
+	if err != nil {
+		log.Printf("could not count waiting jobs: %v", err)
+	}
+	return count
+}
+
+func (bus *SqlBus) Claim(workerId string, done <-chan struct{}) (*Lease, bool) {
+	for {
+		lease, err := bus.tryClaim(workerId)
+		if err != nil {
+			log.Printf("could not claim job: %v", err)
+		} else if lease != nil {
+			return lease, true
+		}
+		select {
+		case <-done:
+			return nil, false
+		case <-time.After(bus.options.PollInterval):
+		}
+	}
+}
+
+// Claims the first waiting job. Returns nil lease if there are none
+func (bus *SqlBus) tryClaim(workerId string) (*Lease, error) {
+	tx, err := bus.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	var taskId int
+	var owner, encoded string
+	err = tx.QueryRow(`SELECT j.task_id, j.owner, j.job `+sqlWaitingJobs+` LIMIT 1`, now.UnixNano()).
+		Scan(&taskId, &owner, &encoded)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var job Job
+	if err = json.Unmarshal([]byte(encoded), &job); err != nil {
+		return nil, err
+	}
+
+	lease := createLease(uuid.New().String(), workerId, job, bus.options.PollInterval)
+	result, err := tx.Exec(`
+		UPDATE scrape_jobs SET lease_id = ?, worker_id = ?, lease_expires_at = ?
+		WHERE task_id = ? AND job_id = ? AND (lease_id IS NULL OR lease_expires_at < ?)`,
+		lease.Id, workerId, now.Add(bus.options.LeaseDuration).UnixNano(), taskId, job.Id, now.UnixNano(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	if claimed, err := result.RowsAffected(); err != nil || claimed == 0 {
+		// Claimed by another worker in the meantime
+		return nil, err
+	}
+	_, err = tx.Exec(`
+		INSERT INTO scrape_job_owners (owner, last_claim)
+		VALUES (?, (SELECT COALESCE(MAX(last_claim), 0) + 1 FROM scrape_job_owners))
+		ON CONFLICT (owner) DO UPDATE SET last_claim = excluded.last_claim`,
+		owner,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return lease, tx.Commit()
+}
+
+// Heartbeat also receives the signal sent to the task, if there is one
+func (bus *SqlBus) Heartbeat(lease *Lease) error {
+	tx, err := bus.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var signal Signal
+	err = tx.QueryRow(`SELECT signal FROM scrape_jobs WHERE task_id = ? AND lease_id = ?`, *lease.Job.Task.Id, lease.Id).
+		Scan(&signal)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrLeaseLost
+	}
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(
+		`UPDATE scrape_jobs SET lease_expires_at = ?, signal = 0 WHERE task_id = ? AND lease_id = ?`,
+		time.Now().Add(bus.options.LeaseDuration).UnixNano(), *lease.Job.Task.Id, lease.Id,
+	)
+	if err != nil {
+		return err
+	}
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+	if signal != 0 {
+		lease.deliver(signal)
+	}
+	return nil
+}
+
+func (bus *SqlBus) Signal(taskId int, signal Signal) error {
+	_, err := bus.db.Exec(`UPDATE scrape_jobs SET signal = ? WHERE task_id = ?`, signal, taskId)
+	return err
+}
+
+func (bus *SqlBus) Publish(lease *Lease, update Update) error {
+	update.JobId = lease.Job.Id
+	update.WorkerId = lease.WorkerId
+	encoded, err := json.Marshal(update)
+	if err != nil {
+		return err
+	}
+
+	tx, err := bus.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	taskId := *lease.Job.Task.Id
+	var held int
+	err = tx.QueryRow(`SELECT COUNT(*) FROM scrape_jobs WHERE task_id = ? AND lease_id = ?`, taskId, lease.Id).Scan(&held)
+	if err != nil {
+		return err
+	}
+	if held == 0 {
+		return ErrLeaseLost
+	}
+	_, err = tx.Exec(`INSERT INTO scrape_updates (task_id, payload) VALUES (?, ?)`, taskId, string(encoded))
+	if err != nil {
+		return err
+	}
+	if update.Final {
+		if _, err = tx.Exec(`DELETE FROM scrape_jobs WHERE task_id = ?`, taskId); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (bus *SqlBus) Purge() error {
+	tx, err := bus.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err = tx.Exec(`DELETE FROM scrape_jobs`); err != nil {
+		return err
+	}
+	if _, err = tx.Exec(`DELETE FROM scrape_updates`); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (bus *SqlBus) ReportStatus(status WorkerStatus) error {
+	encoded, err := json.Marshal(status)
+	if err != nil {
+		return err
+	}
+	_, err = bus.db.Exec(
+		`INSERT INTO scrape_workers (id, status) VALUES (?, ?) ON CONFLICT (id) DO UPDATE SET status = excluded.status`,
+		status.Id, string(encoded),
+	)
+	return err
+}
+
+func (bus *SqlBus) Deregister(workerId string) (bool, error) {
+	result, err := bus.db.Exec(`DELETE FROM scrape_workers WHERE id = ?`, workerId)
+	if err != nil {
+		return false, err
+	}
+	removed, err := result.RowsAffected()
+	return removed > 0, err
+}
+
+func (bus *SqlBus) GetWorkers() ([]WorkerStatus, error) {
+	rows, err := bus.db.Query(`SELECT id, status FROM scrape_workers ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	workers := make([]WorkerStatus, 0)
+	for rows.Next() {
+		var id, encoded string
+		if err = rows.Scan(&id, &encoded); err != nil {
+			return nil, err
+		}
+		var status WorkerStatus
+		if err = json.Unmarshal([]byte(encoded), &status); err != nil {
+			log.Printf("discarding malformed status of worker %s: %v", id, err)
+			continue
+		}
+		workers = append(workers, status)
+	}
+	return workers, rows.Err()
+}
+
+// Updates are removed from the table once they are delivered. Updates left in the table by the previous subscriber are
+// delivered first
+func (bus *SqlBus) Updates(done <-chan struct{}) <-chan Update {
+	data := make(chan Update)
+	go func() {
+		defer close(data)
+		for {
+			delivered, err := bus.deliverUpdates(data, done)
+			if err != nil {
+				log.Printf("could not read task updates: %v", err)
+			}
+			if delivered == updateBatchSize {
+				// There may be more updates waiting
+				continue
+			}
+			select {
+			case <-done:
+				return
+			case <-time.After(bus.options.PollInterval):
+			}
+		}
+	}()
+	return data
+}
+
+// Delivers a batch of updates. Returns the number of updates read, which were delivered or discarded
+func (bus *SqlBus) deliverUpdates(data chan<- Update, done <-chan struct{}) (int, error) {
+	rows, err := bus.db.Query(`SELECT id, payload FROM scrape_updates ORDER BY id LIMIT ?`, updateBatchSize)
+	if err != nil {
+		return 0, err
+	}
+	var ids []int64
+	var payloads []string
+	for rows.Next() {
+		var id int64
+		var payload string
+		if err = rows.Scan(&id, &payload); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		ids = append(ids, id)
+		payloads = append(payloads, payload)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+
+	processed := 0
+deliver:
+	for i, payload := range payloads {
+		var update Update
+		if err = json.Unmarshal([]byte(payload), &update); err != nil {
+			log.Printf("discarding malformed task update %d: %v", ids[i], err)
+		} else {
+			select {
+			case data <- update:
+			case <-done:
+				break deliver
+			}
+		}
+		processed = i + 1
+	}
+	if processed == 0 {
+		return 0, nil
+	}
+	_, err = bus.db.Exec(`DELETE FROM scrape_updates WHERE id <= ?`, ids[processed-1])
+	return processed, err
+}
@@ -0,0 +1,202 @@
+package queue
+
+import (
+	"sort"
+	"sync"
+)
+
+// item is a single queued task
+type item struct {
+	taskId   int
+	priority int
+	owner    string
+	// Insertion sequence number. Used to keep FIFO order among tasks of the same owner and priority
+	seq uint64
+}
+
+// TaskQueue is a priority queue of task IDs with per-owner fair scheduling. Tasks with a higher priority are always
+// dequeued first. Among the owners that have tasks of the highest present priority, tasks are dequeued in round-robin
+// order, so that one owner submitting many tasks can not starve others.
+type TaskQueue struct {
+	mu sync.Mutex
+	// Owner to that owner's queued items, sorted by priority (descending) and then by insertion order
+	owners map[string][]*item
+	// Round-robin order of owners that have queued items
+	ring []string
+	// Index in ring of the owner that is to be considered first when dequeuing
+	cursor int
+	// Task ID to queued item
+	items map[int]*item
+	seq   uint64
+	// Closed and replaced every time an item is pushed, so that waiting consumers are woken up
+	available chan struct{}
+}
+
+func CreateTaskQueue() *TaskQueue {
+	return &TaskQueue{
+		owners:    make(map[string][]*item),
+		ring:      make([]string, 0),
+		items:     make(map[int]*item),
+		available: make(chan struct{}),
+	}
+}
+
+// Push adds a task to the queue. If the task is already queued, its priority is updated instead.
+func (queue *TaskQueue) Push(taskId int, priority int, owner string) {
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+
+	if existing, found := queue.items[taskId]; found {
+		queue.removeLocked(existing)
+	}
+	queue.seq = queue.seq + 1
+	newItem := &item{taskId: taskId, priority: priority, owner: owner, seq: queue.seq}
+	queue.items[taskId] = newItem
+
+	ownerItems, found := queue.owners[owner]
+	if !found {
+		queue.ring = append(queue.ring, owner)
+	}
+	i := sort.Search(len(ownerItems), func(i int) bool {
+		return comesBefore(newItem, ownerItems[i])
+	})
+	ownerItems = append(ownerItems, nil)
+	copy(ownerItems[i+1:], ownerItems[i:])
+	ownerItems[i] = newItem
+	queue.owners[owner] = ownerItems
+
+	// Wake up all waiting consumers
+	close(queue.available)
+	queue.available = make(chan struct{})
+}
+
+// Pop removes and returns the next task ID from the queue, blocking until one is available. Returns false if done
+// channel is closed before a task becomes available.
+func (queue *TaskQueue) Pop(done <-chan struct{}) (int, bool) {
+	for {
+		queue.mu.Lock()
+		if next := peek(queue.cursor, queue.owners, queue.ring); next != nil {
+			queue.cursor = indexOf(queue.ring, next.owner) + 1
+			queue.removeLocked(next)
+			queue.mu.Unlock()
+			return next.taskId, true
+		}
+		available := queue.available
+		queue.mu.Unlock()
+
+		select {
+		case <-done:
+			return 0, false
+		case <-available:
+		}
+	}
+}
+
+// Remove removes a task from the queue. Returns false if the task was not queued.
+func (queue *TaskQueue) Remove(taskId int) bool {
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+	existing, found := queue.items[taskId]
+	if !found {
+		return false
+	}
+	queue.removeLocked(existing)
+	return true
+}
+
+// Position returns the 1-based position of a task in the queue, i.e. the number of tasks (including itself) that
+// will be dequeued before it is picked up, assuming no more tasks are pushed. Returns false if the task is not queued.
+func (queue *TaskQueue) Position(taskId int) (int, bool) {
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+
+	if _, found := queue.items[taskId]; !found {
+		return 0, false
+	}
+
+	// Simulate dequeuing on shallow copies of the owner queues
+	owners := make(map[string][]*item, len(queue.owners))
+	for owner, ownerItems := range queue.owners {
+		owners[owner] = ownerItems
+	}
+	ring := append([]string(nil), queue.ring...)
+	cursor := queue.cursor
+	for position := 1; ; position++ {
+		next := peek(cursor, owners, ring)
+		if next.taskId == taskId {
+			return position, true
+		}
+		i := indexOf(ring, next.owner)
+		owners[next.owner] = owners[next.owner][1:]
+		if len(owners[next.owner]) == 0 {
+			delete(owners, next.owner)
+			ring = append(ring[:i:i], ring[i+1:]...)
+			cursor = i
+		} else {
+			cursor = i + 1
+		}
+	}
+}
+
+// Len returns the number of queued tasks
+func (queue *TaskQueue) Len() int {
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+	return len(queue.items)
+}
+
+// Returns the item that should be dequeued next, or nil if there are no items
+func peek(cursor int, owners map[string][]*item, ring []string) *item {
+	if len(ring) == 0 {
+		return nil
+	}
+	highestPriority := owners[ring[0]][0].priority
+	for _, owner := range ring {
+		highestPriority = max(highestPriority, owners[owner][0].priority)
+	}
+	for i := range ring {
+		owner := ring[(cursor+i)%len(ring)]
+		if head := owners[owner][0]; head.priority == highestPriority {
+			return head
+		}
+	}
+	return nil
+}
+
+func (queue *TaskQueue) removeLocked(target *item) {
+	delete(queue.items, target.taskId)
+	ownerItems := queue.owners[target.owner]
+	for i, existing := range ownerItems {
+		if existing == target {
+			ownerItems = append(ownerItems[:i], ownerItems[i+1:]...)
+			break
+		}
+	}
+	if len(ownerItems) > 0 {
+		queue.owners[target.owner] = ownerItems
+		return
+	}
+	// Owner has no more items - remove it from the round-robin ring
+	delete(queue.owners, target.owner)
+	i := indexOf(queue.ring, target.owner)
+	queue.ring = append(queue.ring[:i], queue.ring[i+1:]...)
+	if queue.cursor > i {
+		queue.cursor = queue.cursor - 1
+	}
+}
+
+func comesBefore(a, b *item) bool {
+	if a.priority != b.priority {
+		return a.priority > b.priority
+	}
+	return a.seq < b.seq
+}
+
+func indexOf(ring []string, owner string) int {
+	for i, value := range ring {
+		if value == owner {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,123 @@
+package queue
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func popAll(queue *TaskQueue) []int {
+	done := make(chan struct{})
+	close(done)
+	ids := make([]int, 0)
+	for {
+		id, ok := queue.Pop(done)
+		if !ok {
+			return ids
+		}
+		ids = append(ids, id)
+	}
+}
+
+func TestTaskQueue_HigherPriorityFirst(t *testing.T) {
+	queue := CreateTaskQueue()
+	queue.Push(1, 0, "user")
+	queue.Push(2, 5, "user")
+	queue.Push(3, 0, "user")
+	queue.Push(4, 5, "user")
+
+	require.Equal(t, []int{2, 4, 1, 3}, popAll(queue))
+}
+
+func TestTaskQueue_OwnersAreScheduledRoundRobin(t *testing.T) {
+	queue := CreateTaskQueue()
+	for id := 1; id <= 5; id++ {
+		queue.Push(id, 0, "greedy")
+	}
+	queue.Push(10, 0, "other")
+	queue.Push(11, 0, "other")
+	queue.Push(20, 0, "third")
+
+	require.Equal(t, []int{1, 10, 20, 2, 11, 3, 4, 5}, popAll(queue))
+}
+
+func TestTaskQueue_Position(t *testing.T) {
+	queue := CreateTaskQueue()
+	queue.Push(1, 0, "greedy")
+	queue.Push(2, 0, "greedy")
+	queue.Push(3, 0, "greedy")
+	queue.Push(10, 0, "other")
+	queue.Push(20, 3, "other")
+
+	expected := map[int]int{20: 1, 1: 2, 10: 3, 2: 4, 3: 5}
+	for id, position := range expected {
+		actual, found := queue.Position(id)
+		require.True(t, found)
+		require.Equal(t, position, actual, "position of task %d", id)
+	}
+
+	_, found := queue.Position(999)
+	require.False(t, found)
+
+	// Positions must match the actual dequeue order
+	require.Equal(t, []int{20, 1, 10, 2, 3}, popAll(queue))
+}
+
+func TestTaskQueue_Remove(t *testing.T) {
+	queue := CreateTaskQueue()
+	queue.Push(1, 0, "a")
+	queue.Push(2, 0, "b")
+	queue.Push(3, 0, "a")
+
+	require.True(t, queue.Remove(1))
+	require.False(t, queue.Remove(1))
+	require.Equal(t, 2, queue.Len())
+
+	position, found := queue.Position(3)
+	require.True(t, found)
+	require.Equal(t, 1, position)
+
+	require.Equal(t, []int{3, 2}, popAll(queue))
+}
+
+func TestTaskQueue_PopBlocksUntilPush(t *testing.T) {
+	queue := CreateTaskQueue()
+	result := make(chan int)
+	go func() {
+		id, _ := queue.Pop(make(chan struct{}))
+		result <- id
+	}()
+
+	select {
+	case <-result:
+		t.Fatal("pop returned before anything was pushed")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	queue.Push(7, 0, "user")
+	select {
+	case id := <-result:
+		require.Equal(t, 7, id)
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for pop")
+	}
+}
+
+func TestTaskQueue_PopReturnsWhenDone(t *testing.T) {
+	queue := CreateTaskQueue()
+	done := make(chan struct{})
+	result := make(chan bool)
+	go func() {
+		_, ok := queue.Pop(done)
+		result <- ok
+	}()
+	close(done)
+
+	select {
+	case ok := <-result:
+		require.False(t, ok)
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for pop to return")
+	}
+}
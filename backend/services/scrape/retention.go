@@ -0,0 +1,145 @@
+package scrape
+
+import (
+	"errors"
+	"log"
+	"time"
+
+	"github.com/martynasd123/golang-scraper/storage"
+)
+
+var (
+	ErrInvalidRetentionPolicy   = errors.New("retention policy limits must not be negative")
+	ErrInvalidRetentionInterval = errors.New("retention interval must be positive")
+)
+
+// RetentionPolicy defines which tasks are removed from storage. Only tasks in a final state are removed.
+// Fields with zero values are not enforced.
+type RetentionPolicy struct {
+	// Tasks created earlier than this long ago are removed
+	MaxAge time.Duration
+	// Only this many most recently created tasks of each user are kept
+	MaxTasksPerUser int
+}
+
+// SetTaskArchive sets the archive, where tasks removed by the retention policy are stored before removal.
+// If no archive is set, the tasks are simply deleted.
+func (service *ScrapeService) SetTaskArchive(archive storage.TaskArchive) {
+	service.controlMu.Lock()
+	defer service.controlMu.Unlock()
+	service.archive = archive
+}
+
+// ApplyRetentionPolicy removes the tasks, which violate the policy at the given time. Returns the number of
+// removed tasks. Tasks, which can not be archived or deleted, are logged and skipped.
+func (service *ScrapeService) ApplyRetentionPolicy(policy RetentionPolicy, now time.Time) (int, error) {
+	if err := policy.validate(); err != nil {
+		return 0, err
+	}
+	candidates, archive := service.findRetentionCandidates(policy, now)
+
+	removed := 0
+	// Archive is written without holding controlMu, so that task updates and control requests are not delayed by it
+	for _, task := range candidates {
+		if archive != nil {
+			if err := service.archiveTask(archive, task); err != nil {
+				log.Printf("could not archive task %d: %v", *task.Id, err)
+				continue
+			}
+		}
+		deleted, err := service.deleteFinishedTask(*task.Id)
+		if err != nil {
+			log.Printf("could not delete task %d: %v", *task.Id, err)
+			continue
+		}
+		if deleted {
+			removed = removed + 1
+		}
+	}
+	return removed, nil
+}
+
+// Returns the tasks in a final state, which violate the policy, along with the archive they are to be stored in
+func (service *ScrapeService) findRetentionCandidates(policy RetentionPolicy, now time.Time) (
+	[]*storage.Task,
+	storage.TaskArchive,
+) {
+	service.controlMu.Lock()
+	defer service.controlMu.Unlock()
+
+	tasksPerUser := make(map[string]int)
+	candidates := make([]*storage.Task, 0)
+	// Tasks are sorted from the newest to the oldest
+	for _, task := range service.storage.GetAllTasks() {
+		tasksPerUser[task.Owner] = tasksPerUser[task.Owner] + 1
+		if !isFinalStatus(task.Status) {
+			continue
+		}
+		expired := policy.MaxAge > 0 && task.CTime.Before(now.Add(-policy.MaxAge))
+		overLimit := policy.MaxTasksPerUser > 0 && tasksPerUser[task.Owner] > policy.MaxTasksPerUser
+		if expired || overLimit {
+			candidates = append(candidates, task)
+		}
+	}
+	return candidates, service.archive
+}
+
+func (service *ScrapeService) archiveTask(archive storage.TaskArchive, task *storage.Task) error {
+	linkResults, err := service.storage.GetLinkResults(*task.Id)
+	if err != nil {
+		return err
+	}
+	return archive.ArchiveTask(task, linkResults)
+}
+
+// Deletes the task, unless it was deleted or queued again since it was found. Returns false if it was not deleted
+func (service *ScrapeService) deleteFinishedTask(id int) (bool, error) {
+	service.controlMu.Lock()
+	defer service.controlMu.Unlock()
+
+	task, err := service.storage.RetrieveTaskById(id)
+	if err != nil || !isFinalStatus(task.Status) {
+		return false, nil
+	}
+	delete(service.finalEventIds, id)
+	return true, service.storage.DeleteTask(id)
+}
+
+// StartRetentionJob applies the policy periodically. Returns a function, which stops the job.
+func (service *ScrapeService) StartRetentionJob(policy RetentionPolicy, interval time.Duration) (stop func(), err error) {
+	if err = policy.validate(); err != nil {
+		return nil, err
+	}
+	if interval <= 0 {
+		return nil, ErrInvalidRetentionInterval
+	}
+	ticker := time.NewTicker(interval)
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case now := <-ticker.C:
+				removed, err := service.ApplyRetentionPolicy(policy, now)
+				if err != nil {
+					log.Printf("could not apply retention policy: %v", err)
+				} else if removed > 0 {
+					log.Printf("retention policy removed %d tasks", removed)
+				}
+			}
+		}
+	}()
+	return func() {
+		ticker.Stop()
+		close(done)
+	}, nil
+}
+
+// Negative limits would remove tasks, which are within them, e.g. a negative age is in the future
+func (policy RetentionPolicy) validate() error {
+	if policy.MaxAge < 0 || policy.MaxTasksPerUser < 0 {
+		return ErrInvalidRetentionPolicy
+	}
+	return nil
+}
@@ -0,0 +1,117 @@
+package scrape_test
+
+import (
+	"errors"
+	"net/url"
+	"slices"
+	"testing"
+	"time"
+
+	scrapeStorage "github.com/martynasd123/golang-scraper/models/scrape"
+	"github.com/martynasd123/golang-scraper/services/scrape"
+	"github.com/martynasd123/golang-scraper/storage"
+	"github.com/stretchr/testify/require"
+)
+
+type archiveStub struct {
+	archived []int
+	// Archiving of these tasks fails
+	failing []int
+}
+
+func (archive *archiveStub) ArchiveTask(task *storage.Task, linkResults []*storage.LinkResult) error {
+	if slices.Contains(archive.failing, *task.Id) {
+		return errors.New("archive is not writable")
+	}
+	archive.archived = append(archive.archived, *task.Id)
+	return nil
+}
+
+func storeTask(t *testing.T, dao storage.TaskDao, status string, owner string, ctime time.Time) int {
+	link, _ := url.Parse("http://example.com")
+	task := storage.CreateTaskInitial(status, link, ctime)
+	task.Owner = owner
+	id, err := dao.StoreTask(task)
+	require.NoError(t, err)
+	return id
+}
+
+func TestScrapeService_ApplyRetentionPolicyMaxAge(t *testing.T) {
+	now := time.Now()
+	dao := storage.CreateTaskInMemoryDao()
+	old := storeTask(t, dao, scrapeStorage.StatusFinished, "user", now.Add(-48*time.Hour))
+	oldPaused := storeTask(t, dao, scrapeStorage.StatusPaused, "user", now.Add(-48*time.Hour))
+	recent := storeTask(t, dao, scrapeStorage.StatusFinished, "user", now.Add(-time.Hour))
+
+	service := scrape.CreateTaskService(dao)
+	archive := &archiveStub{}
+	service.SetTaskArchive(archive)
+
+	removed, err := service.ApplyRetentionPolicy(scrape.RetentionPolicy{MaxAge: 24 * time.Hour}, now)
+	require.NoError(t, err)
+	require.Equal(t, 1, removed)
+	require.Equal(t, []int{old}, archive.archived)
+
+	_, err = dao.RetrieveTaskById(old)
+	require.Error(t, err)
+	// Tasks, which are not in final state, are kept
+	_, err = dao.RetrieveTaskById(oldPaused)
+	require.NoError(t, err)
+	_, err = dao.RetrieveTaskById(recent)
+	require.NoError(t, err)
+}
+
+func TestScrapeService_ApplyRetentionPolicyMaxTasksPerUser(t *testing.T) {
+	now := time.Now()
+	dao := storage.CreateTaskInMemoryDao()
+	oldest := storeTask(t, dao, scrapeStorage.StatusError, "first", now.Add(-3*time.Hour))
+	storeTask(t, dao, scrapeStorage.StatusFinished, "first", now.Add(-2*time.Hour))
+	storeTask(t, dao, scrapeStorage.StatusInterrupted, "first", now.Add(-time.Hour))
+	storeTask(t, dao, scrapeStorage.StatusFinished, "second", now.Add(-3*time.Hour))
+
+	service := scrape.CreateTaskService(dao)
+
+	removed, err := service.ApplyRetentionPolicy(scrape.RetentionPolicy{MaxTasksPerUser: 2}, now)
+	require.NoError(t, err)
+	require.Equal(t, 1, removed)
+
+	_, err = dao.RetrieveTaskById(oldest)
+	require.Error(t, err)
+	require.Len(t, dao.GetAllTasks(), 3)
+}
+
+func TestScrapeService_InvalidRetentionPolicy(t *testing.T) {
+	dao := storage.CreateTaskInMemoryDao()
+	finished := storeTask(t, dao, scrapeStorage.StatusFinished, "user", time.Now())
+	service := scrape.CreateTaskService(dao)
+
+	_, err := service.ApplyRetentionPolicy(scrape.RetentionPolicy{MaxAge: -time.Hour}, time.Now())
+	require.ErrorIs(t, err, scrape.ErrInvalidRetentionPolicy)
+	_, err = service.StartRetentionJob(scrape.RetentionPolicy{MaxTasksPerUser: -1}, time.Hour)
+	require.ErrorIs(t, err, scrape.ErrInvalidRetentionPolicy)
+	_, err = service.StartRetentionJob(scrape.RetentionPolicy{MaxAge: time.Hour}, 0)
+	require.ErrorIs(t, err, scrape.ErrInvalidRetentionInterval)
+
+	// Nothing is removed by the rejected policy
+	_, err = dao.RetrieveTaskById(finished)
+	require.NoError(t, err)
+}
+
+func TestScrapeService_ApplyRetentionPolicyArchiveFailure(t *testing.T) {
+	now := time.Now()
+	dao := storage.CreateTaskInMemoryDao()
+	first := storeTask(t, dao, scrapeStorage.StatusFinished, "user", now.Add(-72*time.Hour))
+	second := storeTask(t, dao, scrapeStorage.StatusFinished, "user", now.Add(-48*time.Hour))
+
+	service := scrape.CreateTaskService(dao)
+	archive := &archiveStub{failing: []int{second}}
+	service.SetTaskArchive(archive)
+
+	// Task, which could not be archived, is kept, while the sweep continues with the others
+	removed, err := service.ApplyRetentionPolicy(scrape.RetentionPolicy{MaxAge: 24 * time.Hour}, now)
+	require.NoError(t, err)
+	require.Equal(t, 1, removed)
+	require.Equal(t, []int{first}, archive.archived)
+	_, err = dao.RetrieveTaskById(second)
+	require.NoError(t, err)
+}
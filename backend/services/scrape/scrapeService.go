@@ -2,12 +2,17 @@ package scrape
 
 import (
 	"errors"
+	"github.com/google/uuid"
+	"github.com/martynasd123/golang-scraper/models/principal"
 	"github.com/martynasd123/golang-scraper/models/scrape"
-	. "github.com/martynasd123/golang-scraper/services/scrape/seeker"
+	"github.com/martynasd123/golang-scraper/services/scrape/bus"
 	"github.com/martynasd123/golang-scraper/storage"
+	"github.com/martynasd123/golang-scraper/utils/datatype"
 	"github.com/martynasd123/golang-scraper/utils/event"
 	"log"
 	"net/url"
+	"slices"
+	"strconv"
 	"sync"
 	"time"
 )
@@ -15,131 +20,265 @@ import (
 var (
 	ErrTaskInFinalState     = errors.New("task is already in final state")
 	ErrInterruptAlreadySent = errors.New("interrupt signal already sent")
+	ErrInvalidPriority      = errors.New("task priority is out of range")
+	ErrInvalidWorkerCount   = errors.New("worker count is out of range")
+	ErrPauseAlreadySent     = errors.New("pause signal already sent")
+	ErrTaskAlreadyPaused    = errors.New("task is already paused")
+	ErrTaskNotPaused        = errors.New("task is not paused")
+	ErrTaskNotFinished      = errors.New("task is not in final state")
+	ErrNoBrokenLinks        = errors.New("task has no broken links")
+	ErrTaskRunning          = errors.New("task is running")
+	ErrTaskNotFound         = errors.New("task not found")
+	ErrTaskNotRunning       = errors.New("task is not running")
+	ErrNoLocalWorker        = errors.New("tasks are only processed by standalone workers")
 )
 
-const MaxInstances = 3
+// Actions recorded in the audit log
+const (
+	AuditActionTaskAdded          = "task.added"
+	AuditActionTaskInterrupted    = "task.interrupted"
+	AuditActionTaskPaused         = "task.paused"
+	AuditActionTaskResumed        = "task.resumed"
+	AuditActionTaskRetried        = "task.retried"
+	AuditActionTaskRechecked      = "task.rechecked"
+	AuditActionTaskDeleted        = "task.deleted"
+	AuditActionWorkerCountChanged = "settings.workers_changed"
+)
+
+const (
+	// DefaultWorkerCount is the number of tasks processed concurrently, unless configured otherwise
+	DefaultWorkerCount = 3
+	MaxWorkerCount     = 50
+
+	MinPriority     = 0
+	MaxPriority     = 10
+	DefaultPriority = MinPriority
+
+	// WorkerRetention is how long workers, which stopped reporting their status, are listed before they are hidden and
+	// removed from the registry by the pruning job
+	WorkerRetention = time.Hour
+)
+
+// TaskOptions are the user supplied parameters of a task
+type TaskOptions struct {
+	// Tasks with higher priority are picked up first. Must be between MinPriority and MaxPriority
+	Priority int
+	// Username of the user submitting the task. Tasks of different owners are scheduled fairly
+	Owner string
+}
 
 type ScrapeService struct {
-	// A map of task id to channel, which is to be used when interrupting the task
-	interruptSignalMap map[int]chan<- struct{}
-	// Locking this mutex locks task status transitions PENDING -> INITIATING
-	interruptMu sync.Mutex
-	stateBroker *event.StateBroker[int, storage.Task]
-	// Task ID to seeker map
-	queuedTasks chan int
+	// Task ID to the job of the task, which is queued or being processed. Updates of other jobs of the task are ignored
+	jobs map[int]*activeJob
+	// Locking this mutex locks task status transitions and sending of control signals
+	controlMu sync.Mutex
+	// IDs of running tasks, which were forcibly deleted, and are to be removed from storage once they stop
+	deleteOnCompletion datatype.Set[int]
+	// Tasks removed by the retention policy are stored here, if set
+	archive storage.TaskArchive
+	// Actions of users are recorded here, if set
+	auditLog storage.AuditDao
+	// Called with every task, which reaches a final state, if set
+	completionListener func(task storage.Task)
+	stateBroker        *event.StateBroker[int, storage.Task]
+	// Task ID to the ID of the last state event published before the task stopped running. Guarded by controlMu
+	finalEventIds map[int]uint64
+	// Distributes queued tasks among workers and carries their updates back
+	bus bus.MessageBus
+	// Worker processing tasks in this process. Nil if tasks are only processed by standalone workers
+	worker *Worker
 	// Task storage interface
 	storage storage.TaskDao
 }
 
+type activeJob struct {
+	id string
+	// Signal sent to the worker processing the job. Only the first signal is sent
+	signal bus.Signal
+	// Status of the task, as last stored
+	status string
+}
+
+// CreateTaskService creates a service, which processes tasks in this process with DefaultWorkerCount workers
 func CreateTaskService(taskStorage storage.TaskDao) *ScrapeService {
+	messageBus := bus.CreateInMemoryBus()
+	localWorker := CreateWorker("local-"+uuid.New().String(), messageBus)
+	if err := localWorker.SetConcurrency(DefaultWorkerCount); err != nil {
+		log.Fatalf("could not start workers: %v", err)
+	}
+	return CreateTaskServiceWithBus(taskStorage, messageBus, localWorker)
+}
+
+// CreateTaskServiceWithBus creates a service, which queues tasks to the message bus. Tasks are processed by the
+// workers of all processes sharing the bus. The local worker, if set, is the one whose concurrency can be changed
+// through the service
+func CreateTaskServiceWithBus(taskStorage storage.TaskDao, messageBus bus.MessageBus, localWorker *Worker) *ScrapeService {
 	scrapeService := &ScrapeService{
 		storage:            taskStorage,
 		stateBroker:        event.CreateStateBroker[int, storage.Task](),
-		queuedTasks:        make(chan int),
-		interruptSignalMap: make(map[int]chan<- struct{}),
-		interruptMu:        sync.Mutex{},
+		bus:                messageBus,
+		worker:             localWorker,
+		jobs:               make(map[int]*activeJob),
+		deleteOnCompletion: datatype.NewSet[int](),
+		finalEventIds:      make(map[int]uint64),
+		controlMu:          sync.Mutex{},
 	}
 	scrapeService.init()
 	return scrapeService
 }
 
-func (service *ScrapeService) setInterruptChannelForTask(taskId int, interruptChannel chan struct{}) {
-	service.interruptMu.Lock()
-	service.interruptSignalMap[taskId] = interruptChannel
-	service.interruptMu.Unlock()
+// SetUpdateInterval limits how often progress updates of a task are sent to its listeners. Updates, which change the
+// status of the task, are always sent immediately. Applies to tasks queued afterwards
+func (service *ScrapeService) SetUpdateInterval(interval time.Duration) {
+	service.stateBroker.SetThrottle(event.Throttle[storage.Task]{
+		Interval: interval,
+		Urgent: func(previous, next *storage.Task) bool {
+			return previous.Status != next.Status
+		},
+	})
 }
 
-func (service *ScrapeService) deleteInterruptChannelForTask(taskId int) {
-	service.interruptMu.Lock()
-	delete(service.interruptSignalMap, taskId)
-	service.interruptMu.Unlock()
+// GetUpdateMetrics returns the number of task updates, which were not delivered to listeners, because they did not keep
+// up with them
+func (service *ScrapeService) GetUpdateMetrics() *event.Metrics {
+	return service.stateBroker.Metrics()
 }
 
-func (service *ScrapeService) processTask(taskId int) {
-	interruptChannel := make(chan struct{}, 1)
+// SetAuditLog records actions performed on tasks in the audit log. Must be called before the service is used
+func (service *ScrapeService) SetAuditLog(auditLog storage.AuditDao) {
+	service.auditLog = auditLog
+}
 
-	// Set the channel, through which this task can be interrupted
-	service.setInterruptChannelForTask(taskId, interruptChannel)
-	defer service.deleteInterruptChannelForTask(taskId)
+// SetCompletionListener sets the function, which is called with every task that reaches a final state. It is called
+// while task status transitions are locked, so it must not block. Must be called before the service is used
+func (service *ScrapeService) SetCompletionListener(listener func(task storage.Task)) {
+	service.completionListener = listener
+}
 
-	broadcaster, err := service.stateBroker.GetStateBroadcaster(taskId)
-	if err != nil {
-		log.Printf("could not retrieve state broker: %v", err)
-		return
+// Calls the completion listener, if the task is in a final state. Must be called while holding controlMu
+func (service *ScrapeService) notifyCompletion(task *storage.Task) {
+	if service.completionListener != nil && isFinalStatus(task.Status) {
+		service.completionListener(*task)
 	}
-	defer service.destroyStateBroadcaster(taskId, broadcaster)
+}
 
-	task, err := service.storage.RetrieveTaskById(taskId)
-	if err != nil {
-		log.Printf("Error retrieving task %d: %v", taskId, err)
-		return
+// Queues the task to the message bus, so that it is claimed by a worker. Must be called while holding controlMu
+func (service *ScrapeService) enqueue(task *storage.Task) error {
+	job := bus.Job{Id: uuid.New().String(), Task: *task}
+	if task.Rechecking {
+		// Counters of the task are only updated if the accessibility of a re-checked link changes
+		results, err := service.storage.GetLinkResults(*task.Id)
+		if err != nil {
+			return err
+		}
+		job.PreviousResults = results
 	}
-	if task.Status == scrape.StatusInterrupted {
-		// Task has been interrupted before it started processing
-		return
+	// Set before the job is queued, so that its updates are not ignored
+	service.jobs[*task.Id] = &activeJob{id: job.Id, status: task.Status}
+	if err := service.bus.Enqueue(job); err != nil {
+		delete(service.jobs, *task.Id)
+		return err
 	}
+	return nil
+}
 
-	// Change task status and store in the database
-	task.Status = scrape.StatusInitiating
+// Same as enqueue, but locks controlMu itself
+func (service *ScrapeService) queueTask(task *storage.Task) error {
+	service.controlMu.Lock()
+	defer service.controlMu.Unlock()
+	return service.enqueue(task)
+}
 
-	// Persist in storage
-	_, err = service.storage.StoreTask(task)
+// Receives updates from the workers until the service is stopped
+func (service *ScrapeService) consumeUpdates() {
+	for update := range service.bus.Updates(nil) {
+		service.handleUpdate(update)
+	}
+}
+
+// Persists the state of the task reported by a worker and notifies subscribers about it
+func (service *ScrapeService) handleUpdate(update bus.Update) {
+	service.controlMu.Lock()
+	defer service.controlMu.Unlock()
+
+	task := &update.Task
+	job, found := service.jobs[*task.Id]
+	if !found || job.id != update.JobId {
+		// Task was stopped, deleted or queued again after the job was claimed
+		return
+	}
+	if update.LinkResult != nil {
+		if err := service.storage.StoreLinkResult(*task.Id, update.LinkResult); err != nil {
+			log.Printf("could not store link result: %v", err)
+		}
+	}
+	broadcaster, err := service.stateBroker.GetStateBroadcaster(*task.Id)
 	if err != nil {
-		log.Printf("could not store task: %v", err)
+		log.Printf("could not retrieve state broadcaster: %v", err)
 		return
 	}
-
-	// Notify subscribers of status started
+	if update.Final {
+		// Final state is published only after it is persisted
+		service.completeTask(task, broadcaster)
+		return
+	}
+	if task.Status != job.status {
+		// Progress is only persisted along with status transitions
+		if _, err = service.storage.StoreTask(task); err != nil {
+			log.Printf("could not store task: %v", err)
+		}
+		job.status = task.Status
+	}
 	broadcaster.Publish(*task)
-	seeker := CreateSeeker(&task.Link)
-	go seeker.Seek()
+}
 
-	func() {
-		for {
-			select {
-			case <-interruptChannel:
-				handleInterruptBegin(task)
-				broadcaster.Publish(*task)
-				seeker.InterruptChannel <- struct{}{}
-			case update, ok := <-seeker.UpdateChannel:
-				if !ok {
-					return
-				}
-				if update.Type() == scrape.UpdateTypePageBaseInfo {
-					updateTaskBaseInfo(task, update.(*scrape.PageBaseInfoUpdate))
-				} else if update.Type() == scrape.UpdateTypeLinkCrawled {
-					handleLinkCrawled(task, update.(*scrape.LinkCrawledUpdate))
-				} else if update.Type() == scrape.UpdateTypeError {
-					handleError(task, update.(*scrape.ErrorUpdate))
-					// Expecting this channel to close before next iteration
-				} else if update.Type() == scrape.UpdateTypeFinished {
-					handleFinished(task, update.(*scrape.FinishedUpdate))
-					// Expecting this channel to close before next iteration
-				} else if update.Type() == scrape.UpdateTypeInterrupted {
-					// Update was interrupted
-					handleInterruptFinish(task, update.(*scrape.InterruptedUpdate))
-					// Expecting this channel to close before next iteration
-				} else {
-					log.Fatalf("unsupported update type %d", update.Type())
-				}
-				broadcaster.Publish(*task)
-			}
+// Persists the final state of the task, notifies subscribers about it and releases resources associated with
+// processing. Must be called while holding controlMu, so that the task can not be resumed before this is completed.
+func (service *ScrapeService) completeTask(task *storage.Task, broadcaster *event.StateBroadcaster[storage.Task]) {
+	deleted := service.deleteOnCompletion.Contains(*task.Id)
+	if deleted {
+		service.deleteOnCompletion.Remove(*task.Id)
+		err := service.storage.DeleteTask(*task.Id)
+		if err != nil {
+			log.Printf("could not delete task: %v", err)
+		}
+	} else {
+		_, err := service.storage.StoreTask(task)
+		if err != nil {
+			log.Printf("could not store task: %v", err)
 		}
-	}()
-
-	// Update task status in the db
-	_, err = service.storage.StoreTask(task)
-	if err != nil {
-		log.Printf("could not store task: %v", err)
 	}
+	broadcaster.Publish(*task)
+	service.notifyCompletion(task)
+	delete(service.jobs, *task.Id)
+	service.destroyStateBroadcaster(*task.Id, broadcaster)
+	if deleted {
+		delete(service.finalEventIds, *task.Id)
+	}
+}
+
+// Tasks, which were paused after the initial page was processed, continue from the remaining links
+func isResumable(task *storage.Task) bool {
+	return task.HtmlVersion != nil && task.PendingLinks != nil
 }
 
 func handleInterruptBegin(task *storage.Task) {
 	task.Status = scrape.StatusInterrupting
 }
 
+func handlePauseBegin(task *storage.Task) {
+	task.Status = scrape.StatusPausing
+}
+
+func handlePauseFinish(task *storage.Task, update *scrape.PausedUpdate) {
+	task.Status = scrape.StatusPaused
+	task.PendingLinks = update.RemainingLinks
+}
+
+// Must be called while holding controlMu
 func (service *ScrapeService) destroyStateBroadcaster(taskId int, broadcaster *event.StateBroadcaster[storage.Task]) {
 	broadcaster.End()
+	service.finalEventIds[taskId] = broadcaster.FinalEventId()
 	err := service.stateBroker.DeleteStateBroadcaster(taskId)
 	if err != nil {
 		log.Printf("could not delete state broadcaster: %v", err)
@@ -147,37 +286,56 @@ func (service *ScrapeService) destroyStateBroadcaster(taskId int, broadcaster *e
 	}
 }
 
-func (service *ScrapeService) scrape() {
-	for taskId := range service.queuedTasks {
-		service.processTask(taskId)
-	}
-}
-
 //goland:noinspection GoUnusedParameter
 func handleFinished(task *storage.Task, update *scrape.FinishedUpdate) {
 	task.Status = scrape.StatusFinished
+	task.PendingLinks = nil
+	task.Rechecking = false
 }
 
 //goland:noinspection GoUnusedParameter
 func handleInterruptFinish(task *storage.Task, update *scrape.InterruptedUpdate) {
 	task.Status = scrape.StatusInterrupted
+	task.PendingLinks = nil
+	task.Rechecking = false
 }
 
 func handleError(task *storage.Task, update *scrape.ErrorUpdate) {
 	task.Status = scrape.StatusError
+	task.PendingLinks = nil
+	task.Rechecking = false
 	err := update.Error.Error()
 	task.Error = &err
 }
 
-func isInvalidHttpStatus(status int) bool {
-	return status >= 400 && status < 600
-}
+// Returns the result of the crawled link and updates the link counters of the task accordingly
+func handleLinkCrawled(
+	task *storage.Task,
+	update *scrape.LinkCrawledUpdate,
+	previousResults map[string]*storage.LinkResult,
+) *storage.LinkResult {
+	result := &storage.LinkResult{
+		Link:           *update.Link,
+		Status:         update.Status,
+		TransportError: update.TransportError,
+		CrawledAt:      time.Now(),
+	}
 
-func handleLinkCrawled(task *storage.Task, update *scrape.LinkCrawledUpdate) {
-	if update.TransportError || isInvalidHttpStatus(update.Status) {
+	previous, crawledBefore := previousResults[result.Link.String()]
+	if crawledBefore {
+		// Link is being re-checked - only a change of its accessibility affects the counters
+		if previous.IsAccessible() && !result.IsAccessible() {
+			*task.InaccessibleLinks = *task.InaccessibleLinks + 1
+		} else if !previous.IsAccessible() && result.IsAccessible() {
+			*task.InaccessibleLinks = *task.InaccessibleLinks - 1
+		}
+		return result
+	}
+	if !result.IsAccessible() {
 		*task.InaccessibleLinks = *task.InaccessibleLinks + 1
 	}
 	task.CrawledLinks = task.CrawledLinks + 1
+	return result
 }
 
 func updateTaskBaseInfo(task *storage.Task, update *scrape.PageBaseInfoUpdate) {
@@ -198,52 +356,246 @@ func updateTaskBaseInfo(task *storage.Task, update *scrape.PageBaseInfoUpdate) {
 }
 
 func (service *ScrapeService) init() {
-	for i := 0; i < MaxInstances; i++ {
-		go service.scrape()
+	go service.consumeUpdates()
+
+	// Queue tasks, which were persisted, but not yet processed
+	pendingTasks := service.storage.GetAllTasks()
+	for i := len(pendingTasks) - 1; i >= 0; i-- {
+		task := pendingTasks[i]
+		if task.Status != scrape.StatusPending {
+			continue
+		}
+		broadcaster, err := service.stateBroker.AddStateBroadcaster(*task.Id)
+		if err != nil {
+			log.Printf("could not create state broadcaster for pending task %d: %v", *task.Id, err)
+			continue
+		}
+		broadcaster.Start(*task)
+		if err = service.queueTask(task); err != nil {
+			log.Printf("could not queue pending task %d: %v", *task.Id, err)
+		}
+	}
+}
+
+// SetWorkerCount changes the number of tasks that are processed concurrently by this process. When the number is
+// decreased, the surplus workers stop after finishing the task they are currently processing.
+func (service *ScrapeService) SetWorkerCount(actor principal.Principal, count int) (err error) {
+	defer func() { service.audit(actor, AuditActionWorkerCountChanged, strconv.Itoa(count), err) }()
+	return service.setWorkerCount(count)
+}
+
+func (service *ScrapeService) setWorkerCount(count int) error {
+	if service.worker == nil {
+		return ErrNoLocalWorker
+	}
+	if count < 1 {
+		return ErrInvalidWorkerCount
+	}
+	return service.worker.SetConcurrency(count)
+}
+
+// GetWorkerCount returns the number of tasks that can be processed concurrently by this process
+func (service *ScrapeService) GetWorkerCount() int {
+	if service.worker == nil {
+		return 0
+	}
+	return service.worker.GetConcurrency()
+}
+
+// GetWorkers returns the statuses of the workers of all processes, which are registered at the message bus. Workers,
+// which have not reported their status for WorkerRetention, are left out
+func (service *ScrapeService) GetWorkers() ([]bus.WorkerStatus, error) {
+	workers, err := service.bus.GetWorkers()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	return slices.DeleteFunc(workers, func(worker bus.WorkerStatus) bool {
+		return isWorkerStale(worker, now)
+	}), nil
+}
+
+// PruneWorkers removes workers, which have not reported their status for WorkerRetention, from the registry, e.g.
+// because they crashed without deregistering. Returns the number of removed workers
+func (service *ScrapeService) PruneWorkers(now time.Time) (int, error) {
+	workers, err := service.bus.GetWorkers()
+	if err != nil {
+		return 0, err
+	}
+	removed := 0
+	for _, worker := range workers {
+		if !isWorkerStale(worker, now) {
+			continue
+		}
+		if _, err = service.bus.Deregister(worker.Id); err != nil {
+			return removed, err
+		}
+		removed = removed + 1
+	}
+	return removed, nil
+}
+
+// StartWorkerPruningJob prunes workers periodically. Returns a function, which stops the job.
+func (service *ScrapeService) StartWorkerPruningJob(interval time.Duration) (stop func()) {
+	ticker := time.NewTicker(interval)
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case now := <-ticker.C:
+				removed, err := service.PruneWorkers(now)
+				if err != nil {
+					log.Printf("could not prune workers: %v", err)
+				} else if removed > 0 {
+					log.Printf("removed %d workers, which stopped reporting their status", removed)
+				}
+			}
+		}
+	}()
+	return func() {
+		ticker.Stop()
+		close(done)
 	}
 }
 
-func (service *ScrapeService) RegisterListener(taskId int) (err error, data <-chan storage.Task, done chan<- struct{}) {
+func isWorkerStale(worker bus.WorkerStatus, now time.Time) bool {
+	return now.Sub(worker.ReportedAt) > WorkerRetention
+}
+
+// GetQueuedTaskCount returns the number of tasks waiting to be processed
+func (service *ScrapeService) GetQueuedTaskCount() int {
+	return service.bus.Len()
+}
+
+// GetQueuePosition returns the 1-based position of a pending task in the queue. Returns false if the task is not queued.
+func (service *ScrapeService) GetQueuePosition(taskId int) (int, bool) {
+	return service.bus.Position(taskId)
+}
+
+// ListenForActivity starts listening for the creation and status changes of all tasks visible to the actor and matching
+// the filter. Progress updates, which do not change the status, are not sent. Caller must write to or close the done
+// channel when the updates are no longer needed. Data channel is closed if the caller does not keep up with the updates
+func (service *ScrapeService) ListenForActivity(
+	actor principal.Principal,
+	filter storage.TaskFilter,
+) (data <-chan event.Event[storage.Task], done chan<- struct{}) {
+	if !actor.AllTasks {
+		filter.Owner = &actor.Username
+	}
+	// Activity of all tasks would pile up behind a stalled listener, so it is disconnected instead
+	events, stopEvents := service.stateBroker.ListenAll(event.ListenOptions{Policy: event.Disconnect})
+	dataCh := make(chan event.Event[storage.Task])
+	doneCh := make(chan struct{})
+	go func() {
+		defer close(dataCh)
+		defer func() {
+			close(stopEvents)
+			// Channel is closed once the broker has unregistered the listener
+			for range events {
+			}
+		}()
+		// Last known status of the running tasks
+		statuses := make(map[int]string)
+		for {
+			select {
+			case <-doneCh:
+				return
+			case update, ok := <-events:
+				if !ok {
+					// Listener was too slow
+					return
+				}
+				task := &update.State
+				if status, known := statuses[update.Topic]; known && status == task.Status {
+					continue
+				}
+				if isFinalStatus(task.Status) || task.Status == scrape.StatusPaused {
+					// No more updates will follow until the task is resumed or retried
+					delete(statuses, update.Topic)
+				} else {
+					statuses[update.Topic] = task.Status
+				}
+				if !filter.Matches(task) {
+					continue
+				}
+				select {
+				case dataCh <- update.Event:
+				case <-doneCh:
+					return
+				}
+			}
+		}
+	}()
+	return dataCh, doneCh
+}
+
+// RegisterListener starts listening for state updates of the task. If lastEventId is set, the events published after it
+// are sent first, as far as they are remembered, otherwise only the latest state is
+func (service *ScrapeService) RegisterListener(
+	actor principal.Principal,
+	taskId int,
+	lastEventId uint64,
+) (err error, data <-chan event.Event[storage.Task], done chan<- struct{}) {
+	task, err := service.getAccessibleTask(actor, taskId)
+	if err != nil {
+		return err, nil, nil
+	}
 	stateBroker, err := service.stateBroker.GetStateBroadcaster(taskId)
 	if err != nil {
-		task, err := service.storage.RetrieveTaskById(taskId)
+		task, err = service.storage.RetrieveTaskById(taskId)
 		if err != nil {
 			return err, nil, nil
 		}
-		if task.Status == scrape.StatusFinished || task.Status == scrape.StatusError || task.Status == scrape.StatusInterrupted {
-			return errors.New("task already finished"), nil, nil
+		if isFinalStatus(task.Status) || task.Status == scrape.StatusPaused {
+			return ErrTaskNotRunning, nil, nil
 		}
 		return errors.New("task not finished, but there is no state broker for it"), nil, nil
 	}
 	err = nil
-	data, done = stateBroker.Listen()
+	data, done = stateBroker.ListenFrom(lastEventId)
 	return
 }
 
+// GetFinalEventId returns the ID of the last state event published for the task before it stopped running. False if
+// the task has not published any events since the service was started, e.g. it stopped in a previous run
+func (service *ScrapeService) GetFinalEventId(taskId int) (uint64, bool) {
+	service.controlMu.Lock()
+	defer service.controlMu.Unlock()
+	id, found := service.finalEventIds[taskId]
+	return id, found
+}
+
 // AddTask Creates a seeker for a given URL. Returns a unique ID associated with it
 //
 // Parameters:
 //
+//	actor (Principal): The user adding the task
 //	link (url): The URL to scrape
+//	options (TaskOptions): Priority and owner of the task
 //
 // Returns:
 //
 //	int: The unique seeker identifier
-func (service *ScrapeService) AddTask(link *url.URL) (int, error) {
-	taskId, _, err := service.setUpNewTask(link)
+func (service *ScrapeService) AddTask(actor principal.Principal, link *url.URL, options TaskOptions) (int, error) {
+	task, _, err := service.setUpNewTask(link, options)
 	if err != nil {
+		service.audit(actor, AuditActionTaskAdded, link.String(), err)
 		return -1, err
 	}
 
-	// Push to channel so that it starts processing
-	go func() {
-		service.queuedTasks <- taskId
-	}()
-	return taskId, nil
+	// Queue so that it starts processing
+	err = service.queueTask(task)
+	service.audit(actor, AuditActionTaskAdded, strconv.Itoa(*task.Id), err)
+	if err != nil {
+		return -1, err
+	}
+	return *task.Id, nil
 }
 
-func (service *ScrapeService) AddTaskAndListenForUpdates(link *url.URL) (taskId int, data <-chan storage.Task, done chan<- struct{}, err error) {
-	taskId, broadcaster, err := service.setUpNewTask(link)
+func (service *ScrapeService) AddTaskAndListenForUpdates(link *url.URL, options TaskOptions) (taskId int, data <-chan event.Event[storage.Task], done chan<- struct{}, err error) {
+	task, broadcaster, err := service.setUpNewTask(link, options)
 	if err != nil {
 		return -1, nil, nil, err
 	}
@@ -251,65 +603,333 @@ func (service *ScrapeService) AddTaskAndListenForUpdates(link *url.URL) (taskId
 	// Start listener before queueing task
 	data, done = broadcaster.Listen()
 
-	// Push to channel so that it starts processing
-	go func() {
-		service.queuedTasks <- taskId
-	}()
-	return taskId, data, done, nil
+	// Queue so that it starts processing
+	if err = service.queueTask(task); err != nil {
+		close(done)
+		return -1, nil, nil, err
+	}
+	return *task.Id, data, done, nil
 }
 
-func (service *ScrapeService) setUpNewTask(link *url.URL) (int, *event.StateBroadcaster[storage.Task], error) {
+func (service *ScrapeService) setUpNewTask(link *url.URL, options TaskOptions) (*storage.Task, *event.StateBroadcaster[storage.Task], error) {
+	return service.setUpTask(link, options, nil)
+}
+
+func (service *ScrapeService) setUpTask(
+	link *url.URL,
+	options TaskOptions,
+	retryOf *int,
+) (*storage.Task, *event.StateBroadcaster[storage.Task], error) {
+	if options.Priority < MinPriority || options.Priority > MaxPriority {
+		return nil, nil, ErrInvalidPriority
+	}
 	task := storage.CreateTaskInitial(scrape.StatusPending, link, time.Now())
+	task.Priority = options.Priority
+	task.Owner = options.Owner
+	task.RetryOf = retryOf
 
 	// Save the newly created task
 	newId, err := service.storage.StoreTask(task)
 	if err != nil {
-		return 0, nil, err
+		return nil, nil, err
 	}
 
 	// CreateTaskService new state broadcaster
 	broadcaster, err := service.stateBroker.AddStateBroadcaster(newId)
 	if err != nil {
-		return 0, nil, err
+		return nil, nil, err
 	}
 
 	// Publish initial state
 	broadcaster.Start(*task)
-	return newId, broadcaster, nil
+	return task, broadcaster, nil
 }
 
-func (service *ScrapeService) InterruptTask(id int) error {
-	service.interruptMu.Lock()
-	defer service.interruptMu.Unlock()
+func (service *ScrapeService) InterruptTask(actor principal.Principal, id int) (err error) {
+	defer func() { service.audit(actor, AuditActionTaskInterrupted, strconv.Itoa(id), err) }()
+	service.controlMu.Lock()
+	defer service.controlMu.Unlock()
 
-	task, err := service.GetTaskById(id)
+	task, err := service.getAccessibleTask(actor, id)
 	if err != nil {
 		return err
 	}
 	if task.Status == scrape.StatusPending {
 		// In pending state - we can just update status, and it will not be picked up
-		return service.interruptPendingTask(task)
+		return service.stopPendingTask(task, scrape.StatusInterrupted)
 	}
-
-	interruptChannel, found := service.interruptSignalMap[id]
-	if found {
-		// Task is currently processing - need to send interrupt signal
-		interruptChannel <- struct{}{}
-		delete(service.interruptSignalMap, id)
+	if task.Status == scrape.StatusPaused {
+		// Nothing is processing - task can be transitioned to its final state right away
+		task.Status = scrape.StatusInterrupted
+		task.PendingLinks = nil
+		if _, err = service.storage.StoreTask(task); err != nil {
+			return err
+		}
+		service.notifyCompletion(task)
 		return nil
 	}
 
-	// Task is in a final state - return error
-	switch task.Status {
-	case scrape.StatusInterrupted, scrape.StatusError, scrape.StatusFinished:
+	// Task is currently processing - need to send interrupt signal. It overrides a pause, which was not completed yet
+	if sent, err := service.signalTask(id, bus.SignalInterrupt); sent || err != nil {
+		return err
+	}
+
+	// Task is in a final state or was already interrupted - return error
+	if isFinalStatus(task.Status) {
 		return ErrTaskInFinalState
-	default:
+	}
+	return ErrInterruptAlreadySent
+}
+
+// PauseTask stops dispatching links of the task. Links that were already dispatched are crawled, and the remaining
+// ones are persisted, so that the task can be continued with ResumeTask.
+func (service *ScrapeService) PauseTask(actor principal.Principal, id int) (err error) {
+	defer func() { service.audit(actor, AuditActionTaskPaused, strconv.Itoa(id), err) }()
+	service.controlMu.Lock()
+	defer service.controlMu.Unlock()
+
+	task, err := service.getAccessibleTask(actor, id)
+	if err != nil {
+		return err
+	}
+	if task.Status == scrape.StatusPending {
+		return service.stopPendingTask(task, scrape.StatusPaused)
+	}
+
+	if sent, err := service.signalTask(id, bus.SignalPause); sent || err != nil {
+		return err
+	}
+
+	switch {
+	case isFinalStatus(task.Status):
+		return ErrTaskInFinalState
+	case task.Status == scrape.StatusPaused:
+		return ErrTaskAlreadyPaused
+	case task.Status == scrape.StatusInterrupting || service.sentSignal(id) == bus.SignalInterrupt:
 		return ErrInterruptAlreadySent
+	default:
+		return ErrPauseAlreadySent
 	}
 }
 
-func (service *ScrapeService) interruptPendingTask(task *storage.Task) error {
-	task.Status = scrape.StatusInterrupted
+// Sends the signal to the worker processing the task, unless a signal was already sent to it. Only an interrupt can
+// follow a pause. Returns false if the signal was not sent. Must be called while holding controlMu
+func (service *ScrapeService) signalTask(id int, signal bus.Signal) (bool, error) {
+	job, found := service.jobs[id]
+	if !found || (job.signal != 0 && !(job.signal == bus.SignalPause && signal == bus.SignalInterrupt)) {
+		return false, nil
+	}
+	if err := service.bus.Signal(id, signal); err != nil {
+		return false, err
+	}
+	job.signal = signal
+	return true, nil
+}
+
+// Returns the signal sent to the worker processing the task, or 0 if none was sent. Must be called while holding
+// controlMu
+func (service *ScrapeService) sentSignal(id int) bus.Signal {
+	if job, found := service.jobs[id]; found {
+		return job.signal
+	}
+	return 0
+}
+
+// ResumeTask queues a paused task again. The task continues from the links that were outstanding when it was paused.
+func (service *ScrapeService) ResumeTask(actor principal.Principal, id int) (err error) {
+	defer func() { service.audit(actor, AuditActionTaskResumed, strconv.Itoa(id), err) }()
+	service.controlMu.Lock()
+	defer service.controlMu.Unlock()
+
+	task, err := service.getAccessibleTask(actor, id)
+	if err != nil {
+		return err
+	}
+	if task.Status != scrape.StatusPaused {
+		return ErrTaskNotPaused
+	}
+
+	task.Status = scrape.StatusPending
+	_, err = service.storage.StoreTask(task)
+	if err != nil {
+		return err
+	}
+	broadcaster, err := service.stateBroker.AddStateBroadcaster(id)
+	if err != nil {
+		return err
+	}
+	broadcaster.Start(*task)
+	return service.enqueue(task)
+}
+
+// RetryTask creates a new task with the link and options of a task, which is in a final state.
+// Returns the ID of the new task.
+func (service *ScrapeService) RetryTask(actor principal.Principal, id int) (_ int, err error) {
+	defer func() { service.audit(actor, AuditActionTaskRetried, strconv.Itoa(id), err) }()
+	task, err := service.getAccessibleTask(actor, id)
+	if err != nil {
+		return -1, err
+	}
+	if !isFinalStatus(task.Status) {
+		return -1, ErrTaskNotFinished
+	}
+
+	options := TaskOptions{Priority: task.Priority, Owner: task.Owner}
+	newTask, _, err := service.setUpTask(&task.Link, options, task.Id)
+	if err != nil {
+		return -1, err
+	}
+	if err = service.queueTask(newTask); err != nil {
+		return -1, err
+	}
+	return *newTask.Id, nil
+}
+
+// RecheckBrokenLinks queues a task in a final state again, so that only the links, which were found inaccessible,
+// are crawled. Results of those links and the inaccessible link count of the task are updated.
+func (service *ScrapeService) RecheckBrokenLinks(actor principal.Principal, id int) (err error) {
+	defer func() { service.audit(actor, AuditActionTaskRechecked, strconv.Itoa(id), err) }()
+	service.controlMu.Lock()
+	defer service.controlMu.Unlock()
+
+	task, err := service.getAccessibleTask(actor, id)
+	if err != nil {
+		return err
+	}
+	if !isFinalStatus(task.Status) {
+		return ErrTaskNotFinished
+	}
+	if task.HtmlVersion == nil {
+		// Initial page was never processed
+		return ErrNoBrokenLinks
+	}
+
+	results, err := service.storage.GetLinkResults(id)
+	if err != nil {
+		return err
+	}
+	brokenLinks := make([]url.URL, 0)
+	for _, result := range results {
+		if !result.IsAccessible() {
+			brokenLinks = append(brokenLinks, result.Link)
+		}
+	}
+	if len(brokenLinks) == 0 {
+		return ErrNoBrokenLinks
+	}
+
+	task.Status = scrape.StatusPending
+	task.PendingLinks = brokenLinks
+	task.Rechecking = true
+	task.Error = nil
+	_, err = service.storage.StoreTask(task)
+	if err != nil {
+		return err
+	}
+	broadcaster, err := service.stateBroker.AddStateBroadcaster(id)
+	if err != nil {
+		return err
+	}
+	broadcaster.Start(*task)
+	return service.enqueue(task)
+}
+
+// GetLinkResults returns results of all crawled links of the task
+func (service *ScrapeService) GetLinkResults(actor principal.Principal, id int) ([]*storage.LinkResult, error) {
+	_, err := service.getAccessibleTask(actor, id)
+	if err != nil {
+		return nil, err
+	}
+	return service.storage.GetLinkResults(id)
+}
+
+func isFinalStatus(status string) bool {
+	return status == scrape.StatusFinished || status == scrape.StatusError || status == scrape.StatusInterrupted
+}
+
+// DeleteTask deletes the task along with its link results. Running tasks are only deleted if force is set - in that
+// case the task is interrupted and deleted once it stops.
+func (service *ScrapeService) DeleteTask(actor principal.Principal, id int, force bool) (err error) {
+	defer func() { service.audit(actor, AuditActionTaskDeleted, strconv.Itoa(id), err) }()
+	service.controlMu.Lock()
+	defer service.controlMu.Unlock()
+
+	task, err := service.getAccessibleTask(actor, id)
+	if err != nil {
+		return err
+	}
+	return service.deleteTask(task, force)
+}
+
+// DeleteTasks deletes all tasks matching the filter. Running tasks are skipped, unless force is set.
+// Returns the number of deleted tasks.
+func (service *ScrapeService) DeleteTasks(actor principal.Principal, filter storage.TaskFilter, force bool) (int, error) {
+	service.controlMu.Lock()
+	defer service.controlMu.Unlock()
+
+	if !actor.AllTasks {
+		filter.Owner = &actor.Username
+	}
+	deleted := 0
+	for _, task := range service.storage.FindTasks(filter) {
+		err := service.deleteTask(task, force)
+		if errors.Is(err, ErrTaskRunning) {
+			continue
+		}
+		service.audit(actor, AuditActionTaskDeleted, strconv.Itoa(*task.Id), err)
+		if err != nil {
+			return deleted, err
+		}
+		deleted = deleted + 1
+	}
+	return deleted, nil
+}
+
+// Records the action in the audit log, if it is set. Failures to record it are only logged, since the action was
+// already performed
+func (service *ScrapeService) audit(actor principal.Principal, action string, target string, err error) {
+	if service.auditLog == nil {
+		return
+	}
+	if recordErr := service.auditLog.RecordEvent(storage.CreateAuditEvent(actor, action, target, err)); recordErr != nil {
+		log.Printf("could not record %s of %s in the audit log: %v", action, target, recordErr)
+	}
+}
+
+// Must be called while holding controlMu
+func (service *ScrapeService) deleteTask(task *storage.Task, force bool) error {
+	id := *task.Id
+	if task.Status == scrape.StatusPending {
+		// If the task was already claimed, the lease of the worker is revoked
+		if err := service.removeJob(id); err != nil {
+			return err
+		}
+		broadcaster, err := service.stateBroker.GetStateBroadcaster(id)
+		if err == nil {
+			service.destroyStateBroadcaster(id, broadcaster)
+		}
+		delete(service.finalEventIds, id)
+		return service.storage.DeleteTask(id)
+	}
+	if isFinalStatus(task.Status) || task.Status == scrape.StatusPaused {
+		delete(service.finalEventIds, id)
+		return service.storage.DeleteTask(id)
+	}
+
+	// Task is running
+	if !force {
+		return ErrTaskRunning
+	}
+	if _, err := service.signalTask(id, bus.SignalInterrupt); err != nil {
+		return err
+	}
+	service.deleteOnCompletion.Add(id)
+	return nil
+}
+
+// Transitions a task, which has not been picked up by a worker yet, to the given status
+func (service *ScrapeService) stopPendingTask(task *storage.Task, status string) error {
+	task.Status = status
 	_, err := service.storage.StoreTask(task)
 	if err != nil {
 		return err
@@ -319,15 +939,56 @@ func (service *ScrapeService) interruptPendingTask(task *storage.Task) error {
 		log.Printf("could not retrieve state broadcaster: %v", err)
 		return err
 	}
-	// Publish update so that the subscribers know this task has been interrupted
+	// Publish update so that the subscribers know the status of this task has changed
 	broadcaster.Publish(*task)
+	service.notifyCompletion(task)
+	// If the task was already claimed, the lease of the worker is revoked, and its updates are ignored
+	if err = service.removeJob(*task.Id); err != nil {
+		log.Printf("could not remove job of task %d: %v", *task.Id, err)
+	}
+	service.destroyStateBroadcaster(*task.Id, broadcaster)
 	return nil
 }
 
+// Removes the job of the task from the message bus. Must be called while holding controlMu
+func (service *ScrapeService) removeJob(id int) error {
+	delete(service.jobs, id)
+	_, err := service.bus.Remove(id)
+	return err
+}
+
+// GetTaskById returns the task regardless of its owner. Requests of users must go through GetTask instead
 func (service *ScrapeService) GetTaskById(id int) (*storage.Task, error) {
 	return service.storage.RetrieveTaskById(id)
 }
 
+// GetTask returns the task, if it is visible to the actor
+func (service *ScrapeService) GetTask(actor principal.Principal, id int) (*storage.Task, error) {
+	return service.getAccessibleTask(actor, id)
+}
+
+// Returns ErrTaskNotFound if the task does not exist or is owned by another user, so that the existence
+// of other users' tasks is not revealed
+func (service *ScrapeService) getAccessibleTask(actor principal.Principal, id int) (*storage.Task, error) {
+	task, err := service.storage.RetrieveTaskById(id)
+	if err != nil {
+		return nil, errors.Join(ErrTaskNotFound, err)
+	}
+	if !actor.CanAccess(task.Owner) {
+		return nil, ErrTaskNotFound
+	}
+	return task, nil
+}
+
+// GetAllTasks returns the tasks of all owners. Requests of users must go through QueryTasks instead
 func (service *ScrapeService) GetAllTasks() []*storage.Task {
 	return service.storage.GetAllTasks()
 }
+
+// QueryTasks returns a page of tasks matching the query, which are visible to the actor
+func (service *ScrapeService) QueryTasks(actor principal.Principal, query storage.TaskQuery) (*storage.TaskPage, error) {
+	if !actor.AllTasks {
+		query.Filter.Owner = &actor.Username
+	}
+	return service.storage.QueryTasks(query)
+}
@@ -1,16 +1,25 @@
 package scrape_test
 
 import (
+	"database/sql"
+	"errors"
 	"fmt"
+	"github.com/martynasd123/golang-scraper/models/principal"
 	scrapeStorage "github.com/martynasd123/golang-scraper/models/scrape"
 	"github.com/martynasd123/golang-scraper/services/scrape"
+	"github.com/martynasd123/golang-scraper/services/scrape/bus"
 	"github.com/martynasd123/golang-scraper/storage"
+	"github.com/martynasd123/golang-scraper/utils/event"
+	_ "github.com/mattn/go-sqlite3"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"path/filepath"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestScrapeService_AddTaskAndListenForUpdates(t *testing.T) {
@@ -27,21 +36,21 @@ func TestScrapeService_AddTaskAndListenForUpdates(t *testing.T) {
 
 	service := scrape.CreateTaskService(taskStorage)
 
-	_, data, _, err := service.AddTaskAndListenForUpdates(serverUrl)
+	_, data, _, err := service.AddTaskAndListenForUpdates(serverUrl, scrape.TaskOptions{})
 	require.NoError(t, err)
 
-	update := <-data
+	update := (<-data).State
 	assert.Equal(t, scrapeStorage.StatusPending, update.Status)
 
-	update = <-data
+	update = (<-data).State
 	assert.Equal(t, scrapeStorage.StatusInitiating, update.Status)
 
 	for range 4 {
-		update = <-data
+		update = (<-data).State
 		assert.Equal(t, scrapeStorage.StatusTryingLinks, update.Status)
 	}
 
-	update = <-data
+	update = (<-data).State
 	assert.Equal(t, scrapeStorage.StatusFinished, update.Status)
 	assert.Equal(t, 1, *update.InaccessibleLinks)
 	assert.Equal(t, 3, update.CrawledLinks)
@@ -60,19 +69,630 @@ func TestScrapeService_AddTaskAndListenForUpdatesWhenPrimaryPageError(t *testing
 
 	service := scrape.CreateTaskService(taskStorage)
 
-	_, data, _, err := service.AddTaskAndListenForUpdates(serverUrl)
+	_, data, _, err := service.AddTaskAndListenForUpdates(serverUrl, scrape.TaskOptions{})
 	require.NoError(t, err)
 
-	update := <-data
+	update := (<-data).State
 	require.Equal(t, scrapeStorage.StatusPending, update.Status)
 
-	update = <-data
+	update = (<-data).State
 	require.Equal(t, scrapeStorage.StatusInitiating, update.Status)
 
-	update = <-data
+	update = (<-data).State
 	require.Equal(t, scrapeStorage.StatusError, update.Status)
 }
 
+func TestScrapeService_FinalEventId(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", createHtmlResponseHandler())
+
+	server := httptest.NewServer(mux)
+	serverUrl, _ := url.Parse(server.URL)
+
+	service := scrape.CreateTaskService(storage.CreateTaskInMemoryDao())
+
+	taskId, data, _, err := service.AddTaskAndListenForUpdates(serverUrl, scrape.TaskOptions{})
+	require.NoError(t, err)
+	_, found := service.GetFinalEventId(taskId)
+	require.False(t, found)
+
+	var last uint64
+	for update := range data {
+		last = update.Id
+	}
+
+	// Final event ID is remembered right after the listeners are closed
+	var finalEventId uint64
+	require.Eventually(t, func() bool {
+		finalEventId, found = service.GetFinalEventId(taskId)
+		return found
+	}, time.Second, time.Millisecond)
+	require.Equal(t, last, finalEventId)
+	err, _, _ = service.RegisterListener(principal.System, taskId, finalEventId)
+	require.ErrorIs(t, err, scrape.ErrTaskNotRunning)
+}
+
+func TestScrapeService_PendingTasksQueuedOnStartup(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", createHtmlResponseHandler())
+
+	server := httptest.NewServer(mux)
+	serverUrl, _ := url.Parse(server.URL)
+
+	// Task was persisted, but never picked up
+	taskStorage := storage.CreateTaskInMemoryDao()
+	taskId, err := taskStorage.StoreTask(storage.CreateTaskInitial(scrapeStorage.StatusPending, serverUrl, time.Now()))
+	require.NoError(t, err)
+
+	service := scrape.CreateTaskService(taskStorage)
+
+	require.Eventually(t, func() bool {
+		task, err := service.GetTaskById(taskId)
+		return err == nil && task.Status == scrapeStorage.StatusFinished
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestScrapeService_SetWorkerCount(t *testing.T) {
+	service := scrape.CreateTaskService(storage.CreateTaskInMemoryDao())
+	require.Equal(t, scrape.DefaultWorkerCount, service.GetWorkerCount())
+
+	require.NoError(t, service.SetWorkerCount(principal.System, 7))
+	require.Equal(t, 7, service.GetWorkerCount())
+
+	require.NoError(t, service.SetWorkerCount(principal.System, 1))
+	require.Equal(t, 1, service.GetWorkerCount())
+
+	require.ErrorIs(t, service.SetWorkerCount(principal.System, 0), scrape.ErrInvalidWorkerCount)
+	require.ErrorIs(t, service.SetWorkerCount(principal.System, scrape.MaxWorkerCount+1), scrape.ErrInvalidWorkerCount)
+}
+
+func TestScrapeService_AddTaskWithInvalidPriority(t *testing.T) {
+	service := scrape.CreateTaskService(storage.CreateTaskInMemoryDao())
+	link, _ := url.Parse("http://example.com")
+
+	_, err := service.AddTask(principal.System, link, scrape.TaskOptions{Priority: scrape.MaxPriority + 1})
+	require.ErrorIs(t, err, scrape.ErrInvalidPriority)
+}
+
+func TestScrapeService_InterruptWhilePausing(t *testing.T) {
+	mux := http.NewServeMux()
+	links := make([]string, 0)
+	for i := range 40 {
+		links = append(links, fmt.Sprintf("/slow/%d", i))
+	}
+	mux.HandleFunc("/slow/", func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+	})
+	mux.HandleFunc("/", createHtmlResponseHandler(links...))
+
+	server := httptest.NewServer(mux)
+	serverUrl, _ := url.Parse(server.URL)
+
+	service := scrape.CreateTaskService(storage.CreateTaskInMemoryDao())
+
+	taskId, data, _, err := service.AddTaskAndListenForUpdates(serverUrl, scrape.TaskOptions{})
+	require.NoError(t, err)
+	for event := range data {
+		if event.State.Status == scrapeStorage.StatusTryingLinks {
+			break
+		}
+	}
+
+	// Links being crawled keep the task pausing, while the interrupt overrides the pause
+	require.NoError(t, service.PauseTask(principal.System, taskId))
+	require.NoError(t, service.InterruptTask(principal.System, taskId))
+	require.ErrorIs(t, service.InterruptTask(principal.System, taskId), scrape.ErrInterruptAlreadySent)
+	require.ErrorIs(t, service.PauseTask(principal.System, taskId), scrape.ErrInterruptAlreadySent)
+
+	var update storage.Task
+	for event := range data {
+		update = event.State
+	}
+	require.Equal(t, scrapeStorage.StatusInterrupted, update.Status)
+	require.Empty(t, update.PendingLinks)
+}
+
+func TestScrapeService_PauseAndResumeAfterRestart(t *testing.T) {
+	mux := http.NewServeMux()
+	links := make([]string, 0)
+	for i := range 40 {
+		links = append(links, fmt.Sprintf("/slow/%d", i))
+	}
+	mux.HandleFunc("/slow/", func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(50 * time.Millisecond)
+	})
+	mux.HandleFunc("/", createHtmlResponseHandler(links...))
+
+	server := httptest.NewServer(mux)
+	serverUrl, _ := url.Parse(server.URL)
+
+	taskStorage := storage.CreateTaskInMemoryDao()
+	service := scrape.CreateTaskService(taskStorage)
+
+	taskId, data, _, err := service.AddTaskAndListenForUpdates(serverUrl, scrape.TaskOptions{})
+	require.NoError(t, err)
+
+	// Pause as soon as first link is crawled
+	for event := range data {
+		if event.State.CrawledLinks > 0 {
+			break
+		}
+	}
+	require.NoError(t, service.PauseTask(principal.System, taskId))
+	require.ErrorIs(t, service.PauseTask(principal.System, taskId), scrape.ErrPauseAlreadySent)
+
+	var update storage.Task
+	for event := range data {
+		update = event.State
+	}
+	require.Equal(t, scrapeStorage.StatusPaused, update.Status)
+	require.NotEmpty(t, update.PendingLinks)
+	require.Equal(t, 40, update.CrawledLinks+len(update.PendingLinks))
+
+	// Simulate server restart by creating a new service on top of the same storage
+	restartedService := scrape.CreateTaskService(taskStorage)
+	require.ErrorIs(t, restartedService.PauseTask(principal.System, taskId), scrape.ErrTaskAlreadyPaused)
+	require.NoError(t, restartedService.ResumeTask(principal.System, taskId))
+	require.ErrorIs(t, restartedService.ResumeTask(principal.System, taskId), scrape.ErrTaskNotPaused)
+
+	require.Eventually(t, func() bool {
+		task, err := restartedService.GetTaskById(taskId)
+		return err == nil && task.Status == scrapeStorage.StatusFinished
+	}, 10*time.Second, 10*time.Millisecond)
+
+	task, err := restartedService.GetTaskById(taskId)
+	require.NoError(t, err)
+	require.Equal(t, 40, task.CrawledLinks)
+	require.Empty(t, task.PendingLinks)
+}
+
+func TestScrapeService_InterruptPausedTask(t *testing.T) {
+	link, _ := url.Parse("http://example.com")
+	taskStorage := storage.CreateTaskInMemoryDao()
+	task := storage.CreateTaskInitial(scrapeStorage.StatusPaused, link, time.Now())
+	taskId, err := taskStorage.StoreTask(task)
+	require.NoError(t, err)
+
+	service := scrape.CreateTaskService(taskStorage)
+	require.NoError(t, service.InterruptTask(principal.System, taskId))
+
+	task, err = service.GetTaskById(taskId)
+	require.NoError(t, err)
+	require.Equal(t, scrapeStorage.StatusInterrupted, task.Status)
+	require.ErrorIs(t, service.ResumeTask(principal.System, taskId), scrape.ErrTaskNotPaused)
+}
+
+func TestScrapeService_CompletionListener(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", errorResponseHandler)
+	server := httptest.NewServer(mux)
+	serverUrl, _ := url.Parse(server.URL)
+
+	link, _ := url.Parse("http://example.com")
+	taskStorage := storage.CreateTaskInMemoryDao()
+	pausedId, err := taskStorage.StoreTask(storage.CreateTaskInitial(scrapeStorage.StatusPaused, link, time.Now()))
+	require.NoError(t, err)
+
+	service := scrape.CreateTaskService(taskStorage)
+	completed := make(chan storage.Task, 2)
+	service.SetCompletionListener(func(task storage.Task) {
+		completed <- task
+	})
+
+	require.NoError(t, service.InterruptTask(principal.System, pausedId))
+	task := <-completed
+	require.Equal(t, pausedId, *task.Id)
+	require.Equal(t, scrapeStorage.StatusInterrupted, task.Status)
+
+	taskId, err := service.AddTask(principal.System, serverUrl, scrape.TaskOptions{})
+	require.NoError(t, err)
+	select {
+	case task = <-completed:
+		require.Equal(t, taskId, *task.Id)
+		require.Equal(t, scrapeStorage.StatusError, task.Status)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for task to complete")
+	}
+}
+
+func TestScrapeService_RecheckBrokenLinks(t *testing.T) {
+	mux := http.NewServeMux()
+	var flakyFixed atomic.Bool
+	mux.HandleFunc("/flaky", func(w http.ResponseWriter, r *http.Request) {
+		if !flakyFixed.Load() {
+			errorResponseHandler(w, r)
+		}
+	})
+	mux.HandleFunc("/success", createHtmlResponseHandler())
+	mux.HandleFunc("/", createHtmlResponseHandler("/flaky", "/success"))
+
+	server := httptest.NewServer(mux)
+	serverUrl, _ := url.Parse(server.URL)
+
+	service := scrape.CreateTaskService(storage.CreateTaskInMemoryDao())
+
+	taskId, data, _, err := service.AddTaskAndListenForUpdates(serverUrl, scrape.TaskOptions{})
+	require.NoError(t, err)
+	var update storage.Task
+	for event := range data {
+		update = event.State
+	}
+	require.Equal(t, scrapeStorage.StatusFinished, update.Status)
+	require.Equal(t, 1, *update.InaccessibleLinks)
+
+	flakyFixed.Store(true)
+	require.NoError(t, service.RecheckBrokenLinks(principal.System, taskId))
+	task, err := service.GetTaskById(taskId)
+	require.NoError(t, err)
+	require.True(t, task.Rechecking)
+
+	require.Eventually(t, func() bool {
+		task, err := service.GetTaskById(taskId)
+		return err == nil && task.Status == scrapeStorage.StatusFinished
+	}, 5*time.Second, 10*time.Millisecond)
+
+	task, err = service.GetTaskById(taskId)
+	require.NoError(t, err)
+	require.False(t, task.Rechecking)
+	require.Equal(t, 0, *task.InaccessibleLinks)
+	require.Equal(t, 2, task.CrawledLinks)
+
+	results, err := service.GetLinkResults(principal.System, taskId)
+	require.NoError(t, err)
+	require.Len(t, results, 2)
+	for _, result := range results {
+		require.True(t, result.IsAccessible())
+	}
+
+	require.ErrorIs(t, service.RecheckBrokenLinks(principal.System, taskId), scrape.ErrNoBrokenLinks)
+}
+
+func TestScrapeService_RetryTask(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", errorResponseHandler)
+
+	server := httptest.NewServer(mux)
+	serverUrl, _ := url.Parse(server.URL)
+
+	service := scrape.CreateTaskService(storage.CreateTaskInMemoryDao())
+
+	options := scrape.TaskOptions{Priority: 4, Owner: "user"}
+	taskId, data, _, err := service.AddTaskAndListenForUpdates(serverUrl, options)
+	require.NoError(t, err)
+	for range data {
+	}
+
+	retryId, err := service.RetryTask(principal.System, taskId)
+	require.NoError(t, err)
+	require.NotEqual(t, taskId, retryId)
+
+	retry, err := service.GetTaskById(retryId)
+	require.NoError(t, err)
+	require.Equal(t, taskId, *retry.RetryOf)
+	require.Equal(t, serverUrl.String(), retry.Link.String())
+	require.Equal(t, options.Priority, retry.Priority)
+	require.Equal(t, options.Owner, retry.Owner)
+}
+
+func TestScrapeService_RetryTaskNotInFinalState(t *testing.T) {
+	link, _ := url.Parse("http://example.com")
+	taskStorage := storage.CreateTaskInMemoryDao()
+	taskId, err := taskStorage.StoreTask(storage.CreateTaskInitial(scrapeStorage.StatusPaused, link, time.Now()))
+	require.NoError(t, err)
+
+	service := scrape.CreateTaskService(taskStorage)
+	_, err = service.RetryTask(principal.System, taskId)
+	require.ErrorIs(t, err, scrape.ErrTaskNotFinished)
+	require.ErrorIs(t, service.RecheckBrokenLinks(principal.System, taskId), scrape.ErrTaskNotFinished)
+}
+
+func TestScrapeService_DeleteTask(t *testing.T) {
+	mux := http.NewServeMux()
+	links := make([]string, 0)
+	for i := range 40 {
+		links = append(links, fmt.Sprintf("/slow/%d", i))
+	}
+	mux.HandleFunc("/slow/", func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(50 * time.Millisecond)
+	})
+	mux.HandleFunc("/", createHtmlResponseHandler(links...))
+
+	server := httptest.NewServer(mux)
+	serverUrl, _ := url.Parse(server.URL)
+
+	taskStorage := storage.CreateTaskInMemoryDao()
+	service := scrape.CreateTaskService(taskStorage)
+
+	taskId, data, _, err := service.AddTaskAndListenForUpdates(serverUrl, scrape.TaskOptions{})
+	require.NoError(t, err)
+	for event := range data {
+		if event.State.Status == scrapeStorage.StatusTryingLinks {
+			break
+		}
+	}
+
+	require.ErrorIs(t, service.DeleteTask(principal.System, taskId, false), scrape.ErrTaskRunning)
+	require.NoError(t, service.DeleteTask(principal.System, taskId, true))
+
+	var update storage.Task
+	for event := range data {
+		update = event.State
+	}
+	require.Equal(t, scrapeStorage.StatusInterrupted, update.Status)
+	_, err = service.GetTaskById(taskId)
+	require.Error(t, err)
+}
+
+func TestScrapeService_DeleteTasks(t *testing.T) {
+	link, _ := url.Parse("http://example.com")
+	otherLink, _ := url.Parse("http://other.com")
+	taskStorage := storage.CreateTaskInMemoryDao()
+	for _, task := range []*storage.Task{
+		storage.CreateTaskInitial(scrapeStorage.StatusFinished, link, time.Now()),
+		storage.CreateTaskInitial(scrapeStorage.StatusError, link, time.Now()),
+		storage.CreateTaskInitial(scrapeStorage.StatusTryingLinks, link, time.Now()),
+		storage.CreateTaskInitial(scrapeStorage.StatusFinished, otherLink, time.Now()),
+	} {
+		_, err := taskStorage.StoreTask(task)
+		require.NoError(t, err)
+	}
+
+	service := scrape.CreateTaskService(taskStorage)
+	deleted, err := service.DeleteTasks(principal.System, storage.TaskFilter{Host: "example.com"}, false)
+	require.NoError(t, err)
+	// Running task is skipped
+	require.Equal(t, 2, deleted)
+
+	remaining := service.GetAllTasks()
+	require.Len(t, remaining, 2)
+}
+
+func TestScrapeService_TaskIsolation(t *testing.T) {
+	link, _ := url.Parse("http://example.com")
+	taskStorage := storage.CreateTaskInMemoryDao()
+	ownTask := storage.CreateTaskInitial(scrapeStorage.StatusFinished, link, time.Now())
+	ownTask.Owner = "alice"
+	ownTaskId, err := taskStorage.StoreTask(ownTask)
+	require.NoError(t, err)
+	otherTask := storage.CreateTaskInitial(scrapeStorage.StatusFinished, link, time.Now())
+	otherTask.Owner = "bob"
+	otherTaskId, err := taskStorage.StoreTask(otherTask)
+	require.NoError(t, err)
+
+	service := scrape.CreateTaskService(taskStorage)
+	alice := principal.Principal{Username: "alice"}
+
+	_, err = service.GetTask(alice, ownTaskId)
+	require.NoError(t, err)
+	_, err = service.GetTask(alice, otherTaskId)
+	require.ErrorIs(t, err, scrape.ErrTaskNotFound)
+	require.ErrorIs(t, service.InterruptTask(alice, otherTaskId), scrape.ErrTaskNotFound)
+	err, _, _ = service.RegisterListener(alice, otherTaskId, 0)
+	require.ErrorIs(t, err, scrape.ErrTaskNotFound)
+
+	page, err := service.QueryTasks(alice, storage.TaskQuery{Limit: 10})
+	require.NoError(t, err)
+	require.Len(t, page.Tasks, 1)
+	require.Equal(t, ownTaskId, *page.Tasks[0].Id)
+
+	admin := principal.Principal{Username: "admin", AllTasks: true}
+	_, err = service.GetTask(admin, otherTaskId)
+	require.NoError(t, err)
+	page, err = service.QueryTasks(admin, storage.TaskQuery{Limit: 10})
+	require.NoError(t, err)
+	require.Len(t, page.Tasks, 2)
+}
+
+func TestScrapeService_ListenForActivity(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", createHtmlResponseHandler("/a", "/b", "/c"))
+	server := httptest.NewServer(mux)
+	serverUrl, _ := url.Parse(server.URL)
+
+	service := scrape.CreateTaskService(storage.CreateTaskInMemoryDao())
+	alice := principal.Principal{Username: "alice"}
+	data, done := service.ListenForActivity(alice, storage.TaskFilter{})
+	defer close(done)
+	finished, finishedDone := service.ListenForActivity(alice, storage.TaskFilter{
+		Statuses: []string{scrapeStorage.StatusFinished},
+	})
+	defer close(finishedDone)
+
+	_, err := service.AddTask(principal.System, serverUrl, scrape.TaskOptions{Owner: "bob"})
+	require.NoError(t, err)
+	taskId, err := service.AddTask(principal.System, serverUrl, scrape.TaskOptions{Owner: "alice"})
+	require.NoError(t, err)
+
+	// Each status is sent once, progress updates are skipped
+	expected := []string{
+		scrapeStorage.StatusPending,
+		scrapeStorage.StatusInitiating,
+		scrapeStorage.StatusTryingLinks,
+		scrapeStorage.StatusFinished,
+	}
+	for _, status := range expected {
+		select {
+		case update := <-data:
+			require.Equal(t, taskId, *update.State.Id)
+			require.Equal(t, status, update.State.Status)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timeout waiting for status %s", status)
+		}
+	}
+
+	update := <-finished
+	require.Equal(t, taskId, *update.State.Id)
+	require.Equal(t, scrapeStorage.StatusFinished, update.State.Status)
+}
+
+func TestScrapeService_StuckListenerDoesNotBlockTask(t *testing.T) {
+	mux := http.NewServeMux()
+	links := make([]string, 0)
+	for i := range 3 * event.HistorySize {
+		links = append(links, fmt.Sprintf("/page/%d", i))
+	}
+	mux.HandleFunc("/page/", func(w http.ResponseWriter, r *http.Request) {})
+	mux.HandleFunc("/", createHtmlResponseHandler(links...))
+	server := httptest.NewServer(mux)
+	serverUrl, _ := url.Parse(server.URL)
+
+	service := scrape.CreateTaskService(storage.CreateTaskInMemoryDao())
+	// Listener never receives the updates
+	taskId, _, done, err := service.AddTaskAndListenForUpdates(serverUrl, scrape.TaskOptions{})
+	require.NoError(t, err)
+	defer close(done)
+
+	require.Eventually(t, func() bool {
+		task, err := service.GetTaskById(taskId)
+		return err == nil && task.Status == scrapeStorage.StatusFinished
+	}, 10*time.Second, 10*time.Millisecond)
+	require.Greater(t, service.GetUpdateMetrics().DroppedEvents(), uint64(0))
+}
+
+func TestScrapeService_SqlBus(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/error-response", errorResponseHandler)
+	mux.HandleFunc("/success", createHtmlResponseHandler())
+	mux.HandleFunc("/", createHtmlResponseHandler("/error-response", "/success"))
+	server := httptest.NewServer(mux)
+	serverUrl, _ := url.Parse(server.URL)
+
+	db, err := sql.Open("sqlite3", "file:"+filepath.Join(t.TempDir(), "bus.db")+"?_busy_timeout=5000&_txlock=immediate")
+	require.NoError(t, err)
+	defer db.Close()
+	messageBus, err := bus.CreateSqlBus(db, bus.SqlBusOptions{PollInterval: 10 * time.Millisecond})
+	require.NoError(t, err)
+
+	localWorker := scrape.CreateWorker("worker", messageBus)
+	require.NoError(t, localWorker.SetConcurrency(1))
+
+	taskStorage := storage.CreateTaskInMemoryDao()
+	service := scrape.CreateTaskServiceWithBus(taskStorage, messageBus, localWorker)
+	taskId, data, done, err := service.AddTaskAndListenForUpdates(serverUrl, scrape.TaskOptions{})
+	require.NoError(t, err)
+	defer close(done)
+
+	var update event.Event[storage.Task]
+	for update = range data {
+	}
+	assert.Equal(t, scrapeStorage.StatusFinished, update.State.Status)
+	assert.Equal(t, 2, update.State.CrawledLinks)
+	assert.Equal(t, 1, *update.State.InaccessibleLinks)
+
+	task, err := taskStorage.RetrieveTaskById(taskId)
+	require.NoError(t, err)
+	assert.Equal(t, scrapeStorage.StatusFinished, task.Status)
+	results, err := taskStorage.GetLinkResults(taskId)
+	require.NoError(t, err)
+	assert.Len(t, results, 2)
+}
+
+// Bus, which fails to publish the first final updates, as if it was temporarily unreachable
+type flakyFinalBus struct {
+	bus.MessageBus
+	failures atomic.Int32
+}
+
+func (flaky *flakyFinalBus) Publish(lease *bus.Lease, update bus.Update) error {
+	if update.Final && flaky.failures.Add(-1) >= 0 {
+		return errors.New("bus unreachable")
+	}
+	return flaky.MessageBus.Publish(lease, update)
+}
+
+func TestScrapeService_RetriesFinalUpdate(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(createHtmlResponseHandler()))
+	defer server.Close()
+	serverUrl, _ := url.Parse(server.URL)
+
+	messageBus := &flakyFinalBus{MessageBus: bus.CreateInMemoryBus()}
+	messageBus.failures.Store(2)
+	localWorker := scrape.CreateWorker("worker", messageBus)
+	require.NoError(t, localWorker.SetConcurrency(1))
+
+	service := scrape.CreateTaskServiceWithBus(storage.CreateTaskInMemoryDao(), messageBus, localWorker)
+	_, data, done, err := service.AddTaskAndListenForUpdates(serverUrl, scrape.TaskOptions{})
+	require.NoError(t, err)
+	defer close(done)
+
+	var update event.Event[storage.Task]
+	for update = range data {
+	}
+	assert.Equal(t, scrapeStorage.StatusFinished, update.State.Status)
+	assert.Equal(t, int32(-1), messageBus.failures.Load())
+}
+
+func TestScrapeService_GetWorkers(t *testing.T) {
+	release := make(chan struct{})
+	mux := http.NewServeMux()
+	mux.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	})
+	mux.HandleFunc("/", createHtmlResponseHandler("/slow"))
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	serverUrl, _ := url.Parse(server.URL)
+
+	messageBus := bus.CreateInMemoryBus()
+	localWorker := scrape.CreateWorker("local", messageBus)
+	require.NoError(t, localWorker.SetConcurrency(2))
+	require.NoError(t, localWorker.Register(10*time.Millisecond))
+	service := scrape.CreateTaskServiceWithBus(storage.CreateTaskInMemoryDao(), messageBus, localWorker)
+
+	// Stale worker, which stopped reporting long ago
+	require.NoError(t, messageBus.ReportStatus(bus.WorkerStatus{
+		Id:             "stale",
+		ReportedAt:     time.Now().Add(-2 * scrape.WorkerRetention),
+		ReportInterval: time.Second,
+	}))
+
+	taskId, err := service.AddTask(principal.System, serverUrl, scrape.TaskOptions{})
+	require.NoError(t, err)
+	var workers []bus.WorkerStatus
+	require.Eventually(t, func() bool {
+		workers, err = service.GetWorkers()
+		return err == nil && len(workers) == 1 && len(workers[0].Tasks) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, "local", workers[0].Id)
+	assert.Equal(t, 2, workers[0].Capacity)
+	assert.Equal(t, []int{taskId}, workers[0].Tasks)
+	assert.True(t, workers[0].IsHealthy(time.Now()))
+
+	close(release)
+	require.Eventually(t, func() bool {
+		workers, err = service.GetWorkers()
+		return err == nil && len(workers) == 1 && len(workers[0].Tasks) == 0
+	}, 5*time.Second, 10*time.Millisecond)
+
+	require.NoError(t, localWorker.Deregister())
+	workers, err = service.GetWorkers()
+	require.NoError(t, err)
+	assert.Empty(t, workers)
+
+	// The stale worker is only hidden until it is pruned
+	workers, err = messageBus.GetWorkers()
+	require.NoError(t, err)
+	require.Len(t, workers, 1)
+	removed, err := service.PruneWorkers(time.Now())
+	require.NoError(t, err)
+	assert.Equal(t, 1, removed)
+	workers, err = messageBus.GetWorkers()
+	require.NoError(t, err)
+	assert.Empty(t, workers)
+}
+
+func TestScrapeService_WithoutLocalWorker(t *testing.T) {
+	service := scrape.CreateTaskServiceWithBus(storage.CreateTaskInMemoryDao(), bus.CreateInMemoryBus(), nil)
+	assert.Equal(t, 0, service.GetWorkerCount())
+	assert.ErrorIs(t, service.SetWorkerCount(principal.System, 2), scrape.ErrNoLocalWorker)
+
+	link, _ := url.Parse("https://example.com")
+	_, err := service.AddTask(principal.System, link, scrape.TaskOptions{})
+	require.NoError(t, err)
+	// Waits for a standalone worker
+	assert.Equal(t, 1, service.GetQueuedTaskCount())
+}
+
 func errorResponseHandler(w http.ResponseWriter, r *http.Request) {
 	http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 }
@@ -15,7 +15,10 @@ import (
 type Seeker struct {
 	UpdateChannel    chan ProcessingUpdate
 	InterruptChannel chan struct{}
+	PauseChannel     chan struct{}
 	link             *url.URL
+	// Links remaining to be crawled, when resuming a paused seeker. Nil, if the seeker starts from the beginning.
+	remainingLinks []url.URL
 }
 
 type UpdatesSubscriber struct {
@@ -26,9 +29,20 @@ func CreateSeeker(link *url.URL) *Seeker {
 		UpdateChannel:    make(chan ProcessingUpdate),
 		link:             link,
 		InterruptChannel: make(chan struct{}, 1),
+		PauseChannel:     make(chan struct{}, 1),
 	}
 }
 
+// CreateResumedSeeker creates a seeker, which skips the initial page and only crawls the given links
+func CreateResumedSeeker(link *url.URL, remainingLinks []url.URL) *Seeker {
+	seeker := CreateSeeker(link)
+	seeker.remainingLinks = remainingLinks
+	if seeker.remainingLinks == nil {
+		seeker.remainingLinks = []url.URL{}
+	}
+	return seeker
+}
+
 func (seeker *Seeker) processPage(rootNode *html.Node) {
 	// Perform initial parsing
 	baseInfo := ParseBaseInfo(rootNode, *seeker.link)
@@ -38,11 +52,15 @@ func (seeker *Seeker) processPage(rootNode *html.Node) {
 		BaseInfo: baseInfo,
 	}
 
+	seeker.crawlLinks(baseInfo.Links)
+}
+
+func (seeker *Seeker) crawlLinks(links []url.URL) {
 	// Instantiate spiderInstance
 	spiderInstance := spider.CreateSpider(seeker.UpdateChannel)
 
 	done := spiderInstance.Start()
-	for _, link := range baseInfo.Links {
+	for i, link := range links {
 		select {
 		case <-seeker.InterruptChannel:
 			// Indicate that no more links will be sent
@@ -52,6 +70,12 @@ func (seeker *Seeker) processPage(rootNode *html.Node) {
 			// Indicate interruption to the updates channel
 			seeker.UpdateChannel <- &InterruptedUpdate{}
 			return
+		case <-seeker.PauseChannel:
+			close(spiderInstance.LinksChannel)
+			<-done
+			// Links that were not yet sent to the spider are still outstanding
+			seeker.UpdateChannel <- &PausedUpdate{RemainingLinks: append([]url.URL{}, links[i:]...)}
+			return
 		case spiderInstance.LinksChannel <- &link:
 		}
 	}
@@ -68,6 +92,12 @@ func (seeker *Seeker) processPage(rootNode *html.Node) {
 func (seeker *Seeker) Seek() {
 	defer close(seeker.UpdateChannel)
 
+	if seeker.remainingLinks != nil {
+		// Resuming - initial page has already been processed
+		seeker.crawlLinks(seeker.remainingLinks)
+		return
+	}
+
 	client := http.Client{
 		Timeout: 10 * time.Second,
 	}
@@ -103,12 +133,17 @@ func closeHttp(resp *http.Response) {
 	}
 }
 
-// Checks if seeker is interrupted. Returns true if it is, and sends signal to update channel about the interruption
+// Checks if seeker is interrupted or paused. Returns true if it is, and sends signal to update channel about the
+// interruption. When paused before the initial page is processed, no links are remembered, so the seeker would
+// have to start from the beginning.
 func (seeker *Seeker) checkInterrupt() bool {
 	select {
 	case <-seeker.InterruptChannel:
 		seeker.UpdateChannel <- &InterruptedUpdate{}
 		return true
+	case <-seeker.PauseChannel:
+		seeker.UpdateChannel <- &PausedUpdate{}
+		return true
 	default:
 		return false
 	}
@@ -0,0 +1,334 @@
+package scrape
+
+import (
+	"errors"
+	"log"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/martynasd123/golang-scraper/models/scrape"
+	"github.com/martynasd123/golang-scraper/services/scrape/bus"
+	. "github.com/martynasd123/golang-scraper/services/scrape/seeker"
+	"github.com/martynasd123/golang-scraper/storage"
+	"github.com/martynasd123/golang-scraper/utils/datatype"
+)
+
+// DefaultReportInterval is how often workers report their status, unless configured otherwise
+const DefaultReportInterval = 10 * time.Second
+
+// Delay before the first retry of publishing the final update of a job. It doubles up to the heartbeat interval
+const finalPublishInitialDelay = 100 * time.Millisecond
+
+// Worker claims jobs from the message bus and processes them. It only communicates with the ScrapeService through the
+// bus, so it can run in another process
+type Worker struct {
+	id        string
+	hostname  string
+	startedAt time.Time
+	bus       bus.MessageBus
+	// Closing one of these channels stops the corresponding goroutine once it finishes its current job
+	stops []chan struct{}
+	// IDs of the tasks being processed
+	tasks datatype.Set[int]
+	// Closing this channel stops reporting the status of the worker. Nil while the worker is not registered
+	stopReports chan struct{}
+	mu          sync.Mutex
+}
+
+func CreateWorker(id string, messageBus bus.MessageBus) *Worker {
+	hostname, err := os.Hostname()
+	if err != nil {
+		log.Printf("could not determine hostname of worker %s: %v", id, err)
+	}
+	return &Worker{
+		id:        id,
+		hostname:  hostname,
+		startedAt: time.Now(),
+		bus:       messageBus,
+		stops:     make([]chan struct{}, 0),
+		tasks:     datatype.NewSet[int](),
+	}
+}
+
+// Id returns the ID the worker claims jobs with
+func (worker *Worker) Id() string {
+	return worker.id
+}
+
+// SetConcurrency changes the number of jobs processed concurrently. When the number is decreased, the surplus
+// goroutines stop after finishing the job they are currently processing.
+func (worker *Worker) SetConcurrency(count int) error {
+	if count < 0 || count > MaxWorkerCount {
+		return ErrInvalidWorkerCount
+	}
+	worker.mu.Lock()
+	defer worker.mu.Unlock()
+	for len(worker.stops) < count {
+		stop := make(chan struct{})
+		worker.stops = append(worker.stops, stop)
+		go worker.run(stop)
+	}
+	for len(worker.stops) > count {
+		last := len(worker.stops) - 1
+		close(worker.stops[last])
+		worker.stops = worker.stops[:last]
+	}
+	return nil
+}
+
+// GetConcurrency returns the number of jobs that can be processed concurrently
+func (worker *Worker) GetConcurrency() int {
+	worker.mu.Lock()
+	defer worker.mu.Unlock()
+	return len(worker.stops)
+}
+
+// Status returns the capacity of the worker and the tasks it is processing
+func (worker *Worker) Status() bus.WorkerStatus {
+	worker.mu.Lock()
+	defer worker.mu.Unlock()
+	tasks := worker.tasks.Values()
+	slices.Sort(tasks)
+	return bus.WorkerStatus{
+		Id:         worker.id,
+		Hostname:   worker.hostname,
+		Capacity:   len(worker.stops),
+		Tasks:      tasks,
+		StartedAt:  worker.startedAt,
+		ReportedAt: time.Now(),
+	}
+}
+
+// Register adds the worker to the registry of the message bus, and keeps reporting its status at the interval until
+// Deregister is called. Returns an error if the first report fails
+func (worker *Worker) Register(interval time.Duration) error {
+	if err := worker.report(interval); err != nil {
+		return err
+	}
+	stop := make(chan struct{})
+	worker.mu.Lock()
+	if worker.stopReports != nil {
+		close(worker.stopReports)
+	}
+	worker.stopReports = stop
+	worker.mu.Unlock()
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				if err := worker.report(interval); err != nil {
+					log.Printf("could not report status of worker %s: %v", worker.id, err)
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+// Deregister stops reporting the status of the worker and removes it from the registry
+func (worker *Worker) Deregister() error {
+	worker.mu.Lock()
+	if worker.stopReports != nil {
+		close(worker.stopReports)
+		worker.stopReports = nil
+	}
+	worker.mu.Unlock()
+	_, err := worker.bus.Deregister(worker.id)
+	return err
+}
+
+func (worker *Worker) report(interval time.Duration) error {
+	status := worker.Status()
+	status.ReportInterval = interval
+	return worker.bus.ReportStatus(status)
+}
+
+func (worker *Worker) run(stop <-chan struct{}) {
+	for {
+		lease, ok := worker.bus.Claim(worker.id, stop)
+		if !ok {
+			return
+		}
+		taskId := *lease.Job.Task.Id
+		worker.setProcessing(taskId, true)
+		worker.process(lease)
+		worker.setProcessing(taskId, false)
+	}
+}
+
+func (worker *Worker) setProcessing(taskId int, processing bool) {
+	worker.mu.Lock()
+	defer worker.mu.Unlock()
+	if processing {
+		worker.tasks.Add(taskId)
+	} else {
+		worker.tasks.Remove(taskId)
+	}
+}
+
+// Runs the seeker and publishes every change of the task, until it reaches a final state or is paused
+func (worker *Worker) process(lease *bus.Lease) {
+	task := lease.Job.Task
+	var seeker *Seeker
+	// Results of links that were crawled before, used when re-checking them
+	var previousResults map[string]*storage.LinkResult
+	if isResumable(&task) {
+		task.Status = scrape.StatusTryingLinks
+		seeker = CreateResumedSeeker(&task.Link, task.PendingLinks)
+		previousResults = make(map[string]*storage.LinkResult, len(lease.Job.PreviousResults))
+		for _, result := range lease.Job.PreviousResults {
+			previousResults[result.Link.String()] = result
+		}
+	} else {
+		task.Status = scrape.StatusInitiating
+		seeker = CreateSeeker(&task.Link)
+	}
+	// Notify subscribers of status started
+	if worker.publish(lease, &bus.Update{Task: task}) != nil {
+		return
+	}
+	go seeker.Seek()
+
+	heartbeat := time.NewTicker(lease.HeartbeatInterval)
+	defer heartbeat.Stop()
+	// Set once the lease is lost - the seeker is interrupted and its updates are discarded
+	lost := false
+	stopLost := func() {
+		lost = true
+		select {
+		case seeker.InterruptChannel <- struct{}{}:
+		default:
+		}
+	}
+	for {
+		select {
+		case <-heartbeat.C:
+			if lost {
+				continue
+			}
+			if err := worker.bus.Heartbeat(lease); errors.Is(err, bus.ErrLeaseLost) {
+				log.Printf("worker %s lost the lease of task %d", worker.id, *task.Id)
+				stopLost()
+			} else if err != nil {
+				log.Printf("could not send heartbeat of task %d: %v", *task.Id, err)
+			}
+		case signal := <-lease.Signals():
+			if lost {
+				continue
+			}
+			switch signal {
+			case bus.SignalInterrupt:
+				handleInterruptBegin(&task)
+				seeker.InterruptChannel <- struct{}{}
+			case bus.SignalPause:
+				handlePauseBegin(&task)
+				seeker.PauseChannel <- struct{}{}
+			}
+			if worker.publish(lease, &bus.Update{Task: task}) != nil {
+				stopLost()
+			}
+		case update, ok := <-seeker.UpdateChannel:
+			if !ok {
+				if !lost {
+					worker.publishFinal(lease, &bus.Update{Task: task, Final: true})
+				}
+				return
+			}
+			if lost {
+				continue
+			}
+			var linkResult *storage.LinkResult
+			if update.Type() == scrape.UpdateTypePageBaseInfo {
+				updateTaskBaseInfo(&task, update.(*scrape.PageBaseInfoUpdate))
+			} else if update.Type() == scrape.UpdateTypeLinkCrawled {
+				linkResult = handleLinkCrawled(&task, update.(*scrape.LinkCrawledUpdate), previousResults)
+			} else if update.Type() == scrape.UpdateTypeError {
+				handleError(&task, update.(*scrape.ErrorUpdate))
+				// Expecting this channel to close before next iteration
+				continue
+			} else if update.Type() == scrape.UpdateTypeFinished {
+				handleFinished(&task, update.(*scrape.FinishedUpdate))
+				// Expecting this channel to close before next iteration
+				continue
+			} else if update.Type() == scrape.UpdateTypeInterrupted {
+				// Update was interrupted
+				handleInterruptFinish(&task, update.(*scrape.InterruptedUpdate))
+				// Expecting this channel to close before next iteration
+				continue
+			} else if update.Type() == scrape.UpdateTypePaused && task.Status == scrape.StatusInterrupting {
+				// Interrupt was received while pausing - it overrides the pause
+				handleInterruptFinish(&task, &scrape.InterruptedUpdate{})
+				continue
+			} else if update.Type() == scrape.UpdateTypePaused {
+				handlePauseFinish(&task, update.(*scrape.PausedUpdate))
+				// Expecting this channel to close before next iteration
+				continue
+			} else {
+				log.Fatalf("unsupported update type %d", update.Type())
+			}
+			if worker.publish(lease, &bus.Update{Task: task, LinkResult: linkResult}) != nil {
+				stopLost()
+			}
+		}
+	}
+}
+
+// Publishes the update. Task is copied, so that it is not affected by later changes. Returns an error if the lease is
+// lost
+func (worker *Worker) publish(lease *bus.Lease, update *bus.Update) error {
+	update.Task = copyTask(&update.Task)
+	err := worker.bus.Publish(lease, *update)
+	if errors.Is(err, bus.ErrLeaseLost) {
+		log.Printf("worker %s lost the lease of task %d", worker.id, *update.Task.Id)
+		return err
+	}
+	if err != nil {
+		// The next update carries the whole state of the task, so only the result of a link can be lost. The final
+		// update has no next one, so it is published through publishFinal instead
+		log.Printf("could not publish update of task %d: %v", *update.Task.Id, err)
+	}
+	return nil
+}
+
+// Publishes the final update, retrying with backoff until it is published or the lease is lost. Otherwise, the job
+// would stay claimed until the lease expires, and the final state of the task would never be reported. The lease is
+// extended while retrying, so that the job is only claimed by another worker once the bus stops accepting heartbeats
+func (worker *Worker) publishFinal(lease *bus.Lease, update *bus.Update) {
+	update.Task = copyTask(&update.Task)
+	delay := finalPublishInitialDelay
+	for {
+		err := worker.bus.Publish(lease, *update)
+		if err == nil {
+			return
+		}
+		if errors.Is(err, bus.ErrLeaseLost) {
+			log.Printf("worker %s lost the lease of task %d", worker.id, *update.Task.Id)
+			return
+		}
+		log.Printf("could not publish final update of task %d, retrying in %s: %v", *update.Task.Id, delay, err)
+		time.Sleep(delay)
+		delay = min(2*delay, lease.HeartbeatInterval)
+		if err = worker.bus.Heartbeat(lease); errors.Is(err, bus.ErrLeaseLost) {
+			log.Printf("worker %s lost the lease of task %d", worker.id, *update.Task.Id)
+			return
+		}
+	}
+}
+
+// Copies the task, so that the copy is not affected by the worker modifying the original. Only the inaccessible link
+// count is modified in place - other fields are replaced
+func copyTask(task *storage.Task) storage.Task {
+	clone := *task
+	if task.InaccessibleLinks != nil {
+		count := *task.InaccessibleLinks
+		clone.InaccessibleLinks = &count
+	}
+	return clone
+}
@@ -0,0 +1,545 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/martynasd123/golang-scraper/models/principal"
+	response "github.com/martynasd123/golang-scraper/models/response"
+	"github.com/martynasd123/golang-scraper/models/scrape"
+	"github.com/martynasd123/golang-scraper/storage"
+)
+
+var (
+	ErrWebhookNotFound      = errors.New("webhook not found")
+	ErrWebhookTaskNotFound  = errors.New("task of the webhook not found")
+	ErrInvalidWebhookUrl    = errors.New("webhook URL must be an absolute http or https URL")
+	ErrHostNotResolved      = errors.New("webhook host could not be resolved")
+	ErrForbiddenAddress     = errors.New("webhook URL must not point to a loopback, link-local, private or unspecified address")
+	ErrInvalidWebhookEvents = errors.New("webhook events are invalid")
+	ErrInvalidThreshold     = errors.New("broken links threshold must not be negative")
+	ErrCouldNotCreateSecret = errors.New("could not generate webhook secret")
+)
+
+// Actions recorded in the audit log
+const (
+	AuditActionWebhookCreated = "webhook.created"
+	AuditActionWebhookDeleted = "webhook.deleted"
+)
+
+// Headers of the requests sent to webhooks
+const (
+	HeaderEvent     = "X-Scraper-Event"
+	HeaderDelivery  = "X-Scraper-Delivery"
+	HeaderTimestamp = "X-Scraper-Timestamp"
+	// HMAC-SHA256 of the timestamp and the body, see Sign
+	HeaderSignature = "X-Scraper-Signature"
+)
+
+const (
+	webhookSecretPrefix = "whsec_"
+	// Responses of webhooks are not used, so only this much of them is read
+	maxResponseSize = 64 * 1024
+	// Time allowed for resolving the host of a webhook URL when it is created
+	resolveTimeout = 5 * time.Second
+	// Deliveries of events, which occur while this many deliveries are being made or retried, are dropped
+	maxPendingDeliveries = 1000
+)
+
+// RetryPolicy defines how failed deliveries are retried. The delay doubles after each failed attempt
+type RetryPolicy struct {
+	// Number of attempts, including the first one
+	MaxAttempts  int
+	InitialDelay time.Duration
+	MaxDelay     time.Duration
+}
+
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts:  5,
+	InitialDelay: 10 * time.Second,
+	MaxDelay:     10 * time.Minute,
+}
+
+// TaskProvider gives access to the tasks, which webhooks are bound to
+type TaskProvider interface {
+	// GetTask returns the task, if it is visible to the actor
+	GetTask(actor principal.Principal, id int) (*storage.Task, error)
+}
+
+// WebhookOptions are the user supplied parameters of a webhook
+type WebhookOptions struct {
+	Url    string
+	Events []string
+	// Minimal number of inaccessible links, which triggers the broken links event. 1 if 0
+	BrokenLinksThreshold int
+	// Binds the webhook to a single task
+	TaskId *int
+}
+
+// WebhookService notifies webhooks of users when their tasks reach a final state
+type WebhookService struct {
+	storage storage.WebhookDao
+	tasks   TaskProvider
+	client  *http.Client
+	retry   RetryPolicy
+	// Actions of users are recorded here, if set
+	auditLog storage.AuditDao
+	// Whether webhooks may point to the addresses of the server's own network (see isForbiddenAddress)
+	allowPrivateAddresses bool
+
+	// Cancelled by Stop, which stops all deliveries
+	ctx  context.Context
+	stop context.CancelFunc
+	// Holds a slot for every delivery, which is being made or retried
+	pending chan struct{}
+	running sync.WaitGroup
+	// Guards the field below
+	mu sync.Mutex
+	// Deliveries of the webhooks being made or retried, by ID of the webhook
+	deliveries map[int]*webhookDeliveries
+}
+
+// Deliveries of a single webhook. The context is cancelled once the webhook is deleted
+type webhookDeliveries struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	count  int
+}
+
+func CreateWebhookService(webhookStorage storage.WebhookDao, tasks TaskProvider) *WebhookService {
+	ctx, stop := context.WithCancel(context.Background())
+	service := &WebhookService{
+		storage:    webhookStorage,
+		tasks:      tasks,
+		retry:      DefaultRetryPolicy,
+		ctx:        ctx,
+		stop:       stop,
+		pending:    make(chan struct{}, maxPendingDeliveries),
+		deliveries: make(map[int]*webhookDeliveries),
+	}
+	// Address is checked once the host is resolved for the connection, so that a host, which resolved to a public
+	// address when the webhook was created, can not be pointed to an internal one later (DNS rebinding)
+	dialer := &net.Dialer{Timeout: 10 * time.Second, Control: service.checkDialedAddress}
+	service.client = &http.Client{
+		Timeout: 10 * time.Second,
+		Transport: &http.Transport{
+			// Proxy is not used, since it would make the connections instead of the dialer
+			Proxy:               nil,
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: 10 * time.Second,
+		},
+		// Redirects are not followed, so that a webhook can not point the requests elsewhere
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	return service
+}
+
+// SetAllowPrivateAddresses allows webhooks to point to loopback, link-local and private addresses, e.g. receivers
+// running next to the server during development. Must be called before the service is used
+func (service *WebhookService) SetAllowPrivateAddresses(allow bool) {
+	service.allowPrivateAddresses = allow
+}
+
+// SetRetryPolicy sets how failed deliveries are retried. Must be called before the service is used
+func (service *WebhookService) SetRetryPolicy(policy RetryPolicy) {
+	service.retry = policy
+}
+
+// SetAuditLog records changes of webhooks in the audit log. Must be called before the service is used
+func (service *WebhookService) SetAuditLog(auditLog storage.AuditDao) {
+	service.auditLog = auditLog
+}
+
+// CreateWebhook registers a webhook of the actor. If it is bound to a task, the task must be visible to the actor.
+// Returns the webhook along with its secret, which the payloads are signed with
+func (service *WebhookService) CreateWebhook(
+	actor principal.Principal,
+	options WebhookOptions,
+) (_ *storage.Webhook, err error) {
+	defer func() { service.audit(actor, AuditActionWebhookCreated, options.Url, err) }()
+	link, err := url.Parse(options.Url)
+	if err != nil || !link.IsAbs() || (link.Scheme != "http" && link.Scheme != "https") || link.Host == "" {
+		return nil, ErrInvalidWebhookUrl
+	}
+	if err = service.checkHost(link.Hostname()); err != nil {
+		return nil, err
+	}
+	if len(options.Events) == 0 {
+		return nil, ErrInvalidWebhookEvents
+	}
+	for _, event := range options.Events {
+		if !isKnownEvent(event) {
+			return nil, ErrInvalidWebhookEvents
+		}
+	}
+	if options.BrokenLinksThreshold < 0 {
+		return nil, ErrInvalidThreshold
+	}
+	if options.BrokenLinksThreshold == 0 {
+		options.BrokenLinksThreshold = 1
+	}
+	if options.TaskId != nil {
+		if _, err = service.tasks.GetTask(actor, *options.TaskId); err != nil {
+			return nil, errors.Join(ErrWebhookTaskNotFound, err)
+		}
+	}
+
+	secret := make([]byte, 32)
+	if _, err = rand.Read(secret); err != nil {
+		return nil, errors.Join(ErrCouldNotCreateSecret, err)
+	}
+	events := slices.Clone(options.Events)
+	slices.Sort(events)
+	webhook := &storage.Webhook{
+		Owner:                actor.Username,
+		Url:                  link.String(),
+		Secret:               webhookSecretPrefix + base64.RawURLEncoding.EncodeToString(secret),
+		Events:               slices.Compact(events),
+		BrokenLinksThreshold: options.BrokenLinksThreshold,
+		TaskId:               options.TaskId,
+		CreatedAt:            time.Now(),
+	}
+	if _, err = service.storage.StoreWebhook(webhook); err != nil {
+		return nil, err
+	}
+	return webhook, nil
+}
+
+// GetWebhooks returns all webhooks of the actor, including the ones bound to tasks
+func (service *WebhookService) GetWebhooks(actor principal.Principal) []*storage.Webhook {
+	return service.storage.GetWebhooks(actor.Username)
+}
+
+// DeleteWebhook deletes the webhook along with its delivery log. Deliveries, which are being retried, are stopped
+func (service *WebhookService) DeleteWebhook(actor principal.Principal, id int) (err error) {
+	defer func() { service.audit(actor, AuditActionWebhookDeleted, strconv.Itoa(id), err) }()
+	if _, err = service.getAccessibleWebhook(actor, id); err != nil {
+		return err
+	}
+	if err = service.storage.DeleteWebhook(id); err != nil {
+		return err
+	}
+	service.mu.Lock()
+	defer service.mu.Unlock()
+	if deliveries, exists := service.deliveries[id]; exists {
+		deliveries.cancel()
+		delete(service.deliveries, id)
+	}
+	return nil
+}
+
+// Stop stops making and retrying deliveries and waits for the attempts being made to be cancelled. Deliveries are
+// not persisted, so the ones, which were not accepted yet, are abandoned. Events occurring afterwards are not delivered
+func (service *WebhookService) Stop() {
+	service.stop()
+	service.running.Wait()
+}
+
+// GetDeliveries returns the logged delivery attempts of the webhook, newest first
+func (service *WebhookService) GetDeliveries(actor principal.Principal, id int) ([]*storage.WebhookDelivery, error) {
+	if _, err := service.getAccessibleWebhook(actor, id); err != nil {
+		return nil, err
+	}
+	return service.storage.GetDeliveries(id), nil
+}
+
+// NotifyTaskCompleted delivers the events of the task, which reached a final state, to the webhooks notified about
+// them. Webhooks bound to the task are notified instead of the other webhooks of its owner. Does not block - the
+// deliveries, along with their retries, are made in the background. Events are dropped, if maxPendingDeliveries
+// deliveries are already pending
+func (service *WebhookService) NotifyTaskCompleted(task storage.Task) {
+	webhooks := service.storage.GetTaskWebhooks(*task.Id)
+	if len(webhooks) == 0 {
+		webhooks = slices.DeleteFunc(service.storage.GetWebhooks(task.Owner), func(webhook *storage.Webhook) bool {
+			return webhook.TaskId != nil
+		})
+	}
+	for _, webhook := range webhooks {
+		for _, event := range taskEvents(webhook, &task) {
+			payload := response.WebhookPayload{
+				Id:        uuid.New().String(),
+				Event:     event,
+				Timestamp: time.Now(),
+				Task:      response.CreateTaskStatusResponse(&task),
+			}
+			// Encoded right away, since the task may change once its final state is no longer being handled
+			body, err := json.Marshal(&payload)
+			if err != nil {
+				log.Printf("could not encode webhook payload: %v", err)
+				continue
+			}
+			service.startDelivery(webhook, &payload, body)
+		}
+	}
+}
+
+// Returns the events of the task, which the webhook is notified about
+func taskEvents(webhook *storage.Webhook, task *storage.Task) []string {
+	var occurred []string
+	switch task.Status {
+	case scrape.StatusFinished:
+		occurred = append(occurred, storage.WebhookEventFinished)
+		if task.InaccessibleLinks != nil && *task.InaccessibleLinks >= webhook.BrokenLinksThreshold {
+			occurred = append(occurred, storage.WebhookEventBrokenLinks)
+		}
+	case scrape.StatusError:
+		occurred = append(occurred, storage.WebhookEventError)
+	case scrape.StatusInterrupted:
+		occurred = append(occurred, storage.WebhookEventInterrupted)
+	}
+	events := make([]string, 0, len(occurred))
+	for _, event := range occurred {
+		if slices.Contains(webhook.Events, event) {
+			events = append(events, event)
+		}
+	}
+	return events
+}
+
+// Makes the delivery in the background, unless the service is stopped or too many deliveries are pending
+func (service *WebhookService) startDelivery(webhook *storage.Webhook, payload *response.WebhookPayload, body []byte) {
+	if service.ctx.Err() != nil {
+		return
+	}
+	select {
+	case service.pending <- struct{}{}:
+	default:
+		log.Printf("dropping %s of task %d for webhook %d: too many pending deliveries", payload.Event, *payload.Task.Id, *webhook.Id)
+		return
+	}
+	ctx := service.acquireDeliveries(*webhook.Id)
+	service.running.Add(1)
+	go func() {
+		defer service.running.Done()
+		defer func() { <-service.pending }()
+		defer service.releaseDeliveries(*webhook.Id, ctx)
+		service.deliver(ctx, webhook, payload, body)
+	}()
+}
+
+// Returns the context of the deliveries of the webhook, which is cancelled once the webhook is deleted or the service
+// is stopped. releaseDeliveries must be called once the delivery is over
+func (service *WebhookService) acquireDeliveries(webhookId int) context.Context {
+	service.mu.Lock()
+	defer service.mu.Unlock()
+	deliveries, exists := service.deliveries[webhookId]
+	if !exists {
+		ctx, cancel := context.WithCancel(service.ctx)
+		deliveries = &webhookDeliveries{ctx: ctx, cancel: cancel}
+		service.deliveries[webhookId] = deliveries
+	}
+	deliveries.count++
+	return deliveries.ctx
+}
+
+func (service *WebhookService) releaseDeliveries(webhookId int, ctx context.Context) {
+	service.mu.Lock()
+	defer service.mu.Unlock()
+	deliveries, exists := service.deliveries[webhookId]
+	// Entry was already removed, if the webhook was deleted
+	if !exists || deliveries.ctx != ctx {
+		return
+	}
+	deliveries.count--
+	if deliveries.count == 0 {
+		deliveries.cancel()
+		delete(service.deliveries, webhookId)
+	}
+}
+
+// Sends the payload to the webhook, retrying with backoff until it is accepted, the attempts run out or the context
+// is cancelled. Every attempt, which was not cancelled, is recorded in the delivery log
+func (service *WebhookService) deliver(
+	ctx context.Context,
+	webhook *storage.Webhook,
+	payload *response.WebhookPayload,
+	body []byte,
+) {
+	delay := service.retry.InitialDelay
+	for attempt := 1; ; attempt++ {
+		statusCode, err := service.send(ctx, webhook, payload, body)
+		if ctx.Err() != nil {
+			service.logCancelled(webhook, payload)
+			return
+		}
+		delivery := &storage.WebhookDelivery{
+			WebhookId:  *webhook.Id,
+			EventId:    payload.Id,
+			Event:      payload.Event,
+			TaskId:     *payload.Task.Id,
+			Attempt:    attempt,
+			StatusCode: statusCode,
+			Timestamp:  time.Now(),
+		}
+		if err != nil {
+			message := err.Error()
+			delivery.Error = &message
+		}
+		if recordErr := service.storage.RecordDelivery(delivery); recordErr != nil {
+			// Webhook was deleted
+			return
+		}
+		if err == nil {
+			return
+		}
+		if attempt >= service.retry.MaxAttempts {
+			log.Printf("giving up on delivering %s of task %d to webhook %d: %v", payload.Event, delivery.TaskId, *webhook.Id, err)
+			return
+		}
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			service.logCancelled(webhook, payload)
+			return
+		}
+		delay = min(2*delay, service.retry.MaxDelay)
+	}
+}
+
+// Deliveries cancelled by deleting the webhook are expected, so only the ones abandoned by stopping the service are
+// logged
+func (service *WebhookService) logCancelled(webhook *storage.Webhook, payload *response.WebhookPayload) {
+	if service.ctx.Err() != nil {
+		log.Printf("abandoning delivery of %s of task %d to webhook %d: service stopped", payload.Event, *payload.Task.Id, *webhook.Id)
+	}
+}
+
+// Makes a single delivery attempt. Returns the status of the response, if one was received
+func (service *WebhookService) send(
+	ctx context.Context,
+	webhook *storage.Webhook,
+	payload *response.WebhookPayload,
+	body []byte,
+) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, webhook.Url, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	timestamp := time.Now().Unix()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(HeaderEvent, payload.Event)
+	req.Header.Set(HeaderDelivery, payload.Id)
+	req.Header.Set(HeaderTimestamp, strconv.FormatInt(timestamp, 10))
+	req.Header.Set(HeaderSignature, Sign(webhook.Secret, timestamp, body))
+	res, err := service.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(res.Body, maxResponseSize))
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return res.StatusCode, fmt.Errorf("webhook responded with status %d", res.StatusCode)
+	}
+	return res.StatusCode, nil
+}
+
+// Sign computes the value of the signature header of a request sent with the timestamp (in Unix seconds) and body.
+// Receivers verify the request by computing it with the secret of the webhook. The timestamp is signed as well, so
+// that receivers can reject old requests being replayed
+func Sign(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Resolves the host of a webhook URL and rejects it if any of its addresses is forbidden, so that users can not make
+// the server send requests to its own network
+func (service *WebhookService) checkHost(host string) error {
+	if service.allowPrivateAddresses {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), resolveTimeout)
+	defer cancel()
+	addresses, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return errors.Join(ErrHostNotResolved, err)
+	}
+	for _, address := range addresses {
+		if isForbiddenAddress(address.IP) {
+			return ErrForbiddenAddress
+		}
+	}
+	return nil
+}
+
+// Control function of the dialer, which is called with the resolved address before connecting
+func (service *WebhookService) checkDialedAddress(_, address string, _ syscall.RawConn) error {
+	if service.allowPrivateAddresses {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || isForbiddenAddress(ip) {
+		return ErrForbiddenAddress
+	}
+	return nil
+}
+
+// Addresses, which belong to the host or the network of the server, rather than the internet
+func isForbiddenAddress(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() ||
+		ip.IsPrivate() || ip.IsUnspecified()
+}
+
+func isKnownEvent(event string) bool {
+	switch event {
+	case storage.WebhookEventFinished,
+		storage.WebhookEventError,
+		storage.WebhookEventInterrupted,
+		storage.WebhookEventBrokenLinks:
+		return true
+	}
+	return false
+}
+
+// Returns ErrWebhookNotFound if the webhook does not exist or is owned by another user, so that the existence of
+// other users' webhooks is not revealed
+func (service *WebhookService) getAccessibleWebhook(actor principal.Principal, id int) (*storage.Webhook, error) {
+	webhook, err := service.storage.GetWebhook(id)
+	if err != nil {
+		return nil, errors.Join(ErrWebhookNotFound, err)
+	}
+	if !actor.CanAccess(webhook.Owner) {
+		return nil, ErrWebhookNotFound
+	}
+	return webhook, nil
+}
+
+// Records the action in the audit log, if it is set. Failures to record it are only logged, since the action was
+// already performed
+func (service *WebhookService) audit(actor principal.Principal, action string, target string, err error) {
+	if service.auditLog == nil {
+		return
+	}
+	if recordErr := service.auditLog.RecordEvent(storage.CreateAuditEvent(actor, action, target, err)); recordErr != nil {
+		log.Printf("could not record %s of %s in the audit log: %v", action, target, recordErr)
+	}
+}
@@ -0,0 +1,327 @@
+package webhook_test
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/martynasd123/golang-scraper/models/principal"
+	response "github.com/martynasd123/golang-scraper/models/response"
+	scrapeModels "github.com/martynasd123/golang-scraper/models/scrape"
+	"github.com/martynasd123/golang-scraper/services/scrape"
+	"github.com/martynasd123/golang-scraper/services/webhook"
+	"github.com/martynasd123/golang-scraper/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var alice = principal.Principal{Username: "alice"}
+
+type receivedRequest struct {
+	header http.Header
+	body   []byte
+}
+
+// Starts a receiver, which responds with the statuses in order, and with 200 once they run out
+func createReceiver(t *testing.T, statuses ...int) (*httptest.Server, <-chan receivedRequest) {
+	received := make(chan receivedRequest, 10)
+	var count atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received <- receivedRequest{header: r.Header, body: body}
+		if i := int(count.Add(1)) - 1; i < len(statuses) {
+			w.WriteHeader(statuses[i])
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server, received
+}
+
+func receive(t *testing.T, received <-chan receivedRequest) receivedRequest {
+	select {
+	case req := <-received:
+		return req
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for webhook request")
+		return receivedRequest{}
+	}
+}
+
+func assertNothingReceived(t *testing.T, received <-chan receivedRequest) {
+	select {
+	case req := <-received:
+		t.Fatalf("unexpected webhook request: %s", req.body)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func createService(t *testing.T) (*webhook.WebhookService, storage.TaskDao) {
+	taskStorage := storage.CreateTaskInMemoryDao()
+	service := webhook.CreateWebhookService(storage.CreateWebhookInMemoryDao(), scrape.CreateTaskService(taskStorage))
+	service.SetRetryPolicy(webhook.RetryPolicy{MaxAttempts: 3, InitialDelay: 10 * time.Millisecond, MaxDelay: 20 * time.Millisecond})
+	// Receivers run on the loopback interface
+	service.SetAllowPrivateAddresses(true)
+	return service, taskStorage
+}
+
+func storeTask(t *testing.T, taskStorage storage.TaskDao, owner string, status string, inaccessibleLinks int) storage.Task {
+	link, _ := url.Parse("https://example.com")
+	task := &storage.Task{Link: *link, Owner: owner, Status: status, InaccessibleLinks: &inaccessibleLinks}
+	_, err := taskStorage.StoreTask(task)
+	require.NoError(t, err)
+	return *task
+}
+
+func TestWebhookService_DeliversSignedPayload(t *testing.T) {
+	server, received := createReceiver(t)
+	service, taskStorage := createService(t)
+	created, err := service.CreateWebhook(alice, webhook.WebhookOptions{
+		Url:                  server.URL,
+		Events:               []string{storage.WebhookEventBrokenLinks},
+		BrokenLinksThreshold: 2,
+	})
+	require.NoError(t, err)
+
+	// Below the threshold
+	service.NotifyTaskCompleted(storeTask(t, taskStorage, alice.Username, scrapeModels.StatusFinished, 1))
+	assertNothingReceived(t, received)
+
+	task := storeTask(t, taskStorage, alice.Username, scrapeModels.StatusFinished, 2)
+	service.NotifyTaskCompleted(task)
+	req := receive(t, received)
+
+	timestamp, err := strconv.ParseInt(req.header.Get(webhook.HeaderTimestamp), 10, 64)
+	require.NoError(t, err)
+	assert.Equal(t, webhook.Sign(created.Secret, timestamp, req.body), req.header.Get(webhook.HeaderSignature))
+	assert.NotEqual(t, webhook.Sign("other secret", timestamp, req.body), req.header.Get(webhook.HeaderSignature))
+	assert.Equal(t, storage.WebhookEventBrokenLinks, req.header.Get(webhook.HeaderEvent))
+
+	var payload response.WebhookPayload
+	require.NoError(t, json.Unmarshal(req.body, &payload))
+	assert.Equal(t, req.header.Get(webhook.HeaderDelivery), payload.Id)
+	assert.Equal(t, storage.WebhookEventBrokenLinks, payload.Event)
+	assert.Equal(t, *task.Id, *payload.Task.Id)
+	assert.Equal(t, 2, *payload.Task.InaccessibleLinks)
+
+	require.Eventually(t, func() bool {
+		deliveries, err := service.GetDeliveries(alice, *created.Id)
+		return err == nil && len(deliveries) == 1 && deliveries[0].Succeeded()
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestWebhookService_RetriesFailedDelivery(t *testing.T) {
+	server, received := createReceiver(t, http.StatusInternalServerError, http.StatusServiceUnavailable)
+	service, taskStorage := createService(t)
+	created, err := service.CreateWebhook(alice, webhook.WebhookOptions{
+		Url:    server.URL,
+		Events: []string{storage.WebhookEventError},
+	})
+	require.NoError(t, err)
+
+	service.NotifyTaskCompleted(storeTask(t, taskStorage, alice.Username, scrapeModels.StatusError, 0))
+	first := receive(t, received)
+	for range 2 {
+		retry := receive(t, received)
+		assert.Equal(t, first.header.Get(webhook.HeaderDelivery), retry.header.Get(webhook.HeaderDelivery))
+		assert.Equal(t, first.body, retry.body)
+	}
+
+	var deliveries []*storage.WebhookDelivery
+	require.Eventually(t, func() bool {
+		deliveries, err = service.GetDeliveries(alice, *created.Id)
+		return err == nil && len(deliveries) == 3
+	}, 5*time.Second, 10*time.Millisecond)
+	// Newest first
+	assert.Equal(t, 3, deliveries[0].Attempt)
+	assert.True(t, deliveries[0].Succeeded())
+	assert.Equal(t, http.StatusServiceUnavailable, deliveries[1].StatusCode)
+	assert.False(t, deliveries[1].Succeeded())
+	assert.Equal(t, http.StatusInternalServerError, deliveries[2].StatusCode)
+	assert.False(t, deliveries[2].Succeeded())
+}
+
+func TestWebhookService_GivesUpAfterMaxAttempts(t *testing.T) {
+	server, received := createReceiver(t, http.StatusInternalServerError, http.StatusInternalServerError, http.StatusInternalServerError)
+	service, taskStorage := createService(t)
+	_, err := service.CreateWebhook(alice, webhook.WebhookOptions{
+		Url:    server.URL,
+		Events: []string{storage.WebhookEventInterrupted},
+	})
+	require.NoError(t, err)
+
+	service.NotifyTaskCompleted(storeTask(t, taskStorage, alice.Username, scrapeModels.StatusInterrupted, 0))
+	for range 3 {
+		receive(t, received)
+	}
+	assertNothingReceived(t, received)
+}
+
+func TestWebhookService_DeletingWebhookStopsRetries(t *testing.T) {
+	server, received := createReceiver(t, http.StatusInternalServerError, http.StatusInternalServerError, http.StatusInternalServerError)
+	service, taskStorage := createService(t)
+	service.SetRetryPolicy(webhook.RetryPolicy{MaxAttempts: 3, InitialDelay: 200 * time.Millisecond, MaxDelay: 200 * time.Millisecond})
+	created, err := service.CreateWebhook(alice, webhook.WebhookOptions{
+		Url:    server.URL,
+		Events: []string{storage.WebhookEventError},
+	})
+	require.NoError(t, err)
+
+	service.NotifyTaskCompleted(storeTask(t, taskStorage, alice.Username, scrapeModels.StatusError, 0))
+	receive(t, received)
+	require.NoError(t, service.DeleteWebhook(alice, *created.Id))
+	select {
+	case req := <-received:
+		t.Fatalf("unexpected webhook request: %s", req.body)
+	case <-time.After(500 * time.Millisecond):
+	}
+}
+
+func TestWebhookService_StopAbandonsRetries(t *testing.T) {
+	server, received := createReceiver(t, http.StatusInternalServerError)
+	service, taskStorage := createService(t)
+	service.SetRetryPolicy(webhook.RetryPolicy{MaxAttempts: 3, InitialDelay: time.Minute, MaxDelay: time.Minute})
+	_, err := service.CreateWebhook(alice, webhook.WebhookOptions{
+		Url:    server.URL,
+		Events: []string{storage.WebhookEventError},
+	})
+	require.NoError(t, err)
+
+	service.NotifyTaskCompleted(storeTask(t, taskStorage, alice.Username, scrapeModels.StatusError, 0))
+	receive(t, received)
+
+	// Does not wait for the retry
+	stopped := make(chan struct{})
+	go func() {
+		service.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for the service to stop")
+	}
+
+	service.NotifyTaskCompleted(storeTask(t, taskStorage, alice.Username, scrapeModels.StatusError, 0))
+	assertNothingReceived(t, received)
+}
+
+func TestWebhookService_TaskWebhookReplacesOwnerWebhooks(t *testing.T) {
+	ownerServer, ownerReceived := createReceiver(t)
+	taskServer, taskReceived := createReceiver(t)
+	service, taskStorage := createService(t)
+	bound := storeTask(t, taskStorage, alice.Username, scrapeModels.StatusFinished, 0)
+	other := storeTask(t, taskStorage, alice.Username, scrapeModels.StatusFinished, 0)
+
+	_, err := service.CreateWebhook(alice, webhook.WebhookOptions{
+		Url:    ownerServer.URL,
+		Events: []string{storage.WebhookEventFinished},
+	})
+	require.NoError(t, err)
+	_, err = service.CreateWebhook(alice, webhook.WebhookOptions{
+		Url:    taskServer.URL,
+		Events: []string{storage.WebhookEventFinished},
+		TaskId: bound.Id,
+	})
+	require.NoError(t, err)
+
+	service.NotifyTaskCompleted(bound)
+	req := receive(t, taskReceived)
+	assert.Equal(t, storage.WebhookEventFinished, req.header.Get(webhook.HeaderEvent))
+	assertNothingReceived(t, ownerReceived)
+
+	service.NotifyTaskCompleted(other)
+	receive(t, ownerReceived)
+	assertNothingReceived(t, taskReceived)
+}
+
+func TestWebhookService_CreateWebhookValidation(t *testing.T) {
+	service, taskStorage := createService(t)
+	bobs := storeTask(t, taskStorage, "bob", scrapeModels.StatusFinished, 0)
+
+	_, err := service.CreateWebhook(alice, webhook.WebhookOptions{Url: "ftp://example.com", Events: []string{storage.WebhookEventFinished}})
+	assert.ErrorIs(t, err, webhook.ErrInvalidWebhookUrl)
+	_, err = service.CreateWebhook(alice, webhook.WebhookOptions{Url: "/relative", Events: []string{storage.WebhookEventFinished}})
+	assert.ErrorIs(t, err, webhook.ErrInvalidWebhookUrl)
+	_, err = service.CreateWebhook(alice, webhook.WebhookOptions{Url: "https://example.com"})
+	assert.ErrorIs(t, err, webhook.ErrInvalidWebhookEvents)
+	_, err = service.CreateWebhook(alice, webhook.WebhookOptions{Url: "https://example.com", Events: []string{"paused"}})
+	assert.ErrorIs(t, err, webhook.ErrInvalidWebhookEvents)
+	_, err = service.CreateWebhook(alice, webhook.WebhookOptions{
+		Url:                  "https://example.com",
+		Events:               []string{storage.WebhookEventBrokenLinks},
+		BrokenLinksThreshold: -1,
+	})
+	assert.ErrorIs(t, err, webhook.ErrInvalidThreshold)
+	_, err = service.CreateWebhook(alice, webhook.WebhookOptions{
+		Url:    "https://example.com",
+		Events: []string{storage.WebhookEventFinished},
+		TaskId: bobs.Id,
+	})
+	assert.ErrorIs(t, err, webhook.ErrWebhookTaskNotFound)
+
+	created, err := service.CreateWebhook(alice, webhook.WebhookOptions{
+		Url:    "https://example.com",
+		Events: []string{storage.WebhookEventFinished, storage.WebhookEventError, storage.WebhookEventFinished},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{storage.WebhookEventError, storage.WebhookEventFinished}, created.Events)
+	assert.Equal(t, 1, created.BrokenLinksThreshold)
+
+	bob := principal.Principal{Username: "bob"}
+	assert.Empty(t, service.GetWebhooks(bob))
+	_, err = service.GetDeliveries(bob, *created.Id)
+	assert.ErrorIs(t, err, webhook.ErrWebhookNotFound)
+	assert.ErrorIs(t, service.DeleteWebhook(bob, *created.Id), webhook.ErrWebhookNotFound)
+
+	require.NoError(t, service.DeleteWebhook(alice, *created.Id))
+	assert.Empty(t, service.GetWebhooks(alice))
+}
+
+func TestWebhookService_RejectsPrivateAddresses(t *testing.T) {
+	service := webhook.CreateWebhookService(storage.CreateWebhookInMemoryDao(), scrape.CreateTaskService(storage.CreateTaskInMemoryDao()))
+	for _, link := range []string{
+		"http://127.0.0.1:8080/hook",
+		"http://localhost/hook",
+		"http://[::1]/hook",
+		"http://169.254.169.254/latest/meta-data",
+		"http://10.0.0.1/hook",
+		"http://192.168.1.1/hook",
+		"http://0.0.0.0/hook",
+	} {
+		_, err := service.CreateWebhook(alice, webhook.WebhookOptions{Url: link, Events: []string{storage.WebhookEventFinished}})
+		assert.ErrorIs(t, err, webhook.ErrForbiddenAddress, link)
+	}
+	_, err := service.CreateWebhook(alice, webhook.WebhookOptions{
+		Url:    "https://93.184.215.14/hook",
+		Events: []string{storage.WebhookEventFinished},
+	})
+	assert.NoError(t, err)
+}
+
+func TestWebhookService_RejectsPrivateAddressWhenConnecting(t *testing.T) {
+	server, received := createReceiver(t)
+	service, taskStorage := createService(t)
+	created, err := service.CreateWebhook(alice, webhook.WebhookOptions{
+		Url:    server.URL,
+		Events: []string{storage.WebhookEventFinished},
+	})
+	require.NoError(t, err)
+
+	// Same as if the host of the webhook resolved to a loopback address only after the webhook was created
+	service.SetAllowPrivateAddresses(false)
+	service.NotifyTaskCompleted(storeTask(t, taskStorage, alice.Username, scrapeModels.StatusFinished, 0))
+
+	var deliveries []*storage.WebhookDelivery
+	require.Eventually(t, func() bool {
+		deliveries, err = service.GetDeliveries(alice, *created.Id)
+		return err == nil && len(deliveries) == 3
+	}, 5*time.Second, 10*time.Millisecond)
+	assertNothingReceived(t, received)
+	assert.Contains(t, *deliveries[0].Error, webhook.ErrForbiddenAddress.Error())
+}
@@ -0,0 +1,88 @@
+package storage
+
+import (
+	"errors"
+	"github.com/martynasd123/golang-scraper/models/role"
+	"sort"
+	"time"
+)
+
+// ApiKey lets a user authenticate without logging in. Only the hash of the key is stored
+type ApiKey struct {
+	Id       *int
+	Username string
+	Name     string
+	Hash     string
+	// First characters of the key, so that the user can tell keys apart
+	Prefix string
+	// Permissions granted to the key. The key can not do more than its owner's role permits
+	Scopes     []role.Permission
+	CreatedAt  time.Time
+	ExpiresAt  *time.Time
+	LastUsedAt *time.Time
+	RevokedAt  *time.Time
+}
+
+// IsActive checks whether the key can be used for authentication at the given time
+func (key *ApiKey) IsActive(now time.Time) bool {
+	return key.RevokedAt == nil && (key.ExpiresAt == nil || now.Before(*key.ExpiresAt))
+}
+
+func (AuthStorage *InMemoryAuthDao) StoreApiKey(key *ApiKey) (int, error) {
+	AuthStorage.mu.Lock()
+	defer AuthStorage.mu.Unlock()
+
+	if key.Id != nil {
+		if _, exists := AuthStorage.apiKeys[*key.Id]; !exists {
+			return 0, errors.New("API key with ID provided, but API key does not exist")
+		}
+		AuthStorage.apiKeys[*key.Id] = *key
+		return *key.Id, nil
+	}
+	AuthStorage.lastApiKeyId = AuthStorage.lastApiKeyId + 1
+	newId := AuthStorage.lastApiKeyId
+	key.Id = &newId
+	AuthStorage.apiKeys[newId] = *key
+	return newId, nil
+}
+
+func (AuthStorage *InMemoryAuthDao) GetApiKeyByHash(hash string) (*ApiKey, error) {
+	AuthStorage.mu.Lock()
+	defer AuthStorage.mu.Unlock()
+
+	for _, key := range AuthStorage.apiKeys {
+		if key.Hash == hash {
+			return &key, nil
+		}
+	}
+	return nil, errors.New("API key not found")
+}
+
+func (AuthStorage *InMemoryAuthDao) SetApiKeyLastUsed(id int, usedAt time.Time) error {
+	AuthStorage.mu.Lock()
+	defer AuthStorage.mu.Unlock()
+
+	key, exists := AuthStorage.apiKeys[id]
+	if !exists {
+		return errors.New("API key not found")
+	}
+	key.LastUsedAt = &usedAt
+	AuthStorage.apiKeys[id] = key
+	return nil
+}
+
+func (AuthStorage *InMemoryAuthDao) GetApiKeys(username string) []*ApiKey {
+	AuthStorage.mu.Lock()
+	defer AuthStorage.mu.Unlock()
+
+	keys := make([]*ApiKey, 0)
+	for _, key := range AuthStorage.apiKeys {
+		if key.Username == username {
+			keys = append(keys, &key)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return *keys[i].Id < *keys[j].Id
+	})
+	return keys
+}
@@ -0,0 +1,51 @@
+package storage
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+)
+
+// TaskArchive stores tasks, which are removed from the task storage by the retention policy
+type TaskArchive interface {
+	ArchiveTask(task *Task, linkResults []*LinkResult) error
+}
+
+// ArchivedTask is a single entry of the task archive
+type ArchivedTask struct {
+	Task        Task
+	LinkResults []*LinkResult
+	ArchivedAt  time.Time
+}
+
+// TaskFileArchive appends archived tasks to a file, one JSON document per line
+type TaskFileArchive struct {
+	path string
+	mu   sync.Mutex
+}
+
+func CreateTaskFileArchive(path string) *TaskFileArchive {
+	return &TaskFileArchive{path: path}
+}
+
+func (archive *TaskFileArchive) ArchiveTask(task *Task, linkResults []*LinkResult) error {
+	line, err := json.Marshal(ArchivedTask{Task: *task, LinkResults: linkResults, ArchivedAt: time.Now()})
+	if err != nil {
+		return err
+	}
+
+	archive.mu.Lock()
+	defer archive.mu.Unlock()
+
+	file, err := os.OpenFile(archive.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(append(line, '\n'))
+	if err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
@@ -0,0 +1,52 @@
+package storage
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/martynasd123/golang-scraper/models/scrape"
+)
+
+func TestArchiveTask(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "archive.jsonl")
+	archive := CreateTaskFileArchive(path)
+
+	link, _ := url.Parse("http://example.com")
+	for i := range 2 {
+		task := CreateTaskInitial(scrape.StatusFinished, link, getSampleTime())
+		task.Id = &i
+		results := []*LinkResult{{Link: *link, Status: 404}}
+		if err := archive.ArchiveTask(task, results); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	lines := 0
+	for scanner.Scan() {
+		var archived ArchivedTask
+		if err := json.Unmarshal(scanner.Bytes(), &archived); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if *archived.Task.Id != lines {
+			t.Fatalf("expected task id %v, got %v", lines, *archived.Task.Id)
+		}
+		if len(archived.LinkResults) != 1 || archived.LinkResults[0].Status != 404 {
+			t.Fatalf("expected link results to be archived")
+		}
+		lines++
+	}
+	if lines != 2 {
+		t.Fatalf("expected 2 archived tasks, got %v", lines)
+	}
+}
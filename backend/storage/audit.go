@@ -0,0 +1,217 @@
+package storage
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/martynasd123/golang-scraper/models/principal"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Outcomes of audited actions
+const (
+	AuditOutcomeSuccess = "success"
+	AuditOutcomeFailure = "failure"
+)
+
+// AuditEvent records an action performed by or on behalf of a user
+type AuditEvent struct {
+	Id *int
+	// Username of the user, who performed the action. Empty for actions performed by the system
+	Actor     string
+	Action    string
+	Target    string
+	IP        string
+	UserAgent string
+	Outcome   string
+	Timestamp time.Time
+}
+
+// CreateAuditEvent creates an event of the action performed by the principal. The outcome is a failure if err is set
+func CreateAuditEvent(actor principal.Principal, action string, target string, err error) *AuditEvent {
+	outcome := AuditOutcomeSuccess
+	if err != nil {
+		outcome = AuditOutcomeFailure
+	}
+	return &AuditEvent{
+		Actor:     actor.Username,
+		Action:    action,
+		Target:    target,
+		IP:        actor.IP,
+		UserAgent: actor.UserAgent,
+		Outcome:   outcome,
+		Timestamp: time.Now(),
+	}
+}
+
+// AuditFilter selects audit events. Empty fields match all events
+type AuditFilter struct {
+	Actor   string
+	Action  string
+	Target  string
+	Outcome string
+	// Only events recorded at or after this time
+	From *time.Time
+	// Only events recorded before this time
+	To *time.Time
+}
+
+func (filter *AuditFilter) matches(event *AuditEvent) bool {
+	return (filter.Actor == "" || event.Actor == filter.Actor) &&
+		(filter.Action == "" || event.Action == filter.Action) &&
+		(filter.Target == "" || event.Target == filter.Target) &&
+		(filter.Outcome == "" || event.Outcome == filter.Outcome) &&
+		(filter.From == nil || !event.Timestamp.Before(*filter.From)) &&
+		(filter.To == nil || event.Timestamp.Before(*filter.To))
+}
+
+// AuditQuery selects a page of audit events, newest first
+type AuditQuery struct {
+	Filter AuditFilter
+	// Maximum number of events in the page. All events are returned if 0
+	Limit int
+	// Cursor returned with the previous page. Empty for the first page
+	Cursor string
+}
+
+// AuditPage is a single page of audit events
+type AuditPage struct {
+	Events []*AuditEvent
+	// Cursor of the next page. Empty if there are no more events
+	NextCursor string
+}
+
+// AuditDao is an append-only store of audit events
+type AuditDao interface {
+	RecordEvent(event *AuditEvent) error
+	// GetEvents returns the events matching the filter in the order they were recorded
+	GetEvents(filter AuditFilter) []*AuditEvent
+	// QueryEvents returns a page of events matching the filter, newest first
+	QueryEvents(query AuditQuery) (*AuditPage, error)
+}
+
+// InMemoryAuditDao keeps audit events in memory. If a file is set, events are also appended to it, one JSON document
+// per line, so that they survive restarts
+type InMemoryAuditDao struct {
+	mu     sync.RWMutex
+	events []AuditEvent
+	path   string
+}
+
+func CreateAuditInMemoryDao() *InMemoryAuditDao {
+	return &InMemoryAuditDao{}
+}
+
+// CreateAuditFileDao loads the events recorded in the file, if it exists, and appends new events to it
+func CreateAuditFileDao(path string) (*InMemoryAuditDao, error) {
+	dao := CreateAuditInMemoryDao()
+	dao.path = path
+
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return dao, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var event AuditEvent
+		if err = json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			return nil, err
+		}
+		dao.events = append(dao.events, event)
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+	return dao, nil
+}
+
+func (dao *InMemoryAuditDao) RecordEvent(event *AuditEvent) error {
+	dao.mu.Lock()
+	defer dao.mu.Unlock()
+	id := len(dao.events) + 1
+	event.Id = &id
+
+	if dao.path != "" {
+		line, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		file, err := os.OpenFile(dao.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+		if err != nil {
+			return err
+		}
+		if _, err = file.Write(append(line, '\n')); err != nil {
+			file.Close()
+			return err
+		}
+		if err = file.Close(); err != nil {
+			return err
+		}
+	}
+	dao.events = append(dao.events, *event)
+	return nil
+}
+
+func (dao *InMemoryAuditDao) GetEvents(filter AuditFilter) []*AuditEvent {
+	dao.mu.RLock()
+	defer dao.mu.RUnlock()
+	events := make([]*AuditEvent, 0)
+	for i := range dao.events {
+		if filter.matches(&dao.events[i]) {
+			event := dao.events[i]
+			events = append(events, &event)
+		}
+	}
+	return events
+}
+
+func (dao *InMemoryAuditDao) QueryEvents(query AuditQuery) (*AuditPage, error) {
+	dao.mu.RLock()
+	defer dao.mu.RUnlock()
+
+	// Events are stored in the order of their IDs, so the page starts right before the event of the cursor
+	end := len(dao.events)
+	if query.Cursor != "" {
+		id, err := decodeAuditCursor(query.Cursor)
+		if err != nil {
+			return nil, err
+		}
+		end = min(max(id-1, 0), len(dao.events))
+	}
+	page := &AuditPage{Events: make([]*AuditEvent, 0)}
+	for i := end - 1; i >= 0; i-- {
+		if !query.Filter.matches(&dao.events[i]) {
+			continue
+		}
+		if query.Limit > 0 && len(page.Events) == query.Limit {
+			page.NextCursor = encodeAuditCursor(*page.Events[len(page.Events)-1].Id)
+			break
+		}
+		event := dao.events[i]
+		page.Events = append(page.Events, &event)
+	}
+	return page, nil
+}
+
+func encodeAuditCursor(id int) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.Itoa(id)))
+}
+
+func decodeAuditCursor(cursor string) (int, error) {
+	value, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return 0, ErrInvalidCursor
+	}
+	id, err := strconv.Atoi(string(value))
+	if err != nil {
+		return 0, ErrInvalidCursor
+	}
+	return id, nil
+}
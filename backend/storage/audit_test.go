@@ -0,0 +1,94 @@
+package storage
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/martynasd123/golang-scraper/models/principal"
+)
+
+func TestQueryAuditEvents(t *testing.T) {
+	dao := CreateAuditInMemoryDao()
+	actor := principal.Principal{Username: "admin"}
+	for i := range 5 {
+		var err error
+		if i%2 == 1 {
+			err = errors.New("failed")
+		}
+		if err := dao.RecordEvent(CreateAuditEvent(actor, "login", "admin", err)); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+	}
+
+	// Pages are returned newest first
+	ids := make([]int, 0)
+	query := AuditQuery{Limit: 2}
+	for {
+		page, err := dao.QueryEvents(query)
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		for _, event := range page.Events {
+			ids = append(ids, *event.Id)
+		}
+		if page.NextCursor == "" {
+			break
+		}
+		query.Cursor = page.NextCursor
+	}
+	expected := []int{5, 4, 3, 2, 1}
+	if len(ids) != len(expected) {
+		t.Fatalf("expected ids %v, got %v", expected, ids)
+	}
+	for i := range expected {
+		if ids[i] != expected[i] {
+			t.Fatalf("expected ids %v, got %v", expected, ids)
+		}
+	}
+
+	page, err := dao.QueryEvents(AuditQuery{Filter: AuditFilter{Outcome: AuditOutcomeFailure}})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if len(page.Events) != 2 || *page.Events[0].Id != 4 || *page.Events[1].Id != 2 {
+		t.Fatalf("expected failed events 4 and 2, got %v", page.Events)
+	}
+
+	if _, err = dao.QueryEvents(AuditQuery{Cursor: "invalid!"}); !errors.Is(err, ErrInvalidCursor) {
+		t.Fatalf("expected error %v, got %v", ErrInvalidCursor, err)
+	}
+}
+
+func TestAuditFileDao(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	dao, err := CreateAuditFileDao(path)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	actor := principal.Principal{Username: "admin", IP: "127.0.0.1", UserAgent: "Mozilla/5.0"}
+	for _, action := range []string{"user.created", "user.deleted"} {
+		if err = dao.RecordEvent(CreateAuditEvent(actor, action, "testuser", nil)); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+	}
+
+	// Events survive restarts
+	dao, err = CreateAuditFileDao(path)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	events := dao.GetEvents(AuditFilter{})
+	if len(events) != 2 {
+		t.Fatalf("expected 2 events, got %d", len(events))
+	}
+	if events[1].Action != "user.deleted" || events[1].IP != "127.0.0.1" || events[1].Outcome != AuditOutcomeSuccess {
+		t.Fatalf("unexpected event %+v", events[1])
+	}
+	if err = dao.RecordEvent(CreateAuditEvent(actor, "user.created", "other", nil)); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if id := *dao.GetEvents(AuditFilter{Target: "other"})[0].Id; id != 3 {
+		t.Fatalf("expected id 3, got %d", id)
+	}
+}
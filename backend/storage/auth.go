@@ -2,33 +2,77 @@ package storage
 
 import (
 	"errors"
+	"github.com/martynasd123/golang-scraper/models/role"
+	"slices"
+	"sort"
 	"sync"
 	"time"
 )
 
+// ErrCodeAlreadyUsed is returned when a second factor code is consumed, which was already used or does not exist
+var ErrCodeAlreadyUsed = errors.New("code was already used")
+
 type User struct {
-	Id                     *int
-	Username               string
-	Password               string
-	DeviceIdentifier       *string
-	RefreshToken           *string
-	RefreshTokenValidUntil *time.Time
+	Id       *int
+	Username string
+	Password string
+	Role     role.Role
+	// Disabled users can not log in
+	Disabled bool
+	// Secret of the TOTP second factor. Only set once enrollment is confirmed
+	TotpSecret string
+	// Secret generated on enrollment, which is not confirmed yet
+	PendingTotpSecret string
+	// TOTP time step of the last accepted code, so that a code can not be used twice
+	TotpLastUsedStep int64
+	// Hashes of the recovery codes, which were not used yet
+	RecoveryCodeHashes []string
+	// Subject of the user at the OpenID Connect provider. Set when the user is provisioned or links the identity
+	OidcSubject string
+}
+
+// HasSecondFactor checks whether the user has to provide a second factor to log in
+func (user *User) HasSecondFactor() bool {
+	return user.TotpSecret != ""
 }
 
 type AuthDao interface {
 	CreateUser(*User) error
 	GetUser(username string) (*User, error)
 	UpdateUser(user *User) error
+	// DeleteUser deletes the user along with their API keys
+	DeleteUser(username string) error
+	// GetAllUsers returns all users sorted by username
+	GetAllUsers() []*User
+	// ConsumeTotpStep records the TOTP time step as used, if it is later than the last used one. Returns
+	// ErrCodeAlreadyUsed otherwise
+	ConsumeTotpStep(username string, step int64) error
+	// ConsumeRecoveryCode removes the recovery code with the hash. Returns ErrCodeAlreadyUsed if the user has no such
+	// code
+	ConsumeRecoveryCode(username string, hash string) error
+
+	// StoreApiKey creates the API key if it has no ID, otherwise updates it. Returns the ID of the key
+	StoreApiKey(key *ApiKey) (int, error)
+	GetApiKeyByHash(hash string) (*ApiKey, error)
+	// SetApiKeyLastUsed records when the API key was used. Other fields are not changed, so that a concurrent
+	// revocation is not undone
+	SetApiKeyLastUsed(id int, usedAt time.Time) error
+	// GetApiKeys returns all API keys of the user sorted by ID
+	GetApiKeys(username string) []*ApiKey
 }
 
 type InMemoryAuthDao struct {
 	mu    sync.Mutex
 	users map[string]User
+	// API key ID to API key
+	apiKeys      map[int]ApiKey
+	lastApiKeyId int
 }
 
 func CreateAuthInMemoryDao() *InMemoryAuthDao {
 	return &InMemoryAuthDao{
-		users: make(map[string]User),
+		users:   make(map[string]User),
+		apiKeys: make(map[int]ApiKey),
 	}
 }
 
@@ -65,11 +109,80 @@ func (AuthStorage *InMemoryAuthDao) UpdateUser(user *User) error {
 
 	existingUser.Username = user.Username
 	existingUser.Password = user.Password
-	existingUser.DeviceIdentifier = user.DeviceIdentifier
-	existingUser.RefreshToken = user.RefreshToken
-	existingUser.RefreshTokenValidUntil = user.RefreshTokenValidUntil
+	existingUser.Role = user.Role
+	existingUser.Disabled = user.Disabled
+	existingUser.TotpSecret = user.TotpSecret
+	existingUser.PendingTotpSecret = user.PendingTotpSecret
+	existingUser.TotpLastUsedStep = user.TotpLastUsedStep
+	existingUser.RecoveryCodeHashes = slices.Clone(user.RecoveryCodeHashes)
+	existingUser.OidcSubject = user.OidcSubject
 
 	AuthStorage.users[user.Username] = existingUser
 
 	return nil
 }
+
+func (AuthStorage *InMemoryAuthDao) DeleteUser(username string) error {
+	AuthStorage.mu.Lock()
+	defer AuthStorage.mu.Unlock()
+
+	if _, exists := AuthStorage.users[username]; !exists {
+		return errors.New("user not found")
+	}
+	delete(AuthStorage.users, username)
+	// Keys would otherwise stay usable, or be taken over by a new user with the same username
+	for id, key := range AuthStorage.apiKeys {
+		if key.Username == username {
+			delete(AuthStorage.apiKeys, id)
+		}
+	}
+	return nil
+}
+
+func (AuthStorage *InMemoryAuthDao) ConsumeTotpStep(username string, step int64) error {
+	AuthStorage.mu.Lock()
+	defer AuthStorage.mu.Unlock()
+
+	user, exists := AuthStorage.users[username]
+	if !exists {
+		return errors.New("user not found")
+	}
+	if step <= user.TotpLastUsedStep {
+		return ErrCodeAlreadyUsed
+	}
+	user.TotpLastUsedStep = step
+	AuthStorage.users[username] = user
+	return nil
+}
+
+func (AuthStorage *InMemoryAuthDao) ConsumeRecoveryCode(username string, hash string) error {
+	AuthStorage.mu.Lock()
+	defer AuthStorage.mu.Unlock()
+
+	user, exists := AuthStorage.users[username]
+	if !exists {
+		return errors.New("user not found")
+	}
+	index := slices.Index(user.RecoveryCodeHashes, hash)
+	if index < 0 {
+		return ErrCodeAlreadyUsed
+	}
+	// The stored slice is shared with copies of the user, which were returned before
+	user.RecoveryCodeHashes = slices.Delete(slices.Clone(user.RecoveryCodeHashes), index, index+1)
+	AuthStorage.users[username] = user
+	return nil
+}
+
+func (AuthStorage *InMemoryAuthDao) GetAllUsers() []*User {
+	AuthStorage.mu.Lock()
+	defer AuthStorage.mu.Unlock()
+
+	users := make([]*User, 0, len(AuthStorage.users))
+	for _, user := range AuthStorage.users {
+		users = append(users, &user)
+	}
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].Username < users[j].Username
+	})
+	return users
+}
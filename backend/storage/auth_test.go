@@ -1,6 +1,7 @@
 package storage
 
 import (
+	"github.com/martynasd123/golang-scraper/models/role"
 	"testing"
 	"time"
 )
@@ -66,11 +67,10 @@ func TestUpdateUser(t *testing.T) {
 	}
 
 	updatedUser := &User{
-		Username:               "testuser",
-		Password:               "newpassword",
-		DeviceIdentifier:       strPtr("newDeviceIdentifier"),
-		RefreshToken:           strPtr("newRefreshToken"),
-		RefreshTokenValidUntil: timePtr(time.Now().Add(24 * time.Hour)),
+		Username: "testuser",
+		Password: "newpassword",
+		Role:     role.Admin,
+		Disabled: true,
 	}
 
 	err = dao.UpdateUser(updatedUser)
@@ -86,14 +86,11 @@ func TestUpdateUser(t *testing.T) {
 	if retrievedUser.Password != updatedUser.Password {
 		t.Fatalf("expected password %v, got %v", updatedUser.Password, retrievedUser.Password)
 	}
-	if *retrievedUser.DeviceIdentifier != *updatedUser.DeviceIdentifier {
-		t.Fatalf("expected device identifier %v, got %v", *updatedUser.DeviceIdentifier, *retrievedUser.DeviceIdentifier)
-	}
-	if *retrievedUser.RefreshToken != *updatedUser.RefreshToken {
-		t.Fatalf("expected refresh token %v, got %v", *updatedUser.RefreshToken, *retrievedUser.RefreshToken)
+	if retrievedUser.Role != updatedUser.Role {
+		t.Fatalf("expected role %v, got %v", updatedUser.Role, retrievedUser.Role)
 	}
-	if !retrievedUser.RefreshTokenValidUntil.Equal(*updatedUser.RefreshTokenValidUntil) {
-		t.Fatalf("expected refresh token valid until %v, got %v", *updatedUser.RefreshTokenValidUntil, *retrievedUser.RefreshTokenValidUntil)
+	if !retrievedUser.Disabled {
+		t.Fatalf("expected user to be disabled")
 	}
 
 	nonExistentUser := &User{
@@ -106,10 +103,62 @@ func TestUpdateUser(t *testing.T) {
 	}
 }
 
-func strPtr(s string) *string {
-	return &s
+func TestDeleteUser(t *testing.T) {
+	dao := CreateAuthInMemoryDao()
+	user := &User{
+		Username: "testuser",
+		Password: "password",
+	}
+
+	err := dao.CreateUser(user)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	err = dao.DeleteUser("testuser")
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	_, err = dao.GetUser("testuser")
+	if err == nil {
+		t.Fatalf("expected error, got nil")
+	}
+
+	err = dao.DeleteUser("testuser")
+	if err == nil {
+		t.Fatalf("expected error, got nil")
+	}
 }
 
-func timePtr(t time.Time) *time.Time {
-	return &t
+func TestSetApiKeyLastUsed(t *testing.T) {
+	dao := CreateAuthInMemoryDao()
+	id, err := dao.StoreApiKey(&ApiKey{Username: "testuser", Hash: "hash"})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	// The key is revoked while it is being used
+	key, _ := dao.GetApiKeyByHash("hash")
+	revokedAt := time.Now()
+	key.RevokedAt = &revokedAt
+	if _, err = dao.StoreApiKey(key); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	usedAt := time.Now()
+	if err = dao.SetApiKeyLastUsed(id, usedAt); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	key, _ = dao.GetApiKeyByHash("hash")
+	if key.RevokedAt == nil {
+		t.Fatalf("expected the key to stay revoked")
+	}
+	if key.LastUsedAt == nil || !key.LastUsedAt.Equal(usedAt) {
+		t.Fatalf("expected last usage %v, got %v", usedAt, key.LastUsedAt)
+	}
+
+	if err = dao.SetApiKeyLastUsed(id+1, usedAt); err == nil {
+		t.Fatalf("expected error, got nil")
+	}
 }
@@ -0,0 +1,128 @@
+package storage
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+)
+
+// RevocationDao keeps IDs of access tokens, which were revoked before they expired
+type RevocationDao interface {
+	// RevokeToken adds the token to the revocation list. The token is kept in the list until it expires
+	RevokeToken(id string, expiresAt time.Time) error
+	IsTokenRevoked(id string) bool
+}
+
+// RevokedToken is a single entry of the revocation list
+type RevokedToken struct {
+	Id        string
+	ExpiresAt time.Time
+}
+
+// InMemoryRevocationDao keeps the revocation list in memory. If a file is set, revoked tokens are also appended to
+// it, one JSON document per line, so that the list survives restarts
+type InMemoryRevocationDao struct {
+	mu sync.RWMutex
+	// Token ID to expiry of the token
+	revoked map[string]time.Time
+	path    string
+}
+
+func CreateRevocationInMemoryDao() *InMemoryRevocationDao {
+	return &InMemoryRevocationDao{revoked: make(map[string]time.Time)}
+}
+
+// CreateRevocationFileDao loads the revocation list from the file, if it exists, and appends newly revoked tokens to
+// it. Expired entries are dropped from the file when it is loaded
+func CreateRevocationFileDao(path string) (*InMemoryRevocationDao, error) {
+	dao := CreateRevocationInMemoryDao()
+	dao.path = path
+
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return dao, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var token RevokedToken
+		if err = json.Unmarshal(scanner.Bytes(), &token); err != nil {
+			file.Close()
+			return nil, err
+		}
+		if token.ExpiresAt.After(now) {
+			dao.revoked[token.Id] = token.ExpiresAt
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	if err = file.Close(); err != nil {
+		return nil, err
+	}
+	return dao, dao.rewriteFile()
+}
+
+func (dao *InMemoryRevocationDao) RevokeToken(id string, expiresAt time.Time) error {
+	dao.mu.Lock()
+	defer dao.mu.Unlock()
+
+	now := time.Now()
+	for revokedId, revokedExpiresAt := range dao.revoked {
+		if !revokedExpiresAt.After(now) {
+			delete(dao.revoked, revokedId)
+		}
+	}
+	dao.revoked[id] = expiresAt
+
+	if dao.path == "" {
+		return nil
+	}
+	line, err := json.Marshal(RevokedToken{Id: id, ExpiresAt: expiresAt})
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(dao.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(append(line, '\n'))
+	if err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+func (dao *InMemoryRevocationDao) IsTokenRevoked(id string) bool {
+	dao.mu.RLock()
+	defer dao.mu.RUnlock()
+	_, revoked := dao.revoked[id]
+	return revoked
+}
+
+// Replaces the file with the entries, which are currently in memory
+func (dao *InMemoryRevocationDao) rewriteFile() error {
+	file, err := os.OpenFile(dao.path, os.O_TRUNC|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	for id, expiresAt := range dao.revoked {
+		line, err := json.Marshal(RevokedToken{Id: id, ExpiresAt: expiresAt})
+		if err != nil {
+			file.Close()
+			return err
+		}
+		if _, err = file.Write(append(line, '\n')); err != nil {
+			file.Close()
+			return err
+		}
+	}
+	return file.Close()
+}
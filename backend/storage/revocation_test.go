@@ -0,0 +1,40 @@
+package storage
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRevocationFileDao(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "revoked.jsonl")
+	dao, err := CreateRevocationFileDao(path)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	if err = dao.RevokeToken("expired", time.Now().Add(-time.Minute)); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if err = dao.RevokeToken("active", time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if !dao.IsTokenRevoked("active") {
+		t.Fatalf("expected token to be revoked")
+	}
+	if dao.IsTokenRevoked("other") {
+		t.Fatalf("expected token not to be revoked")
+	}
+
+	// Simulate restart
+	reloaded, err := CreateRevocationFileDao(path)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if !reloaded.IsTokenRevoked("active") {
+		t.Fatalf("expected token to stay revoked after reload")
+	}
+	if reloaded.IsTokenRevoked("expired") {
+		t.Fatalf("expected expired token to be dropped")
+	}
+}
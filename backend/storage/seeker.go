@@ -1,10 +1,15 @@
 package storage
 
 import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"net/url"
+	"slices"
 	"sort"
+	"strings"
 	"sync"
 	"time"
 )
@@ -23,6 +28,190 @@ type Task struct {
 	CrawledLinks      int
 	Error             *string
 	CTime             time.Time
+	// Tasks with higher priority are picked up for processing first
+	Priority int
+	// Username of the user who submitted the task
+	Owner string
+	// Links of the page that were not crawled yet. Set when the task is paused after the initial page was processed,
+	// or when broken links of the task are to be re-checked
+	PendingLinks []url.URL
+	// Set when the pending links are previously crawled links, which are being re-checked
+	Rechecking bool
+	// ID of the task this task is a retry of
+	RetryOf *int
+}
+
+// LinkResult is the outcome of crawling a single link of the page
+type LinkResult struct {
+	Link url.URL
+	// Http status of response
+	Status int
+	// Flag which indicates that a transport level error occurred
+	TransportError bool
+	CrawledAt      time.Time
+}
+
+func (result *LinkResult) IsAccessible() bool {
+	return !result.TransportError && (result.Status < 400 || result.Status >= 600)
+}
+
+// TaskFilter selects tasks. Fields with zero values do not restrict the selection.
+type TaskFilter struct {
+	Statuses []string
+	// Host of the task link
+	Host          string
+	Owner         *string
+	CreatedBefore *time.Time
+	// Inclusive lower bound of creation time
+	CreatedAfter *time.Time
+	// Case-insensitive substring of the page title
+	TitleContains string
+	// Selects tasks with at least one inaccessible link if true, tasks without them if false
+	HasBrokenLinks *bool
+}
+
+func (filter *TaskFilter) Matches(task *Task) bool {
+	if len(filter.Statuses) > 0 && !slices.Contains(filter.Statuses, task.Status) {
+		return false
+	}
+	if filter.Host != "" && !strings.EqualFold(filter.Host, task.Link.Host) {
+		return false
+	}
+	if filter.Owner != nil && *filter.Owner != task.Owner {
+		return false
+	}
+	if filter.CreatedBefore != nil && !task.CTime.Before(*filter.CreatedBefore) {
+		return false
+	}
+	if filter.CreatedAfter != nil && task.CTime.Before(*filter.CreatedAfter) {
+		return false
+	}
+	if filter.TitleContains != "" &&
+		(task.PageTitle == nil || !strings.Contains(strings.ToLower(*task.PageTitle), strings.ToLower(filter.TitleContains))) {
+		return false
+	}
+	if filter.HasBrokenLinks != nil {
+		hasBrokenLinks := task.InaccessibleLinks != nil && *task.InaccessibleLinks > 0
+		if hasBrokenLinks != *filter.HasBrokenLinks {
+			return false
+		}
+	}
+	return true
+}
+
+// Fields, by which the tasks can be sorted
+const (
+	SortByCreationTime      = "ctime"
+	SortByCrawledLinks      = "crawledLinks"
+	SortByInaccessibleLinks = "inaccessibleLinks"
+)
+
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// TaskQuery selects a page of tasks
+type TaskQuery struct {
+	Filter TaskFilter
+	// One of SortByCreationTime, SortByCrawledLinks or SortByInaccessibleLinks. Tasks with equal sort values
+	// are ordered by ID
+	SortBy    string
+	Ascending bool
+	// Maximum number of tasks in the page
+	Limit int
+	// Cursor returned with the previous page. Empty for the first page
+	Cursor string
+}
+
+// TaskPage is a single page of tasks
+type TaskPage struct {
+	Tasks []*Task
+	// Cursor of the next page. Empty if there are no more tasks
+	NextCursor string
+}
+
+// Position of a task in the sort order. Encoded into cursors, so that the next page starts right after it
+type taskSortKey struct {
+	Value int64 `json:"v"`
+	Id    int   `json:"id"`
+}
+
+func createTaskSortKey(task *Task, sortBy string) taskSortKey {
+	key := taskSortKey{Id: *task.Id}
+	switch sortBy {
+	case SortByCrawledLinks:
+		key.Value = int64(task.CrawledLinks)
+	case SortByInaccessibleLinks:
+		key.Value = -1
+		if task.InaccessibleLinks != nil {
+			key.Value = int64(*task.InaccessibleLinks)
+		}
+	default:
+		key.Value = task.CTime.UnixNano()
+	}
+	return key
+}
+
+func (key taskSortKey) less(other taskSortKey) bool {
+	if key.Value != other.Value {
+		return key.Value < other.Value
+	}
+	return key.Id < other.Id
+}
+
+// Cursor of the next page. Bound to the order and the filter of the query it was returned with, since the position
+// means nothing in a different order or among different tasks
+type taskCursor struct {
+	taskSortKey
+	SortBy    string `json:"s"`
+	Ascending bool   `json:"a"`
+	// Hash of the filter (see hashTaskFilter)
+	Filter string `json:"f"`
+}
+
+func createTaskCursor(key taskSortKey, query *TaskQuery) taskCursor {
+	return taskCursor{
+		taskSortKey: key,
+		SortBy:      normalizeSortBy(query.SortBy),
+		Ascending:   query.Ascending,
+		Filter:      hashTaskFilter(query.Filter),
+	}
+}
+
+// Tasks are sorted by creation time, unless another known field is requested
+func normalizeSortBy(sortBy string) string {
+	if sortBy == SortByCrawledLinks || sortBy == SortByInaccessibleLinks {
+		return sortBy
+	}
+	return SortByCreationTime
+}
+
+func hashTaskFilter(filter TaskFilter) string {
+	// Order of the statuses does not change the selected tasks
+	filter.Statuses = slices.Clone(filter.Statuses)
+	slices.Sort(filter.Statuses)
+	value, _ := json.Marshal(filter)
+	hash := sha256.Sum256(value)
+	return base64.RawURLEncoding.EncodeToString(hash[:12])
+}
+
+func encodeCursor(cursor taskCursor) string {
+	value, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(value)
+}
+
+// Decodes the cursor, which must have been returned with a query of the same order and filter
+func decodeCursor(encoded string, query *TaskQuery) (taskSortKey, error) {
+	var cursor taskCursor
+	value, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return cursor.taskSortKey, ErrInvalidCursor
+	}
+	if err = json.Unmarshal(value, &cursor); err != nil {
+		return cursor.taskSortKey, ErrInvalidCursor
+	}
+	if expected := createTaskCursor(cursor.taskSortKey, query); cursor != expected {
+		return cursor.taskSortKey, ErrInvalidCursor
+	}
+	return cursor.taskSortKey, nil
 }
 
 func CreateTaskInitial(status string, link *url.URL, Ctime time.Time) *Task {
@@ -54,15 +243,32 @@ type TaskDao interface {
 
 	// Returns all tasks sorted by creation time in descending order
 	GetAllTasks() []*Task
+
+	// FindTasks returns tasks matching the filter, sorted by creation time in descending order
+	FindTasks(filter TaskFilter) []*Task
+
+	// QueryTasks returns a page of tasks matching the query filter, in the requested order
+	QueryTasks(query TaskQuery) (*TaskPage, error)
+
+	// DeleteTask deletes the task along with its link results
+	DeleteTask(id int) error
+
+	// StoreLinkResult stores the result of crawling a link of the task. Previous result of the same link is overwritten.
+	StoreLinkResult(taskId int, result *LinkResult) error
+
+	// GetLinkResults returns results of all crawled links of the task, sorted by link
+	GetLinkResults(taskId int) ([]*LinkResult, error)
 }
 
 // TaskInMemoryDao is a simple in-memory storage mechanism for tasks.
 // This likely shouldn't be used outside of testing environment,
 // because it offers no persistence and is not very performant.
 type TaskInMemoryDao struct {
-	tasks  map[int]Task
-	lastId int
-	mu     sync.RWMutex
+	tasks map[int]Task
+	// Task ID to link results of that task, keyed by link
+	linkResults map[int]map[string]LinkResult
+	lastId      int
+	mu          sync.RWMutex
 }
 
 func (storage *TaskInMemoryDao) GetAllTasks() []*Task {
@@ -78,6 +284,75 @@ func (storage *TaskInMemoryDao) GetAllTasks() []*Task {
 	return tasks
 }
 
+func (storage *TaskInMemoryDao) FindTasks(filter TaskFilter) []*Task {
+	tasks := storage.GetAllTasks()
+	return slices.DeleteFunc(tasks, func(task *Task) bool {
+		return !filter.Matches(task)
+	})
+}
+
+func (storage *TaskInMemoryDao) QueryTasks(query TaskQuery) (*TaskPage, error) {
+	var after *taskSortKey
+	if query.Cursor != "" {
+		key, err := decodeCursor(query.Cursor, &query)
+		if err != nil {
+			return nil, err
+		}
+		after = &key
+	}
+
+	// Only the sort keys of matching tasks are collected, tasks are copied after the page is selected
+	storage.mu.RLock()
+	defer storage.mu.RUnlock()
+	keys := make([]taskSortKey, 0)
+	for _, task := range storage.tasks {
+		if query.Filter.Matches(&task) {
+			keys = append(keys, createTaskSortKey(&task, query.SortBy))
+		}
+	}
+	comesBefore := func(a, b taskSortKey) bool {
+		if query.Ascending {
+			return a.less(b)
+		}
+		return b.less(a)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return comesBefore(keys[i], keys[j])
+	})
+
+	start := 0
+	if after != nil {
+		start = sort.Search(len(keys), func(i int) bool {
+			return comesBefore(*after, keys[i])
+		})
+	}
+	end := len(keys)
+	if query.Limit > 0 {
+		end = min(end, start+query.Limit)
+	}
+
+	page := &TaskPage{Tasks: make([]*Task, 0, end-start)}
+	for _, key := range keys[start:end] {
+		task := storage.tasks[key.Id]
+		page.Tasks = append(page.Tasks, &task)
+	}
+	if end < len(keys) {
+		page.NextCursor = encodeCursor(createTaskCursor(keys[end-1], &query))
+	}
+	return page, nil
+}
+
+func (storage *TaskInMemoryDao) DeleteTask(id int) error {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+	if _, ok := storage.tasks[id]; !ok {
+		return fmt.Errorf("no task found with id %d", id)
+	}
+	delete(storage.tasks, id)
+	delete(storage.linkResults, id)
+	return nil
+}
+
 func (storage *TaskInMemoryDao) StoreTask(task *Task) (int, error) {
 	storage.mu.Lock()
 	defer storage.mu.Unlock()
@@ -107,6 +382,37 @@ func (storage *TaskInMemoryDao) RetrieveTaskById(id int) (*Task, error) {
 	return nil, fmt.Errorf("no task found with id %d", id)
 }
 
+func (storage *TaskInMemoryDao) StoreLinkResult(taskId int, result *LinkResult) error {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+	if _, ok := storage.tasks[taskId]; !ok {
+		return fmt.Errorf("no task found with id %d", taskId)
+	}
+	results, ok := storage.linkResults[taskId]
+	if !ok {
+		results = make(map[string]LinkResult)
+		storage.linkResults[taskId] = results
+	}
+	results[result.Link.String()] = *result
+	return nil
+}
+
+func (storage *TaskInMemoryDao) GetLinkResults(taskId int) ([]*LinkResult, error) {
+	storage.mu.RLock()
+	defer storage.mu.RUnlock()
+	if _, ok := storage.tasks[taskId]; !ok {
+		return nil, fmt.Errorf("no task found with id %d", taskId)
+	}
+	results := make([]*LinkResult, 0, len(storage.linkResults[taskId]))
+	for _, result := range storage.linkResults[taskId] {
+		results = append(results, &result)
+	}
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].Link.String() < results[j].Link.String()
+	})
+	return results, nil
+}
+
 func CreateTaskInMemoryDao() *TaskInMemoryDao {
-	return &TaskInMemoryDao{tasks: make(map[int]Task), lastId: 0}
+	return &TaskInMemoryDao{tasks: make(map[int]Task), linkResults: make(map[int]map[string]LinkResult), lastId: 0}
 }
@@ -1,6 +1,8 @@
 package storage
 
 import (
+	"errors"
+	"fmt"
 	"github.com/martynasd123/golang-scraper/models/scrape"
 	"net/url"
 	"testing"
@@ -99,6 +101,175 @@ func TestGetAllTasks(t *testing.T) {
 	}
 }
 
+func TestStoreLinkResult(t *testing.T) {
+	dao := CreateTaskInMemoryDao()
+
+	link, _ := url.Parse("http://example.com")
+	id, err := dao.StoreTask(CreateTaskInitial(scrape.StatusPending, link, getSampleTime()))
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	brokenLink, _ := url.Parse("http://example.com/broken")
+	otherLink, _ := url.Parse("http://example.com/a")
+	results := []*LinkResult{
+		{Link: *brokenLink, Status: 404},
+		{Link: *otherLink, Status: 200},
+		// Overwrites the first result
+		{Link: *brokenLink, Status: 200},
+	}
+	for _, result := range results {
+		if err := dao.StoreLinkResult(id, result); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+	}
+
+	stored, err := dao.GetLinkResults(id)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if len(stored) != 2 {
+		t.Fatalf("expected 2 results, got %v", len(stored))
+	}
+	if stored[0].Link != *otherLink || stored[1].Link != *brokenLink {
+		t.Fatalf("expected results to be sorted by link")
+	}
+	if !stored[1].IsAccessible() {
+		t.Fatalf("expected result to be overwritten")
+	}
+
+	if err := dao.StoreLinkResult(999, results[0]); err == nil {
+		t.Fatalf("expected error, got nil")
+	}
+}
+
+func TestFindTasks(t *testing.T) {
+	dao := CreateTaskInMemoryDao()
+
+	link1, _ := url.Parse("http://example1.com")
+	link2, _ := url.Parse("http://example2.com")
+	tasks := []*Task{
+		CreateTaskInitial(scrape.StatusFinished, link1, getSampleTime()),
+		CreateTaskInitial(scrape.StatusError, link1, getSampleTime().Add(time.Hour)),
+		CreateTaskInitial(scrape.StatusFinished, link2, getSampleTime().Add(2*time.Hour)),
+	}
+	for _, task := range tasks {
+		if _, err := dao.StoreTask(task); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+	}
+
+	createdBefore := getSampleTime().Add(90 * time.Minute)
+	found := dao.FindTasks(TaskFilter{Host: "example1.com", CreatedBefore: &createdBefore})
+	if len(found) != 2 {
+		t.Fatalf("expected 2 tasks, got %v", len(found))
+	}
+
+	found = dao.FindTasks(TaskFilter{Statuses: []string{scrape.StatusFinished}})
+	if len(found) != 2 || found[0].Link != *link2 {
+		t.Fatalf("expected 2 finished tasks sorted by creation time descending")
+	}
+}
+
+func TestQueryTasks(t *testing.T) {
+	dao := CreateTaskInMemoryDao()
+
+	link, _ := url.Parse("http://example.com")
+	for i := range 5 {
+		task := CreateTaskInitial(scrape.StatusFinished, link, getSampleTime().Add(time.Duration(i)*time.Hour))
+		task.CrawledLinks = i % 3
+		task.InaccessibleLinks = new(int)
+		*task.InaccessibleLinks = i % 2
+		title := fmt.Sprintf("Page %d", i)
+		task.PageTitle = &title
+		if _, err := dao.StoreTask(task); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+	}
+
+	// Paginate through tasks sorted by crawled links, ties broken by id
+	query := TaskQuery{SortBy: SortByCrawledLinks, Ascending: true, Limit: 2}
+	var crawledLinks []int
+	for pages := 0; ; pages++ {
+		page, err := dao.QueryTasks(query)
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		for _, task := range page.Tasks {
+			crawledLinks = append(crawledLinks, task.CrawledLinks)
+		}
+		if page.NextCursor == "" {
+			if pages != 2 {
+				t.Fatalf("expected 3 pages, got %v", pages+1)
+			}
+			break
+		}
+		query.Cursor = page.NextCursor
+	}
+	if fmt.Sprint(crawledLinks) != "[0 0 1 1 2]" {
+		t.Fatalf("unexpected order of tasks: %v", crawledLinks)
+	}
+
+	hasBrokenLinks := true
+	page, err := dao.QueryTasks(TaskQuery{
+		Filter: TaskFilter{HasBrokenLinks: &hasBrokenLinks, TitleContains: "page"},
+		SortBy: SortByCreationTime,
+	})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if len(page.Tasks) != 2 || *page.Tasks[0].PageTitle != "Page 3" || *page.Tasks[1].PageTitle != "Page 1" {
+		t.Fatalf("expected tasks with broken links sorted by creation time descending")
+	}
+
+	_, err = dao.QueryTasks(TaskQuery{Cursor: "not a cursor"})
+	if !errors.Is(err, ErrInvalidCursor) {
+		t.Fatalf("expected invalid cursor error, got %v", err)
+	}
+
+	// Cursor is only valid with the order and the filter of the query it was returned with
+	first, err := dao.QueryTasks(TaskQuery{SortBy: SortByCrawledLinks, Ascending: true, Limit: 2})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	for _, replayed := range []TaskQuery{
+		{SortBy: SortByCreationTime, Ascending: true},
+		{SortBy: SortByCrawledLinks, Ascending: false},
+		{SortBy: SortByCrawledLinks, Ascending: true, Filter: TaskFilter{TitleContains: "page"}},
+	} {
+		replayed.Cursor = first.NextCursor
+		if _, err = dao.QueryTasks(replayed); !errors.Is(err, ErrInvalidCursor) {
+			t.Fatalf("expected invalid cursor error for %+v, got %v", replayed, err)
+		}
+	}
+}
+
+func TestDeleteTask(t *testing.T) {
+	dao := CreateTaskInMemoryDao()
+
+	link, _ := url.Parse("http://example.com")
+	id, err := dao.StoreTask(CreateTaskInitial(scrape.StatusFinished, link, getSampleTime()))
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if err := dao.StoreLinkResult(id, &LinkResult{Link: *link, Status: 200}); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	if err := dao.DeleteTask(id); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if _, err := dao.RetrieveTaskById(id); err == nil {
+		t.Fatalf("expected error, got nil")
+	}
+	if _, err := dao.GetLinkResults(id); err == nil {
+		t.Fatalf("expected error, got nil")
+	}
+	if err := dao.DeleteTask(id); err == nil {
+		t.Fatalf("expected error, got nil")
+	}
+}
+
 func getSampleTime() time.Time {
 	parsedTime, err := time.Parse("2006-01-02 15:04:05", "2023-05-27 14:23:45")
 	if err != nil {
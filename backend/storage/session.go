@@ -0,0 +1,154 @@
+package storage
+
+import (
+	"errors"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ErrSessionChanged is returned when the refresh token of a session was replaced or the session was revoked since it
+// was read
+var ErrSessionChanged = errors.New("session was changed concurrently")
+
+// Session is a login of a user on one device. Its refresh token is replaced every time it is used - the tokens
+// replaced this way form a family, and are kept, so that reuse of a stolen token can be detected
+type Session struct {
+	Id               *int
+	Username         string
+	DeviceIdentifier string
+	UserAgent        string
+	IP               string
+	// Hash of the current refresh token
+	RefreshTokenHash string
+	// Hashes of the refresh tokens, which were already used
+	PreviousTokenHashes []string
+	ValidUntil          time.Time
+	CreatedAt           time.Time
+	LastSeenAt          time.Time
+	RevokedAt           *time.Time
+	// Access tokens issued in the session, which have not expired yet, so that they can be revoked with the session
+	AccessTokens []IssuedToken
+}
+
+// IssuedToken identifies an access token by its jti claim
+type IssuedToken struct {
+	Id        string
+	ExpiresAt time.Time
+}
+
+// IsActive checks whether the session can be used at the given time
+func (session *Session) IsActive(now time.Time) bool {
+	return session.RevokedAt == nil && now.Before(session.ValidUntil)
+}
+
+type SessionDao interface {
+	// StoreSession creates the session if it has no ID, otherwise updates it. Returns the ID of the session
+	StoreSession(session *Session) (int, error)
+	GetSession(id int) (*Session, error)
+	// RotateRefreshToken stores the session, whose refresh token was replaced, only if the refresh token with the
+	// previous hash is still the current one and the session is not revoked. Returns ErrSessionChanged otherwise
+	RotateRefreshToken(session *Session, previousHash string) error
+	// GetSessionByTokenHash returns the session, which the refresh token with the hash belongs to. The token might
+	// be either the current or a previous one
+	GetSessionByTokenHash(hash string) (*Session, error)
+	// GetSessions returns all sessions of the user sorted by ID
+	GetSessions(username string) []*Session
+}
+
+// InMemorySessionDao keeps sessions in memory. Sessions are lost on restart, so all users have to log in again
+type InMemorySessionDao struct {
+	mu       sync.Mutex
+	sessions map[int]Session
+	lastId   int
+}
+
+func CreateSessionInMemoryDao() *InMemorySessionDao {
+	return &InMemorySessionDao{
+		sessions: make(map[int]Session),
+	}
+}
+
+func (sessionStorage *InMemorySessionDao) StoreSession(session *Session) (int, error) {
+	sessionStorage.mu.Lock()
+	defer sessionStorage.mu.Unlock()
+
+	if session.Id != nil {
+		if _, exists := sessionStorage.sessions[*session.Id]; !exists {
+			return 0, errors.New("session with ID provided, but session does not exist")
+		}
+		sessionStorage.sessions[*session.Id] = cloneSession(session)
+		return *session.Id, nil
+	}
+	sessionStorage.lastId = sessionStorage.lastId + 1
+	newId := sessionStorage.lastId
+	session.Id = &newId
+	sessionStorage.sessions[newId] = cloneSession(session)
+	return newId, nil
+}
+
+func (sessionStorage *InMemorySessionDao) RotateRefreshToken(session *Session, previousHash string) error {
+	sessionStorage.mu.Lock()
+	defer sessionStorage.mu.Unlock()
+
+	stored, exists := sessionStorage.sessions[*session.Id]
+	if !exists {
+		return errors.New("session not found")
+	}
+	if stored.RefreshTokenHash != previousHash || stored.RevokedAt != nil {
+		return ErrSessionChanged
+	}
+	sessionStorage.sessions[*session.Id] = cloneSession(session)
+	return nil
+}
+
+func (sessionStorage *InMemorySessionDao) GetSession(id int) (*Session, error) {
+	sessionStorage.mu.Lock()
+	defer sessionStorage.mu.Unlock()
+
+	session, exists := sessionStorage.sessions[id]
+	if !exists {
+		return nil, errors.New("session not found")
+	}
+	session = cloneSession(&session)
+	return &session, nil
+}
+
+func (sessionStorage *InMemorySessionDao) GetSessionByTokenHash(hash string) (*Session, error) {
+	sessionStorage.mu.Lock()
+	defer sessionStorage.mu.Unlock()
+
+	for _, session := range sessionStorage.sessions {
+		if session.RefreshTokenHash == hash || slices.Contains(session.PreviousTokenHashes, hash) {
+			session = cloneSession(&session)
+			return &session, nil
+		}
+	}
+	return nil, errors.New("session not found")
+}
+
+func (sessionStorage *InMemorySessionDao) GetSessions(username string) []*Session {
+	sessionStorage.mu.Lock()
+	defer sessionStorage.mu.Unlock()
+
+	sessions := make([]*Session, 0)
+	for _, session := range sessionStorage.sessions {
+		if session.Username == username {
+			session = cloneSession(&session)
+			sessions = append(sessions, &session)
+		}
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return *sessions[i].Id < *sessions[j].Id
+	})
+	return sessions
+}
+
+// Copies the slices of the session, so that the stored session is not modified through the returned one
+func cloneSession(session *Session) Session {
+	clone := *session
+	clone.PreviousTokenHashes = slices.Clone(session.PreviousTokenHashes)
+	clone.AccessTokens = slices.Clone(session.AccessTokens)
+	return clone
+}
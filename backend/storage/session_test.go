@@ -0,0 +1,82 @@
+package storage
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestStoreAndRetrieveSession(t *testing.T) {
+	dao := CreateSessionInMemoryDao()
+	session := &Session{
+		Username:         "testuser",
+		RefreshTokenHash: "current",
+		ValidUntil:       time.Now().Add(time.Hour),
+	}
+
+	id, err := dao.StoreSession(session)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	session.PreviousTokenHashes = append(session.PreviousTokenHashes, "current")
+	session.RefreshTokenHash = "next"
+	_, err = dao.StoreSession(session)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	for _, hash := range []string{"current", "next"} {
+		retrieved, err := dao.GetSessionByTokenHash(hash)
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if *retrieved.Id != id {
+			t.Fatalf("expected session %v, got %v", id, *retrieved.Id)
+		}
+	}
+
+	_, err = dao.GetSessionByTokenHash("unknown")
+	if err == nil {
+		t.Fatalf("expected error, got nil")
+	}
+
+	if sessions := dao.GetSessions("testuser"); len(sessions) != 1 {
+		t.Fatalf("expected 1 session, got %v", len(sessions))
+	}
+	if sessions := dao.GetSessions("otheruser"); len(sessions) != 0 {
+		t.Fatalf("expected no sessions, got %v", len(sessions))
+	}
+}
+
+func TestRotateRefreshToken(t *testing.T) {
+	dao := CreateSessionInMemoryDao()
+	_, err := dao.StoreSession(&Session{Username: "testuser", RefreshTokenHash: "current"})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	// Two requests read the session with the same token, only the first one replaces it
+	first, _ := dao.GetSessionByTokenHash("current")
+	second, _ := dao.GetSessionByTokenHash("current")
+	first.RefreshTokenHash = "first"
+	if err = dao.RotateRefreshToken(first, "current"); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	second.RefreshTokenHash = "second"
+	if err = dao.RotateRefreshToken(second, "current"); !errors.Is(err, ErrSessionChanged) {
+		t.Fatalf("expected ErrSessionChanged, got %v", err)
+	}
+
+	// Revoked sessions are not rotated
+	now := time.Now()
+	first.RevokedAt = &now
+	if _, err = dao.StoreSession(first); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	first.RevokedAt = nil
+	first.RefreshTokenHash = "third"
+	if err = dao.RotateRefreshToken(first, "first"); !errors.Is(err, ErrSessionChanged) {
+		t.Fatalf("expected ErrSessionChanged, got %v", err)
+	}
+}
@@ -0,0 +1,201 @@
+package storage
+
+import (
+	"errors"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Events, which webhooks can be notified about
+const (
+	WebhookEventFinished    = "finished"
+	WebhookEventError       = "error"
+	WebhookEventInterrupted = "interrupted"
+	// Task finished with at least Webhook.BrokenLinksThreshold inaccessible links
+	WebhookEventBrokenLinks = "broken_links"
+)
+
+// MaxDeliveriesPerWebhook is the number of most recent deliveries kept in the delivery log of each webhook
+const MaxDeliveriesPerWebhook = 100
+
+// Webhook is a URL, which is notified when tasks of its owner reach a final state
+type Webhook struct {
+	Id    *int
+	Owner string
+	Url   string
+	// Key the payloads are signed with
+	Secret string
+	// Events the webhook is notified about
+	Events []string
+	// Minimal number of inaccessible links of a finished task, which triggers the broken links event
+	BrokenLinksThreshold int
+	// If set, the webhook is only notified about this task, and replaces the other webhooks of the task owner for it
+	TaskId    *int
+	CreatedAt time.Time
+}
+
+// WebhookDelivery is a single attempt to deliver an event to a webhook
+type WebhookDelivery struct {
+	Id        *int
+	WebhookId int
+	// Identifies the delivered event. All attempts to deliver the same event share it
+	EventId string
+	Event   string
+	TaskId  int
+	Attempt int
+	// HTTP status of the response. 0 if no response was received
+	StatusCode int
+	// Set if the attempt failed
+	Error     *string
+	Timestamp time.Time
+}
+
+// Succeeded checks whether the webhook accepted the delivery
+func (delivery *WebhookDelivery) Succeeded() bool {
+	return delivery.Error == nil
+}
+
+type WebhookDao interface {
+	// StoreWebhook creates the webhook if it has no ID, otherwise updates it. Returns the ID of the webhook
+	StoreWebhook(webhook *Webhook) (int, error)
+	GetWebhook(id int) (*Webhook, error)
+	// DeleteWebhook deletes the webhook along with its delivery log
+	DeleteWebhook(id int) error
+	// GetWebhooks returns all webhooks of the user, including the ones bound to tasks, sorted by ID
+	GetWebhooks(owner string) []*Webhook
+	// GetTaskWebhooks returns the webhooks bound to the task, sorted by ID
+	GetTaskWebhooks(taskId int) []*Webhook
+	// RecordDelivery adds the delivery to the log of its webhook. Only MaxDeliveriesPerWebhook most recent
+	// deliveries are kept
+	RecordDelivery(delivery *WebhookDelivery) error
+	// GetDeliveries returns the logged deliveries of the webhook, newest first
+	GetDeliveries(webhookId int) []*WebhookDelivery
+}
+
+// InMemoryWebhookDao keeps webhooks in memory. Registrations and delivery logs are lost on restart
+type InMemoryWebhookDao struct {
+	mu         sync.Mutex
+	webhooks   map[int]Webhook
+	deliveries map[int][]WebhookDelivery
+	lastId     int
+	// Deliveries of all webhooks share the ID sequence
+	lastDeliveryId int
+}
+
+func CreateWebhookInMemoryDao() *InMemoryWebhookDao {
+	return &InMemoryWebhookDao{
+		webhooks:   make(map[int]Webhook),
+		deliveries: make(map[int][]WebhookDelivery),
+	}
+}
+
+func (webhookStorage *InMemoryWebhookDao) StoreWebhook(webhook *Webhook) (int, error) {
+	webhookStorage.mu.Lock()
+	defer webhookStorage.mu.Unlock()
+
+	if webhook.Id != nil {
+		if _, exists := webhookStorage.webhooks[*webhook.Id]; !exists {
+			return 0, errors.New("webhook with ID provided, but webhook does not exist")
+		}
+		webhookStorage.webhooks[*webhook.Id] = cloneWebhook(webhook)
+		return *webhook.Id, nil
+	}
+	webhookStorage.lastId = webhookStorage.lastId + 1
+	newId := webhookStorage.lastId
+	webhook.Id = &newId
+	webhookStorage.webhooks[newId] = cloneWebhook(webhook)
+	return newId, nil
+}
+
+func (webhookStorage *InMemoryWebhookDao) GetWebhook(id int) (*Webhook, error) {
+	webhookStorage.mu.Lock()
+	defer webhookStorage.mu.Unlock()
+
+	webhook, exists := webhookStorage.webhooks[id]
+	if !exists {
+		return nil, errors.New("webhook not found")
+	}
+	webhook = cloneWebhook(&webhook)
+	return &webhook, nil
+}
+
+func (webhookStorage *InMemoryWebhookDao) DeleteWebhook(id int) error {
+	webhookStorage.mu.Lock()
+	defer webhookStorage.mu.Unlock()
+
+	if _, exists := webhookStorage.webhooks[id]; !exists {
+		return errors.New("webhook not found")
+	}
+	delete(webhookStorage.webhooks, id)
+	delete(webhookStorage.deliveries, id)
+	return nil
+}
+
+func (webhookStorage *InMemoryWebhookDao) GetWebhooks(owner string) []*Webhook {
+	return webhookStorage.findWebhooks(func(webhook *Webhook) bool {
+		return webhook.Owner == owner
+	})
+}
+
+func (webhookStorage *InMemoryWebhookDao) GetTaskWebhooks(taskId int) []*Webhook {
+	return webhookStorage.findWebhooks(func(webhook *Webhook) bool {
+		return webhook.TaskId != nil && *webhook.TaskId == taskId
+	})
+}
+
+func (webhookStorage *InMemoryWebhookDao) findWebhooks(matches func(webhook *Webhook) bool) []*Webhook {
+	webhookStorage.mu.Lock()
+	defer webhookStorage.mu.Unlock()
+
+	webhooks := make([]*Webhook, 0)
+	for _, webhook := range webhookStorage.webhooks {
+		if matches(&webhook) {
+			webhook = cloneWebhook(&webhook)
+			webhooks = append(webhooks, &webhook)
+		}
+	}
+	sort.Slice(webhooks, func(i, j int) bool {
+		return *webhooks[i].Id < *webhooks[j].Id
+	})
+	return webhooks
+}
+
+func (webhookStorage *InMemoryWebhookDao) RecordDelivery(delivery *WebhookDelivery) error {
+	webhookStorage.mu.Lock()
+	defer webhookStorage.mu.Unlock()
+
+	if _, exists := webhookStorage.webhooks[delivery.WebhookId]; !exists {
+		return errors.New("webhook not found")
+	}
+	webhookStorage.lastDeliveryId = webhookStorage.lastDeliveryId + 1
+	newId := webhookStorage.lastDeliveryId
+	delivery.Id = &newId
+	deliveries := append(webhookStorage.deliveries[delivery.WebhookId], *delivery)
+	if len(deliveries) > MaxDeliveriesPerWebhook {
+		deliveries = deliveries[len(deliveries)-MaxDeliveriesPerWebhook:]
+	}
+	webhookStorage.deliveries[delivery.WebhookId] = deliveries
+	return nil
+}
+
+func (webhookStorage *InMemoryWebhookDao) GetDeliveries(webhookId int) []*WebhookDelivery {
+	webhookStorage.mu.Lock()
+	defer webhookStorage.mu.Unlock()
+
+	logged := webhookStorage.deliveries[webhookId]
+	deliveries := make([]*WebhookDelivery, len(logged))
+	for i := range logged {
+		delivery := logged[len(logged)-1-i]
+		deliveries[i] = &delivery
+	}
+	return deliveries
+}
+
+// Copies the events of the webhook, so that the stored webhook is not modified through the returned one
+func cloneWebhook(webhook *Webhook) Webhook {
+	clone := *webhook
+	clone.Events = slices.Clone(webhook.Events)
+	return clone
+}
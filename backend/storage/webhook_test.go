@@ -0,0 +1,77 @@
+package storage
+
+import (
+	"testing"
+)
+
+func TestStoreAndRetrieveWebhooks(t *testing.T) {
+	dao := CreateWebhookInMemoryDao()
+	taskId := 7
+	general := &Webhook{Owner: "testuser", Url: "http://example.com/general", Events: []string{WebhookEventFinished}}
+	bound := &Webhook{Owner: "testuser", Url: "http://example.com/bound", TaskId: &taskId}
+
+	for _, webhook := range []*Webhook{general, bound} {
+		if _, err := dao.StoreWebhook(webhook); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+	}
+
+	retrieved, err := dao.GetWebhook(*general.Id)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	retrieved.Events[0] = WebhookEventError
+	if retrieved, _ = dao.GetWebhook(*general.Id); retrieved.Events[0] != WebhookEventFinished {
+		t.Fatalf("stored webhook was modified through the retrieved one")
+	}
+
+	if webhooks := dao.GetWebhooks("testuser"); len(webhooks) != 2 || *webhooks[0].Id != *general.Id {
+		t.Fatalf("expected both webhooks sorted by ID, got %v", webhooks)
+	}
+	if webhooks := dao.GetTaskWebhooks(taskId); len(webhooks) != 1 || *webhooks[0].Id != *bound.Id {
+		t.Fatalf("expected only the bound webhook, got %v", webhooks)
+	}
+	if webhooks := dao.GetTaskWebhooks(taskId + 1); len(webhooks) != 0 {
+		t.Fatalf("expected no webhooks, got %v", len(webhooks))
+	}
+
+	if err = dao.DeleteWebhook(*general.Id); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if _, err = dao.GetWebhook(*general.Id); err == nil {
+		t.Fatalf("expected error, got nil")
+	}
+}
+
+func TestRecordWebhookDeliveries(t *testing.T) {
+	dao := CreateWebhookInMemoryDao()
+	webhook := &Webhook{Owner: "testuser", Url: "http://example.com"}
+	id, err := dao.StoreWebhook(webhook)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	for attempt := 1; attempt <= MaxDeliveriesPerWebhook+5; attempt++ {
+		if err = dao.RecordDelivery(&WebhookDelivery{WebhookId: id, Attempt: attempt}); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+	}
+	deliveries := dao.GetDeliveries(id)
+	if len(deliveries) != MaxDeliveriesPerWebhook {
+		t.Fatalf("expected %v deliveries, got %v", MaxDeliveriesPerWebhook, len(deliveries))
+	}
+	if deliveries[0].Attempt != MaxDeliveriesPerWebhook+5 {
+		t.Fatalf("expected newest delivery first, got attempt %v", deliveries[0].Attempt)
+	}
+
+	if err = dao.RecordDelivery(&WebhookDelivery{WebhookId: id + 1}); err == nil {
+		t.Fatalf("expected error for unknown webhook, got nil")
+	}
+
+	if err = dao.DeleteWebhook(id); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if deliveries = dao.GetDeliveries(id); len(deliveries) != 0 {
+		t.Fatalf("expected delivery log to be deleted, got %v deliveries", len(deliveries))
+	}
+}
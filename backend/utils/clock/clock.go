@@ -0,0 +1,103 @@
+package clock
+
+import (
+	"slices"
+	"sync"
+	"time"
+)
+
+// Clock provides the current time, so that time-dependent logic can be tested without waiting
+type Clock interface {
+	Now() time.Time
+	// AfterFunc calls f in its own goroutine once the duration has passed
+	AfterFunc(duration time.Duration, f func()) Timer
+}
+
+// Timer is a call scheduled with AfterFunc
+type Timer interface {
+	// Stop prevents the call. Returns false if it was already made or stopped
+	Stop() bool
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) AfterFunc(duration time.Duration, f func()) Timer {
+	return time.AfterFunc(duration, f)
+}
+
+// Real is the clock backed by the system time
+var Real Clock = realClock{}
+
+// FakeClock is a clock, which only moves when it is advanced
+type FakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+}
+
+type fakeTimer struct {
+	clock *FakeClock
+	at    time.Time
+	f     func()
+}
+
+func CreateFakeClock(now time.Time) *FakeClock {
+	return &FakeClock{now: now}
+}
+
+func (clock *FakeClock) Now() time.Time {
+	clock.mu.Lock()
+	defer clock.mu.Unlock()
+	return clock.now
+}
+
+// AfterFunc schedules f, which is called by Advance, once the clock is advanced past the duration. Unlike with the real
+// clock, f is called in the goroutine advancing the clock
+func (clock *FakeClock) AfterFunc(duration time.Duration, f func()) Timer {
+	clock.mu.Lock()
+	defer clock.mu.Unlock()
+	timer := &fakeTimer{clock: clock, at: clock.now.Add(duration), f: f}
+	clock.timers = append(clock.timers, timer)
+	return timer
+}
+
+// Advance moves the clock forward by the duration, and calls the functions, which became due, in the order they are due
+func (clock *FakeClock) Advance(duration time.Duration) {
+	clock.mu.Lock()
+	clock.now = clock.now.Add(duration)
+	var due []*fakeTimer
+	pending := clock.timers[:0]
+	for _, timer := range clock.timers {
+		if timer.at.After(clock.now) {
+			pending = append(pending, timer)
+		} else {
+			due = append(due, timer)
+		}
+	}
+	clock.timers = pending
+	clock.mu.Unlock()
+
+	slices.SortStableFunc(due, func(a, b *fakeTimer) int {
+		return a.at.Compare(b.at)
+	})
+	for _, timer := range due {
+		timer.f()
+	}
+}
+
+func (timer *fakeTimer) Stop() bool {
+	clock := timer.clock
+	clock.mu.Lock()
+	defer clock.mu.Unlock()
+	for i, scheduled := range clock.timers {
+		if scheduled == timer {
+			clock.timers = slices.Delete(clock.timers, i, i+1)
+			return true
+		}
+	}
+	return false
+}
@@ -3,13 +3,30 @@ package event
 import (
 	"fmt"
 	"sync"
+	"sync/atomic"
 )
 
 // StateBroker Holds a registry of state broadcasters (see stateBroadcaster.go) and associates them
-// with corresponding topics. A topic can be any datatype, as long as it is comparable
+// with corresponding topics. A topic can be any datatype, as long as it is comparable. Event IDs are unique across all
+// broadcasters of the broker, so they keep increasing when a broadcaster is recreated for the same topic
 type StateBroker[Topic comparable, Data any] struct {
 	broadcasters map[Topic]*StateBroadcaster[Data]
 	mu           sync.Mutex
+	sequence     atomic.Uint64
+	// Applied to broadcasters added later
+	throttle Throttle[Data]
+
+	metrics Metrics
+
+	// Subscribers of all topics (see ListenAll)
+	wildcardSubscribers []*subscriberQueue[TopicEvent[Topic, Data]]
+	wildcardMu          sync.RWMutex
+}
+
+// TopicEvent is an event published by the broadcaster of the topic
+type TopicEvent[Topic comparable, Data any] struct {
+	Topic Topic
+	Event[Data]
 }
 
 func CreateStateBroker[Topic comparable, Data any]() *StateBroker[Topic, Data] {
@@ -19,13 +36,23 @@ func CreateStateBroker[Topic comparable, Data any]() *StateBroker[Topic, Data] {
 	}
 }
 
+// SetThrottle limits how often the states published by broadcasters added afterwards are delivered
+func (broker *StateBroker[Topic, Data]) SetThrottle(throttle Throttle[Data]) {
+	broker.mu.Lock()
+	defer broker.mu.Unlock()
+	broker.throttle = throttle
+}
+
 func (broker *StateBroker[Topic, Data]) AddStateBroadcaster(topic Topic) (*StateBroadcaster[Data], error) {
 	broker.mu.Lock()
 	defer broker.mu.Unlock()
 	if _, exists := broker.broadcasters[topic]; exists {
 		return nil, fmt.Errorf("state broadcaster already exists for given topic: %v", topic)
 	} else {
-		broadcaster := CreateStateBroadcaster[Data]()
+		broadcaster := createStateBroadcaster[Data](&broker.sequence, &broker.metrics, func(event Event[Data]) {
+			broker.notifyWildcardSubscribers(topic, event)
+		})
+		broadcaster.SetThrottle(broker.throttle)
 		broker.broadcasters[topic] = broadcaster
 		return broadcaster, nil
 	}
@@ -51,3 +78,43 @@ func (broker *StateBroker[Topic, Data]) DeleteStateBroadcaster(topic Topic) erro
 	}
 	return nil
 }
+
+// Metrics of the events not delivered to slow subscribers of all broadcasters of the broker
+func (broker *StateBroker[Topic, Data]) Metrics() *Metrics {
+	return &broker.metrics
+}
+
+// ListenAll starts listening for the events of all topics, including the initial states of broadcasters started later.
+// Unlike Listen of a broadcaster, current states are not sent. Caller must write to or close the done channel when
+// the events are no longer needed. Data channel is closed afterwards, or when the subscriber is disconnected by the
+// policy. LastEventId of the options is not used
+func (broker *StateBroker[Topic, Data]) ListenAll(options ListenOptions) (data <-chan TopicEvent[Topic, Data], done chan<- struct{}) {
+	subscriber := createSubscriberQueue[TopicEvent[Topic, Data]](options, &broker.metrics,
+		func(event TopicEvent[Topic, Data]) any { return event.Topic })
+	broker.wildcardMu.Lock()
+	broker.wildcardSubscribers = append(broker.wildcardSubscribers, subscriber)
+	broker.wildcardMu.Unlock()
+
+	doneCh := make(chan struct{})
+	go func() {
+		<-doneCh
+		subscriber.cancel()
+		broker.wildcardMu.Lock()
+		defer broker.wildcardMu.Unlock()
+		for i, sub := range broker.wildcardSubscribers {
+			if sub == subscriber {
+				broker.wildcardSubscribers = append(broker.wildcardSubscribers[:i], broker.wildcardSubscribers[i+1:]...)
+				break
+			}
+		}
+	}()
+	return subscriber.data, doneCh
+}
+
+func (broker *StateBroker[Topic, Data]) notifyWildcardSubscribers(topic Topic, event Event[Data]) {
+	broker.wildcardMu.RLock()
+	defer broker.wildcardMu.RUnlock()
+	for _, subscriber := range broker.wildcardSubscribers {
+		subscriber.push(TopicEvent[Topic, Data]{Topic: topic, Event: event})
+	}
+}
@@ -0,0 +1,81 @@
+package event
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStateBroker_ListenAll(t *testing.T) {
+	broker := CreateStateBroker[int, State]()
+	dataCh, doneCh := broker.ListenAll(ListenOptions{})
+
+	first, err := broker.AddStateBroadcaster(1)
+	assert.NoError(t, err)
+	first.Start(State{Value: 1})
+	defer first.End()
+	second, err := broker.AddStateBroadcaster(2)
+	assert.NoError(t, err)
+	second.Start(State{Value: 10})
+	defer second.End()
+	first.Publish(State{Value: 2})
+
+	received := make(map[int][]State)
+	for range 3 {
+		select {
+		case event := <-dataCh:
+			received[event.Topic] = append(received[event.Topic], event.State)
+		case <-time.After(time.Second):
+			t.Fatal("timeout waiting for event")
+		}
+	}
+	assert.Equal(t, []State{{Value: 1}, {Value: 2}}, received[1])
+	assert.Equal(t, []State{{Value: 10}}, received[2])
+
+	close(doneCh)
+	select {
+	case _, ok := <-dataCh:
+		assert.False(t, ok, "data channel should be closed")
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for data channel to close")
+	}
+
+	// Publishing does not block once the subscriber is gone
+	for i := range HistorySize + 1 {
+		second.Publish(State{Value: i})
+	}
+}
+
+func TestStateBroker_ListenAllDisconnectsStuckSubscriber(t *testing.T) {
+	broker := CreateStateBroker[int, State]()
+	dataCh, doneCh := broker.ListenAll(ListenOptions{Policy: Disconnect})
+	defer close(doneCh)
+
+	broadcaster, err := broker.AddStateBroadcaster(1)
+	assert.NoError(t, err)
+	broadcaster.Start(State{Value: 0})
+	defer broadcaster.End()
+
+	published := make(chan struct{})
+	go func() {
+		for i := range 2 * HistorySize {
+			broadcaster.Publish(State{Value: i})
+		}
+		close(published)
+	}()
+	select {
+	case <-published:
+	case <-time.After(5 * time.Second):
+		t.Fatal("publishing is blocked by the stuck subscriber")
+	}
+
+	// Queued events are dropped along with the subscriber
+	select {
+	case _, ok := <-dataCh:
+		assert.False(t, ok, "data channel should be closed")
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for data channel to close")
+	}
+	assert.Equal(t, uint64(1), broker.Metrics().DisconnectedSubscribers())
+}
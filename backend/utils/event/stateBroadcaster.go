@@ -2,67 +2,183 @@ package event
 
 import (
 	"github.com/barkimedes/go-deepcopy"
+	"github.com/martynasd123/golang-scraper/utils/clock"
 	"log"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
+// HistorySize is the number of the most recent events a broadcaster keeps for replaying to reconnecting subscribers
+const HistorySize = 100
+
+// Event is a state published by the broadcaster. IDs are increasing in the order the states were published
+type Event[T any] struct {
+	Id    uint64
+	State T
+}
+
+// Throttle limits how often published states are delivered to subscribers, coalescing bursts of updates
+type Throttle[T any] struct {
+	// Minimum time between delivered states. States published sooner are held back - only the latest of them is
+	// delivered, once the interval has passed. 0 delivers every state
+	Interval time.Duration
+	// Returns true for states, which must be delivered regardless of the interval, e.g. status changes. Optional
+	Urgent func(previous, next *T) bool
+	// Clock used to measure the interval. Real clock is used if not set
+	Clock clock.Clock
+}
+
+func (throttle *Throttle[T]) now() time.Time {
+	return throttle.clock().Now()
+}
+
+func (throttle *Throttle[T]) clock() clock.Clock {
+	if throttle.Clock == nil {
+		return clock.Real
+	}
+	return throttle.Clock
+}
+
 type Subscriber[T any] struct {
-	Data chan T
-	Done chan struct{}
+	queue   *subscriberQueue[Event[T]]
+	Done    chan struct{}
+	options ListenOptions
 }
 
 // StateBroadcaster is a type of broadcaster, where the latest update value is remembered. When a subscriber is registered,
-// the latest value is sent. A deep copy of the data is always made to ensure no concurrent modification+read
+// the latest value is sent. A deep copy of the data is always made to ensure no concurrent modification+read.
+// Each subscriber receives the events through its own queue, so a subscriber, which stopped receiving, does not delay
+// the others or the publisher (see SlowSubscriberPolicy)
 type StateBroadcaster[T any] struct {
-	subscribers      []Subscriber[T]
-	addSubscriber    chan Subscriber[T]
-	removeSubscriber chan Subscriber[T]
-	publisher        chan T
+	subscribers      []*Subscriber[T]
+	addSubscriber    chan *Subscriber[T]
+	removeSubscriber chan *Subscriber[T]
 	stateUpdates     chan T
-	newestState      T
+	// Closed once the broadcaster has ended
+	ended chan struct{}
+	// Most recent events, oldest first. The last one is the newest state
+	history []Event[T]
+	// ID of the newest event, which was dropped from the history. 0 if the history is complete
+	droppedEventId uint64
+	sequence       *atomic.Uint64
+	metrics        *Metrics
+	// Called with every published event, including the initial state
+	onPublish func(Event[T])
+
+	throttle Throttle[T]
+	// Guards the fields below, which are used by publishers rather than the broadcaster goroutine
+	publishMu sync.Mutex
+	// Copy of the last delivered state and the time it was published at
+	lastPublished T
+	lastPublishAt time.Time
+	// Copy of the latest state held back by the throttle, and the timer delivering it. Nil if there is none
+	heldBack   *T
+	flushTimer clock.Timer
+	// Set once End is called, so that held back states are no longer delivered
+	publishEnded bool
 }
 
 func CreateStateBroadcaster[T any]() *StateBroadcaster[T] {
+	return createStateBroadcaster[T](&atomic.Uint64{}, &Metrics{}, func(Event[T]) {})
+}
+
+// Event IDs are taken from the sequence, so that broadcasters sharing it never reuse IDs of each other
+func createStateBroadcaster[T any](
+	sequence *atomic.Uint64,
+	metrics *Metrics,
+	onPublish func(Event[T]),
+) *StateBroadcaster[T] {
 	return &StateBroadcaster[T]{
-		subscribers:      make([]Subscriber[T], 0),
-		addSubscriber:    make(chan Subscriber[T]),
-		removeSubscriber: make(chan Subscriber[T]),
-		publisher:        make(chan T),
+		subscribers:      make([]*Subscriber[T], 0),
+		addSubscriber:    make(chan *Subscriber[T]),
+		removeSubscriber: make(chan *Subscriber[T]),
 		stateUpdates:     make(chan T, 10),
-		newestState:      *new(T),
+		ended:            make(chan struct{}),
+		history:          make([]Event[T], 0, HistorySize),
+		sequence:         sequence,
+		metrics:          metrics,
+		onPublish:        onPublish,
 	}
 }
 
+// Metrics of the events not delivered to slow subscribers
+func (broadcaster *StateBroadcaster[T]) Metrics() *Metrics {
+	return broadcaster.metrics
+}
+
+func (broadcaster *StateBroadcaster[T]) newestEvent() Event[T] {
+	return broadcaster.history[len(broadcaster.history)-1]
+}
+
+func (broadcaster *StateBroadcaster[T]) record(state T) {
+	if len(broadcaster.history) == HistorySize {
+		broadcaster.droppedEventId = broadcaster.history[0].Id
+		broadcaster.history = append(broadcaster.history[:0], broadcaster.history[1:]...)
+	}
+	event := Event[T]{Id: broadcaster.sequence.Add(1), State: state}
+	broadcaster.history = append(broadcaster.history, event)
+	broadcaster.onPublish(event)
+}
+
+// missedEvents returns the events published after the given one. If some of them are no longer in the history, or
+// the event is unknown, only the newest event is returned
+func (broadcaster *StateBroadcaster[T]) missedEvents(lastEventId uint64) []Event[T] {
+	newest := broadcaster.newestEvent()
+	if lastEventId == 0 || lastEventId < broadcaster.droppedEventId || lastEventId > newest.Id {
+		return []Event[T]{newest}
+	}
+	for i, event := range broadcaster.history {
+		if event.Id > lastEventId {
+			return broadcaster.history[i:]
+		}
+	}
+	return nil
+}
+
 func (broadcaster *StateBroadcaster[T]) notifyListeners() {
 	for _, subscriber := range broadcaster.subscribers {
-		subscriber.Data <- broadcaster.newestState
+		subscriber.queue.push(broadcaster.newestEvent())
 	}
 }
 
+// closeListeners closes the subscriptions once the events queued for them are delivered
 func (broadcaster *StateBroadcaster[T]) closeListeners() {
 	for _, subscriber := range broadcaster.subscribers {
-		close(subscriber.Data)
+		subscriber.queue.finish()
 	}
+	close(broadcaster.ended)
 }
 
-func (broadcaster *StateBroadcaster[T]) closeListener(subscriber Subscriber[T]) {
+func (broadcaster *StateBroadcaster[T]) closeListener(subscriber *Subscriber[T]) {
 	for i, sub := range broadcaster.subscribers {
 		if sub == subscriber {
-			close(subscriber.Data)
+			subscriber.queue.cancel()
 			broadcaster.subscribers = append(broadcaster.subscribers[:i], broadcaster.subscribers[i+1:]...)
+			return
 		}
 	}
 }
 
+// SetThrottle limits how often the published states are delivered. Must be called before the broadcaster is started
+func (broadcaster *StateBroadcaster[T]) SetThrottle(throttle Throttle[T]) {
+	broadcaster.throttle = throttle
+}
+
 // Start function starts the broadcaster. It is the responsibility of the caller to call End when function
 // is not needed anymore
 func (broadcaster *StateBroadcaster[T]) Start(data T) {
-	broadcaster.newestState = data
+	broadcaster.lastPublished = data
+	broadcaster.lastPublishAt = broadcaster.throttle.now()
+	broadcaster.record(data)
 	go func() {
 		defer broadcaster.closeListeners()
 		for {
 			select {
 			case subscriber := <-broadcaster.addSubscriber:
-				subscriber.Data <- broadcaster.newestState
+				for _, event := range broadcaster.missedEvents(subscriber.options.LastEventId) {
+					subscriber.queue.push(event)
+				}
 				broadcaster.subscribers = append(broadcaster.subscribers, subscriber)
 			case subscriber := <-broadcaster.removeSubscriber:
 				broadcaster.closeListener(subscriber)
@@ -70,11 +186,7 @@ func (broadcaster *StateBroadcaster[T]) Start(data T) {
 				if !ok {
 					return
 				}
-				updateCopy, err := deepcopy.Anything(update)
-				if err != nil {
-					log.Fatalf("failed to copy state: %v", err)
-				}
-				broadcaster.newestState = updateCopy.(T)
+				broadcaster.record(update)
 				broadcaster.notifyListeners()
 			}
 		}
@@ -86,31 +198,116 @@ func (broadcaster *StateBroadcaster[T]) Start(data T) {
 // to ensure that the done channel is closed after it is no longer needed.
 // Returns:
 //
-//	data (<-chan T): The channel through which data is to be sent
+//	data (<-chan Event[T]): The channel through which data is to be sent
 //	done (chan<- struct{}): Channel through which to send signal when updates are no longer needed
-func (broadcaster *StateBroadcaster[T]) Listen() (data <-chan T, done chan<- struct{}) {
-	subscriber := Subscriber[T]{Data: make(chan T, 1), Done: make(chan struct{})}
+func (broadcaster *StateBroadcaster[T]) Listen() (data <-chan Event[T], done chan<- struct{}) {
+	return broadcaster.ListenFrom(0)
+}
+
+// ListenFrom works like Listen, but instead of the latest state, first sends all events published after the event
+// with the given ID. If some of them are no longer remembered, only the latest state is sent
+func (broadcaster *StateBroadcaster[T]) ListenFrom(lastEventId uint64) (data <-chan Event[T], done chan<- struct{}) {
+	return broadcaster.ListenWith(ListenOptions{LastEventId: lastEventId})
+}
+
+// ListenWith works like ListenFrom, with the given policy for handling the subscriber, if it does not keep up with
+// the published states
+func (broadcaster *StateBroadcaster[T]) ListenWith(options ListenOptions) (data <-chan Event[T], done chan<- struct{}) {
+	subscriber := &Subscriber[T]{
+		queue:   createSubscriberQueue[Event[T]](options, broadcaster.metrics, nil),
+		Done:    make(chan struct{}),
+		options: options,
+	}
+	select {
+	case broadcaster.addSubscriber <- subscriber:
+	case <-broadcaster.ended:
+		subscriber.queue.finish()
+		return subscriber.queue.data, subscriber.Done
+	}
 	go func() {
+		// Subscriber unsubscribed from updates, unless the broadcaster has been closed already
+		<-subscriber.Done
 		select {
-		case _, ok := <-subscriber.Done:
-			if ok {
-				// Subscriber unsubscribed from updates
-				broadcaster.removeSubscriber <- subscriber
-			} else {
-				// Broadcaster has been closed
-			}
+		case broadcaster.removeSubscriber <- subscriber:
+		case <-broadcaster.ended:
 		}
 	}()
-	broadcaster.addSubscriber <- subscriber
-	return subscriber.Data, subscriber.Done
+	return subscriber.queue.data, subscriber.Done
 }
 
-// End the broadcaster. This unregisters all listeners and closes relevant channels.
+// End the broadcaster. This unregisters all listeners and closes relevant channels. A state held back by the throttle
+// is delivered first
 func (broadcaster *StateBroadcaster[T]) End() {
+	broadcaster.publishMu.Lock()
+	defer broadcaster.publishMu.Unlock()
+	broadcaster.deliverHeldBack()
+	broadcaster.publishEnded = true
 	close(broadcaster.stateUpdates)
 }
 
-// Publish data to the channel
+// FinalEventId waits for the broadcaster to end and returns the ID of the last event it published
+func (broadcaster *StateBroadcaster[T]) FinalEventId() uint64 {
+	<-broadcaster.ended
+	return broadcaster.newestEvent().Id
+}
+
+// Publish data to the channel. If the broadcaster is throttled, the data is held back when the previous state was
+// published less than the interval ago, unless the data is urgent. The latest held back state is delivered once the
+// interval has passed. The copy is made before returning, so the caller is free to modify the data afterwards
 func (broadcaster *StateBroadcaster[T]) Publish(data T) {
-	broadcaster.stateUpdates <- data
+	broadcaster.publishMu.Lock()
+	defer broadcaster.publishMu.Unlock()
+	now := broadcaster.throttle.now()
+	throttled := now.Sub(broadcaster.lastPublishAt) < broadcaster.throttle.Interval &&
+		(broadcaster.throttle.Urgent == nil || !broadcaster.throttle.Urgent(&broadcaster.lastPublished, &data))
+	dataCopy := copyState(data)
+	if throttled {
+		broadcaster.heldBack = &dataCopy
+		if broadcaster.flushTimer == nil {
+			wait := broadcaster.lastPublishAt.Add(broadcaster.throttle.Interval).Sub(now)
+			broadcaster.flushTimer = broadcaster.throttle.clock().AfterFunc(wait, broadcaster.flush)
+		}
+		return
+	}
+	// The held back state is older than the data
+	broadcaster.heldBack = nil
+	broadcaster.deliver(dataCopy, now)
+}
+
+// Delivers the held back state, once the interval has passed
+func (broadcaster *StateBroadcaster[T]) flush() {
+	broadcaster.publishMu.Lock()
+	defer broadcaster.publishMu.Unlock()
+	broadcaster.flushTimer = nil
+	if !broadcaster.publishEnded {
+		broadcaster.deliverHeldBack()
+	}
+}
+
+// Must be called while holding publishMu
+func (broadcaster *StateBroadcaster[T]) deliverHeldBack() {
+	if broadcaster.heldBack != nil {
+		state := *broadcaster.heldBack
+		broadcaster.heldBack = nil
+		broadcaster.deliver(state, broadcaster.throttle.now())
+	}
+}
+
+// Must be called while holding publishMu
+func (broadcaster *StateBroadcaster[T]) deliver(state T, now time.Time) {
+	if broadcaster.flushTimer != nil {
+		broadcaster.flushTimer.Stop()
+		broadcaster.flushTimer = nil
+	}
+	broadcaster.lastPublished = state
+	broadcaster.lastPublishAt = now
+	broadcaster.stateUpdates <- state
+}
+
+func copyState[T any](data T) T {
+	dataCopy, err := deepcopy.Anything(data)
+	if err != nil {
+		log.Fatalf("failed to copy state: %v", err)
+	}
+	return dataCopy.(T)
 }
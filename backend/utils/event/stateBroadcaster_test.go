@@ -1,10 +1,13 @@
 package event
 
 import (
+	"fmt"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
+
+	"github.com/martynasd123/golang-scraper/utils/clock"
 )
 
 type State struct {
@@ -21,7 +24,7 @@ func TestStateBroadcaster_InitialStateSentToSubscriber(t *testing.T) {
 
 	select {
 	case state := <-dataCh:
-		assert.Equal(t, initialState, state)
+		assert.Equal(t, initialState, state.State)
 	case <-time.After(time.Second):
 		t.Fatal("timeout waiting for initial state")
 	}
@@ -46,14 +49,14 @@ func TestStateBroadcaster_UpdatesSentToSubscribers(t *testing.T) {
 
 	select {
 	case state := <-dataCh1:
-		assert.Equal(t, updatedState, state)
+		assert.Equal(t, updatedState, state.State)
 	case <-time.After(1 * time.Second):
 		t.Fatal("timeout waiting for updated state")
 	}
 
 	select {
 	case state := <-dataCh2:
-		assert.Equal(t, updatedState, state)
+		assert.Equal(t, updatedState, state.State)
 	case <-time.After(1 * time.Second):
 		t.Fatal("timeout waiting for updated state")
 	}
@@ -117,3 +120,288 @@ func TestStateBroadcaster_EndClosesAllChannels(t *testing.T) {
 	close(doneCh1)
 	close(doneCh2)
 }
+
+func TestStateBroadcaster_FinalEventId(t *testing.T) {
+	broadcaster := CreateStateBroadcaster[State]()
+	broadcaster.Start(State{Value: 1})
+
+	dataCh, doneCh := broadcaster.Listen()
+	<-dataCh
+	broadcaster.Publish(State{Value: 2})
+	last := <-dataCh
+	close(doneCh)
+	broadcaster.End()
+
+	assert.Equal(t, last.Id, broadcaster.FinalEventId())
+}
+
+func TestStateBroadcaster_EventIdsIncrease(t *testing.T) {
+	broker := CreateStateBroker[int, State]()
+	broadcaster, err := broker.AddStateBroadcaster(1)
+	assert.NoError(t, err)
+	broadcaster.Start(State{Value: 1})
+
+	dataCh, doneCh := broadcaster.Listen()
+	first := <-dataCh
+	broadcaster.Publish(State{Value: 2})
+	second := <-dataCh
+	assert.Greater(t, second.Id, first.Id)
+	close(doneCh)
+	broadcaster.End()
+	assert.NoError(t, broker.DeleteStateBroadcaster(1))
+
+	// Broadcaster recreated for the same topic continues the sequence
+	broadcaster, err = broker.AddStateBroadcaster(1)
+	assert.NoError(t, err)
+	broadcaster.Start(State{Value: 3})
+	defer broadcaster.End()
+	dataCh, doneCh = broadcaster.Listen()
+	assert.Greater(t, (<-dataCh).Id, second.Id)
+	close(doneCh)
+}
+
+func TestStateBroadcaster_ListenFromReplaysMissedEvents(t *testing.T) {
+	broadcaster := CreateStateBroadcaster[State]()
+	broadcaster.Start(State{Value: 0})
+	defer broadcaster.End()
+
+	dataCh, doneCh := broadcaster.Listen()
+	seen := <-dataCh
+	for i := 1; i <= 3; i++ {
+		broadcaster.Publish(State{Value: i})
+		event := <-dataCh
+		if i == 1 {
+			seen = event
+		}
+	}
+	close(doneCh)
+
+	// Events published after the last seen one are replayed in order
+	dataCh, doneCh = broadcaster.ListenFrom(seen.Id)
+	for i := 2; i <= 3; i++ {
+		select {
+		case event := <-dataCh:
+			assert.Equal(t, State{Value: i}, event.State)
+		case <-time.After(time.Second):
+			t.Fatal("timeout waiting for replayed state")
+		}
+	}
+	broadcaster.Publish(State{Value: 4})
+	assert.Equal(t, State{Value: 4}, (<-dataCh).State)
+	close(doneCh)
+
+	// Unknown events fall back to the latest state
+	dataCh, doneCh = broadcaster.ListenFrom(seen.Id + 1000)
+	assert.Equal(t, State{Value: 4}, (<-dataCh).State)
+	close(doneCh)
+}
+
+func TestStateBroadcaster_ListenFromEvictedEvent(t *testing.T) {
+	broadcaster := CreateStateBroadcaster[State]()
+	broadcaster.Start(State{Value: 0})
+	defer broadcaster.End()
+
+	dataCh, doneCh := broadcaster.Listen()
+	first := <-dataCh
+	for i := 1; i <= HistorySize+1; i++ {
+		broadcaster.Publish(State{Value: i})
+		<-dataCh
+	}
+	close(doneCh)
+
+	// The events following the first one are no longer all remembered, so only the latest state is sent
+	dataCh, doneCh = broadcaster.ListenFrom(first.Id)
+	assert.Equal(t, State{Value: HistorySize + 1}, (<-dataCh).State)
+	select {
+	case event := <-dataCh:
+		t.Fatalf("unexpected event %v", event)
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(doneCh)
+}
+
+func TestStateBroadcaster_Throttle(t *testing.T) {
+	fakeClock := clock.CreateFakeClock(time.Now())
+	broadcaster := CreateStateBroadcaster[State]()
+	broadcaster.SetThrottle(Throttle[State]{
+		Interval: time.Second,
+		Urgent: func(previous, next *State) bool {
+			return next.Value < 0
+		},
+		Clock: fakeClock,
+	})
+	broadcaster.Start(State{Value: 0})
+
+	dataCh, doneCh := broadcaster.Listen()
+	<-dataCh
+
+	// Published too soon
+	broadcaster.Publish(State{Value: 1})
+	// Urgent states are sent regardless
+	broadcaster.Publish(State{Value: -1})
+	assert.Equal(t, State{Value: -1}, (<-dataCh).State)
+
+	fakeClock.Advance(time.Second)
+	broadcaster.Publish(State{Value: 2})
+	broadcaster.Publish(State{Value: 3})
+	broadcaster.Publish(State{Value: 4})
+	assert.Equal(t, State{Value: 2}, (<-dataCh).State)
+	select {
+	case event := <-dataCh:
+		t.Fatalf("unexpected event %v", event)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// The latest held back state is delivered once the interval has passed
+	fakeClock.Advance(time.Second)
+	assert.Equal(t, State{Value: 4}, (<-dataCh).State)
+
+	// Held back states are delivered before the broadcaster ends as well
+	broadcaster.Publish(State{Value: 5})
+	broadcaster.End()
+	assert.Equal(t, State{Value: 5}, (<-dataCh).State)
+	_, ok := <-dataCh
+	assert.False(t, ok)
+	close(doneCh)
+}
+
+// Resembles a task of a page with many links
+type largeState struct {
+	Status  string
+	Crawled int
+	Links   []string
+	Title   *string
+}
+
+func createLargeState() largeState {
+	title := "Example"
+	state := largeState{Status: "TRYING_LINKS", Title: &title}
+	for i := range 1000 {
+		state.Links = append(state.Links, fmt.Sprintf("https://example.com/page/%d", i))
+	}
+	return state
+}
+
+func benchmarkPublish(b *testing.B, throttle Throttle[largeState]) {
+	broadcaster := CreateStateBroadcaster[largeState]()
+	broadcaster.SetThrottle(throttle)
+	state := createLargeState()
+	broadcaster.Start(state)
+	defer broadcaster.End()
+	dataCh, doneCh := broadcaster.Listen()
+	defer close(doneCh)
+	go func() {
+		for range dataCh {
+		}
+	}()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := range b.N {
+		state.Crawled = i
+		broadcaster.Publish(state)
+	}
+}
+
+func BenchmarkStateBroadcaster_Publish(b *testing.B) {
+	benchmarkPublish(b, Throttle[largeState]{})
+}
+
+func BenchmarkStateBroadcaster_PublishThrottled(b *testing.B) {
+	benchmarkPublish(b, Throttle[largeState]{
+		Interval: 100 * time.Millisecond,
+		Urgent: func(previous, next *largeState) bool {
+			return previous.Status != next.Status
+		},
+	})
+}
+
+func TestStateBroadcaster_StuckSubscriberDoesNotBlockPublishing(t *testing.T) {
+	broadcaster := CreateStateBroadcaster[State]()
+	broadcaster.Start(State{Value: 0})
+	defer broadcaster.End()
+
+	// Never receives anything
+	stuckCh, stuckDoneCh := broadcaster.Listen()
+	dataCh, doneCh := broadcaster.Listen()
+
+	const count = 10 * HistorySize
+	published := make(chan struct{})
+	go func() {
+		for i := 1; i <= count; i++ {
+			broadcaster.Publish(State{Value: i})
+		}
+		close(published)
+	}()
+	select {
+	case <-published:
+	case <-time.After(5 * time.Second):
+		t.Fatal("publishing is blocked by the stuck subscriber")
+	}
+
+	// Other subscriber still receives the latest state
+	for event := range dataCh {
+		if event.State.Value == count {
+			break
+		}
+	}
+	close(doneCh)
+
+	// Stuck subscriber only gets the latest states once it resumes receiving
+	assert.Greater(t, broadcaster.Metrics().DroppedEvents(), uint64(0))
+	received := 0
+	for event := range stuckCh {
+		received++
+		if event.State.Value == count {
+			break
+		}
+	}
+	assert.LessOrEqual(t, received, HistorySize+1)
+	close(stuckDoneCh)
+}
+
+func TestStateBroadcaster_DisconnectSlowSubscriber(t *testing.T) {
+	broadcaster := CreateStateBroadcaster[State]()
+	broadcaster.Start(State{Value: 0})
+	defer broadcaster.End()
+
+	dataCh, doneCh := broadcaster.ListenWith(ListenOptions{Policy: Disconnect, Timeout: 50 * time.Millisecond})
+	defer close(doneCh)
+	broadcaster.Publish(State{Value: 1})
+
+	time.Sleep(100 * time.Millisecond)
+	select {
+	case _, ok := <-dataCh:
+		assert.False(t, ok, "data channel should be closed")
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for data channel to close")
+	}
+	assert.Equal(t, uint64(1), broadcaster.Metrics().DisconnectedSubscribers())
+
+	// Publishing continues without the subscriber
+	broadcaster.Publish(State{Value: 2})
+	otherCh, otherDoneCh := broadcaster.Listen()
+	assert.Equal(t, State{Value: 2}, (<-otherCh).State)
+	close(otherDoneCh)
+}
+
+func TestStateBroadcaster_ListenAfterEnd(t *testing.T) {
+	broadcaster := CreateStateBroadcaster[State]()
+	broadcaster.Start(State{Value: 0})
+	broadcaster.End()
+
+	// Broadcaster may still send the latest state, if it has not stopped yet
+	dataCh, doneCh := broadcaster.Listen()
+	closed := make(chan struct{})
+	go func() {
+		for range dataCh {
+		}
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("listening to an ended broadcaster is blocked")
+	}
+	close(doneCh)
+}
@@ -0,0 +1,225 @@
+package event
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultSlowSubscriberTimeout is how long a subscriber with the Disconnect policy may take to receive an event
+const DefaultSlowSubscriberTimeout = 10 * time.Second
+
+// SlowSubscriberPolicy decides what happens to a subscriber, which does not receive events as fast as they are
+// published. Publishing never waits for subscribers, regardless of the policy
+type SlowSubscriberPolicy int
+
+const (
+	// DropIntermediate collapses the undelivered events to the newest state once HistorySize of them are queued, so
+	// that the subscriber receives the latest state next, instead of catching up on stale ones. Until then, every event
+	// is delivered, e.g. the ones replayed to a reconnecting subscriber
+	DropIntermediate SlowSubscriberPolicy = iota
+	// Disconnect closes the subscription, if an event is not received within the timeout, or HistorySize events are
+	// queued
+	Disconnect
+)
+
+// ListenOptions configure a subscription
+type ListenOptions struct {
+	// Events published after this one are sent first (see StateBroadcaster.ListenFrom). Only used by broadcasters
+	LastEventId uint64
+	Policy      SlowSubscriberPolicy
+	// Used by the Disconnect policy. DefaultSlowSubscriberTimeout if 0
+	Timeout time.Duration
+}
+
+// Metrics count the events, which were not delivered to slow subscribers
+type Metrics struct {
+	droppedEvents           atomic.Uint64
+	disconnectedSubscribers atomic.Uint64
+}
+
+// DroppedEvents is the number of events dropped by subscribers with the DropIntermediate policy
+func (metrics *Metrics) DroppedEvents() uint64 {
+	return metrics.droppedEvents.Load()
+}
+
+// DisconnectedSubscribers is the number of subscribers closed by the Disconnect policy
+func (metrics *Metrics) DisconnectedSubscribers() uint64 {
+	return metrics.disconnectedSubscribers.Load()
+}
+
+// subscriberQueue delivers events to a subscriber from its own goroutine, so that a subscriber, which stopped
+// receiving, can not block the publisher
+type subscriberQueue[E any] struct {
+	data    chan E
+	options ListenOptions
+	metrics *Metrics
+	// Returns the key of the state the event carries. Events with the same key are collapsed by DropIntermediate
+	key func(E) any
+
+	mu      sync.Mutex
+	pending []E
+	// No more events are pushed, data channel is closed once the pending ones are delivered
+	finishing bool
+	// Signals the delivering goroutine that there are pending events
+	ready chan struct{}
+	// Closed when the remaining events are to be dropped. Data channel is closed right away
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// Key may be nil if all events carry the same state
+func createSubscriberQueue[E any](options ListenOptions, metrics *Metrics, key func(E) any) *subscriberQueue[E] {
+	if options.Timeout == 0 {
+		options.Timeout = DefaultSlowSubscriberTimeout
+	}
+	queue := &subscriberQueue[E]{
+		data:    make(chan E),
+		options: options,
+		metrics: metrics,
+		key:     key,
+		pending: make([]E, 0),
+		ready:   make(chan struct{}, 1),
+		stop:    make(chan struct{}),
+	}
+	go queue.deliver()
+	return queue
+}
+
+// push queues the event for delivery. Never blocks
+func (queue *subscriberQueue[E]) push(event E) {
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+	if queue.finishing || queue.stopped() {
+		return
+	}
+	if len(queue.pending) >= HistorySize {
+		if queue.options.Policy == Disconnect {
+			queue.disconnect()
+			return
+		}
+		queue.pending = append(queue.pending, event)
+		queue.collapse()
+		queue.signal()
+		return
+	}
+	queue.pending = append(queue.pending, event)
+	queue.signal()
+}
+
+// collapse keeps only the newest pending event of each key, in the order they were pushed. Must be called while
+// holding mu
+func (queue *subscriberQueue[E]) collapse() {
+	newest := make(map[any]int, 1)
+	for i, event := range queue.pending {
+		newest[queue.keyOf(event)] = i
+	}
+	kept := make([]E, 0, len(newest))
+	for i, event := range queue.pending {
+		if newest[queue.keyOf(event)] == i {
+			kept = append(kept, event)
+		}
+	}
+	queue.metrics.droppedEvents.Add(uint64(len(queue.pending) - len(kept)))
+	queue.pending = kept
+}
+
+func (queue *subscriberQueue[E]) keyOf(event E) any {
+	if queue.key == nil {
+		return nil
+	}
+	return queue.key(event)
+}
+
+// finish closes the data channel once all pending events are delivered
+func (queue *subscriberQueue[E]) finish() {
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+	queue.finishing = true
+	queue.signal()
+}
+
+// cancel drops the pending events and closes the data channel
+func (queue *subscriberQueue[E]) cancel() {
+	queue.stopOnce.Do(func() {
+		close(queue.stop)
+	})
+}
+
+func (queue *subscriberQueue[E]) disconnect() {
+	queue.metrics.disconnectedSubscribers.Add(1)
+	queue.cancel()
+}
+
+func (queue *subscriberQueue[E]) stopped() bool {
+	select {
+	case <-queue.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+func (queue *subscriberQueue[E]) signal() {
+	select {
+	case queue.ready <- struct{}{}:
+	default:
+	}
+}
+
+// next takes the oldest pending event. If there are none, ok is false, and finished tells whether more can follow
+func (queue *subscriberQueue[E]) next() (event E, ok bool, finished bool) {
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+	if len(queue.pending) == 0 {
+		return event, false, queue.finishing
+	}
+	event = queue.pending[0]
+	queue.pending = queue.pending[1:]
+	return event, true, false
+}
+
+func (queue *subscriberQueue[E]) deliver() {
+	defer close(queue.data)
+	for {
+		select {
+		case <-queue.stop:
+			return
+		case <-queue.ready:
+		}
+		for {
+			event, ok, finished := queue.next()
+			if finished {
+				return
+			}
+			if !ok {
+				break
+			}
+			if !queue.send(event) {
+				return
+			}
+		}
+	}
+}
+
+func (queue *subscriberQueue[E]) send(event E) bool {
+	if queue.options.Policy != Disconnect {
+		select {
+		case queue.data <- event:
+			return true
+		case <-queue.stop:
+			return false
+		}
+	}
+	timer := time.NewTimer(queue.options.Timeout)
+	defer timer.Stop()
+	select {
+	case queue.data <- event:
+		return true
+	case <-queue.stop:
+		return false
+	case <-timer.C:
+		queue.disconnect()
+		return false
+	}
+}
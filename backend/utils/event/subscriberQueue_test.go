@@ -0,0 +1,47 @@
+package event
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Queue without the delivering goroutine, so that the pending events can be inspected
+func createIdleQueue[E any](options ListenOptions, key func(E) any) *subscriberQueue[E] {
+	return &subscriberQueue[E]{
+		options: options,
+		metrics: &Metrics{},
+		key:     key,
+		ready:   make(chan struct{}, 1),
+		stop:    make(chan struct{}),
+	}
+}
+
+func TestSubscriberQueue_DropIntermediateCollapsesToNewestState(t *testing.T) {
+	queue := createIdleQueue[Event[State]](ListenOptions{Policy: DropIntermediate}, nil)
+	for i := 1; i <= HistorySize; i++ {
+		queue.push(Event[State]{Id: uint64(i), State: State{Value: i}})
+	}
+	// Every event is kept until the queue is full
+	assert.Len(t, queue.pending, HistorySize)
+
+	queue.push(Event[State]{Id: HistorySize + 1, State: State{Value: HistorySize + 1}})
+	assert.Equal(t, []Event[State]{{Id: HistorySize + 1, State: State{Value: HistorySize + 1}}}, queue.pending)
+	assert.Equal(t, uint64(HistorySize), queue.metrics.DroppedEvents())
+}
+
+func TestSubscriberQueue_DropIntermediateKeepsNewestStateOfEachTopic(t *testing.T) {
+	queue := createIdleQueue[TopicEvent[int, State]](
+		ListenOptions{Policy: DropIntermediate},
+		func(event TopicEvent[int, State]) any { return event.Topic },
+	)
+	queue.push(TopicEvent[int, State]{Topic: 1, Event: Event[State]{Id: 1, State: State{Value: 1}}})
+	for i := 2; i <= HistorySize+1; i++ {
+		queue.push(TopicEvent[int, State]{Topic: 2, Event: Event[State]{Id: uint64(i), State: State{Value: i}}})
+	}
+
+	assert.Equal(t, []TopicEvent[int, State]{
+		{Topic: 1, Event: Event[State]{Id: 1, State: State{Value: 1}}},
+		{Topic: 2, Event: Event[State]{Id: HistorySize + 1, State: State{Value: HistorySize + 1}}},
+	}, queue.pending)
+}
@@ -0,0 +1,61 @@
+package patch
+
+import (
+	"encoding/json"
+	"reflect"
+)
+
+// CreateMergePatch returns a JSON merge patch (RFC 7386), which turns the JSON encoding of previous into the JSON
+// encoding of next. Both values must encode to JSON objects. Arrays are replaced as a whole, removed fields are set to
+// null. Returns an empty object if the encodings are equal
+func CreateMergePatch(previous any, next any) (json.RawMessage, error) {
+	previousObject, err := toObject(previous)
+	if err != nil {
+		return nil, err
+	}
+	nextObject, err := toObject(next)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(diff(previousObject, nextObject))
+}
+
+func toObject(value any) (map[string]any, error) {
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	var object map[string]any
+	if err = json.Unmarshal(encoded, &object); err != nil {
+		return nil, err
+	}
+	return object, nil
+}
+
+func diff(previous map[string]any, next map[string]any) map[string]any {
+	result := make(map[string]any)
+	for key, previousValue := range previous {
+		nextValue, exists := next[key]
+		if !exists {
+			result[key] = nil
+			continue
+		}
+		previousObject, previousIsObject := previousValue.(map[string]any)
+		nextObject, nextIsObject := nextValue.(map[string]any)
+		if previousIsObject && nextIsObject {
+			if nested := diff(previousObject, nextObject); len(nested) > 0 {
+				result[key] = nested
+			}
+			continue
+		}
+		if !reflect.DeepEqual(previousValue, nextValue) {
+			result[key] = nextValue
+		}
+	}
+	for key, nextValue := range next {
+		if _, exists := previous[key]; !exists {
+			result[key] = nextValue
+		}
+	}
+	return result
+}
@@ -0,0 +1,59 @@
+package patch
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type state struct {
+	Status  string         `json:"status"`
+	Crawled int            `json:"crawled"`
+	Title   *string        `json:"title"`
+	Counts  []int          `json:"counts"`
+	Nested  map[string]int `json:"nested,omitempty"`
+}
+
+func TestCreateMergePatch(t *testing.T) {
+	title := "Example"
+	previous := state{Status: "TRYING_LINKS", Crawled: 1, Counts: []int{1, 2}, Nested: map[string]int{"a": 1, "b": 2}}
+	next := state{Status: "TRYING_LINKS", Crawled: 2, Title: &title, Counts: []int{1, 3}, Nested: map[string]int{"a": 1}}
+
+	result, err := CreateMergePatch(previous, next)
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"crawled":2,"title":"Example","counts":[1,3],"nested":{"b":null}}`, string(result))
+
+	// Removed fields are set to null
+	next.Nested = nil
+	result, err = CreateMergePatch(previous, next)
+	assert.NoError(t, err)
+	var decoded map[string]any
+	assert.NoError(t, json.Unmarshal(result, &decoded))
+	assert.Contains(t, decoded, "nested")
+	assert.Nil(t, decoded["nested"])
+
+	result, err = CreateMergePatch(previous, previous)
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{}`, string(result))
+}
+
+func BenchmarkCreateMergePatch(b *testing.B) {
+	title := "Example"
+	previous := state{Status: "TRYING_LINKS", Title: &title, Counts: make([]int, 1000)}
+	next := previous
+	full, _ := json.Marshal(next)
+
+	b.ReportAllocs()
+	var size int
+	for i := range b.N {
+		next.Crawled = i
+		result, err := CreateMergePatch(previous, next)
+		if err != nil {
+			b.Fatal(err)
+		}
+		size = len(result)
+	}
+	b.ReportMetric(float64(size), "patch-bytes")
+	b.ReportMetric(float64(len(full)), "full-bytes")
+}
@@ -26,7 +26,9 @@ export enum TaskStatus {
     STATUS_FINISHED = "FINISHED",
     STATUS_ERROR = "ERROR",
     STATUS_INTERRUPTED = "INTERRUPTED",
-    STATUS_INTERRUPTING = "INTERRUPTING"
+    STATUS_INTERRUPTING = "INTERRUPTING",
+    STATUS_PAUSING = "PAUSING",
+    STATUS_PAUSED = "PAUSED"
 }
 
 export interface TaskStateUpdate {
@@ -50,5 +52,10 @@ export const sendAddTaskRequest = (request: AddTaskRequest) => AuthenticatedClie
 export const sendInterruptTaskRequest = (id: string) => AuthenticatedClient
     .post<void, AxiosResponse<void>>(`/api/scrape/task/${id}/interrupt`)
 
-export const sendGetTasksRequest = () => AuthenticatedClient
-    .get<AddTaskRequest, AxiosResponse<TaskListItemResponse[]>>("/api/scrape/tasks")
+interface TaskListResponse {
+    items: TaskListItemResponse[];
+    nextCursor?: string;
+}
+
+export const sendGetTasksRequest = (cursor?: string) => AuthenticatedClient
+    .get<void, AxiosResponse<TaskListResponse>>("/api/scrape/tasks", {params: {cursor}})
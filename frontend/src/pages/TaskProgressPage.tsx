@@ -78,6 +78,9 @@ const TaskProgressPage: React.FC = () => {
             setTaskState(JSON.parse(update.data))
         }
 
+        // Task is no longer running, so there are no more updates to reconnect for
+        eventSource.addEventListener("end", () => eventSource.close())
+
         eventSource.onerror = (error) => {
             if (eventSource.readyState !== EventSource.CLOSED) {
                 return
@@ -99,7 +102,8 @@ const TaskProgressPage: React.FC = () => {
 
     const isInterruptibleState = [TaskStatus.STATUS_PENDING,
         TaskStatus.STATUS_INITIATING,
-        TaskStatus.STATUS_TRYING_LINKS].includes(taskState?.status)
+        TaskStatus.STATUS_TRYING_LINKS,
+        TaskStatus.STATUS_PAUSING].includes(taskState?.status)
 
     let PageContent;
 
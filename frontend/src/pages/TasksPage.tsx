@@ -40,6 +40,9 @@ const mapGetTasksErrorMessage = (err: AxiosError) => {
 
 const TasksPage: React.FC = () => {
     const [tasks, setTasks] = useState<TaskCard[]>()
+    // Cursor of the next page of tasks. Undefined once all tasks are loaded
+    const [nextCursor, setNextCursor] = useState<string>()
+    const [loadingMore, setLoadingMore] = useState(false)
     const [newScrapeTaskUrl, setNewScrapeTaskUrl] = useState("")
 
     const navigate = useNavigate()
@@ -59,13 +62,25 @@ const TasksPage: React.FC = () => {
 
     useEffect(() => {
         sendGetTasksRequest().then(response => {
-            setTasks(response.data)
+            setTasks(response.data.items)
+            setNextCursor(response.data.nextCursor)
         }).catch(err => showAlert({
             type: AlertType.WARNING,
             message: mapGetTasksErrorMessage(err)
         }))
     }, [])
 
+    const handleLoadMore = () => {
+        setLoadingMore(true)
+        sendGetTasksRequest(nextCursor).then(response => {
+            setTasks(loaded => [...(loaded ?? []), ...response.data.items])
+            setNextCursor(response.data.nextCursor)
+        }).catch(err => showAlert({
+            type: AlertType.WARNING,
+            message: mapGetTasksErrorMessage(err)
+        })).finally(() => setLoadingMore(false))
+    };
+
     return <>
         <Layout.Header />
         <Layout.Content>
@@ -99,6 +114,9 @@ const TasksPage: React.FC = () => {
                     <RightArrow/>
                 </div>
             </CardComponent>)}
+            {nextCursor && <button className="load-more-button" disabled={loadingMore} onClick={handleLoadMore}>
+                {loadingMore ? "Loading..." : "Load more"}
+            </button>}
         </Layout.Content>
     </>
 }
@@ -66,7 +66,10 @@ module.exports = function (env, argv) {
                 {
                     context: ['/api'],
                     target: 'http://localhost:8080',
-                    changeOrigin: true,
+                    // Host is kept, so that the origin check of the back-end accepts requests of the page
+                    changeOrigin: false,
+                    // Task updates can also be received through a WebSocket
+                    ws: true,
                 },
             ],
         }